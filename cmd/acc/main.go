@@ -0,0 +1,15 @@
+// Command acc runs and renders the tasks of the acc package.
+//
+// Binaries that define their own tasks register them with acc.Register and call acc.Main
+// in the same way.
+package main
+
+import (
+	"github.com/mumoshu/golang-experiments/pkg/acc"
+)
+
+func main() {
+	acc.Register("my-script", acc.MyScript, "seed")
+
+	acc.Main()
+}
@@ -2,31 +2,76 @@ package acc
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 // TaskScope exposes various operations and symbols for defining
 // a program.
 type TaskScope interface {
-	Do(name string, task TaskStepRun) TaskStep
+	Do(name string, task TaskStepRun, opts ...StepOption) TaskStep
 	Defer(name string, task TaskStepRun)
 	Get(key string) Ref
+
+	// Secret declares the input as secret and returns the ref to it. The value of a secret input,
+	// and the outputs of the steps derived from it, are masked in everything the task run writes.
+	Secret(key string) Ref
+
 	Cmd(path string, args ...interface{}) Command
+
+	// Call defines the steps of the sub-task define, named after the sub-task like "setup/start cluster".
+	// The sub-task reads the inputs mapped to the refs of the calling task, and makes the outputs
+	// it exports available via the returned SubTask. It has its own cleanup stack: Run executes
+	// its cleanup steps in reverse order once its steps finish, so a resource the calling task
+	// uses after the sub-task is to be cleaned up by the calling task. When the run stops within
+	// the sub-task, they are executed along with the ones of the calling task. The emitted scripts
+	// and workflows run them along with the cleanup steps of the task, the bash script from its
+	// trap on exit.
+	Call(name string, define func(TaskScope), inputs map[string]Ref) SubTask
+
+	// Export makes the ref available as the output key of the task to the task calling it.
+	Export(key string, ref Ref)
+
+	// Matrix calls define for every combination of the values of the axes, as the sub-tasks of
+	// the sub-task name named after the combinations, like "e2e/k8s=1.27,mode=dind".
+	// The combinations read the inputs of the calling task, and are run one by one unless
+	// MaxParallel is given. define is called once more with placeholders like "\x00matrix.k8s\x00"
+	// as the values, for rendering the matrix into workflows and scripts, so it should have no side effects
+	// other than defining steps. When that call panics, like when define parses the values,
+	// the emitters render the steps of every combination instead.
+	Matrix(name string, axes map[string][]string, define func(TaskScope, MatrixCombo), opts ...MatrixOption) []SubTask
+
+	// ForEach is Matrix with the single axis "item", calling define for every item.
+	ForEach(name string, items []string, define func(TaskScope, string), opts ...MatrixOption) []SubTask
+
+	// When defines the steps and cleanup steps of define to run only when the condition holds.
+	When(cond Cond, define func(TaskScope))
 }
 
 // Task is the unit of execution. It typically
 // corresponds 1:1 to a single task in a workflow job or a CI job.
 type Task struct {
+	// Inputs are the names of the inputs the task expects, in alphabetical order.
+	Inputs []string
+
+	// Secrets are the names of the inputs declared secret, in alphabetical order.
+	Secrets []string
+
 	Steps   []TaskStep
 	Cleanup []TaskStep
+
+	// Exports are the outputs the task exports with TaskScope.Export.
+	Exports map[string]Ref
 }
 
 func newStreams(jobName string) Streams {
@@ -50,8 +95,30 @@ type TaskStep struct {
 	Run     TaskStepRun
 	Streams Streams
 	Outputs Values
+
+	// Cache, when set, lets the step reuse the outputs of a previous execution
+	// with the same resolved command, inputs and files.
+	Cache *StepCache
+
+	// CleanupFor is, for a cleanup step, the name of the step that makes the cleanup necessary.
+	// TaskBuilder sets it to the step defined right after the cleanup step,
+	// or the last step defined before it when there is none.
+	CleanupFor string
+
+	// SubTask is the name of the sub-task the step is defined in, like "setup" or "setup/cluster"
+	// for a sub-task called by another one. It is empty for the steps of the task itself.
+	SubTask string
+
+	// Combo is the combination of the outermost matrix the step is defined for, if any.
+	Combo *MatrixCombo
+
+	// If is the condition the step is run on, if any. The step is skipped when it does not hold.
+	If *Cond
 }
 
+// StepOption changes a step being defined with TaskScope.Do.
+type StepOption func(*TaskStep)
+
 func (j TaskStep) Get(key string) Ref {
 	ref, err := j.Outputs.Get(key)
 	if err != nil {
@@ -66,12 +133,39 @@ func (j TaskStep) Get(key string) Ref {
 type Command struct {
 	Path string
 	Args []interface{}
+
+	// Env sets environment variables for the command on top of the ones
+	// inherited according to EnvInheritance. Values can be string, Ref or Expr.
+	Env map[string]interface{}
+
+	// EnvInheritance decides which variables of the current process the command inherits.
+	EnvInheritance EnvInheritance
+
+	// EnvAllowlist lists the variables inherited when EnvInheritance is EnvInheritAllowlist.
+	EnvAllowlist []string
+
+	// Dir is the working directory of the command. It can be a string, Ref or Expr.
+	// Nil means the working directory of the current process.
+	Dir interface{}
+
+	// Stdin is fed to the standard input of the command. It can be a string, Ref or Expr.
+	Stdin interface{}
 }
 
 type Func struct {
-	Name    string
-	F       func(ctx TaskStepContext) error
+	Name string
+	F    func(ctx TaskStepContext) error
+
+	// Outputs are the keys of the outputs the func sets. Setting any other key,
+	// or leaving one of them unset, fails the step.
 	Outputs []string
+
+	// Inputs are the outputs of upstream steps the func reads with TaskStepContext.Output,
+	// Stdout and Stderr, like `create.Get("stdout")`, and the task inputs it reads.
+	Inputs []Ref
+
+	// outType is the Out struct of a TypedFunc.
+	outType reflect.Type
 }
 
 type TaskStepContext interface {
@@ -81,6 +175,16 @@ type TaskStepContext interface {
 	// Get returns an input value for the current task step by key
 	Get(key string) string
 
+	// Output returns the value of the upstream step output the ref points to,
+	// which must be one of the Inputs of the Func.
+	Output(ref Ref) string
+
+	// Stdout returns the stdout of the upstream command step, which must be one of the Inputs of the Func.
+	Stdout(step string) string
+
+	// Stderr returns the stderr of the upstream command step, which must be one of the Inputs of the Func.
+	Stderr(step string) string
+
 	// Cmd initializes an OS command to be executed
 	Cmd(path string, args ...string) *TaskStepCmd
 
@@ -93,6 +197,27 @@ type TaskStepCmd struct {
 	ctx TaskStepContext
 }
 
+// Env sets the environment variable key to val for the command.
+func (cmd *TaskStepCmd) Env(key, val string) *TaskStepCmd {
+	cmd.cmd = cmd.cmd.WithEnv(key, val)
+
+	return cmd
+}
+
+// Dir sets the working directory of the command.
+func (cmd *TaskStepCmd) Dir(dir string) *TaskStepCmd {
+	cmd.cmd = cmd.cmd.WithDir(dir)
+
+	return cmd
+}
+
+// Stdin sets the content fed to the standard input of the command.
+func (cmd *TaskStepCmd) Stdin(stdin string) *TaskStepCmd {
+	cmd.cmd = cmd.cmd.WithStdin(stdin)
+
+	return cmd
+}
+
 func (cmd *TaskStepCmd) Exec() (ExecResult, error) {
 	return cmd.ctx.Exec(cmd.cmd)
 }
@@ -102,6 +227,7 @@ var _ TaskStepContext = &stepContext{}
 type stepContext struct {
 	setOutput func(key, val string)
 	get       func(key string) string
+	output    func(ref Ref) string
 	executor  Target
 }
 
@@ -153,6 +279,18 @@ func (c *stepContext) Get(key string) string {
 	return c.get(key)
 }
 
+func (c *stepContext) Output(ref Ref) string {
+	return c.output(ref)
+}
+
+func (c *stepContext) Stdout(step string) string {
+	return c.output(Ref{Job: step, Key: "stdout"})
+}
+
+func (c *stepContext) Stderr(step string) string {
+	return c.output(Ref{Job: step, Key: "stderr"})
+}
+
 var _ Target = &Runtime{}
 
 // Runtime is the default implementation of Target that has useful features like
@@ -162,18 +300,44 @@ type Runtime struct {
 
 	// binDir is the filesystem path to the temporary directory
 	// that stores shims to the command simulator.
-	binDir string
+	// Start creates one when it is empty.
+	binDir     string
+	ownsBinDir bool
 
-	// GoTestName must be set to the current the value returned by *testing.T.Name() before calling Runtime.Start().
-	// The value is used to redirect shim executions to the command simulator, so that
-	// the simulator is able to run your code even in go-test.
+	// server runs the stubs on behalf of the shims.
+	server *stubServer
+
+	// GoTestName is the value returned by *testing.T.Name() for the test using the Runtime.
+	//
+	// Deprecated: shims no longer re-run the test binary, so the value is unused.
 	GoTestName string
 
 	AllowByDefault bool
 	Allowed        map[string]bool
 	CommandPrinter CommandPrinter
 
+	// Policy, when set, decides which commands are run for real, which require a stub and
+	// which are denied. Commands no rule matches get Policy.Default, falling back to
+	// AllowByDefault and Allowed when it is empty.
+	Policy *Policy
+
+	// CollectUnexpected makes unexpected commands succeed with no output instead of panicking,
+	// so that a single run reports all of them via UnexpectedCommands and WriteStubFile.
+	CollectUnexpected bool
+
+	unexpected *unexpectedCommands
+
+	// mask masks the secrets of the task run in the policy audit log and the collected unexpected commands.
+	mask func(string) string
+
 	Stdout, Stderr io.Writer
+
+	// Timestamps prefixes every line streamed to Stdout and Stderr with the time it was produced.
+	Timestamps bool
+
+	// MaxOutputBytes bounds the per-stream copy of command output kept for step outputs.
+	// Defaults to DefaultMaxCaptureBytes.
+	MaxOutputBytes int
 }
 
 func (t Runtime) GetStdout() io.Writer {
@@ -192,6 +356,9 @@ const (
 type WrappedExitErr struct {
 	ExitErr     *exec.ExitError
 	CombinedBuf *bytes.Buffer
+
+	// Stdout and Stderr are what the command wrote to each stream before it exited.
+	Stdout, Stderr *bytes.Buffer
 }
 
 func (e WrappedExitErr) Error() string {
@@ -209,74 +376,145 @@ type UnexpectedCommandError struct {
 	Args           []string
 }
 
-type CommandPrinter interface {
-	Sprint(Command) string
+func (e UnexpectedCommandError) Error() string {
+	args := e.Args
+
+	msg := fmt.Sprintf(
+		"command %s is not expected for execution. Add the below as expectation:\n%s\n",
+		fmt.Sprintf("%s %s", e.Command.Path, strings.Join(args, " ")),
+		e.CommandPrinter.Sprint(e.printable()),
+	)
+
+	return msg
 }
 
-type goCommandPrinter struct {
+// printable returns the command with the resolved args, which is what a stub has to match.
+func (e UnexpectedCommandError) printable() Command {
+	cmd := Command{Path: e.Command.Path}
+
+	for _, a := range e.Args {
+		cmd.Args = append(cmd.Args, a)
+	}
+
+	return cmd
 }
 
-func (p goCommandPrinter) Sprint(cmd Command) string {
-	var args []string
+// unexpectedMu guards the creation of the collected unexpected commands of Runtimes.
+var unexpectedMu sync.Mutex
+
+// collected returns the unexpected commands collected with CollectUnexpected, which the copies of
+// the Runtime made for every step share. It is created once, before the steps run, by Start and Run,
+// as the combinations of a matrix run at once.
+func (t *Runtime) collected() *unexpectedCommands {
+	unexpectedMu.Lock()
+	defer unexpectedMu.Unlock()
 
-	for _, a := range cmd.Args {
-		args = append(args, fmt.Sprintf("%q", a))
+	if t.unexpected == nil {
+		t.unexpected = &unexpectedCommands{}
 	}
-	return fmt.Sprintf(`Command{
-  Path: %q,
-  Args: []interface{}{
-    %s,
-  },
-}`, cmd.Path, strings.Join(args, ", \n    "))
+
+	return t.unexpected
 }
 
-func (e UnexpectedCommandError) Error() string {
-	args := e.Args
+// UnexpectedCommands returns the unexpected commands collected with CollectUnexpected.
+func (t *Runtime) UnexpectedCommands() []UnexpectedCommandError {
+	return t.unexpected.list()
+}
 
-	msg := fmt.Sprintf(
-		"command %s is not expected for execution. Add the below as expectation:\n%s\n",
-		fmt.Sprintf("%s %s", e.Command.Path, strings.Join(args, " ")),
-		e.CommandPrinter.Sprint(e.Command),
-	)
+// WriteStubFile prints the unexpected commands collected with CollectUnexpected as a stub file
+// in the format of CommandPrinter.
+func (t *Runtime) WriteStubFile(w io.Writer) error {
+	return WriteStubFile(w, t.CommandPrinter, t.UnexpectedCommands())
+}
 
-	return msg
+// ExecuteRedirected is Execute writing the output of the command to the writers of the Redirect.
+func (t *Runtime) ExecuteRedirected(cmd Command, args []string, r Redirect) ExecResult {
+	c := *t
+	c.Stdout, c.Stderr = r.Stdout, r.Stderr
+
+	if r.Mask != nil {
+		c.mask = r.Mask
+	}
+
+	return c.Execute(cmd, args)
 }
 
-func (t Runtime) Execute(cmd Command, args []string) ExecResult {
+func (t *Runtime) Execute(cmd Command, args []string) ExecResult {
 	var c *exec.Cmd
 
 	var path string
 
 	ex := t.findExpected(cmd.Path, args)
+
+	action := PolicyRequireStub
+	if t.AllowByDefault || (t.Allowed != nil && t.Allowed[filepath.Base(cmd.Path)]) {
+		action = PolicyAllow
+	}
+
+	if t.Policy != nil {
+		decision := t.Policy.decide(cmd, args, ex != nil, action, t.mask)
+		if decision.Action == PolicyDeny {
+			panic(PolicyDeniedError{Decision: decision})
+		}
+
+		action = decision.Action
+	}
+
 	if ex == nil {
-		if t.AllowByDefault || (t.Allowed != nil && t.Allowed[filepath.Base(cmd.Path)]) {
+		if action == PolicyAllow {
 			path = cmd.Path
 
 			c = exec.Command(path, args...)
 
-			c.Env = []string{"PATH=" + t.binDir}
+			c.Env = cmd.environ(t.binDir)
 		} else {
 			commandPrinter := t.CommandPrinter
 			if commandPrinter == nil {
-				commandPrinter = goCommandPrinter{}
+				commandPrinter = GoCommandPrinter{}
 			}
-			panic(
-				UnexpectedCommandError{
-					CommandPrinter: commandPrinter,
-					Command:        cmd,
-					Args:           args,
-				},
-			)
+
+			unexpected := UnexpectedCommandError{
+				CommandPrinter: commandPrinter,
+				Command:        cmd,
+				Args:           args,
+			}
+
+			if !t.CollectUnexpected {
+				panic(unexpected)
+			}
+
+			if t.mask != nil {
+				unexpected.Args = nil
+
+				for _, a := range args {
+					unexpected.Args = append(unexpected.Args, t.mask(a))
+				}
+			}
+
+			t.collected().add(unexpected)
+
+			return ExecResult{Stdout: strings.NewReader(""), Stderr: strings.NewReader("")}
 		}
 	} else {
 		path = filepath.Join(t.binDir, filepath.Base(ex.Command.Path))
 
 		c = exec.Command(path, args...)
 
-		c.Env = []string{"PATH=" + t.binDir, InvocationEnv + "=" + ex.Command.Path}
+		c.Env = append(cmd.environ(t.binDir), InvocationEnv+"="+ex.Command.Path)
+	}
+
+	c.Dir = cmd.dir()
+
+	if stdin, ok := cmd.stdin(); ok {
+		c.Stdin = strings.NewReader(stdin)
 	}
 
-	res, err := RunExecCmd(c)
+	res, err := RunExecCmdWithOptions(c, ExecOptions{
+		Stdout:          t.GetStdout(),
+		Stderr:          t.GetStderr(),
+		Timestamps:      t.Timestamps,
+		MaxCaptureBytes: t.MaxOutputBytes,
+	})
 	if err != nil {
 		errMsg := err.Error()
 		if strings.Contains(errMsg, LogPrefix) {
@@ -326,6 +564,14 @@ func (t Runtime) findExpected(path string, args []string) *ExecutionStub {
 			continue
 		}
 
+		if ex.Match != nil {
+			if !ex.Match(args) {
+				continue
+			}
+
+			return &ex
+		}
+
 		var exArgs []string
 
 		for _, a := range ex.Command.Args {
@@ -342,33 +588,29 @@ func (t Runtime) findExpected(path string, args []string) *ExecutionStub {
 	return nil
 }
 
-func (t Runtime) Start() {
-	if cmdName := os.Getenv(InvocationEnv); cmdName != "" {
-		path := cmdName
-
-		var args []string
-
-		if os.Args[1] == "-test.run" {
-			args = os.Args[3:]
-		} else {
-			args = os.Args[1:]
-		}
-
-		if args[0] == "--" {
-			args = args[1:]
-		}
+// Start places shims for the stubbed commands into the bin directory and starts serving the stubs.
+// Stop must be called once the Runtime is no longer used.
+func (t *Runtime) Start() {
+	t.collected()
 
-		ex := t.findExpected(path, args)
-		if ex == nil {
-			fmt.Fprintf(os.Stderr, "Path %s args %v is not expected: %+v\n", path, args, t.ExecutionStubs)
-			os.Exit(1)
+	if t.binDir == "" {
+		dir, err := ioutil.TempDir("", "acc")
+		if err != nil {
+			panic(err)
 		}
 
-		ctx := RunContext{Stdout: os.Stdout}
+		t.binDir = dir
+		t.ownsBinDir = true
+	}
 
-		ex.Run(ctx)
+	exe, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
 
-		os.Exit(0)
+	manifest := shimManifest{
+		Socket:   filepath.Join(t.binDir, "acc.sock"),
+		Commands: map[string]string{},
 	}
 
 	for i, ex := range t.ExecutionStubs {
@@ -378,91 +620,133 @@ func (t Runtime) Start() {
 			panic(fmt.Errorf("bug: empty command path in command at %d: %+v", i, ex.Command))
 		}
 
-		wrapperPath := filepath.Join(t.binDir, binName)
-
-		bashPath, err := exec.LookPath("bash")
-		if err != nil {
-			panic(fmt.Errorf("bash not found: %v", err))
+		if _, ok := manifest.Commands[binName]; ok {
+			continue
 		}
 
-		var optionalExtraArgs string
+		manifest.Commands[binName] = ex.Command.Path
 
-		if t.GoTestName != "" {
-			optionalExtraArgs = fmt.Sprintf("-test.run ^%s$ ", t.GoTestName)
+		if err := writeShim(exe, filepath.Join(t.binDir, binName)); err != nil {
+			panic(fmt.Errorf("writing shim for %s: %v", ex.Command.Path, err))
 		}
+	}
 
-		if err := ioutil.WriteFile(wrapperPath, []byte(fmt.Sprintf(`#!%s -e
-%s=%s %s %s-- "$@"
-`, bashPath, InvocationEnv, ex.Command.Path, os.Args[0], optionalExtraArgs)), 0755); err != nil {
-			panic(err)
-		}
+	bs, err := json.Marshal(manifest)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(t.binDir, shimManifestName), bs, 0644); err != nil {
+		panic(err)
+	}
+
+	listener, err := net.Listen("unix", manifest.Socket)
+	if err != nil {
+		panic(fmt.Errorf("listening for shims: %v", err))
+	}
+
+	t.server = &stubServer{listener: listener, runtime: t}
+
+	go t.server.serve()
+}
+
+// Stop stops serving the stubs and removes the bin directory if Start created it.
+func (t *Runtime) Stop() {
+	if t.server != nil {
+		t.server.close()
+		t.server = nil
+	}
+
+	if t.ownsBinDir {
+		os.RemoveAll(t.binDir)
+		t.binDir = ""
+		t.ownsBinDir = false
 	}
 }
 
+// ExecutionStub simulates the command. Run is called in the process that started the Runtime,
+// so it can read and update the state of the test. Stubs may run at once, like when stubbed
+// commands are piped to each other, so stubs sharing state have to guard it, as the simulators do.
 type ExecutionStub struct {
 	Command Command
 	Run     func(ctx RunContext)
+
+	// Match, when set, decides whether the stub simulates the invocation of Command.Path
+	// with the args, instead of requiring the args to equal Command.Args.
+	Match func(args []string) bool
 }
 
 type RunContext struct {
+	// Path and Args are the stubbed command and the args it was invoked with.
+	Path string
+	Args []string
+
 	Stdout io.Writer
-}
+	Stderr io.Writer
+	Stdin  io.Reader
 
-func (c RunContext) Exit(code int) {
-	os.Exit(code)
-}
+	// Env is the environment the stubbed command was run with, in the os/exec format.
+	Env []string
 
-type mapInputs struct {
-	m map[string]string
+	// Dir is the working directory the stubbed command was run in.
+	Dir string
 }
 
-func (m *mapInputs) get(key string) (string, error) {
-	v, ok := m.m[key]
-	if !ok {
-		return "", fmt.Errorf("no input provided for key %q", key)
+// Getenv returns the value of the environment variable the stubbed command was run with.
+func (c RunContext) Getenv(key string) string {
+	for _, kv := range c.Env {
+		if strings.HasPrefix(kv, key+"=") {
+			return strings.TrimPrefix(kv, key+"=")
+		}
 	}
 
-	return v, nil
+	return ""
 }
 
-var _ Target = &FakeRuntime{}
-
-type FakeRuntime struct {
-	Stdout, Stderr bytes.Buffer
+// Exit ends the stub with the exit code, as if the stubbed command exited.
+func (c RunContext) Exit(code int) {
+	panic(stubExit{code: code})
 }
 
-func (e *FakeRuntime) GetStdout() io.Writer {
-	return &e.Stdout
-}
+type mapInputs struct {
+	m map[string]string
 
-func (e *FakeRuntime) GetStderr() io.Writer {
-	return &e.Stderr
+	// secrets are the secrets of the run the inputs are given to.
+	secrets *secrets
 }
 
-func (e *FakeRuntime) Execute(cmd Command, args []string) ExecResult {
-	c := exec.Command("bash", "-c", "echo", fmt.Sprintf("%s %v", cmd.Path, args))
+// NewInputs returns the inputs holding the values keyed by input names, to run or render
+// a task from another package like acctest.
+func NewInputs(values map[string]string) *mapInputs {
+	m := map[string]string{}
 
-	if err := c.Start(); err != nil {
-		panic(err)
+	for k, v := range values {
+		m[k] = v
 	}
 
-	res := ExecResult{
-		Stdout: ioutil.NopCloser(&bytes.Buffer{}),
-		Stderr: ioutil.NopCloser(&bytes.Buffer{}),
-		Err:    nil,
-	}
+	return &mapInputs{m: m}
+}
 
-	if err := c.Wait(); err != nil {
-		panic(err)
+func (m *mapInputs) get(key string) (string, error) {
+	v, ok := m.m[key]
+	if !ok {
+		return "", fmt.Errorf("no input provided for key %q", key)
 	}
 
-	return res
+	return v, nil
 }
 
 type ExecResult struct {
 	Stdout io.Reader
 	Stderr io.Reader
 	Err    error
+
+	// StdoutStreamed and StderrStreamed are true when the target has already forwarded
+	// Stdout and Stderr respectively to its own GetStdout and GetStderr while the command was running.
+	StdoutStreamed, StderrStreamed bool
+
+	// Truncated is true when the head of Stdout or Stderr was dropped at the capture limit.
+	Truncated bool
 }
 
 // Target is the system the program is interacting against
@@ -472,6 +756,23 @@ type Target interface {
 	GetStderr() io.Writer
 }
 
+// Redirect is where a RedirectableTarget writes the output of a command instead of its own writers.
+type Redirect struct {
+	Stdout, Stderr io.Writer
+
+	// Mask, when set, masks the secrets of the task run in what the target writes on its own,
+	// like the policy audit log.
+	Mask func(string) string
+}
+
+// RedirectableTarget is a Target that streams the output of commands to its own writers while
+// they run, like Runtime. A target wrapping another one implements it by handing the Redirect
+// to the wrapped target, so that the run masks secrets in the output of wrapped runtimes too.
+type RedirectableTarget interface {
+	Target
+	ExecuteRedirected(cmd Command, args []string, r Redirect) ExecResult
+}
+
 func getFrame(skipFrames int) runtime.Frame {
 	// We need the frame at index skipFrames+2, since we never want runtime.Callers and getFrame
 	targetFrameIndex := skipFrames + 2
@@ -0,0 +1,307 @@
+// Package acctest runs table-driven tests of tasks built with package acc.
+package acctest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mumoshu/golang-experiments/pkg/acc"
+)
+
+// UpdateEnv is the environment variable that, set to a non-empty value, makes AssertGolden
+// rewrite the golden files instead of comparing against them. It is not a flag so that
+// the test packages importing acctest are free to define their own flags.
+const UpdateEnv = "ACCTEST_UPDATE"
+
+// TaskTestCase is a single run of the task under test along with its expectations.
+type TaskTestCase struct {
+	// Name names the subtest. Defaults to "case N".
+	Name string
+
+	// Inputs are provided to the task.
+	Inputs map[string]string
+
+	// Stdout and Stderr are the expected output of the whole run.
+	Stdout string
+	Stderr string
+
+	// Outputs are the expected outputs of steps, keyed by step name and output key.
+	// Only the outputs listed here are compared.
+	Outputs map[string]map[string]string
+
+	// Commands are the expected commands executed, as bash command lines, in order.
+	// Nil skips the comparison.
+	Commands []string
+
+	// WantErr is a substring of the error the run is expected to fail with.
+	// Empty means the run is expected to succeed.
+	WantErr string
+
+	// Cleanup are the names of the cleanup steps expected to be executed, in order.
+	// Nil skips the comparison.
+	Cleanup []string
+
+	// Golden is the path, without extension, of the golden files the run is compared against:
+	// <Golden>.plan.txt for the executed commands, <Golden>.sh for the bash script and
+	// <Golden>.gha.yaml for the GitHub Actions workflow. Run the test with ACCTEST_UPDATE=1 to rewrite them.
+	Golden string
+
+	// Target returns the target to run the task against. Defaults to an acc.Runtime
+	// that allows every command. An *acc.Runtime with stubs is started before the run
+	// and stopped once the test ends. The output of the run is written to the writers
+	// of the target as well as compared against the expectations.
+	Target func(t *testing.T) acc.Target
+}
+
+// RunTaskTest builds the task with taskFunc and runs it once per test case, each as a subtest.
+func RunTaskTest(t *testing.T, taskFunc func(acc.TaskScope), testcases ...TaskTestCase) {
+	t.Helper()
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		name := tc.Name
+		if name == "" {
+			name = fmt.Sprintf("case %d", i)
+		}
+
+		t.Run(name, func(t *testing.T) {
+			t.Helper()
+
+			runTaskTestCase(t, taskFunc, tc)
+		})
+	}
+}
+
+func runTaskTestCase(t *testing.T, taskFunc func(acc.TaskScope), tc TaskTestCase) {
+	t.Helper()
+
+	var builder acc.TaskBuilder
+
+	for key := range tc.Inputs {
+		builder.Inputs.Def(key, nil)
+	}
+
+	if err := build(func() { taskFunc(&builder) }); err != nil {
+		t.Fatalf("building task: %v", err)
+	}
+
+	task := builder.Build()
+
+	var target acc.Target
+
+	if tc.Target != nil {
+		target = tc.Target(t)
+	} else {
+		target = &acc.Runtime{AllowByDefault: true}
+	}
+
+	rec := &Recorder{Target: target}
+
+	if r, ok := target.(*acc.Runtime); ok {
+		// Without stubs there is nothing to serve, and an unstarted runtime
+		// lets commands find each other in the PATH of the test.
+		if len(r.ExecutionStubs) > 0 {
+			Start(t, r)
+		}
+	}
+
+	res, err := acc.Run(task, rec, acc.NewInputs(tc.Inputs))
+
+	switch {
+	case tc.WantErr == "" && err != nil:
+		t.Errorf("unexpected error: %v", err)
+	case tc.WantErr != "" && err == nil:
+		t.Errorf("expected error containing %q, got none", tc.WantErr)
+	case tc.WantErr != "" && !strings.Contains(err.Error(), tc.WantErr):
+		t.Errorf("expected error containing %q, got: %v", tc.WantErr, err)
+	}
+
+	if want, got := tc.Stdout, rec.Stdout.String(); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	if want, got := tc.Stderr, rec.Stderr.String(); got != want {
+		t.Errorf("unexpected stderr: want %q, got %q", want, got)
+	}
+
+	for step, outputs := range tc.Outputs {
+		for key, want := range outputs {
+			got, ok := res.Outputs[step][key]
+			if !ok {
+				t.Errorf("step %q has no output %q", step, key)
+			} else if got != want {
+				t.Errorf("unexpected output %q of step %q: want %q, got %q", key, step, want, got)
+			}
+		}
+	}
+
+	if tc.Commands != nil {
+		if got := rec.Plan(); !reflect.DeepEqual(tc.Commands, got) {
+			t.Errorf("unexpected commands:\nwant:\n%s\ngot:\n%s", strings.Join(tc.Commands, "\n"), strings.Join(got, "\n"))
+		}
+	}
+
+	if tc.Cleanup != nil {
+		if got := res.Cleanup; !equalNames(tc.Cleanup, got) {
+			t.Errorf("unexpected cleanup: want %v, got %v", tc.Cleanup, got)
+		}
+	}
+
+	if tc.Golden != "" {
+		AssertGolden(t, tc.Golden+".plan.txt", strings.Join(rec.Plan(), "\n")+"\n")
+
+		var script, workflow bytes.Buffer
+
+		placeholders := map[string]string{}
+		for _, in := range task.Inputs {
+			placeholders[in] = fmt.Sprintf("${%s}", strings.ToUpper(in))
+		}
+
+		if err := build(func() { acc.WriteBashScript(task, acc.NewInputs(placeholders), &script) }); err != nil {
+			t.Errorf("writing bash script: %v", err)
+		} else {
+			AssertGolden(t, tc.Golden+".sh", normalizeExecutable(script.String()))
+		}
+
+		if err := build(func() { acc.WriteGitHubActionsWorkflow(task, filepath.Base(tc.Golden), &workflow) }); err != nil {
+			t.Errorf("writing GitHub Actions workflow: %v", err)
+		} else {
+			AssertGolden(t, tc.Golden+".gha.yaml", normalizeExecutable(workflow.String()))
+		}
+	}
+}
+
+// teeWriter returns the writer writing to both w and, if not nil, to dst.
+func teeWriter(w, dst io.Writer) io.Writer {
+	if dst == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, dst)
+}
+
+// Start starts the runtime for the test and stops it once the test ends.
+func Start(t *testing.T, r *acc.Runtime) {
+	t.Helper()
+
+	r.Start()
+
+	t.Cleanup(r.Stop)
+}
+
+// AssertGolden fails the test unless got equals the content of the golden file at path.
+// When UpdateEnv is set, the file is rewritten instead.
+func AssertGolden(t *testing.T, path, got string) {
+	t.Helper()
+
+	if os.Getenv(UpdateEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("creating directory for golden file: %v", err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("updating golden file: %v", err)
+		}
+
+		return
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file: %v. Run the test with %s=1 to create it", err, UpdateEnv)
+	}
+
+	if want := string(bs); want != got {
+		t.Errorf("%s does not match. Run the test with %s=1 if this is an expected change:\nwant:\n%s\ngot:\n%s", path, UpdateEnv, want, got)
+	}
+}
+
+// Recorder is a Target that records the commands executed through it and
+// the output of the run before handing them to Target. It writes the output
+// to the writers of Target as well.
+type Recorder struct {
+	Target acc.Target
+
+	Stdout, Stderr bytes.Buffer
+
+	mu         sync.Mutex
+	executions []acc.Execution
+}
+
+var _ acc.RedirectableTarget = &Recorder{}
+
+func (r *Recorder) Execute(cmd acc.Command, args []string) acc.ExecResult {
+	return r.ExecuteRedirected(cmd, args, acc.Redirect{Stdout: r.GetStdout(), Stderr: r.GetStderr()})
+}
+
+// ExecuteRedirected records the command and hands the Redirect to Target, when it is
+// an acc.RedirectableTarget, so that the run can mask the output streamed by it.
+func (r *Recorder) ExecuteRedirected(cmd acc.Command, args []string, redirect acc.Redirect) acc.ExecResult {
+	r.mu.Lock()
+	r.executions = append(r.executions, acc.Execution{Command: cmd, Args: append([]string(nil), args...)})
+	r.mu.Unlock()
+
+	if t, ok := r.Target.(acc.RedirectableTarget); ok {
+		return t.ExecuteRedirected(cmd, args, redirect)
+	}
+
+	return r.Target.Execute(cmd, args)
+}
+
+func (r *Recorder) GetStdout() io.Writer {
+	return teeWriter(&r.Stdout, r.Target.GetStdout())
+}
+
+func (r *Recorder) GetStderr() io.Writer {
+	return teeWriter(&r.Stderr, r.Target.GetStderr())
+}
+
+// Plan returns the executed commands as bash command lines, in order.
+func (r *Recorder) Plan() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var plan []string
+
+	for _, ex := range r.executions {
+		plan = append(plan, ex.String())
+	}
+
+	return plan
+}
+
+// build runs f, which panics on errors like the rest of package acc, and returns the error.
+func build(f func()) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	f()
+
+	return nil
+}
+
+// normalizeExecutable replaces the path to the test binary, which emitted scripts invoke
+// for Func steps, with its file name so that golden files do not depend on the build directory.
+func normalizeExecutable(s string) string {
+	return strings.ReplaceAll(s, os.Args[0], filepath.Base(os.Args[0]))
+}
+
+func equalNames(want, got []string) bool {
+	if len(want) == 0 && len(got) == 0 {
+		return true
+	}
+
+	return reflect.DeepEqual(want, got)
+}
@@ -0,0 +1,170 @@
+package acctest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mumoshu/golang-experiments/pkg/acc"
+)
+
+func TestSimple(t *testing.T) {
+	RunTaskTest(t,
+		func(s acc.TaskScope) {
+			s.Do("say hello", s.Cmd("bash", "-c", "echo hello"))
+		},
+		TaskTestCase{
+			Inputs: map[string]string{},
+			Stdout: "hello\n",
+		},
+	)
+	RunTaskTest(t,
+		func(s acc.TaskScope) {
+			s.Do("say hello", s.Cmd("bash", "-c", "echo hello 1>&2"))
+		},
+		TaskTestCase{
+			Inputs: map[string]string{},
+			Stderr: "hello\n",
+		},
+	)
+	RunTaskTest(t,
+		func(s acc.TaskScope) {
+			s.Do("say hello", s.Cmd("bash", "-c", "echo $GREETING $(pwd) $(cat)").
+				WithEnv("GREETING", s.Get("greeting")).
+				WithDir("/").
+				WithStdin(acc.Expr{Format: "from %s", Args: []interface{}{s.Get("name")}}),
+			)
+		},
+		TaskTestCase{
+			Inputs: map[string]string{"greeting": "hello", "name": "stdin"},
+			Stdout: "hello / from stdin\n",
+		},
+	)
+}
+
+func TestRuntimeWriters(t *testing.T) {
+	var stdout bytes.Buffer
+
+	r := &acc.Runtime{AllowByDefault: true, Stdout: &stdout}
+
+	t.Run("run", func(t *testing.T) {
+		RunTaskTest(t,
+			func(s acc.TaskScope) {
+				s.Do("say hello", s.Cmd("bash", "-c", "echo hello"))
+			},
+			TaskTestCase{
+				Stdout: "hello\n",
+				Target: func(t *testing.T) acc.Target { return r },
+			},
+		)
+	})
+
+	if want, got := "hello\n", stdout.String(); want != got {
+		t.Errorf("unexpected stdout of the runtime: want %q, got %q", want, got)
+	}
+
+	if r.Stdout != &stdout || r.Stderr != nil {
+		t.Errorf("expected the writers of the runtime to be put back, got %v and %v", r.Stdout, r.Stderr)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	cluster := func(s acc.TaskScope) {
+		s.Defer("delete cluster", s.Cmd("kind", "delete", "cluster", "--name", s.Get("name")))
+
+		created := s.Do("create cluster", s.Cmd("kind", "create", "cluster", "--name", s.Get("name")))
+
+		s.Do("report", s.Cmd("kubectl", "apply", "-f", "-").WithStdin(created.Get("stdout")))
+	}
+
+	fake := func(responses ...acc.FakeResponse) func(t *testing.T) acc.Target {
+		return func(t *testing.T) acc.Target {
+			return &acc.FakeRuntime{Responses: responses}
+		}
+	}
+
+	RunTaskTest(t, cluster,
+		TaskTestCase{
+			Name:   "success",
+			Inputs: map[string]string{"name": "test"},
+			Target: fake(
+				acc.FakeResponse{Path: "kind", Args: []string{"create", "cluster", "--name", "test"}, Stdout: "created\n"},
+				acc.FakeResponse{Path: "kubectl", Stdout: "applied\n"},
+			),
+			Stdout: "created\napplied\n",
+			Outputs: map[string]map[string]string{
+				"create cluster": {"stdout": "created\n"},
+			},
+			Commands: []string{
+				"kind create cluster --name test",
+				`printf '%s' "created
+" | kubectl apply -f -`,
+				"kind delete cluster --name test",
+			},
+			Cleanup: []string{"delete cluster"},
+			Golden:  "testdata/cluster",
+		},
+		TaskTestCase{
+			Name:   "failure",
+			Inputs: map[string]string{"name": "test"},
+			Target: fake(
+				acc.FakeResponse{Path: "kind", Args: []string{"create", "cluster", "--name", "test"}, ExitCode: 1},
+			),
+			WantErr: "kind create cluster --name test: exit code 1",
+			Commands: []string{
+				"kind create cluster --name test",
+				"kind delete cluster --name test",
+			},
+			Cleanup: []string{"delete cluster"},
+		},
+	)
+}
+
+func TestSubTaskCleanup(t *testing.T) {
+	cluster := func(s acc.TaskScope) {
+		s.Defer("delete cluster", s.Cmd("kind", "delete", "cluster", "--name", s.Get("name")))
+
+		s.Do("create cluster", s.Cmd("kind", "create", "cluster", "--name", s.Get("name")))
+	}
+
+	task := func(s acc.TaskScope) {
+		s.Defer("report", s.Cmd("echo", "done"))
+
+		s.Call("cluster", cluster, map[string]acc.Ref{"name": s.Get("name")})
+
+		s.Do("test", s.Cmd("go", "test", "./..."))
+	}
+
+	RunTaskTest(t, task,
+		TaskTestCase{
+			Inputs: map[string]string{"name": "test"},
+			Target: func(t *testing.T) acc.Target { return &acc.FakeRuntime{} },
+			Commands: []string{
+				"kind create cluster --name test",
+				"kind delete cluster --name test",
+				"go test ./...",
+				"echo done",
+			},
+			Cleanup: []string{"cluster/delete cluster", "report"},
+			Golden:  "testdata/subtask_cleanup",
+		},
+	)
+}
+
+func TestSecretsMasked(t *testing.T) {
+	var stdout bytes.Buffer
+
+	RunTaskTest(t,
+		func(s acc.TaskScope) {
+			s.Do("login", s.Cmd("bash", "-c", "echo token=$TOKEN").WithEnv("TOKEN", s.Secret("token")))
+		},
+		TaskTestCase{
+			Inputs: map[string]string{"token": "supersecret"},
+			Stdout: "token=***\n",
+			Target: func(t *testing.T) acc.Target { return &acc.Runtime{AllowByDefault: true, Stdout: &stdout} },
+		},
+	)
+
+	if want, got := "token=***\n", stdout.String(); want != got {
+		t.Errorf("unexpected stdout of the runtime: want %q, got %q", want, got)
+	}
+}
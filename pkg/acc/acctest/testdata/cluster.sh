@@ -0,0 +1,12 @@
+#!/usr/bin/env bash
+set -e
+if [ -z "${NAME}" ]; then echo "\${NAME} is empty.; exit 1; fi"
+acc_cleanup() {
+  ACC_EXIT_CODE=$?
+  kind delete cluster --name ${NAME} || ACC_CLEANUP_FAILED=1
+  if [ -n "${ACC_CLEANUP_FAILED}" ] && [ "${ACC_EXIT_CODE}" -eq 0 ]; then ACC_EXIT_CODE=1; fi
+  exit "${ACC_EXIT_CODE}"
+}
+trap acc_cleanup EXIT
+{ ACC_CREATE_CLUSTER_STDERR_FILE=$(mktemp); ACC_CREATE_CLUSTER_EXIT_CODE=0; ACC_CREATE_CLUSTER_STDOUT=$({ kind create cluster --name ${NAME}; } 2>"${ACC_CREATE_CLUSTER_STDERR_FILE}") || ACC_CREATE_CLUSTER_EXIT_CODE=$?; ACC_CREATE_CLUSTER_STDERR=$(cat "${ACC_CREATE_CLUSTER_STDERR_FILE}"); rm -f "${ACC_CREATE_CLUSTER_STDERR_FILE}"; echo "${ACC_CREATE_CLUSTER_STDOUT}"; if [ -n "${ACC_CREATE_CLUSTER_STDERR}" ]; then echo "${ACC_CREATE_CLUSTER_STDERR}" >&2; fi; (exit "${ACC_CREATE_CLUSTER_EXIT_CODE}"); }
+printf '%s' "${ACC_CREATE_CLUSTER_STDOUT}" | kubectl apply -f -
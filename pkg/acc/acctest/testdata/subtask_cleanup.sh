@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+set -e
+if [ -z "${NAME}" ]; then echo "\${NAME} is empty.; exit 1; fi"
+acc_cleanup() {
+  ACC_EXIT_CODE=$?
+  kind delete cluster --name ${NAME} || ACC_CLEANUP_FAILED=1
+  echo done || ACC_CLEANUP_FAILED=1
+  if [ -n "${ACC_CLEANUP_FAILED}" ] && [ "${ACC_EXIT_CODE}" -eq 0 ]; then ACC_EXIT_CODE=1; fi
+  exit "${ACC_EXIT_CODE}"
+}
+trap acc_cleanup EXIT
+# sub-task cluster
+kind create cluster --name ${NAME}
+go test ./...
@@ -7,73 +7,10 @@ import (
 	"testing"
 )
 
-type TaskTestCase struct {
-	Inputs map[string]string
-	Stdout string
-	Stderr string
-}
-
-func TestSimple(t *testing.T) {
-	RunTaskTest(t,
-		func(s TaskScope) {
-			s.Do("say hello", s.Cmd("bash", "-c", "echo hello"))
-		},
-		TaskTestCase{
-			Inputs: map[string]string{},
-			Stdout: "hello\n",
-		},
-	)
-	RunTaskTest(t,
-		func(s TaskScope) {
-			s.Do("say hello", s.Cmd("bash", "-c", "echo hello 1>&2"))
-		},
-		TaskTestCase{
-			Inputs: map[string]string{},
-			Stderr: "hello\n",
-		},
-	)
-}
-
-func RunTaskTest(t *testing.T, taskFunc func(TaskScope), testcases ...TaskTestCase) {
-	t.Helper()
-
-	for i := range testcases {
-		tc := testcases[i]
-
-		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
-			t.Helper()
-
-			var (
-				stdout, stderr bytes.Buffer
-				builder        TaskBuilder
-			)
-
-			taskFunc(&builder)
-			task := builder.Build()
-
-			runtime := &Runtime{
-				AllowByDefault: true,
-				Stderr:         &stderr,
-				Stdout:         &stdout,
-			}
-
-			RunTask(task, runtime, &mapInputs{m: tc.Inputs})
-
-			if got := tc.Stdout; stdout.String() != got {
-				t.Errorf("unexpected stdout: want %q, got %q", got, stdout.String())
-			}
-
-			if got := tc.Stderr; stderr.String() != got {
-				t.Errorf("unexpected stderr: want %q, got %q", got, stderr.String())
-			}
-		})
-	}
-}
-
 func Start(t *testing.T, e *Runtime) {
-	e.GoTestName = t.Name()
-
 	e.Start()
+
+	t.Cleanup(e.Stop)
 }
 
 func TestGoRuntime(t *testing.T) {
@@ -165,8 +102,7 @@ func TestGoRuntime(t *testing.T) {
 				},
 			},
 		},
-		binDir:     t.TempDir(),
-		GoTestName: t.Name(),
+		binDir: t.TempDir(),
 		Stdout: &bytes.Buffer{},
 		Stderr: &bytes.Buffer{},
 	}
@@ -207,6 +143,17 @@ func TestGoRuntime(t *testing.T) {
 
 	RunTask(task, fakeRuntime, inputs)
 
+	fakeRuntime.AssertPlan(t,
+		"kind create cluster --name someseed",
+		"helm upgrade --install ../charts/actions-runner-controller someseed",
+		"kubectl apply -f testdata/",
+		"kubectl wait -n actions-runner-system deploy/controller-manager",
+		"ghcp empty-commit -u mumoshu -r actions-test -m empty commit 1 -b main",
+		"bash -c echo test",
+		"ghcp commit -u mumoshu -r actions-test -m mpty commit 1 -b main .github/workflows/someseed.yaml",
+		"kind delete cluster --name someseed",
+	)
+
 	RunTask(task, runtime, inputs)
 
 	var buf bytes.Buffer
@@ -232,13 +179,20 @@ func TestGoRuntime(t *testing.T) {
 	expectedLogs := fmt.Sprintf(`#!/usr/bin/env bash
 set -e
 if [ -z "${SEED}" ]; then echo "\${SEED} is empty.; exit 1; fi"
+acc_cleanup() {
+  ACC_EXIT_CODE=$?
+  kind delete cluster --name ${SEED} || ACC_CLEANUP_FAILED=1
+  if [ -n "${ACC_CLEANUP_FAILED}" ] && [ "${ACC_EXIT_CODE}" -eq 0 ]; then ACC_EXIT_CODE=1; fi
+  exit "${ACC_EXIT_CODE}"
+}
+trap acc_cleanup EXIT
 kind create cluster --name ${SEED}
 helm upgrade --install ../charts/actions-runner-controller ${SEED}
 kubectl apply -f testdata/
 kubectl wait -n actions-runner-system deploy/controller-manager
 ghcp empty-commit -u mumoshu -r actions-test -m empty commit 1 -b main
-%s run-task-step "generate workflow"
-ghcp commit -u mumoshu -r actions-test -m mpty commit 1 -b main ${GEN_YAMLPATH}
+eval "$(%s run-task-step "generate workflow" || echo "(exit $?)")"
+ghcp commit -u mumoshu -r actions-test -m mpty commit 1 -b main ${GENERATE_WORKFLOW_YAMLPATH}
 `, os.Args[0])
 
 	got := buf.String()
@@ -13,6 +13,14 @@ type TaskBuilder struct {
 	jobs        []TaskStep
 	cleanupJobs []TaskStep
 
+	// deferredAt is the number of steps defined before each cleanup step.
+	deferredAt []int
+
+	exports map[string]Ref
+
+	// cond is the condition of the TaskScope.When blocks being defined, if any.
+	cond *Cond
+
 	Inputs Values
 }
 
@@ -27,7 +35,9 @@ func (p *TaskBuilder) Defer(name string, task TaskStepRun) {
 	p.cleanupJobs = append(p.cleanupJobs, TaskStep{
 		Name: name,
 		Run:  task,
+		If:   p.cond,
 	})
+	p.deferredAt = append(p.deferredAt, len(p.jobs))
 }
 
 func (p *TaskBuilder) Get(key string) Ref {
@@ -41,7 +51,13 @@ func (p *TaskBuilder) Get(key string) Ref {
 	return *ref
 }
 
-func (p *TaskBuilder) Do(name string, task TaskStepRun) TaskStep {
+func (p *TaskBuilder) Secret(key string) Ref {
+	p.Inputs.DefSecret(key)
+
+	return p.Get(key)
+}
+
+func (p *TaskBuilder) Do(name string, task TaskStepRun, opts ...StepOption) TaskStep {
 	vals := Values{
 		Job: name,
 	}
@@ -50,10 +66,18 @@ func (p *TaskBuilder) Do(name string, task TaskStepRun) TaskStep {
 	case Command:
 		vals.Def("stdout", nil)
 		vals.Def("stderr", nil)
+		vals.Def("exitCode", nil)
 	case Func:
 		for _, key := range impl.Outputs {
 			vals.Def(key, nil)
 		}
+
+		// The task inputs the func reads are inferred from its inputs.
+		for _, ref := range impl.Inputs {
+			if _, err := p.Inputs.Get(ref.Key); ref.Job == "" && err != nil {
+				p.Inputs.Def(ref.Key, nil)
+			}
+		}
 	default:
 		panic(fmt.Errorf("unsupported type of task: %T: %v", impl, impl))
 	}
@@ -65,14 +89,68 @@ func (p *TaskBuilder) Do(name string, task TaskStepRun) TaskStep {
 		Outputs: vals,
 	}
 
+	if p.cond != nil {
+		job.If = p.cond
+	}
+
+	for _, o := range opts {
+		o(&job)
+	}
+
 	p.jobs = append(p.jobs, job)
 
 	return job
 }
 
+func (p *TaskBuilder) Call(name string, define func(TaskScope), inputs map[string]Ref) SubTask {
+	return p.call("", name, define, inputs)
+}
+
+func (p *TaskBuilder) When(cond Cond, define func(TaskScope)) {
+	p.when(cond, func() {
+		define(p)
+	})
+}
+
+// when defines the steps of define to run only when the condition holds,
+// along with the conditions of the enclosing When blocks.
+func (p *TaskBuilder) when(cond Cond, define func()) {
+	enclosing := p.cond
+
+	p.cond = andCond(enclosing, cond)
+
+	defer func() {
+		p.cond = enclosing
+	}()
+
+	define()
+}
+
+func (p *TaskBuilder) Export(key string, ref Ref) {
+	if p.exports == nil {
+		p.exports = map[string]Ref{}
+	}
+
+	p.exports[key] = ref
+}
+
 func (p *TaskBuilder) Build() *Task {
+	cleanup := append([]TaskStep(nil), p.cleanupJobs...)
+
+	for i := range cleanup {
+		switch n := p.deferredAt[i]; {
+		case n < len(p.jobs):
+			cleanup[i].CleanupFor = p.jobs[n].Name
+		case n > 0:
+			cleanup[i].CleanupFor = p.jobs[n-1].Name
+		}
+	}
+
 	return &Task{
+		Inputs:  p.Inputs.Keys(),
+		Secrets: p.Inputs.Secrets(),
 		Steps:   p.jobs,
-		Cleanup: p.cleanupJobs,
+		Cleanup: cleanup,
+		Exports: p.exports,
 	}
 }
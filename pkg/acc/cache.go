@@ -0,0 +1,326 @@
+package acc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StepCache is how a cached step is identified besides its resolved command or function.
+type StepCache struct {
+	// Files are the paths to the files the step reads. Their contents are part of the cache key.
+	Files []string
+}
+
+// Cache makes the step reuse the outputs and streams of a previous execution when the
+// resolved command, or the function along with the task inputs, and the contents of
+// the files are the same. It takes effect when the task is run with RunOptions.Cache.
+func Cache(files ...string) StepOption {
+	return func(s *TaskStep) {
+		s.Cache = &StepCache{Files: files}
+	}
+}
+
+// CacheEntry is what a CacheStore stores for a step execution.
+type CacheEntry struct {
+	Step      string            `json:"step"`
+	Outputs   map[string]string `json:"outputs"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// CacheStore stores the outputs of cached steps by content-addressed keys.
+type CacheStore interface {
+	// Get returns the entry for the key. It returns nil when there is no usable entry.
+	Get(key string) (*CacheEntry, error)
+	Put(key string, e *CacheEntry) error
+}
+
+// FSCache is a CacheStore keeping an entry per file in Dir.
+type FSCache struct {
+	Dir string
+
+	// TTL is how long entries are used after they are stored. Zero means forever.
+	TTL time.Duration
+
+	// MaxBytes bounds the total size of the entries. The least recently used entries
+	// are evicted when it is exceeded. Zero means unbounded.
+	MaxBytes int64
+
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mu sync.Mutex
+}
+
+var _ CacheStore = &FSCache{}
+
+func (c *FSCache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+
+	return time.Now()
+}
+
+func (c *FSCache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+func (c *FSCache) Get(key string) (*CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path(key)
+
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var e CacheEntry
+
+	if err := json.Unmarshal(bs, &e); err != nil {
+		// A corrupted entry is as good as none.
+		os.Remove(path)
+		return nil, nil
+	}
+
+	now := c.now()
+
+	if c.TTL > 0 && now.Sub(e.CreatedAt) > c.TTL {
+		os.Remove(path)
+		return nil, nil
+	}
+
+	// The modification time records the last use for the eviction.
+	if err := os.Chtimes(path, now, now); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (c *FSCache) Put(key string, e *CacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+
+	now := c.now()
+
+	if e.CreatedAt.IsZero() {
+		entry := *e
+		entry.CreatedAt = now
+		e = &entry
+	}
+
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.Dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	path := c.path(key)
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(path, now, now); err != nil {
+		return err
+	}
+
+	return c.evict()
+}
+
+// evict removes the least recently used entries until the entries fit in MaxBytes.
+func (c *FSCache) evict() error {
+	if c.MaxBytes <= 0 {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+
+	var (
+		entries []os.FileInfo
+		total   int64
+	)
+
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+
+		entries = append(entries, fi)
+		total += fi.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	for _, fi := range entries {
+		if total <= c.MaxBytes {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(c.Dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		total -= fi.Size()
+	}
+
+	return nil
+}
+
+// cacheKey returns the content address of the execution of the step: the resolved command,
+// including the outputs of upstream steps it refers to, or the function, the task inputs and
+// the outputs of upstream steps it reads, along with the contents of the declared files.
+func cacheKey(instruction TaskStep, inputs *mapInputs, state map[string]map[string]string) (key string, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	h := sha256.New()
+
+	write := func(kind string, values ...string) {
+		fmt.Fprintf(h, "%s %d\n", kind, len(values))
+
+		for _, v := range values {
+			fmt.Fprintf(h, "%d:%s\n", len(v), v)
+		}
+	}
+
+	switch impl := instruction.Run.(type) {
+	case Command:
+		cmd, args := resolveCommand(instruction.Name, impl, inputs, state)
+
+		write("path", cmd.Path)
+		write("args", args...)
+
+		for _, k := range sortedEnvKeys(cmd.Env) {
+			write("env", k, fmt.Sprint(cmd.Env[k]))
+		}
+
+		write("inherit", fmt.Sprint(cmd.EnvInheritance))
+		write("allowlist", cmd.EnvAllowlist...)
+		write("dir", cmd.dir())
+
+		if stdin, ok := cmd.stdin(); ok {
+			write("stdin", stdin)
+		}
+	case Func:
+		write("func", impl.Name, instruction.Name)
+		write("outputs", impl.Outputs...)
+
+		var keys []string
+
+		for k := range inputs.m {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			write("input", k, inputs.m[k])
+		}
+
+		for _, ref := range impl.Inputs {
+			write("ref", ref.Job, ref.Key, resolveValue(instruction.Name, ref, inputs, state))
+		}
+	default:
+		return "", fmt.Errorf("unsupported type of instruction: %T", impl)
+	}
+
+	for _, f := range instruction.Cache.Files {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", fmt.Errorf("cache file %s: %v", f, err)
+		}
+
+		sum := sha256.Sum256(bs)
+
+		write("file", f, hex.EncodeToString(sum[:]))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runCachedStep is like runStep but reuses the outputs of the step stored in the cache,
+// replaying the streams of a command to the target. It reports whether the cache was hit.
+func runCachedStep(instruction TaskStep, t Target, inputs *mapInputs, state map[string]map[string]string, store CacheStore) (bool, error) {
+	key, err := cacheKey(instruction, inputs, state)
+	if err != nil {
+		return false, fmt.Errorf("instruction %q: computing cache key: %v", instruction.Name, err)
+	}
+
+	e, err := store.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("instruction %q: reading cache: %v", instruction.Name, err)
+	}
+
+	if e != nil {
+		if _, ok := instruction.Run.(Command); ok {
+			if _, err := io.WriteString(t.GetStdout(), e.Outputs["stdout"]); err != nil {
+				return true, err
+			}
+
+			if _, err := io.WriteString(t.GetStderr(), e.Outputs["stderr"]); err != nil {
+				return true, err
+			}
+		}
+
+		state[instruction.Name] = e.Outputs
+
+		return true, nil
+	}
+
+	if err := runStep(instruction, t, inputs, state); err != nil {
+		return false, err
+	}
+
+	// The outputs of a func reading secret inputs are derived from secrets, which are never cached.
+	if inputs.secrets.isTainted(instruction.Name) {
+		return false, nil
+	}
+
+	if err := store.Put(key, &CacheEntry{Step: instruction.Name, Outputs: state[instruction.Name]}); err != nil {
+		return false, fmt.Errorf("instruction %q: writing cache: %v", instruction.Name, err)
+	}
+
+	return false, nil
+}
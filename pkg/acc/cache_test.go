@@ -0,0 +1,184 @@
+package acc
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+
+	values := filepath.Join(dir, "values.yaml")
+
+	if err := ioutil.WriteFile(values, []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var generated int
+
+	var b TaskBuilder
+
+	b.Inputs.Def("seed", nil)
+
+	render := b.Do("render", b.Cmd("helm", "template", b.Get("seed"), "-f", values), Cache(values))
+	b.Do("generate", Func{
+		Name:    "gen",
+		Outputs: []string{"path"},
+		F: func(ctx TaskStepContext) error {
+			generated++
+			ctx.Set("path", ctx.Get("seed")+".yaml")
+			return nil
+		},
+	}, Cache())
+	b.Do("apply", b.Cmd("kubectl", "apply", "-f", render.Get("stdout")))
+
+	task := b.Build()
+
+	store := &FSCache{Dir: filepath.Join(dir, "cache")}
+
+	run := func(seed string) (*RunResult, *FakeRuntime) {
+		fake := &FakeRuntime{
+			Responses: []FakeResponse{
+				{Path: "helm", Stdout: "manifests of " + seed},
+			},
+		}
+
+		res, err := RunWithOptions(task, fake, NewInputs(map[string]string{"seed": seed}), RunOptions{Cache: store})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res, fake
+	}
+
+	res, fake := run("a")
+
+	fake.AssertPlan(t, "helm template a -f "+values, `kubectl apply -f manifests of a`)
+
+	if want, got := []string{"render", "generate"}, res.CacheMisses; !equalStrings(want, got) {
+		t.Errorf("unexpected cache misses: want %v, got %v", want, got)
+	}
+
+	res, fake = run("a")
+
+	fake.AssertPlan(t, `kubectl apply -f manifests of a`)
+
+	if want, got := []string{"render", "generate"}, res.CacheHits; !equalStrings(want, got) {
+		t.Errorf("unexpected cache hits: want %v, got %v", want, got)
+	}
+
+	if want, got := "manifests of a", fake.Stdout.String(); got != want {
+		t.Errorf("unexpected replayed stdout: want %q, got %q", want, got)
+	}
+
+	if want, got := "a.yaml", res.Outputs["generate"]["path"]; got != want {
+		t.Errorf("unexpected cached output: want %q, got %q", want, got)
+	}
+
+	if want, got := 1, generated; got != want {
+		t.Errorf("unexpected number of func executions: want %d, got %d", want, got)
+	}
+
+	// Changing an input or a declared file makes the steps miss the cache.
+	res, _ = run("b")
+
+	if want, got := []string{"render", "generate"}, res.CacheMisses; !equalStrings(want, got) {
+		t.Errorf("unexpected cache misses: want %v, got %v", want, got)
+	}
+
+	if err := ioutil.WriteFile(values, []byte("replicas: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ = run("a")
+
+	if want, got := []string{"render"}, res.CacheMisses; !equalStrings(want, got) {
+		t.Errorf("unexpected cache misses: want %v, got %v", want, got)
+	}
+}
+
+func TestFSCacheExpiration(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store := &FSCache{
+		Dir: t.TempDir(),
+		TTL: time.Hour,
+		Now: func() time.Time {
+			return now
+		},
+	}
+
+	if err := store.Put("k", &CacheEntry{Step: "s", Outputs: map[string]string{"stdout": "x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(59 * time.Minute)
+
+	if e, err := store.Get("k"); err != nil || e == nil || e.Outputs["stdout"] != "x" {
+		t.Errorf("expected a hit, got %+v, %v", e, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if e, err := store.Get("k"); err != nil || e != nil {
+		t.Errorf("expected the entry to expire, got %+v, %v", e, err)
+	}
+}
+
+func TestFSCacheEviction(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entry := &CacheEntry{Step: "s", Outputs: map[string]string{"stdout": strings.Repeat("x", 100)}}
+
+	store := &FSCache{
+		Dir: t.TempDir(),
+		Now: func() time.Time {
+			return now
+		},
+	}
+
+	put := func(key string) {
+		t.Helper()
+
+		now = now.Add(time.Minute)
+
+		if err := store.Put(key, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("a")
+
+	infos, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for two entries.
+	store.MaxBytes = 2*infos[0].Size() + 1
+
+	put("b")
+
+	now = now.Add(time.Minute)
+
+	// Using "a" makes "b" the least recently used.
+	if e, _ := store.Get("a"); e == nil {
+		t.Fatal("expected a hit for a")
+	}
+
+	put("c")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		e, err := store.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := e != nil; got != want {
+			t.Errorf("unexpected presence of %s: want %v, got %v", key, want, got)
+		}
+	}
+}
@@ -0,0 +1,1073 @@
+package acc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Exit codes of the command line tool.
+const (
+	ExitOK = 0
+	// ExitFailed is returned when a task or a step fails.
+	ExitFailed = 1
+	// ExitUsage is returned for unknown commands, tasks, steps or flags and missing inputs.
+	ExitUsage = 2
+	// ExitInvalid is returned when validate finds problems in a task.
+	ExitInvalid = 3
+)
+
+// TaskDef is a task registered to a CLI.
+type TaskDef struct {
+	Name string
+
+	// Inputs are the names of the inputs the task expects.
+	// Secret inputs are declared by Define with TaskScope.Secret.
+	Inputs []string
+
+	// Define defines the steps of the task, like MyScript.
+	Define func(TaskScope)
+}
+
+// CLI is the command line tool that runs and renders the registered tasks.
+type CLI struct {
+	Stdout, Stderr io.Writer
+
+	// NewTarget returns the target `run` executes the tasks against, which writes the output
+	// of the commands to stdout and stderr. Defaults to a Runtime allowing all commands.
+	NewTarget func(stdout, stderr io.Writer) Target
+
+	// LookupEnv looks up the environment variables inputs are read from. Defaults to os.LookupEnv.
+	LookupEnv func(key string) (string, bool)
+
+	tasks []TaskDef
+}
+
+// DefaultCLI is the CLI Register and Main use.
+var DefaultCLI = &CLI{}
+
+// Register registers the task to DefaultCLI.
+func Register(name string, define func(TaskScope), inputs ...string) {
+	DefaultCLI.Register(name, define, inputs...)
+}
+
+// Main runs DefaultCLI with the command line arguments and exits with its exit code.
+// User binaries call it from their main func after registering their tasks.
+func Main() {
+	os.Exit(DefaultCLI.Run(os.Args[1:]))
+}
+
+// Register registers the task under the name, replacing the task registered under the same name if any.
+func (c *CLI) Register(name string, define func(TaskScope), inputs ...string) {
+	def := TaskDef{Name: name, Inputs: inputs, Define: define}
+
+	for i, t := range c.tasks {
+		if t.Name == name {
+			c.tasks[i] = def
+			return
+		}
+	}
+
+	c.tasks = append(c.tasks, def)
+}
+
+// cliError is an error that makes the command exit with the code.
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string {
+	return e.err.Error()
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &cliError{code: ExitUsage, err: fmt.Errorf(format, args...)}
+}
+
+const cliUsage = `Usage: %[1]s <command> [flags] [args]
+
+Commands:
+  run TASK                 run the task
+  plan TASK                print what running the task would do
+  render FORMAT TASK       print the task as a bash script, gha workflow, gitlab CI configuration or make file
+  graph TASK               print the steps and their dependencies as text, DOT or Mermaid
+  steps TASK               list the steps
+  validate [TASK...]       check the tasks for problems, all tasks by default
+  run-task-step STEP       run a func step of a rendered task
+
+Inputs are read from -i key=value flags, then from the file given with --inputs-file,
+then from the environment variables named after the inputs in upper case.
+
+Every command accepts --json to print its result as JSON.
+
+Exit codes: 0 on success, 1 when the task fails, 2 on usage errors, 3 when validation fails.
+
+Tasks:
+`
+
+// Run runs the command given by the args and returns the exit code.
+func (c *CLI) Run(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		c.usage(c.stdout())
+
+		if len(args) == 0 {
+			return ExitUsage
+		}
+
+		return ExitOK
+	}
+
+	commands := map[string]func(*cliCommand) error{
+		"run":           c.run,
+		"plan":          c.plan,
+		"render":        c.render,
+		"graph":         c.graph,
+		"steps":         c.steps,
+		"validate":      c.validate,
+		"run-task-step": c.runTaskStep,
+	}
+
+	f, ok := commands[args[0]]
+	if !ok {
+		return c.fail(false, usageErrorf("unknown command %q", args[0]))
+	}
+
+	cmd := &cliCommand{name: args[0], flags: flag.NewFlagSet(args[0], flag.ContinueOnError)}
+
+	cmd.flags.SetOutput(ioutil.Discard)
+	cmd.flags.BoolVar(&cmd.json, "json", false, "print the result as JSON")
+	cmd.flags.Var(&cmd.inputs, "i", "an input as key=value")
+	cmd.flags.Var(&cmd.inputs, "input", "an input as key=value")
+	cmd.flags.StringVar(&cmd.inputsFile, "inputs-file", "", "a JSON object or key=value lines of inputs")
+
+	cmd.args = args[1:]
+
+	return c.fail(cmd.json, f(cmd))
+}
+
+func (c *CLI) usage(w io.Writer) {
+	fmt.Fprintf(w, cliUsage, filepath.Base(os.Args[0]))
+
+	for _, t := range c.tasks {
+		fmt.Fprintf(w, "  %s", t.Name)
+
+		if len(t.Inputs) > 0 {
+			fmt.Fprintf(w, " (inputs: %s)", strings.Join(t.Inputs, ", "))
+		}
+
+		fmt.Fprintln(w)
+	}
+}
+
+// fail reports the error, if any, and returns the exit code for it.
+func (c *CLI) fail(jsonMode bool, err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	code := ExitFailed
+
+	var silent silentError
+	if errors.As(err, &silent) {
+		return silent.err.code
+	}
+
+	var ce *cliError
+	if errors.As(err, &ce) {
+		code = ce.code
+	}
+
+	if jsonMode {
+		c.writeJSON(map[string]interface{}{"error": err.Error(), "exitCode": code})
+	} else {
+		fmt.Fprintf(c.stderr(), "Error: %v\n", err)
+	}
+
+	if code == ExitUsage && !jsonMode {
+		fmt.Fprintf(c.stderr(), "Run '%s help' for usage.\n", filepath.Base(os.Args[0]))
+	}
+
+	return code
+}
+
+func (c *CLI) stdout() io.Writer {
+	if c.Stdout == nil {
+		return os.Stdout
+	}
+
+	return c.Stdout
+}
+
+func (c *CLI) stderr() io.Writer {
+	if c.Stderr == nil {
+		return os.Stderr
+	}
+
+	return c.Stderr
+}
+
+func (c *CLI) writeJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout())
+
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+func (c *CLI) target(stdout, stderr io.Writer) Target {
+	if c.NewTarget != nil {
+		return c.NewTarget(stdout, stderr)
+	}
+
+	return &Runtime{AllowByDefault: true, Stdout: stdout, Stderr: stderr}
+}
+
+func (c *CLI) lookupEnv(key string) (string, bool) {
+	if c.LookupEnv != nil {
+		return c.LookupEnv(key)
+	}
+
+	return os.LookupEnv(key)
+}
+
+// cliCommand is a command being run with its flags.
+type cliCommand struct {
+	name  string
+	flags *flag.FlagSet
+	args  []string
+
+	json       bool
+	inputs     stringsFlag
+	inputsFile string
+}
+
+// parse parses the flags, which can be interspersed with the positional args, and
+// returns the positional args after checking that there are as many as wanted.
+func (cmd *cliCommand) parse(min, max int, usage string) ([]string, error) {
+	var positional []string
+
+	args := cmd.args
+
+	for {
+		if err := cmd.flags.Parse(args); err != nil {
+			return nil, usageErrorf("%s: %v", cmd.name, err)
+		}
+
+		args = cmd.flags.Args()
+		if len(args) == 0 {
+			break
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if len(positional) < min || (max >= 0 && len(positional) > max) {
+		return nil, usageErrorf("usage: %s %s", cmd.name, usage)
+	}
+
+	return positional, nil
+}
+
+// stringsFlag is a flag that can be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+func (c *CLI) task(name string) (TaskDef, error) {
+	for _, t := range c.tasks {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+
+	return TaskDef{}, usageErrorf("unknown task %q", name)
+}
+
+// build defines the task, turning the panics of the definition into an error.
+func (d TaskDef) build() (p *Task, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("defining task %q: %v", d.Name, e)
+		}
+	}()
+
+	b := &TaskBuilder{}
+
+	for _, in := range d.Inputs {
+		b.Inputs.Def(in, nil)
+	}
+
+	d.Define(b)
+
+	return b.Build(), nil
+}
+
+func (c *CLI) buildTask(name string) (TaskDef, *Task, error) {
+	def, err := c.task(name)
+	if err != nil {
+		return def, nil, err
+	}
+
+	p, err := def.build()
+	if err != nil {
+		return def, nil, &cliError{code: ExitInvalid, err: err}
+	}
+
+	return def, p, nil
+}
+
+// inputs returns the inputs given to the command for the task. When required is set,
+// all the inputs of the task must be given.
+func (c *CLI) inputs(cmd *cliCommand, def TaskDef, p *Task, required bool) (*mapInputs, error) {
+	values := map[string]string{}
+
+	for _, in := range taskInputs(def, p) {
+		if v, ok := c.lookupEnv(envName(in)); ok {
+			values[in] = v
+		}
+	}
+
+	if cmd.inputsFile != "" {
+		fromFile, err := readInputsFile(cmd.inputsFile)
+		if err != nil {
+			return nil, usageErrorf("%v", err)
+		}
+
+		for k, v := range fromFile {
+			values[k] = v
+		}
+	}
+
+	for _, kv := range cmd.inputs {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, usageErrorf("input %q must be given as key=value", kv)
+		}
+
+		values[kv[:i]] = kv[i+1:]
+	}
+
+	declared := map[string]bool{}
+
+	for _, in := range p.Inputs {
+		declared[in] = true
+	}
+
+	var keys []string
+
+	for k := range values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !declared[k] {
+			return nil, usageErrorf("task %q has no input %q", def.Name, k)
+		}
+	}
+
+	if required {
+		for _, in := range taskInputs(def, p) {
+			if _, ok := values[in]; !ok {
+				return nil, usageErrorf("missing input %q: give it with -i %s=VALUE or $%s", in, in, envName(in))
+			}
+		}
+	}
+
+	return NewInputs(values), nil
+}
+
+// taskInputs returns the inputs of the task in the order they were registered, followed by
+// the ones the task declares when defined, like its secret inputs.
+func taskInputs(def TaskDef, p *Task) []string {
+	inputs := append([]string(nil), def.Inputs...)
+
+	registered := map[string]bool{}
+
+	for _, in := range def.Inputs {
+		registered[in] = true
+	}
+
+	for _, in := range p.Inputs {
+		if !registered[in] {
+			inputs = append(inputs, in)
+		}
+	}
+
+	return inputs
+}
+
+// readInputsFile reads inputs from a JSON object or key=value lines.
+func readInputsFile(path string) (map[string]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+
+	if trimmed := bytes.TrimSpace(bs); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &values); err != nil {
+			return nil, fmt.Errorf("parsing inputs file %s: %v", path, err)
+		}
+
+		return values, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("parsing inputs file %s: line %d: expected key=value", path, n)
+		}
+
+		values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+
+	return values, scanner.Err()
+}
+
+func (c *CLI) run(cmd *cliCommand) error {
+	var (
+		skip, only             stringsFlag
+		from, to               string
+		checkpoint, resumeFrom string
+		events, junit, html    string
+		otlpEndpoint, traces   string
+		progress               bool
+	)
+
+	cmd.flags.Var(&skip, "skip", "a step not to execute")
+	cmd.flags.Var(&only, "only", "the only step to execute")
+	cmd.flags.StringVar(&from, "from", "", "the step to start from")
+	cmd.flags.StringVar(&to, "to", "", "the step to stop after")
+	cmd.flags.StringVar(&checkpoint, "checkpoint", "", "the file to save the state of the run to after every step")
+	cmd.flags.StringVar(&resumeFrom, "resume", "", "the state file of the run to resume")
+	cmd.flags.BoolVar(&progress, "progress", false, "print the progress of the steps to stderr")
+	cmd.flags.StringVar(&events, "events", "", "the file to write the events of the run to as JSON lines")
+	cmd.flags.StringVar(&junit, "junit", "", "the file to write the JUnit XML report of the run to")
+	cmd.flags.StringVar(&html, "html", "", "the file to write the HTML report of the run to")
+	cmd.flags.StringVar(&otlpEndpoint, "otlp-endpoint", "", "the OTLP/HTTP endpoint to export the trace of the run to. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT")
+	cmd.flags.StringVar(&traces, "trace-file", "", "the file to append the trace of the run to as OTLP/JSON")
+
+	args, err := cmd.parse(1, 1, "TASK [-i key=value...] [--skip STEP...] [--only STEP...] [--from STEP] [--to STEP] [--checkpoint FILE | --resume FILE] [--progress] [--events FILE] [--junit FILE] [--html FILE] [--otlp-endpoint URL | --trace-file FILE]")
+	if err != nil {
+		return err
+	}
+
+	def, p, err := c.buildTask(args[0])
+	if err != nil {
+		return err
+	}
+
+	// In JSON mode, the output of the commands goes to stderr to keep stdout parseable.
+	stdout := c.stdout()
+	if cmd.json {
+		stdout = c.stderr()
+	}
+
+	t := c.target(stdout, c.stderr())
+
+	if r, ok := t.(*Runtime); ok && len(r.ExecutionStubs) > 0 {
+		r.Start()
+		defer r.Stop()
+	}
+
+	var observers []Observer
+
+	if progress {
+		observers = append(observers, &ProgressObserver{W: c.stderr()})
+	}
+
+	if events != "" {
+		f, err := os.Create(events)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		observers = append(observers, &JSONLinesObserver{W: f})
+	}
+
+	rec := &RecordingObserver{}
+
+	if junit != "" || html != "" {
+		observers = append(observers, rec)
+	}
+
+	if otlpEndpoint != "" && traces != "" {
+		return usageErrorf("run: --otlp-endpoint and --trace-file cannot be given together")
+	}
+
+	if otlpEndpoint == "" && traces == "" {
+		otlpEndpoint, _ = c.lookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+
+	var tracer *Tracer
+
+	switch {
+	case traces != "":
+		tracer = &Tracer{Exporter: &FileExporter{Path: traces}}
+	case otlpEndpoint != "":
+		tracer = &Tracer{Exporter: &OTLPExporter{Endpoint: otlpEndpoint}}
+	}
+
+	var res *RunResult
+
+	if resumeFrom != "" {
+		// The secret inputs are not saved with the run, so they are given again.
+		inputs, ierr := c.inputs(cmd, def, p, false)
+		if ierr != nil {
+			return ierr
+		}
+
+		res, err = RunWithOptions(p, t, inputs, RunOptions{Checkpoint: resumeFrom, Observers: observers, Tracer: tracer, TaskName: def.Name, resume: true})
+	} else {
+		inputs, ierr := c.inputs(cmd, def, p, true)
+		if ierr != nil {
+			return ierr
+		}
+
+		res, err = RunWithOptions(p, t, inputs, RunOptions{
+			SkipSteps:  skip,
+			OnlySteps:  only,
+			FromStep:   from,
+			ToStep:     to,
+			Checkpoint: checkpoint,
+			Observers:  observers,
+			Tracer:     tracer,
+			TaskName:   def.Name,
+		})
+	}
+
+	var (
+		unknown UnknownStepError
+		bound   CleanupStepRangeError
+	)
+
+	if res == nil && (errors.As(err, &unknown) || errors.As(err, &bound)) {
+		return &cliError{code: ExitUsage, err: err}
+	}
+
+	if res != nil {
+		report := NewReport(def.Name, p, rec.Events())
+
+		for _, r := range []struct {
+			path  string
+			write func(io.Writer) error
+		}{
+			{path: junit, write: report.WriteJUnit},
+			{path: html, write: report.WriteHTML},
+		} {
+			if r.path == "" {
+				continue
+			}
+
+			if werr := writeFile(r.path, r.write); werr != nil {
+				return werr
+			}
+		}
+	}
+
+	if cmd.json {
+		out := map[string]interface{}{"result": res}
+
+		if err != nil {
+			out["error"] = err.Error()
+			out["exitCode"] = ExitFailed
+		}
+
+		if werr := c.writeJSON(out); werr != nil {
+			return werr
+		}
+
+		if err != nil {
+			// The error is already in the JSON output.
+			return silentError{&cliError{code: ExitFailed, err: err}}
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+func (c *CLI) plan(cmd *cliCommand) error {
+	args, err := cmd.parse(1, 1, "TASK [-i key=value...]")
+	if err != nil {
+		return err
+	}
+
+	def, p, err := c.buildTask(args[0])
+	if err != nil {
+		return err
+	}
+
+	inputs, err := c.inputs(cmd, def, p, false)
+	if err != nil {
+		return err
+	}
+
+	plan, err := PlanTask(p, inputs)
+	if err != nil {
+		return &cliError{code: ExitInvalid, err: err}
+	}
+
+	if cmd.json {
+		return plan.WriteJSON(c.stdout())
+	}
+
+	return plan.WriteText(c.stdout())
+}
+
+func (c *CLI) render(cmd *cliCommand) error {
+	args, err := cmd.parse(2, 2, "bash|gha|gitlab|make TASK")
+	if err != nil {
+		return err
+	}
+
+	format := args[0]
+
+	def, p, err := c.buildTask(args[1])
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	switch format {
+	case "bash":
+		inputs, err := c.inputs(cmd, def, p, false)
+		if err != nil {
+			return err
+		}
+
+		for _, in := range taskInputs(def, p) {
+			if _, ok := inputs.m[in]; !ok {
+				inputs.m[in] = fmt.Sprintf("${%s}", envName(in))
+			}
+		}
+
+		WriteBashScript(p, inputs, &buf)
+	case "gha":
+		WriteGitHubActionsWorkflow(p, def.Name, &buf)
+	case "gitlab":
+		WriteGitLabCI(p, &buf)
+	case "make":
+		WriteMakefile(p, &buf)
+	default:
+		return usageErrorf("unknown format %q: must be one of bash, gha, gitlab and make", format)
+	}
+
+	if cmd.json {
+		return c.writeJSON(map[string]string{"format": format, "content": buf.String()})
+	}
+
+	_, err = buf.WriteTo(c.stdout())
+
+	return err
+}
+
+func (c *CLI) graph(cmd *cliCommand) error {
+	var format string
+
+	cmd.flags.StringVar(&format, "format", "text", "the format of the graph: text, dot or mermaid")
+
+	args, err := cmd.parse(1, 1, "[--format text|dot|mermaid] TASK")
+	if err != nil {
+		return err
+	}
+
+	_, p, err := c.buildTask(args[0])
+	if err != nil {
+		return err
+	}
+
+	g := TaskGraph(p)
+
+	if cmd.json {
+		return c.writeJSON(g)
+	}
+
+	switch format {
+	case "text":
+	case "dot":
+		WriteDOT(p, c.stdout())
+		return nil
+	case "mermaid":
+		WriteMermaid(p, c.stdout())
+		return nil
+	default:
+		return usageErrorf("unknown format %q: must be one of text, dot and mermaid", format)
+	}
+
+	deps := map[string][]string{}
+
+	for _, e := range g.Edges {
+		if e.Kind == EdgeOutput {
+			deps[e.To] = append(deps[e.To], e.From)
+		}
+	}
+
+	for _, n := range g.Nodes {
+		line := n.Name
+
+		if n.Cleanup {
+			line += " (cleanup)"
+		}
+
+		if len(deps[n.Name]) > 0 {
+			line += " <- " + strings.Join(deps[n.Name], ", ")
+		}
+
+		fmt.Fprintln(c.stdout(), line)
+	}
+
+	return nil
+}
+
+func (c *CLI) steps(cmd *cliCommand) error {
+	args, err := cmd.parse(1, 1, "TASK")
+	if err != nil {
+		return err
+	}
+
+	_, p, err := c.buildTask(args[0])
+	if err != nil {
+		return err
+	}
+
+	nodes := TaskGraph(p).Nodes
+
+	if cmd.json {
+		return c.writeJSON(nodes)
+	}
+
+	for _, n := range nodes {
+		if n.Cleanup {
+			fmt.Fprintf(c.stdout(), "%s\t%s\tcleanup\n", n.Name, n.Kind)
+		} else {
+			fmt.Fprintf(c.stdout(), "%s\t%s\n", n.Name, n.Kind)
+		}
+	}
+
+	return nil
+}
+
+func (c *CLI) validate(cmd *cliCommand) error {
+	names, err := cmd.parse(0, -1, "[TASK...]")
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		for _, t := range c.tasks {
+			names = append(names, t.Name)
+		}
+	}
+
+	type report struct {
+		Task   string   `json:"task"`
+		Errors []string `json:"errors"`
+	}
+
+	var (
+		reports []report
+		invalid int
+	)
+
+	for _, name := range names {
+		def, err := c.task(name)
+		if err != nil {
+			return err
+		}
+
+		r := report{Task: name, Errors: []string{}}
+
+		p, err := def.build()
+		if err != nil {
+			r.Errors = append(r.Errors, err.Error())
+		} else {
+			for _, e := range ValidateTask(p) {
+				r.Errors = append(r.Errors, e.Error())
+			}
+		}
+
+		if len(r.Errors) > 0 {
+			invalid++
+		}
+
+		reports = append(reports, r)
+	}
+
+	if cmd.json {
+		if err := c.writeJSON(reports); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range reports {
+			if len(r.Errors) == 0 {
+				fmt.Fprintf(c.stdout(), "%s: ok\n", r.Task)
+				continue
+			}
+
+			for _, e := range r.Errors {
+				fmt.Fprintf(c.stdout(), "%s: %s\n", r.Task, e)
+			}
+		}
+	}
+
+	if invalid > 0 {
+		err := &cliError{code: ExitInvalid, err: fmt.Errorf("%d of %d tasks are invalid", invalid, len(reports))}
+		if cmd.json {
+			// The problems are already in the JSON output.
+			return silentError{err}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// runTaskStep runs a Func step on behalf of a script rendered from the task, reading
+// the inputs from the environment. The outputs are printed as shell variable assignments
+// to be evaluated, and written to $GITHUB_OUTPUT when it is set. Secrets are masked in the
+// output of the func as in a run of the task, and on GitHub Actions the outputs derived
+// from secrets are masked in the log of the workflow with ::add-mask::.
+func (c *CLI) runTaskStep(cmd *cliCommand) error {
+	var taskName, outputDir string
+
+	cmd.flags.StringVar(&taskName, "task", "", "the task the step belongs to. Required when more than one task is registered")
+	cmd.flags.StringVar(&outputDir, "output-dir", "", "the directory to write the outputs to, a file per output")
+
+	args, err := cmd.parse(1, 1, "[--task TASK] [--output-dir DIR] STEP")
+	if err != nil {
+		return err
+	}
+
+	if taskName == "" {
+		if v, ok := c.lookupEnv("ACC_TASK"); ok {
+			taskName = v
+		} else if len(c.tasks) == 1 {
+			taskName = c.tasks[0].Name
+		} else {
+			return usageErrorf("run-task-step: --task is required when more than one task is registered")
+		}
+	}
+
+	def, p, err := c.buildTask(taskName)
+	if err != nil {
+		return err
+	}
+
+	var (
+		step  TaskStep
+		impl  *Func
+		combo *MatrixCombo
+	)
+
+	// The steps before the func tell which of the upstream outputs are derived from secrets.
+	var upstream []TaskStep
+
+	for _, s := range append(append([]TaskStep(nil), p.Steps...), p.Cleanup...) {
+		if f, ok := s.Run.(Func); ok && s.Name == args[0] {
+			step, impl, combo = s, &f, s.Combo
+		} else if impl == nil {
+			upstream = append(upstream, s)
+		}
+	}
+
+	if impl == nil {
+		return usageErrorf("task %q has no func step %q", taskName, args[0])
+	}
+
+	inputs, err := c.inputs(cmd, def, p, false)
+	if err != nil {
+		return err
+	}
+
+	sec := newSecrets(p, inputs)
+	if sec != nil {
+		inputs = inputs.withSecrets(sec)
+	}
+
+	for _, s := range upstream {
+		sec.derived(s)
+	}
+
+	// The upstream outputs the func reads are passed by the script in environment variables.
+	state := map[string]map[string]string{}
+
+	for _, ref := range impl.Inputs {
+		if ref.Job == "" {
+			continue
+		}
+
+		v, ok := c.lookupEnv(funcInputEnv(ref))
+
+		// The scripts rendering a matrix once for all its combinations name the outputs
+		// of the steps of the combination after the steps of the template.
+		if !ok && combo != nil {
+			v, ok = c.lookupEnv(funcInputEnv(matrixTemplateRef(combo, ref)))
+		}
+
+		if ok {
+			if state[ref.Job] == nil {
+				state[ref.Job] = map[string]string{}
+			}
+
+			state[ref.Job][ref.Key] = v
+
+			if sec.isTainted(ref.Job) {
+				sec.addOutputs(map[string]string{ref.Key: v})
+			}
+		}
+	}
+
+	// The output of the commands goes to stderr, as stdout is evaluated by the script.
+	// It is masked and held until the func finishes, like in a run of the task.
+	var t Target = c.target(c.stderr(), c.stderr())
+
+	var maskedOut, maskedErr *maskingWriter
+
+	if sec != nil {
+		maskedOut, maskedErr = newMaskingWriter(c.stderr(), sec, true), newMaskingWriter(c.stderr(), sec, true)
+
+		t = &redirectedTarget{Target: t, stdout: maskedOut, stderr: maskedErr, secrets: sec}
+	}
+
+	outputs, err := runFunc(step, *impl, t, inputs, state)
+
+	derived := sec.derived(step)
+
+	if derived {
+		sec.addOutputs(outputs)
+	}
+
+	if sec != nil {
+		maskedOut.flush()
+		maskedErr.flush()
+	}
+
+	if err != nil {
+		return sec.maskError(err)
+	}
+
+	keys := impl.Outputs
+
+	// GitHub Actions masks the outputs derived from secrets in the log from now on,
+	// including where later steps print them.
+	if v, _ := c.lookupEnv("GITHUB_ACTIONS"); v == "true" && derived {
+		for _, k := range keys {
+			for _, l := range strings.Split(outputs[k], "\n") {
+				if l = strings.TrimSpace(l); l != "" {
+					fmt.Fprintf(c.stdout(), "::add-mask::%s\n", l)
+				}
+			}
+		}
+	}
+
+	if outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := ioutil.WriteFile(filepath.Join(outputDir, k), []byte(outputs[k]), 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	if path, ok := c.lookupEnv("GITHUB_OUTPUT"); ok && path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			fmt.Fprintf(f, "%s<<ACC_EOF\n%s\nACC_EOF\n", k, outputs[k])
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	if cmd.json {
+		return c.writeJSON(outputs)
+	}
+
+	names := []string{step.Name}
+
+	// The scripts rendering a matrix once for all its combinations refer to the outputs
+	// after the step of the template.
+	if combo != nil {
+		if name := matrixTemplateRef(combo, Ref{Job: step.Name}).Job; name != step.Name {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		for _, k := range keys {
+			fmt.Fprintf(c.stdout(), "%s=%s\n", funcOutputVar(name, k), shellQuote(outputs[k]))
+		}
+	}
+
+	return nil
+}
+
+// writeFile creates the file and writes it with write.
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// silentError is an error that has already been reported.
+type silentError struct {
+	err *cliError
+}
+
+func (e silentError) Error() string {
+	return e.err.Error()
+}
+
+func (e silentError) Unwrap() error {
+	return e.err
+}
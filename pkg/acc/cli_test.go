@@ -0,0 +1,427 @@
+package acc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cliTestEnv makes the test binary run the CLI with scriptTestTask instead of the tests,
+// so that the scripts rendered by the tests can invoke it for `run-task-step`.
+const cliTestEnv = "ACC_TEST_CLI"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(cliTestEnv) != "" {
+		c := &CLI{}
+
+		c.Register("script", scriptTestTask)
+
+		os.Exit(c.Run(os.Args[1:]))
+	}
+
+	os.Exit(m.Run())
+}
+
+// scriptTestTask runs two funcs of the same name, whose outputs the script keeps apart.
+func scriptTestTask(s TaskScope) {
+	gen := func(path string) Func {
+		return Func{Name: "gen", Outputs: []string{"path"}, F: func(ctx TaskStepContext) error {
+			ctx.Set("path", path)
+			return nil
+		}}
+	}
+
+	first := s.Do("first", gen("it's first"))
+	second := s.Do("second", gen("second"))
+
+	s.Do("print", s.Cmd("echo", first.Get("path"), second.Get("path")))
+}
+
+func testCLI(fake *FakeRuntime, env map[string]string) (*CLI, *bytes.Buffer, *bytes.Buffer) {
+	var stdout, stderr bytes.Buffer
+
+	c := &CLI{
+		Stdout: &stdout,
+		Stderr: &stderr,
+		NewTarget: func(_, _ io.Writer) Target {
+			return fake
+		},
+		LookupEnv: func(key string) (string, bool) {
+			v, ok := env[key]
+			return v, ok
+		},
+	}
+
+	c.Register("deploy", func(s TaskScope) {
+		s.Defer("delete cluster", s.Cmd("kind", "delete", "cluster", "--name", s.Get("seed")))
+
+		create := s.Do("create cluster", s.Cmd("kind", "create", "cluster", "--name", s.Get("seed")))
+
+		kubeconfig, _ := create.Outputs.Get("stdout")
+
+		s.Do("install", s.Cmd("helm", "upgrade", "--install", s.Get("release"), "stable/nginx").
+			WithEnv("KUBECONFIG", *kubeconfig))
+
+		s.Do("generate workflow", Func{Name: "gen", Outputs: []string{"path"}, F: func(ctx TaskStepContext) error {
+			ctx.Set("path", ".github/workflows/"+ctx.Get("seed")+".yaml")
+			return nil
+		}})
+	}, "seed", "release")
+
+	return c, &stdout, &stderr
+}
+
+func TestCLIRun(t *testing.T) {
+	fake := &FakeRuntime{}
+
+	inputsFile := filepath.Join(t.TempDir(), "inputs.env")
+
+	if err := ioutil.WriteFile(inputsFile, []byte("# inputs\nseed = from-file\nrelease = web\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _, stderr := testCLI(fake, map[string]string{"SEED": "from-env", "RELEASE": "from-env"})
+
+	if code := c.Run([]string{"run", "deploy", "--inputs-file", inputsFile, "-i", "seed=e2e", "--skip", "install"}); code != ExitOK {
+		t.Fatalf("unexpected exit code: want %d, got %d: %s", ExitOK, code, stderr)
+	}
+
+	fake.AssertPlan(t,
+		"kind create cluster --name e2e",
+		"kind delete cluster --name e2e",
+	)
+}
+
+func TestCLIExitCodes(t *testing.T) {
+	fake := &FakeRuntime{
+		Responses: []FakeResponse{
+			{Path: "kind", Args: []string{"create", "cluster", "--name", "e2e"}, ExitCode: 1},
+		},
+	}
+
+	c, _, _ := testCLI(fake, nil)
+
+	c.Register("invalid", func(s TaskScope) {
+		s.Do("step", s.Cmd("true"))
+		s.Do("step", s.Cmd("true"))
+	})
+
+	testcases := []struct {
+		args []string
+		want int
+	}{
+		{args: nil, want: ExitUsage},
+		{args: []string{"help"}, want: ExitOK},
+		{args: []string{"nope"}, want: ExitUsage},
+		{args: []string{"run", "nope"}, want: ExitUsage},
+		{args: []string{"run", "deploy", "-i", "seed=e2e"}, want: ExitUsage},
+		{args: []string{"run", "deploy", "-i", "seed=e2e", "-i", "release=web", "-i", "other=x"}, want: ExitUsage},
+		{args: []string{"run", "deploy", "-i", "seed=e2e", "-i", "release=web", "--only", "nope"}, want: ExitUsage},
+		{args: []string{"run", "deploy", "-i", "seed=e2e", "-i", "release=web", "--from", "delete cluster"}, want: ExitUsage},
+		{args: []string{"run", "deploy", "-i", "seed=e2e", "-i", "release=web"}, want: ExitFailed},
+		{args: []string{"render", "yaml", "deploy"}, want: ExitUsage},
+		{args: []string{"validate", "deploy"}, want: ExitOK},
+		{args: []string{"validate"}, want: ExitInvalid},
+	}
+
+	for _, tc := range testcases {
+		if got := c.Run(tc.args); got != tc.want {
+			t.Errorf("unexpected exit code for %q: want %d, got %d", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestCLIJSON(t *testing.T) {
+	fake := &FakeRuntime{
+		Responses: []FakeResponse{
+			{Path: "kind", Args: []string{"create", "cluster", "--name", "e2e"}, Stdout: "kubeconfig"},
+		},
+	}
+
+	c, stdout, _ := testCLI(fake, nil)
+
+	if code := c.Run([]string{"run", "--json", "deploy", "-i", "seed=e2e", "-i", "release=web"}); code != ExitOK {
+		t.Fatalf("unexpected exit code: want %d, got %d", ExitOK, code)
+	}
+
+	var out struct {
+		Result RunResult `json:"result"`
+		Error  string    `json:"error"`
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		t.Fatalf("%v: %s", err, stdout)
+	}
+
+	if want, got := ".github/workflows/e2e.yaml", out.Result.Outputs["generate workflow"]["path"]; got != want {
+		t.Errorf("unexpected output: want %q, got %q", want, got)
+	}
+
+	if out.Error != "" {
+		t.Errorf("unexpected error: %s", out.Error)
+	}
+
+	stdout.Reset()
+
+	if code := c.Run([]string{"run", "deploy", "--json"}); code != ExitUsage {
+		t.Fatalf("unexpected exit code: want %d, got %d", ExitUsage, code)
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		t.Fatalf("%v: %s", err, stdout)
+	}
+
+	if want, got := `missing input "seed": give it with -i seed=VALUE or $SEED`, out.Error; got != want {
+		t.Errorf("unexpected error: want %q, got %q", want, got)
+	}
+}
+
+func TestCLIGraph(t *testing.T) {
+	c, stdout, _ := testCLI(&FakeRuntime{}, nil)
+
+	if code := c.Run([]string{"graph", "deploy"}); code != ExitOK {
+		t.Fatalf("unexpected exit code: want %d, got %d", ExitOK, code)
+	}
+
+	want := `create cluster
+install <- create cluster
+generate workflow
+delete cluster (cleanup)
+`
+
+	if got := stdout.String(); got != want {
+		t.Errorf("unexpected graph: want %q, got %q", want, got)
+	}
+}
+
+func TestCLIRender(t *testing.T) {
+	c, stdout, _ := testCLI(&FakeRuntime{}, nil)
+
+	c.Register("release", func(s TaskScope) {
+		s.Defer("delete cluster", s.Cmd("kind", "delete", "cluster", "--name", s.Get("seed")))
+
+		create := s.Do("create cluster", s.Cmd("kind", "create", "cluster", "--name", s.Get("seed")))
+
+		s.Do("print", s.Cmd("echo", "$HOME").WithStdin(create.Get("stdout")))
+	}, "seed")
+
+	testcases := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: "gitlab",
+			want: `variables:
+  SEED:
+    value: ""
+    description: "The seed input of the task"
+
+task:
+  script:
+    # create cluster
+    - "ACC_CREATE_CLUSTER_STDERR_FILE=$(mktemp)"
+    - "ACC_CREATE_CLUSTER_EXIT_CODE=0"
+    - "ACC_CREATE_CLUSTER_STDOUT=$({ kind create cluster --name ${SEED}; } 2>\"${ACC_CREATE_CLUSTER_STDERR_FILE}\") || ACC_CREATE_CLUSTER_EXIT_CODE=$?"
+    - "ACC_CREATE_CLUSTER_STDERR=$(cat \"${ACC_CREATE_CLUSTER_STDERR_FILE}\")"
+    - "rm -f \"${ACC_CREATE_CLUSTER_STDERR_FILE}\""
+    - "echo \"${ACC_CREATE_CLUSTER_STDOUT}\""
+    - "if [ -n \"${ACC_CREATE_CLUSTER_STDERR}\" ]; then echo \"${ACC_CREATE_CLUSTER_STDERR}\" >&2; fi"
+    - "(exit \"${ACC_CREATE_CLUSTER_EXIT_CODE}\")"
+    # print
+    - "printf '%s' \"${ACC_CREATE_CLUSTER_STDOUT}\" | echo $HOME"
+  after_script:
+    # delete cluster
+    - "kind delete cluster --name ${SEED}"
+`,
+		},
+		{
+			format: "make",
+			want: "SHELL := /bin/bash\n" +
+				".SHELLFLAGS := -o pipefail -c\n" +
+				"\n" +
+				"SEED ?= $(error SEED is required)\n" +
+				"\n" +
+				".PHONY: all cleanup create-cluster print\n" +
+				"\n" +
+				"all: print\n" +
+				"\n" +
+				"# create cluster\n" +
+				"create-cluster:\n" +
+				"\t@mkdir -p .acc/create-cluster\n" +
+				"\t{ { kind create cluster --name $(SEED); } 2>&1 1>&3 | tee .acc/create-cluster/stderr >&2; } 3>&1 | tee .acc/create-cluster/stdout; code=$$?; echo $$code > .acc/create-cluster/exitCode; exit $$code\n" +
+				"\n" +
+				"# print\n" +
+				"print: create-cluster\n" +
+				"\t@mkdir -p .acc/print\n" +
+				"\t{ { printf '%s' \"$$(cat .acc/create-cluster/stdout)\" | echo $$HOME; } 2>&1 1>&3 | tee .acc/print/stderr >&2; } 3>&1 | tee .acc/print/stdout; code=$$?; echo $$code > .acc/print/exitCode; exit $$code\n" +
+				"\n" +
+				"cleanup:\n" +
+				"\t-@mkdir -p .acc/delete-cluster\n" +
+				"\t-{ { kind delete cluster --name $(SEED); } 2>&1 1>&3 | tee .acc/delete-cluster/stderr >&2; } 3>&1 | tee .acc/delete-cluster/stdout; code=$$?; echo $$code > .acc/delete-cluster/exitCode; exit $$code\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		stdout.Reset()
+
+		if code := c.Run([]string{"render", tc.format, "release"}); code != ExitOK {
+			t.Fatalf("unexpected exit code for %s: want %d, got %d", tc.format, ExitOK, code)
+		}
+
+		if got := stdout.String(); got != tc.want {
+			t.Errorf("unexpected %s output: want %q, got %q", tc.format, tc.want, got)
+		}
+	}
+}
+
+func TestCLIRunTaskStep(t *testing.T) {
+	dir := t.TempDir()
+
+	githubOutput := filepath.Join(dir, "github_output")
+
+	c, stdout, _ := testCLI(&FakeRuntime{}, map[string]string{"SEED": "e2e", "GITHUB_OUTPUT": githubOutput})
+
+	if code := c.Run([]string{"run-task-step", "--output-dir", filepath.Join(dir, "out"), "generate workflow"}); code != ExitOK {
+		t.Fatalf("unexpected exit code: want %d, got %d", ExitOK, code)
+	}
+
+	if want, got := "GENERATE_WORKFLOW_PATH=.github/workflows/e2e.yaml\n", stdout.String(); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	for file, want := range map[string]string{
+		githubOutput:                      "path<<ACC_EOF\n.github/workflows/e2e.yaml\nACC_EOF\n",
+		filepath.Join(dir, "out", "path"): ".github/workflows/e2e.yaml",
+	} {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(bs); got != want {
+			t.Errorf("unexpected content of %s: want %q, got %q", file, want, got)
+		}
+	}
+
+	if code := c.Run([]string{"run-task-step", "install"}); code != ExitUsage {
+		t.Errorf("unexpected exit code for a command step: want %d, got %d", ExitUsage, code)
+	}
+}
+
+func TestCLIRunTaskStepInputs(t *testing.T) {
+	c, stdout, _ := testCLI(&FakeRuntime{}, map[string]string{"ACC_INPUT_CREATE_CLUSTER_STDOUT": "/tmp/kubeconfig"})
+
+	c.Register("check", func(s TaskScope) {
+		create := s.Do("create cluster", s.Cmd("kind", "create", "cluster"))
+
+		s.Do("kubeconfig", Func{Name: "kubeconfig", Inputs: []Ref{create.Get("stdout")}, Outputs: []string{"path"}, F: func(ctx TaskStepContext) error {
+			ctx.Set("path", ctx.Stdout("create cluster"))
+			return nil
+		}})
+	})
+
+	if code := c.Run([]string{"render", "bash", "check"}); code != ExitOK {
+		t.Fatalf("unexpected exit code: want %d, got %d", ExitOK, code)
+	}
+
+	if want, got := `ACC_INPUT_CREATE_CLUSTER_STDOUT="${ACC_CREATE_CLUSTER_STDOUT}" `, stdout.String(); !strings.Contains(got, want) {
+		t.Errorf("expected the script to pass the output to run-task-step with %q, got:\n%s", want, got)
+	}
+
+	stdout.Reset()
+
+	if code := c.Run([]string{"run-task-step", "--task", "check", "kubeconfig"}); code != ExitOK {
+		t.Fatalf("unexpected exit code: want %d, got %d", ExitOK, code)
+	}
+
+	if want, got := "KUBECONFIG_PATH=/tmp/kubeconfig\n", stdout.String(); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+}
+
+func TestCLIRunTaskStepSecrets(t *testing.T) {
+	githubOutput := filepath.Join(t.TempDir(), "github_output")
+
+	c, stdout, stderr := testCLI(nil, map[string]string{"TOKEN": secretsTestToken, "GITHUB_ACTIONS": "true", "GITHUB_OUTPUT": githubOutput})
+
+	c.NewTarget = nil
+
+	c.Register("login", func(s TaskScope) {
+		s.Secret("token")
+
+		s.Do("session", Func{Name: "session", Outputs: []string{"id"}, F: func(ctx TaskStepContext) error {
+			token := ctx.Get("token")
+
+			if _, err := ctx.Exec(Command{Path: "sh", Args: []interface{}{"-c", "echo token=$TOKEN >&2"}, Env: map[string]interface{}{"TOKEN": token}}); err != nil {
+				return err
+			}
+
+			ctx.Set("id", strings.ToUpper(token))
+
+			return nil
+		}})
+	})
+
+	if code := c.Run([]string{"run-task-step", "--task", "login", "session"}); code != ExitOK {
+		t.Fatalf("unexpected exit code: want %d, got %d: %s", ExitOK, code, stderr.String())
+	}
+
+	id := strings.ToUpper(secretsTestToken)
+
+	if want, got := "::add-mask::"+id+"\nSESSION_ID="+id+"\n", stdout.String(); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	if want, got := "token=***\n", stderr.String(); got != want {
+		t.Errorf("unexpected stderr: want %q, got %q", want, got)
+	}
+}
+
+func TestFuncOutputVars(t *testing.T) {
+	gen := Func{Name: "gen", Outputs: []string{"path"}, F: func(ctx TaskStepContext) error {
+		return nil
+	}}
+
+	var b TaskBuilder
+
+	first := b.Do("first", gen)
+	second := b.Do("second", gen)
+
+	b.Do("print", b.Cmd("echo", first.Get("path"), second.Get("path")))
+
+	var script bytes.Buffer
+
+	WriteBashScript(b.Build(), nil, &script)
+
+	if want, got := "echo ${FIRST_PATH} ${SECOND_PATH}\n", script.String(); !strings.Contains(got, want) {
+		t.Errorf("expected the script to contain %q, got:\n%s", want, got)
+	}
+}
+
+func TestBashScriptRun(t *testing.T) {
+	c, stdout, _ := testCLI(nil, nil)
+
+	c.Register("script", scriptTestTask)
+
+	if code := c.Run([]string{"render", "bash", "script"}); code != ExitOK {
+		t.Fatalf("unexpected exit code: want %d, got %d", ExitOK, code)
+	}
+
+	cmd := exec.Command("bash", "-c", stdout.String())
+	cmd.Env = append(os.Environ(), cliTestEnv+"=1")
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running the script: %v\n%s", err, stdout.String())
+	}
+
+	if want, got := "it's first second\n", string(out); got != want {
+		t.Errorf("unexpected output of the script: want %q, got %q", want, got)
+	}
+}
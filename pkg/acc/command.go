@@ -0,0 +1,128 @@
+package acc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvInheritance is the rule for passing the environment of the current process to a command.
+type EnvInheritance int
+
+const (
+	// EnvInherit passes the whole environment of the current process.
+	EnvInherit EnvInheritance = iota
+	// EnvInheritAllowlist passes only the variables listed in Command.EnvAllowlist.
+	EnvInheritAllowlist
+	// EnvInheritClean passes nothing but Command.Env.
+	EnvInheritClean
+)
+
+// WithEnv returns a copy of the command that sets the environment variable key to val,
+// which can be a string, Ref or Expr.
+func (c Command) WithEnv(key string, val interface{}) Command {
+	env := map[string]interface{}{}
+
+	for k, v := range c.Env {
+		env[k] = v
+	}
+
+	env[key] = val
+
+	c.Env = env
+
+	return c
+}
+
+// WithEnvInheritance returns a copy of the command that inherits the environment
+// of the current process according to the rule. allowlist is used for EnvInheritAllowlist.
+func (c Command) WithEnvInheritance(rule EnvInheritance, allowlist ...string) Command {
+	c.EnvInheritance = rule
+	c.EnvAllowlist = append([]string(nil), allowlist...)
+
+	return c
+}
+
+// WithDir returns a copy of the command that runs in dir, which can be a string, Ref or Expr.
+func (c Command) WithDir(dir interface{}) Command {
+	c.Dir = dir
+
+	return c
+}
+
+// WithStdin returns a copy of the command that reads stdin, which can be a string, Ref or Expr.
+func (c Command) WithStdin(stdin interface{}) Command {
+	c.Stdin = stdin
+
+	return c
+}
+
+// environ returns the environment of the resolved command in the os/exec format.
+// pathPrefix, when not empty, replaces the inherited PATH so that only the
+// commands found there can be run by the command. A PATH set in Command.Env
+// is still searched after pathPrefix.
+func (c Command) environ(pathPrefix string) []string {
+	var env []string
+
+	switch c.EnvInheritance {
+	case EnvInherit:
+		env = os.Environ()
+	case EnvInheritAllowlist:
+		for _, key := range c.EnvAllowlist {
+			if v, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+v)
+			}
+		}
+	case EnvInheritClean:
+	default:
+		panic(fmt.Errorf("unsupported env inheritance: %d", c.EnvInheritance))
+	}
+
+	for _, k := range sortedEnvKeys(c.Env) {
+		env = setEnv(env, k, fmt.Sprintf("%s", c.Env[k]))
+	}
+
+	if pathPrefix != "" {
+		path := pathPrefix
+
+		if v, ok := c.Env["PATH"]; ok {
+			path += string(os.PathListSeparator) + fmt.Sprintf("%s", v)
+		}
+
+		env = setEnv(env, "PATH", path)
+	}
+
+	return env
+}
+
+func (c Command) dir() string {
+	if c.Dir == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s", c.Dir)
+}
+
+func (c Command) stdin() (string, bool) {
+	if c.Stdin == nil {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s", c.Stdin), true
+}
+
+func setEnv(env []string, key, val string) []string {
+	return append(unsetEnv(env, key), key+"="+val)
+}
+
+func unsetEnv(env []string, key string) []string {
+	var res []string
+
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			res = append(res, kv)
+		}
+	}
+
+	return res
+}
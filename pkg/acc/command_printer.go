@@ -0,0 +1,252 @@
+package acc
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CommandPrinter prints an unexpected command as something that can be added to the stubs.
+type CommandPrinter interface {
+	Sprint(Command) string
+}
+
+// StubFilePrinter is a CommandPrinter that also prints a complete stub file
+// for all the unexpected commands of a run.
+type StubFilePrinter interface {
+	CommandPrinter
+
+	SprintFile([]Command) string
+}
+
+// GoCommandPrinter prints a Command literal to be used in an ExecutionStub. It is the default.
+type GoCommandPrinter struct {
+}
+
+func (p GoCommandPrinter) Sprint(cmd Command) string {
+	var args []string
+
+	for _, a := range cmd.Args {
+		args = append(args, fmt.Sprintf("%q", a))
+	}
+	return fmt.Sprintf(`Command{
+  Path: %q,
+  Args: []interface{}{
+    %s,
+  },
+}`, cmd.Path, strings.Join(args, ", \n    "))
+}
+
+// GoStubPrinter prints an ExecutionStub literal with a Run skeleton to be filled in.
+type GoStubPrinter struct {
+	// Package is the package clause of the stub file. Defaults to "main".
+	Package string
+
+	// Var is the name of the variable the stub file declares. Defaults to "executionStubs".
+	Var string
+}
+
+func (p GoStubPrinter) Sprint(cmd Command) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "acc.ExecutionStub{\n")
+	fmt.Fprintf(&b, "\tCommand: acc.Command{\n")
+	fmt.Fprintf(&b, "\t\tPath: %q,\n", cmd.Path)
+
+	if len(cmd.Args) > 0 {
+		fmt.Fprintf(&b, "\t\tArgs: []interface{}{\n")
+
+		for _, a := range cmd.Args {
+			fmt.Fprintf(&b, "\t\t\t%q,\n", a)
+		}
+
+		fmt.Fprintf(&b, "\t\t},\n")
+	}
+
+	fmt.Fprintf(&b, "\t},\n")
+	fmt.Fprintf(&b, "\tRun: func(ctx acc.RunContext) {\n")
+	fmt.Fprintf(&b, "\t\tfmt.Fprintln(ctx.Stdout, \"\")\n")
+	fmt.Fprintf(&b, "\t},\n")
+	fmt.Fprintf(&b, "}")
+
+	return b.String()
+}
+
+func (p GoStubPrinter) SprintFile(cmds []Command) string {
+	pkg := p.Package
+	if pkg == "" {
+		pkg = "main"
+	}
+
+	name := p.Var
+	if name == "" {
+		name = "executionStubs"
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	fmt.Fprintf(&b, "import (\n\t\"fmt\"\n\n\t\"github.com/mumoshu/golang-experiments/pkg/acc\"\n)\n\n")
+	fmt.Fprintf(&b, "var %s = []acc.ExecutionStub{\n", name)
+
+	for _, cmd := range cmds {
+		stub := strings.TrimPrefix(p.Sprint(cmd), "acc.ExecutionStub")
+
+		for _, l := range strings.Split(stub+",", "\n") {
+			fmt.Fprintf(&b, "\t%s\n", l)
+		}
+	}
+
+	fmt.Fprintf(&b, "}\n")
+
+	return b.String()
+}
+
+// ShellCommandPrinter prints the command line. The stub file it prints defines a bash function
+// per command that answers the printed invocations and fails on any other.
+type ShellCommandPrinter struct {
+}
+
+func (p ShellCommandPrinter) Sprint(cmd Command) string {
+	words := []string{shellQuote(cmd.Path)}
+
+	for _, a := range cmd.Args {
+		words = append(words, shellQuote(fmt.Sprint(a)))
+	}
+
+	return strings.Join(words, " ")
+}
+
+func (p ShellCommandPrinter) SprintFile(cmds []Command) string {
+	var (
+		paths []string
+		byCmd = map[string][]Command{}
+	)
+
+	for _, cmd := range cmds {
+		if _, ok := byCmd[cmd.Path]; !ok {
+			paths = append(paths, cmd.Path)
+		}
+
+		byCmd[cmd.Path] = append(byCmd[cmd.Path], cmd)
+	}
+
+	sort.Strings(paths)
+
+	var b strings.Builder
+
+	b.WriteString("#!/usr/bin/env bash\n")
+
+	for _, path := range paths {
+		fmt.Fprintf(&b, "\n%s() {\n", shellFuncName(path))
+		fmt.Fprintf(&b, "  case \"$*\" in\n")
+
+		for _, cmd := range byCmd[path] {
+			var args []string
+
+			for _, a := range cmd.Args {
+				args = append(args, fmt.Sprint(a))
+			}
+
+			fmt.Fprintf(&b, "  %s)\n", shellQuote(strings.Join(args, " ")))
+			fmt.Fprintf(&b, "    echo ''\n")
+			fmt.Fprintf(&b, "    ;;\n")
+		}
+
+		fmt.Fprintf(&b, "  *)\n")
+		fmt.Fprintf(&b, "    echo \"unexpected command: %s $*\" 1>&2\n", path)
+		fmt.Fprintf(&b, "    return 1\n")
+		fmt.Fprintf(&b, "    ;;\n")
+		fmt.Fprintf(&b, "  esac\n")
+		fmt.Fprintf(&b, "}\n")
+	}
+
+	return b.String()
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./:=@%+,-]+$`)
+
+// shellQuote returns s as a single shell word, quoting it only when needed.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellFuncName returns the name of the bash function that stands in for the command at path.
+func shellFuncName(path string) string {
+	name := path
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return name
+}
+
+// unexpectedCommands collects the unexpected commands of a run, in the order they were executed.
+type unexpectedCommands struct {
+	mu   sync.Mutex
+	errs []UnexpectedCommandError
+}
+
+func (c *unexpectedCommands) add(e UnexpectedCommandError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.errs = append(c.errs, e)
+}
+
+func (c *unexpectedCommands) list() []UnexpectedCommandError {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]UnexpectedCommandError(nil), c.errs...)
+}
+
+// WriteStubFile prints the unexpected commands, without duplicates, as a complete stub file.
+// Printers that are not StubFilePrinters have their commands printed one after another.
+func WriteStubFile(w io.Writer, printer CommandPrinter, errs []UnexpectedCommandError) error {
+	if printer == nil {
+		printer = GoCommandPrinter{}
+	}
+
+	var (
+		cmds []Command
+		seen = map[string]bool{}
+	)
+
+	for _, e := range errs {
+		cmd := e.printable()
+
+		key := ShellCommandPrinter{}.Sprint(cmd)
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+
+		cmds = append(cmds, cmd)
+	}
+
+	if fp, ok := printer.(StubFilePrinter); ok {
+		_, err := io.WriteString(w, fp.SprintFile(cmds))
+		return err
+	}
+
+	for _, cmd := range cmds {
+		if _, err := fmt.Fprintf(w, "%s\n", printer.Sprint(cmd)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
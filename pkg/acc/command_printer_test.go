@@ -0,0 +1,154 @@
+package acc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCommandPrinters(t *testing.T) {
+	cmd := Command{Path: "helm", Args: []interface{}{"upgrade", "--install", "it's"}}
+
+	testcases := []struct {
+		printer CommandPrinter
+		want    string
+	}{
+		{
+			printer: GoStubPrinter{},
+			want: `acc.ExecutionStub{
+	Command: acc.Command{
+		Path: "helm",
+		Args: []interface{}{
+			"upgrade",
+			"--install",
+			"it's",
+		},
+	},
+	Run: func(ctx acc.RunContext) {
+		fmt.Fprintln(ctx.Stdout, "")
+	},
+}`,
+		},
+		{
+			printer: ShellCommandPrinter{},
+			want:    `helm upgrade --install 'it'\''s'`,
+		},
+	}
+
+	for _, tc := range testcases {
+		if got := tc.printer.Sprint(cmd); got != tc.want {
+			t.Errorf("unexpected output of %T:\nwant:\n%s\ngot:\n%s", tc.printer, tc.want, got)
+		}
+	}
+}
+
+func TestCollectUnexpected(t *testing.T) {
+	var builder TaskBuilder
+
+	builder.Inputs.Def("seed", nil)
+
+	builder.Do("create", builder.Cmd("kind", "create", "cluster", "--name", builder.Get("seed")))
+	builder.Do("install", builder.Cmd("helm", "install", builder.Get("seed"), "stable/nginx"))
+	builder.Do("recreate", builder.Cmd("kind", "create", "cluster", "--name", builder.Get("seed")))
+
+	runtime := &Runtime{
+		CollectUnexpected: true,
+		CommandPrinter:    ShellCommandPrinter{},
+		Stdout:            &bytes.Buffer{},
+		Stderr:            &bytes.Buffer{},
+	}
+
+	RunTask(builder.Build(), runtime, NewInputs(map[string]string{"seed": "e2e"}))
+
+	if want, got := 3, len(runtime.UnexpectedCommands()); got != want {
+		t.Fatalf("unexpected number of unexpected commands: want %d, got %d", want, got)
+	}
+
+	var buf bytes.Buffer
+
+	if err := runtime.WriteStubFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `#!/usr/bin/env bash
+
+helm() {
+  case "$*" in
+  'install e2e stable/nginx')
+    echo ''
+    ;;
+  *)
+    echo "unexpected command: helm $*" 1>&2
+    return 1
+    ;;
+  esac
+}
+
+kind() {
+  case "$*" in
+  'create cluster --name e2e')
+    echo ''
+    ;;
+  *)
+    echo "unexpected command: kind $*" 1>&2
+    return 1
+    ;;
+  esac
+}
+`
+
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected stub file:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestFakeRuntimeCollectUnexpected(t *testing.T) {
+	fake := &FakeRuntime{
+		Strict:            true,
+		CollectUnexpected: true,
+		CommandPrinter:    ShellCommandPrinter{},
+		Responses: []FakeResponse{
+			{Path: "kind", Stdout: "ok"},
+		},
+	}
+
+	fake.Execute(Command{Path: "kind"}, []string{"create", "cluster"})
+	fake.Execute(Command{Path: "helm"}, []string{"list"})
+	fake.Execute(Command{Path: "kubectl"}, nil)
+
+	var buf bytes.Buffer
+
+	if err := fake.WriteStubFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `#!/usr/bin/env bash
+
+helm() {
+  case "$*" in
+  list)
+    echo ''
+    ;;
+  *)
+    echo "unexpected command: helm $*" 1>&2
+    return 1
+    ;;
+  esac
+}
+
+kubectl() {
+  case "$*" in
+  '')
+    echo ''
+    ;;
+  *)
+    echo "unexpected command: kubectl $*" 1>&2
+    return 1
+    ;;
+  esac
+}
+`
+
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected stub file:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,59 @@
+package acc
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCommandEnviron(t *testing.T) {
+	os.Setenv("ACC_TEST_INHERITED", "inherited")
+	defer os.Unsetenv("ACC_TEST_INHERITED")
+
+	cmd := Command{Path: "kubectl"}.WithEnv("KUBECONFIG", "/tmp/kubeconfig")
+
+	env := RunContext{Env: cmd.environ("/bin-dir")}
+	if v := env.Getenv("ACC_TEST_INHERITED"); v != "inherited" {
+		t.Errorf("expected ACC_TEST_INHERITED to be inherited, got %q", v)
+	}
+	if v := env.Getenv("PATH"); v != "/bin-dir" {
+		t.Errorf("unexpected PATH: %q", v)
+	}
+
+	clean := cmd.WithEnvInheritance(EnvInheritClean).WithEnv("PATH", "/usr/bin").environ("/bin-dir")
+	if want, got := []string{"KUBECONFIG=/tmp/kubeconfig", "PATH=/bin-dir:/usr/bin"}, clean; !equalStrings(want, got) {
+		t.Errorf("unexpected clean env: want %v, got %v", want, got)
+	}
+
+	allowed := cmd.WithEnvInheritance(EnvInheritAllowlist, "ACC_TEST_INHERITED", "ACC_TEST_UNSET").environ("")
+	if want, got := []string{"ACC_TEST_INHERITED=inherited", "KUBECONFIG=/tmp/kubeconfig"}, allowed; !equalStrings(want, got) {
+		t.Errorf("unexpected allowlisted env: want %v, got %v", want, got)
+	}
+}
+
+func TestBashCommandLine(t *testing.T) {
+	cmd := Command{Path: "kubectl"}.
+		WithEnvInheritance(EnvInheritAllowlist, "HOME").
+		WithEnv("KUBECONFIG", "${WORKDIR}/kubeconfig").
+		WithDir("${WORKDIR}").
+		WithStdin(`{"kind": "Namespace"}`)
+
+	want := `(cd "${WORKDIR}" && printf '%s' "{\"kind\": \"Namespace\"}" | env -i HOME="${HOME}" KUBECONFIG="${WORKDIR}/kubeconfig" kubectl apply -f -)`
+
+	if got := bashCommandLine(cmd, []string{"apply", "-f", "-"}); got != want {
+		t.Errorf("unexpected command line:\nwant %s\ngot  %s", want, got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,313 @@
+package acc
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Cond is a condition deciding whether a step is run, given with If or TaskScope.When.
+// It is evaluated right before the step, from the task inputs, the outputs of the steps
+// executed before it and whether they succeeded or were skipped.
+// A step whose condition does not hold is skipped.
+type Cond struct {
+	op condOp
+
+	// args are the string, Ref or Expr operands of a comparison.
+	args []interface{}
+
+	// step is the name of the step whose status is checked.
+	step string
+
+	// conds are the operands of Not, And and Or.
+	conds []Cond
+}
+
+type condOp int
+
+const (
+	condEquals condOp = iota
+	condContains
+	condSucceeded
+	condSkipped
+	condNot
+	condAnd
+	condOr
+)
+
+// Equals holds when the values of a and b, each of which can be a string, Ref or Expr, are equal.
+func Equals(a, b interface{}) Cond {
+	return Cond{op: condEquals, args: condArgs(a, b)}
+}
+
+// Contains holds when the value of s contains the value of substr, each of which can be a string, Ref or Expr.
+func Contains(s, substr interface{}) Cond {
+	return Cond{op: condContains, args: condArgs(s, substr)}
+}
+
+// Succeeded holds when the step was executed and succeeded. A step skipped with its outputs
+// provided, like by a resumed run, counts as succeeded.
+func Succeeded(step TaskStep) Cond {
+	return Cond{op: condSucceeded, step: step.Name}
+}
+
+// Skipped holds when the step was skipped, like when its own condition did not hold.
+func Skipped(step TaskStep) Cond {
+	return Cond{op: condSkipped, step: step.Name}
+}
+
+// Not holds when c does not.
+func Not(c Cond) Cond {
+	return Cond{op: condNot, conds: []Cond{c}}
+}
+
+// And holds when all of the conds hold.
+func And(conds ...Cond) Cond {
+	return Cond{op: condAnd, conds: conds}
+}
+
+// Or holds when any of the conds holds.
+func Or(conds ...Cond) Cond {
+	return Cond{op: condOr, conds: conds}
+}
+
+// If makes the step run only when the condition holds, in addition to the conditions
+// of the TaskScope.When blocks it is defined in.
+func If(c Cond) StepOption {
+	return func(s *TaskStep) {
+		s.If = andCond(s.If, c)
+	}
+}
+
+func condArgs(args ...interface{}) []interface{} {
+	for _, a := range args {
+		switch a.(type) {
+		case string, Ref, Expr:
+		default:
+			f := getFrame(2)
+			panic(fmt.Sprintf("%s:%d: unexpected type of operand: %T: %+v", filepath.Base(f.File), f.Line, a, a))
+		}
+	}
+
+	return args
+}
+
+// andCond returns the condition holding when both c, if any, and d hold.
+func andCond(c *Cond, d Cond) *Cond {
+	if c == nil {
+		return &d
+	}
+
+	and := And(*c, d)
+
+	return &and
+}
+
+// refs returns the refs to inputs and step outputs the condition refers to, in order of appearance.
+func (c Cond) refs() []Ref {
+	var refs []Ref
+
+	for _, a := range c.args {
+		refs = append(refs, commandRefs(Command{Args: []interface{}{a}})...)
+	}
+
+	for _, d := range c.conds {
+		refs = append(refs, d.refs()...)
+	}
+
+	return refs
+}
+
+// statusSteps returns the names of the steps whose status the condition checks.
+func (c Cond) statusSteps() []string {
+	var steps []string
+
+	if c.step != "" {
+		steps = append(steps, c.step)
+	}
+
+	for _, d := range c.conds {
+		steps = append(steps, d.statusSteps()...)
+	}
+
+	return steps
+}
+
+// condFormat is the syntax a condition is written in by an emitter.
+type condFormat struct {
+	equals, contains func(a, b interface{}) string
+	status           func(step string, status StepStatus) string
+	not              func(c string) string
+	and, or          func(cs []string) string
+}
+
+func (c Cond) format(f condFormat) string {
+	var conds []string
+
+	for _, d := range c.conds {
+		conds = append(conds, d.format(f))
+	}
+
+	switch c.op {
+	case condEquals:
+		return f.equals(c.args[0], c.args[1])
+	case condContains:
+		return f.contains(c.args[0], c.args[1])
+	case condSucceeded:
+		return f.status(c.step, StepSucceeded)
+	case condSkipped:
+		return f.status(c.step, StepSkipped)
+	case condNot:
+		return f.not(conds[0])
+	case condAnd:
+		return f.and(conds)
+	case condOr:
+		return f.or(conds)
+	default:
+		panic(fmt.Errorf("unsupported op of condition: %d", c.op))
+	}
+}
+
+// eval returns whether the condition of the step holds, given the status of the steps executed
+// or skipped before it.
+func (c Cond) eval(stepName string, inputs *mapInputs, state map[string]map[string]string, status func(step string) StepStatus) bool {
+	switch c.op {
+	case condEquals:
+		return resolveValue(stepName, c.args[0], inputs, state) == resolveValue(stepName, c.args[1], inputs, state)
+	case condContains:
+		return strings.Contains(resolveValue(stepName, c.args[0], inputs, state), resolveValue(stepName, c.args[1], inputs, state))
+	case condSucceeded, condSkipped:
+		s := status(c.step)
+		if s == "" {
+			panic(fmt.Errorf("instruction %q: depends on the status of %q but it is not yet executed", stepName, c.step))
+		}
+
+		return (c.op == condSucceeded && s == StepSucceeded) || (c.op == condSkipped && s == StepSkipped)
+	case condNot:
+		return !c.conds[0].eval(stepName, inputs, state, status)
+	case condAnd:
+		for _, d := range c.conds {
+			if !d.eval(stepName, inputs, state, status) {
+				return false
+			}
+		}
+
+		return true
+	case condOr:
+		for _, d := range c.conds {
+			if d.eval(stepName, inputs, state, status) {
+				return true
+			}
+		}
+
+		return false
+	default:
+		panic(fmt.Errorf("unsupported op of condition: %d", c.op))
+	}
+}
+
+// evalCond is like Cond.eval but returns the error the condition failed to be evaluated with.
+func evalCond(s TaskStep, inputs *mapInputs, state map[string]map[string]string, status func(step string) StepStatus) (ok bool, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if er, isErr := e.(error); isErr {
+				err = er
+			} else {
+				err = fmt.Errorf("%v", e)
+			}
+		}
+	}()
+
+	return s.If.eval(s.Name, inputs, state, status), nil
+}
+
+// text returns the condition for humans to review, with the values resolved from the inputs
+// and the symbolic outputs of a Plan.
+func (c Cond) text(stepName string, inputs *mapInputs, state map[string]map[string]string) string {
+	value := func(v interface{}) string {
+		return fmt.Sprintf("%q", resolveValue(stepName, v, inputs, state))
+	}
+
+	join := func(op string) func([]string) string {
+		return func(cs []string) string {
+			return "(" + strings.Join(cs, " "+op+" ") + ")"
+		}
+	}
+
+	return c.format(condFormat{
+		equals: func(a, b interface{}) string {
+			return value(a) + " == " + value(b)
+		},
+		contains: func(a, b interface{}) string {
+			return fmt.Sprintf("contains(%s, %s)", value(a), value(b))
+		},
+		status: func(step string, status StepStatus) string {
+			return fmt.Sprintf("%s(%q)", status, step)
+		},
+		not: func(c string) string {
+			return "!(" + c + ")"
+		},
+		and: join("&&"),
+		or:  join("||"),
+	})
+}
+
+// bashCond returns the condition as a bash command list. The status of a step is the condition
+// of the step, as the script stops at the first failure.
+func bashCond(c Cond, conds map[string]*Cond, value func(v interface{}) string) string {
+	join := func(op, empty string) func([]string) string {
+		return func(cs []string) string {
+			if len(cs) == 0 {
+				return empty
+			}
+
+			return "{ " + strings.Join(cs, " "+op+" ") + "; }"
+		}
+	}
+
+	return c.format(condFormat{
+		equals: func(a, b interface{}) string {
+			return fmt.Sprintf("[ %s = %s ]", bashDoubleQuote(value(a)), bashDoubleQuote(value(b)))
+		},
+		contains: func(a, b interface{}) string {
+			return fmt.Sprintf("[[ %s == *%s* ]]", bashDoubleQuote(value(a)), bashDoubleQuote(value(b)))
+		},
+		status: func(step string, status StepStatus) string {
+			ran := "true"
+			if d := conds[step]; d != nil {
+				ran = bashCond(*d, conds, value)
+			}
+
+			if status == StepSkipped {
+				return bashNot(ran)
+			}
+
+			return ran
+		},
+		not: bashNot,
+		and: join("&&", "true"),
+		or:  join("||", "false"),
+	})
+}
+
+// bashNot negates the bash command list, grouping it when it is already negated.
+func bashNot(c string) string {
+	if strings.HasPrefix(c, "!") {
+		return "! { " + c + "; }"
+	}
+
+	return "! " + c
+}
+
+// stepConds returns the conditions of the steps and cleanup steps keyed by step name.
+func stepConds(steps ...[]TaskStep) map[string]*Cond {
+	conds := map[string]*Cond{}
+
+	for _, ss := range steps {
+		for _, s := range ss {
+			conds[s.Name] = s.If
+		}
+	}
+
+	return conds
+}
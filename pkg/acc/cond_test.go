@@ -0,0 +1,195 @@
+package acc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func condTestTask() *Task {
+	var b TaskBuilder
+
+	b.Inputs.Def("reuse_cluster", nil)
+
+	b.When(Equals(b.Get("reuse_cluster"), "false"), func(s TaskScope) {
+		s.Call("cluster", func(s TaskScope) {
+			s.Defer("delete", s.Cmd("kind", "delete", "cluster"))
+
+			s.Do("create", s.Cmd("kind", "create", "cluster"))
+		}, nil)
+	})
+
+	diff := b.Do("diff", b.Cmd("helm", "diff"))
+
+	deploy := b.Do("deploy", b.Cmd("helm", "upgrade"), If(Not(Contains(diff.Get("stdout"), "unchanged"))))
+
+	b.Do("notify", b.Cmd("echo", "deployed"), If(Succeeded(deploy)))
+
+	b.ForEach("lint", []string{"a", "b"}, func(s TaskScope, item string) {
+		s.Do("lint", s.Cmd("golint", item), If(Not(Equals(item, "b"))))
+	})
+
+	return b.Build()
+}
+
+func TestCond(t *testing.T) {
+	for _, c := range []struct {
+		reuse, diff string
+		plan        []string
+		skipped     []string
+	}{
+		{
+			reuse: "false",
+			diff:  "changed",
+			plan: []string{
+				"kind create cluster",
+				"kind delete cluster",
+				"helm diff",
+				"helm upgrade",
+				"echo deployed",
+				"golint a",
+			},
+			skipped: []string{"lint/b/lint"},
+		},
+		{
+			reuse: "true",
+			diff:  "unchanged",
+			plan: []string{
+				"helm diff",
+				"golint a",
+			},
+			skipped: []string{"cluster/create", "cluster/delete", "deploy", "notify", "lint/b/lint"},
+		},
+	} {
+		fake := &FakeRuntime{Responses: []FakeResponse{{Path: "helm", Args: []string{"diff"}, Stdout: c.diff}}}
+
+		res, err := Run(condTestTask(), fake, NewInputs(map[string]string{"reuse_cluster": c.reuse}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fake.AssertPlan(t, c.plan...)
+
+		if want, got := c.skipped, res.Skipped; !equalStrings(want, got) {
+			t.Errorf("unexpected skipped steps: want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestCondFailed(t *testing.T) {
+	var b TaskBuilder
+
+	b.Do("deploy", b.Cmd("helm", "upgrade"), If(Equals(Ref{Job: "diff", Key: "stdout"}, "")))
+
+	res, err := Run(b.Build(), &FakeRuntime{}, NewInputs(nil))
+	if want := `depends on "diff" but it is not yet executed`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("unexpected error: want %q, got %v", want, err)
+	}
+
+	if want, got := "deploy", res.Failed; want != got {
+		t.Errorf("unexpected failed step: want %q, got %q", want, got)
+	}
+}
+
+func TestCondRendered(t *testing.T) {
+	p := condTestTask()
+
+	var bash, gha, gitlab, make, text bytes.Buffer
+
+	WriteBashScript(p, NewInputs(map[string]string{"reuse_cluster": "true"}), &bash)
+	WriteGitHubActionsWorkflow(p, "ci", &gha)
+	WriteGitLabCI(p, &gitlab)
+	WriteMakefile(p, &make)
+
+	plan, err := PlanTask(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := plan.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name, got, want string
+	}{
+		{name: "bash", got: bash.String(), want: "if [ \"true\" = \"false\" ]; then kind create cluster; fi\n"},
+		{name: "bash", got: bash.String(), want: "ACC_DIFF_STDOUT=$({ helm diff; } 2>\"${ACC_DIFF_STDERR_FILE}\") || ACC_DIFF_EXIT_CODE=$?; "},
+		{name: "bash", got: bash.String(), want: "if ! [[ \"${ACC_DIFF_STDOUT}\" == *\"unchanged\"* ]]; then helm upgrade; fi\n"},
+		{name: "bash", got: bash.String(), want: "if ! [[ \"${ACC_DIFF_STDOUT}\" == *\"unchanged\"* ]]; then echo deployed; fi\n"},
+		{name: "bash", got: bash.String(), want: "  if ! [ \"${ACC_MATRIX_ITEM}\" = \"b\" ]; then golint ${ACC_MATRIX_ITEM}; fi\n"},
+		{name: "gha", got: gha.String(), want: "      if: ${{ github.event.inputs.reuse_cluster == 'false' }}\n"},
+		{name: "gha", got: gha.String(), want: "      if: ${{ !(contains(steps.diff.outputs.stdout, 'unchanged')) }}\n"},
+		{name: "gha", got: gha.String(), want: "      if: ${{ steps.deploy.outcome == 'success' }}\n"},
+		{name: "gha", got: gha.String(), want: "      if: ${{ always() && github.event.inputs.reuse_cluster == 'false' }}\n"},
+		{name: "gha", got: gha.String(), want: "      if: ${{ !(matrix.item == 'b') }}\n"},
+		{name: "gitlab", got: gitlab.String(), want: "    - \"if [ \\\"${REUSE_CLUSTER}\\\" = \\\"false\\\" ]; then kind create cluster; fi\"\n"},
+		{name: "gitlab", got: gitlab.String(), want: "    - \"if ! [[ \\\"${ACC_DIFF_STDOUT}\\\" == *\\\"unchanged\\\"* ]]; then helm upgrade; fi\"\n"},
+		{name: "make", got: make.String(), want: "\tif ! [[ \"$$(cat .acc/diff/stdout)\" == *\"unchanged\"* ]]; then { { helm upgrade; } "},
+		{name: "make", got: make.String(), want: "\t-if [ \"$(REUSE_CLUSTER)\" = \"false\" ]; then { { kind delete cluster; } "},
+		{name: "plan", got: text.String(), want: "     depends on: diff\n     if: !(contains(\"${steps.diff.stdout}\", \"unchanged\"))\n"},
+		{name: "plan", got: text.String(), want: "     depends on: deploy\n     if: succeeded(\"deploy\")\n"},
+	} {
+		if !strings.Contains(c.got, c.want) {
+			t.Errorf("%s: expected %q, got:\n%s", c.name, c.want, c.got)
+		}
+	}
+}
+
+func TestGHAExpr(t *testing.T) {
+	for _, c := range []struct {
+		s, want string
+	}{
+		{s: "it's", want: "'it''s'"},
+		{s: "${{ matrix.k8s }}", want: "matrix.k8s"},
+		{s: "v${{ matrix.k8s }}-{x}", want: "format('v{0}-{{x}}', matrix.k8s)"},
+	} {
+		if got := ghaExpr(c.s); got != c.want {
+			t.Errorf("unexpected expression of %q: want %q, got %q", c.s, c.want, got)
+		}
+	}
+}
+
+func TestGHAScriptEnv(t *testing.T) {
+	lines, env := ghaScriptEnv([]string{
+		`kind create cluster --name "${{ github.event.inputs.name }}"`,
+		`printf '%s' "${{ steps.create.outputs.stdout }}" | kubectl apply --context "kind-${{ github.event.inputs.name }}" -f -`,
+	})
+
+	if want, got := []string{
+		`kind create cluster --name "${NAME}"`,
+		`printf '%s' "${ACC_STEPS_CREATE_STDOUT}" | kubectl apply --context "kind-${NAME}" -f -`,
+	}, lines; !equalStrings(want, got) {
+		t.Errorf("unexpected script: want %q, got %q", want, got)
+	}
+
+	if want, got := []string{
+		"NAME", "${{ github.event.inputs.name }}",
+		"ACC_STEPS_CREATE_STDOUT", "${{ steps.create.outputs.stdout }}",
+	}, env; !equalStrings(want, got) {
+		t.Errorf("unexpected env: want %q, got %q", want, got)
+	}
+}
+
+func TestCondInvalid(t *testing.T) {
+	var b TaskBuilder
+
+	notify := TaskStep{Name: "notify"}
+
+	b.Do("deploy", b.Cmd("helm", "upgrade"), If(Skipped(notify)))
+	b.Do("notify", b.Cmd("echo", "deployed"))
+
+	errs := ValidateTask(b.Build())
+
+	if want := `instruction "deploy": depends on the status of "notify" but it is not yet executed`; len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("unexpected errors: want %q, got %v", want, errs)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic")
+		}
+	}()
+
+	Equals(1, "1")
+}
@@ -0,0 +1,224 @@
+package acc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var _ Target = &FakeRuntime{}
+
+// FakeRuntime is a Target that executes nothing. It records every command it is asked to execute
+// and answers with the scripted responses, so that the plan of a task can be asserted
+// without running any external process.
+type FakeRuntime struct {
+	Stdout, Stderr bytes.Buffer
+
+	// Responses are the scripted results of commands. The first response
+	// matching an execution is used. Unmatched executions succeed with no output.
+	Responses []FakeResponse
+
+	// Strict makes executions that match no response fail with UnexpectedCommandError.
+	Strict bool
+
+	// CommandPrinter prints unexpected commands when Strict is set.
+	CommandPrinter CommandPrinter
+
+	// CollectUnexpected makes unexpected commands succeed with no output even when Strict is set,
+	// so that a single run reports all of them via UnexpectedCommands and WriteStubFile.
+	CollectUnexpected bool
+
+	mu         sync.Mutex
+	executions []Execution
+	unexpected []UnexpectedCommandError
+}
+
+// FakeResponse is the scripted result of executing a command on FakeRuntime.
+type FakeResponse struct {
+	// Path is the path of the command to respond to.
+	Path string
+
+	// Args are the resolved args of the command to respond to. Nil matches any args.
+	Args []string
+
+	Stdout, Stderr string
+
+	// ExitCode other than 0 makes the execution fail with FakeExitError.
+	ExitCode int
+}
+
+// Execution is a command executed on FakeRuntime with its args resolved.
+type Execution struct {
+	Command Command
+	Args    []string
+}
+
+// String returns the execution as a bash command line.
+func (e Execution) String() string {
+	return bashCommandLine(e.Command, e.Args)
+}
+
+// FakeExitError is raised when a scripted response has a non-zero exit code.
+type FakeExitError struct {
+	Execution      Execution
+	ExitCode       int
+	Stdout, Stderr string
+}
+
+func (e FakeExitError) Error() string {
+	return fmt.Sprintf("%s: exit code %d\n%s", e.Execution, e.ExitCode, e.Stderr)
+}
+
+func (e *FakeRuntime) GetStdout() io.Writer {
+	return &e.Stdout
+}
+
+func (e *FakeRuntime) GetStderr() io.Writer {
+	return &e.Stderr
+}
+
+func (e *FakeRuntime) Execute(cmd Command, args []string) ExecResult {
+	ex := Execution{Command: cmd, Args: append([]string(nil), args...)}
+
+	e.mu.Lock()
+	e.executions = append(e.executions, ex)
+	e.mu.Unlock()
+
+	res := e.findResponse(cmd.Path, args)
+	if res == nil {
+		if e.Strict {
+			commandPrinter := e.CommandPrinter
+			if commandPrinter == nil {
+				commandPrinter = GoCommandPrinter{}
+			}
+
+			unexpected := UnexpectedCommandError{
+				CommandPrinter: commandPrinter,
+				Command:        cmd,
+				Args:           args,
+			}
+
+			if !e.CollectUnexpected {
+				panic(unexpected)
+			}
+
+			e.mu.Lock()
+			e.unexpected = append(e.unexpected, unexpected)
+			e.mu.Unlock()
+		}
+
+		res = &FakeResponse{}
+	}
+
+	if res.ExitCode != 0 {
+		panic(FakeExitError{Execution: ex, ExitCode: res.ExitCode, Stdout: res.Stdout, Stderr: res.Stderr})
+	}
+
+	return ExecResult{
+		Stdout: strings.NewReader(res.Stdout),
+		Stderr: strings.NewReader(res.Stderr),
+	}
+}
+
+func (e *FakeRuntime) findResponse(path string, args []string) *FakeResponse {
+	for i := range e.Responses {
+		r := &e.Responses[i]
+
+		if r.Path != path {
+			continue
+		}
+
+		if r.Args != nil && !reflect.DeepEqual(r.Args, args) {
+			continue
+		}
+
+		return r
+	}
+
+	return nil
+}
+
+// Executions returns the commands executed so far, in order.
+func (e *FakeRuntime) Executions() []Execution {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]Execution(nil), e.executions...)
+}
+
+// UnexpectedCommands returns the unexpected commands collected with Strict and CollectUnexpected.
+func (e *FakeRuntime) UnexpectedCommands() []UnexpectedCommandError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]UnexpectedCommandError(nil), e.unexpected...)
+}
+
+// WriteStubFile prints the collected unexpected commands as a stub file in the format of CommandPrinter.
+func (e *FakeRuntime) WriteStubFile(w io.Writer) error {
+	return WriteStubFile(w, e.CommandPrinter, e.UnexpectedCommands())
+}
+
+// Plan returns the commands executed so far as bash command lines, in order.
+func (e *FakeRuntime) Plan() []string {
+	var plan []string
+
+	for _, ex := range e.Executions() {
+		plan = append(plan, ex.String())
+	}
+
+	return plan
+}
+
+// TestingT is the subset of *testing.T used by the assertion helpers.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// AssertPlan fails the test unless the commands executed so far equal want, in order.
+func (e *FakeRuntime) AssertPlan(t TestingT, want ...string) {
+	t.Helper()
+
+	got := e.Plan()
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected plan:\nwant:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// AssertPlanGolden fails the test unless the commands executed so far equal
+// the lines in the golden file. When update is true, the file is rewritten instead.
+func (e *FakeRuntime) AssertPlanGolden(t TestingT, path string, update bool) {
+	t.Helper()
+
+	got := strings.Join(e.Plan(), "\n") + "\n"
+
+	if update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("creating directory for golden file: %v", err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("updating golden file: %v", err)
+		}
+
+		return
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file: %v", err)
+	}
+
+	if want := string(bs); want != got {
+		t.Errorf("plan does not match %s. Update the golden file if this is an expected change:\nwant:\n%s\ngot:\n%s", path, want, got)
+	}
+}
@@ -0,0 +1,193 @@
+package acc
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFakeRuntime(t *testing.T) {
+	var builder TaskBuilder
+
+	builder.Inputs.Def("name", nil)
+
+	clusters := builder.Do("get clusters", builder.Cmd("kind", "get", "clusters"))
+	builder.Do("create cluster", builder.Cmd("kind", "create", "cluster", "--name", builder.Get("name")))
+	builder.Do("apply", builder.Cmd("kubectl", "apply", "-f", "-").WithStdin(clusters.Get("stdout")))
+
+	fake := &FakeRuntime{
+		Responses: []FakeResponse{
+			{Path: "kind", Args: []string{"get", "clusters"}, Stdout: "existing"},
+			{Path: "kubectl", Stdout: "applied\n"},
+		},
+	}
+
+	RunTask(builder.Build(), fake, NewInputs(map[string]string{"name": "test"}))
+
+	fake.AssertPlan(t,
+		"kind get clusters",
+		"kind create cluster --name test",
+		`printf '%s' "existing" | kubectl apply -f -`,
+	)
+
+	if want, got := "existingapplied\n", fake.Stdout.String(); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	golden := filepath.Join(t.TempDir(), "plan.txt")
+
+	fake.AssertPlanGolden(t, golden, true)
+	fake.AssertPlanGolden(t, golden, false)
+}
+
+func TestFakeRuntimeFailures(t *testing.T) {
+	fake := &FakeRuntime{
+		Strict: true,
+		Responses: []FakeResponse{
+			{Path: "helm", Args: []string{"status", "web"}, Stderr: "Error: release: not found", ExitCode: 1},
+		},
+	}
+
+	recovered := func(f func()) (e interface{}) {
+		defer func() {
+			e = recover()
+		}()
+
+		f()
+
+		return nil
+	}
+
+	err := recovered(func() {
+		fake.Execute(Command{Path: "helm"}, []string{"status", "web"})
+	})
+	if exitErr, ok := err.(FakeExitError); !ok || exitErr.ExitCode != 1 {
+		t.Errorf("expected FakeExitError with exit code 1, got %v", err)
+	}
+
+	err = recovered(func() {
+		fake.Execute(Command{Path: "helm"}, []string{"list"})
+	})
+	if _, ok := err.(UnexpectedCommandError); !ok {
+		t.Errorf("expected UnexpectedCommandError, got %v", err)
+	}
+
+	fake.AssertPlan(t, "helm status web", "helm list")
+}
+
+func TestFuncInputs(t *testing.T) {
+	var b TaskBuilder
+
+	create := b.Do("create cluster", b.Cmd("kind", "create", "cluster"))
+
+	b.Do("check", Func{Name: "check", Inputs: []Ref{create.Get("stdout"), create.Get("stderr")}, Outputs: []string{"summary"}, F: func(ctx TaskStepContext) error {
+		ctx.Set("summary", ctx.Output(create.Get("stdout"))+"/"+ctx.Stderr("create cluster"))
+		return nil
+	}})
+
+	b.Do("undeclared", Func{Name: "undeclared", F: func(ctx TaskStepContext) error {
+		ctx.Stdout("create cluster")
+		return nil
+	}})
+
+	fake := &FakeRuntime{Responses: []FakeResponse{{Path: "kind", Stdout: "created", Stderr: "warning"}}}
+
+	res, err := Run(b.Build(), fake, nil)
+	if err == nil || !strings.Contains(err.Error(), `output "stdout" of "create cluster" is not declared in the inputs of the func`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if want, got := "created/warning", res.Outputs["check"]["summary"]; got != want {
+		t.Errorf("unexpected output: want %q, got %q", want, got)
+	}
+}
+
+func TestStepOutputs(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		f    func(ctx TaskStepContext) error
+		err  string
+	}{
+		{
+			name: "undeclared",
+			f: func(ctx TaskStepContext) error {
+				ctx.Set("path", "a.yaml")
+				ctx.Set("extra", "b")
+				return nil
+			},
+			err: `output "extra" is not declared in the outputs of the func`,
+		},
+		{
+			name: "missing",
+			f: func(ctx TaskStepContext) error {
+				return nil
+			},
+			err: `func did not set its declared outputs "path"`,
+		},
+	} {
+		var b TaskBuilder
+
+		b.Do("gen", Func{Name: "gen", Outputs: []string{"path"}, F: c.f})
+
+		if _, err := Run(b.Build(), &FakeRuntime{}, nil); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+
+	var b TaskBuilder
+
+	b.Do("create cluster", b.Cmd("kind", "create", "cluster"))
+	b.Do("install", b.Cmd("helm", "install", "web"))
+
+	fake := &FakeRuntime{
+		Responses: []FakeResponse{
+			{Path: "kind", Stdout: "created", Stderr: "warning"},
+			{Path: "helm", Stdout: "installing", Stderr: "failed", ExitCode: 3},
+		},
+	}
+
+	res, _ := Run(b.Build(), fake, nil)
+
+	if want, got := map[string]string{"stdout": "created", "stderr": "warning", "exitCode": "0"}, res.Outputs["create cluster"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected outputs of the command step: want %v, got %v", want, got)
+	}
+
+	if want, got := map[string]string{"stdout": "installing", "stderr": "failed", "exitCode": "3"}, res.Outputs["install"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected outputs of the failed command step: want %v, got %v", want, got)
+	}
+}
+
+func TestStepOutputsRendered(t *testing.T) {
+	var b TaskBuilder
+
+	create := b.Do("create", b.Cmd("kind", "create", "cluster"))
+	b.Do("warn", b.Cmd("echo", create.Get("stderr"), create.Get("exitCode")))
+
+	p := b.Build()
+
+	if errs := ValidateTask(p); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var bash, gha, gitlab, make bytes.Buffer
+
+	WriteBashScript(p, NewInputs(nil), &bash)
+	WriteGitHubActionsWorkflow(p, "ci", &gha)
+	WriteGitLabCI(p, &gitlab)
+	WriteMakefile(p, &make)
+
+	for _, c := range []struct {
+		name, got, want string
+	}{
+		{name: "bash", got: bash.String(), want: `echo ${ACC_CREATE_STDERR} ${ACC_CREATE_EXIT_CODE}`},
+		{name: "gha", got: gha.String(), want: "ACC_STEPS_CREATE_EXITCODE: ${{ steps.create.outputs.exitCode }}\n      run: |\n        echo \"${ACC_STEPS_CREATE_STDERR}\" \"${ACC_STEPS_CREATE_EXITCODE}\"\n"},
+		{name: "gitlab", got: gitlab.String(), want: `echo ${ACC_CREATE_STDERR} ${ACC_CREATE_EXIT_CODE}`},
+		{name: "make", got: make.String(), want: `echo $$(cat .acc/create/stderr) $$(cat .acc/create/exitCode)`},
+	} {
+		if !strings.Contains(c.got, c.want) {
+			t.Errorf("%s: expected %q, got:\n%s", c.name, c.want, c.got)
+		}
+	}
+}
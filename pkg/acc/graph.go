@@ -0,0 +1,143 @@
+package acc
+
+import (
+	"strings"
+)
+
+// Graph is the inputs and steps of a task and the dependencies between them.
+type Graph struct {
+	Inputs []string    `json:"inputs"`
+	Nodes  []GraphNode `json:"nodes"`
+	Edges  []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a step of the task.
+type GraphNode struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Cleanup bool   `json:"cleanup,omitempty"`
+
+	// SubTask is the name of the sub-task the step is defined in, if any.
+	SubTask string `json:"subTask,omitempty"`
+}
+
+// The kinds of GraphEdge.
+const (
+	// EdgeOutput is a dependency of a step on the outputs of another step.
+	EdgeOutput = "output"
+	// EdgeInput is a dependency of a step on an input of the task, which is the From of the edge.
+	EdgeInput = "input"
+	// EdgeOrder is the implicit ordering between a step and the step defined before it.
+	EdgeOrder = "order"
+	// EdgeCleanup links the step that makes a cleanup step necessary to the cleanup step.
+	EdgeCleanup = "cleanup"
+)
+
+// GraphEdge is a dependency of the step To on the step or input From.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+
+	// Label is the comma-separated output keys an output edge carries.
+	Label string `json:"label,omitempty"`
+}
+
+// TaskGraph returns the steps of the task in the order they are executed, followed by the
+// cleanup steps in the order they are executed, along with the dependencies between them.
+//
+// Steps depend on the inputs and outputs they refer to and on the step executed before them.
+// The ordering edge is omitted when the step already depends on the outputs of the step before it.
+func TaskGraph(p *Task) *Graph {
+	g := &Graph{Inputs: append([]string{}, p.Inputs...)}
+
+	add := func(s TaskStep, prev string, cleanup bool) {
+		g.Nodes = append(g.Nodes, GraphNode{Name: s.Name, Kind: stepKind(s), Cleanup: cleanup, SubTask: s.SubTask})
+
+		var (
+			steps  []string
+			inputs []string
+		)
+
+		keys := map[string][]string{}
+		seen := map[Ref]bool{}
+
+		for _, ref := range stepRefs(s) {
+			if seen[ref] {
+				continue
+			}
+
+			seen[ref] = true
+
+			if ref.Job == "" {
+				inputs = append(inputs, ref.Key)
+				continue
+			}
+
+			if _, ok := keys[ref.Job]; !ok {
+				steps = append(steps, ref.Job)
+			}
+
+			keys[ref.Job] = append(keys[ref.Job], ref.Key)
+		}
+
+		for _, in := range inputs {
+			g.Edges = append(g.Edges, GraphEdge{From: in, To: s.Name, Kind: EdgeInput})
+		}
+
+		if prev != "" && keys[prev] == nil {
+			g.Edges = append(g.Edges, GraphEdge{From: prev, To: s.Name, Kind: EdgeOrder})
+		}
+
+		for _, dep := range steps {
+			g.Edges = append(g.Edges, GraphEdge{From: dep, To: s.Name, Kind: EdgeOutput, Label: strings.Join(keys[dep], ", ")})
+		}
+
+		if cleanup && s.CleanupFor != "" {
+			g.Edges = append(g.Edges, GraphEdge{From: s.CleanupFor, To: s.Name, Kind: EdgeCleanup})
+		}
+	}
+
+	var prev string
+
+	for _, s := range p.Steps {
+		add(s, prev, false)
+		prev = s.Name
+	}
+
+	for i := len(p.Cleanup) - 1; i >= 0; i-- {
+		add(p.Cleanup[i], "", true)
+	}
+
+	return g
+}
+
+// stepKind returns "command" or "func" depending on how the step is run.
+func stepKind(s TaskStep) string {
+	switch s.Run.(type) {
+	case Command:
+		return "command"
+	case Func:
+		return "func"
+	default:
+		return "unknown"
+	}
+}
+
+// stepRefs returns the refs to inputs and step outputs the step and its condition refer to, in order of appearance.
+func stepRefs(s TaskStep) []Ref {
+	var refs []Ref
+
+	if s.If != nil {
+		refs = s.If.refs()
+	}
+
+	switch impl := s.Run.(type) {
+	case Command:
+		return append(refs, commandRefs(impl)...)
+	case Func:
+		return append(refs, impl.Inputs...)
+	}
+
+	return refs
+}
@@ -0,0 +1,374 @@
+package acc
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Matrix expands the steps defined with TaskScope.Matrix or TaskScope.ForEach
+// for every combination of the values of its axes.
+type Matrix struct {
+	// Name is the namespaced name of the matrix, which is the sub-task calling its combinations.
+	Name string
+
+	// Axes are the axes of the matrix in alphabetical order of their names.
+	Axes []MatrixAxis
+
+	// MaxParallel is the number of combinations run at once. Zero runs them one by one.
+	MaxParallel int
+
+	// ContinueOnError runs every combination even when some fail, instead of skipping
+	// the steps not started yet once one fails. The matrix fails either way.
+	ContinueOnError bool
+
+	// template are the steps and cleanup steps of a combination whose values are
+	// the placeholders of the axes, from which the emitters render the matrix.
+	// They are none when the template could not be defined.
+	template        []TaskStep
+	templateCleanup []TaskStep
+}
+
+// MatrixAxis is a dimension of a Matrix.
+type MatrixAxis struct {
+	Name   string
+	Values []string
+}
+
+// MatrixCombo is a combination of the values of the axes of a Matrix.
+type MatrixCombo struct {
+	Matrix *Matrix
+
+	// Name is the name of the sub-task of the combination, which is the value of the single axis
+	// of the matrix like "1.27", or the values of the axes like "k8s=1.27,mode=dind".
+	Name string
+
+	// Values are the values of the axes keyed by axis name.
+	Values map[string]string
+}
+
+// MatrixOption changes a matrix being defined with TaskScope.Matrix or TaskScope.ForEach.
+type MatrixOption func(*Matrix)
+
+// MaxParallel makes the matrix run up to n combinations at once.
+func MaxParallel(n int) MatrixOption {
+	return func(m *Matrix) {
+		m.MaxParallel = n
+	}
+}
+
+// ContinueOnError makes the matrix run every combination even when some fail.
+func ContinueOnError() MatrixOption {
+	return func(m *Matrix) {
+		m.ContinueOnError = true
+	}
+}
+
+// forEachAxis is the name of the axis of the matrix defined with TaskScope.ForEach.
+const forEachAxis = "item"
+
+// matrixPlaceholder is the value of the axis in the template of a matrix, which the emitters
+// replace with their own syntax, like ${{ matrix.k8s }}.
+func matrixPlaceholder(axis string) string {
+	return "\x00matrix." + axis + "\x00"
+}
+
+// replaceMatrixPlaceholders replaces the placeholders of the axes of the matrix in s with
+// what replacement returns for each axis.
+func replaceMatrixPlaceholders(m *Matrix, s string, replacement func(axis string) string) string {
+	for _, a := range m.Axes {
+		s = strings.Replace(s, matrixPlaceholder(a.Name), replacement(a.Name), -1)
+	}
+
+	return s
+}
+
+func (p *TaskBuilder) Matrix(name string, axes map[string][]string, define func(TaskScope, MatrixCombo), opts ...MatrixOption) []SubTask {
+	return p.matrix("", p.visibleInputs(), name, axes, define, opts)
+}
+
+func (p *TaskBuilder) ForEach(name string, items []string, define func(TaskScope, string), opts ...MatrixOption) []SubTask {
+	return p.matrix("", p.visibleInputs(), name, forEachAxes(items), forEachDefine(define), opts)
+}
+
+func (s *subTaskScope) Matrix(name string, axes map[string][]string, define func(TaskScope, MatrixCombo), opts ...MatrixOption) []SubTask {
+	return s.root.matrix(s.name, s.inputs, name, axes, define, opts)
+}
+
+func (s *subTaskScope) ForEach(name string, items []string, define func(TaskScope, string), opts ...MatrixOption) []SubTask {
+	return s.root.matrix(s.name, s.inputs, name, forEachAxes(items), forEachDefine(define), opts)
+}
+
+func forEachAxes(items []string) map[string][]string {
+	return map[string][]string{forEachAxis: items}
+}
+
+func forEachDefine(define func(TaskScope, string)) func(TaskScope, MatrixCombo) {
+	return func(s TaskScope, c MatrixCombo) {
+		define(s, c.Values[forEachAxis])
+	}
+}
+
+// visibleInputs returns the refs to the inputs of the task, which the combinations of
+// the matrices it defines read.
+func (p *TaskBuilder) visibleInputs() map[string]Ref {
+	inputs := map[string]Ref{}
+
+	for _, k := range p.Inputs.Keys() {
+		inputs[k] = Ref{Key: k}
+	}
+
+	return inputs
+}
+
+// matrix defines the steps of the combinations of the matrix called by the sub-task parent,
+// or by the task itself when parent is empty, in the task being built. The combinations
+// are sub-tasks of the sub-task of the matrix, reading the inputs of the calling scope.
+func (p *TaskBuilder) matrix(parent string, inputs map[string]Ref, name string, axes map[string][]string, define func(TaskScope, MatrixCombo), opts []MatrixOption) []SubTask {
+	fail := func(err error) {
+		f := getFrame(3)
+		panic(fmt.Sprintf("%s:%d: matrix %q: %v", filepath.Base(f.File), f.Line, name, err))
+	}
+
+	if name == "" || strings.Contains(name, "/") {
+		fail(fmt.Errorf("invalid name: it must be non-empty and contain no \"/\""))
+	}
+
+	m := &Matrix{Name: name}
+
+	if parent != "" {
+		m.Name = parent + "/" + name
+	}
+
+	for _, o := range opts {
+		o(m)
+	}
+
+	var names []string
+
+	for a := range axes {
+		names = append(names, a)
+	}
+
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		fail(fmt.Errorf("no axes"))
+	}
+
+	for _, a := range names {
+		if len(axes[a]) == 0 {
+			fail(fmt.Errorf("axis %q has no values", a))
+		}
+
+		for _, v := range axes[a] {
+			if v == "" || strings.Contains(v, "/") {
+				fail(fmt.Errorf("invalid value %q of axis %q: it must be non-empty and contain no \"/\"", v, a))
+			}
+		}
+
+		m.Axes = append(m.Axes, MatrixAxis{Name: a, Values: append([]string(nil), axes[a]...)})
+	}
+
+	var subTasks []SubTask
+
+	for _, values := range matrixCombos(m.Axes) {
+		c := &MatrixCombo{Matrix: m, Name: matrixComboName(m, values), Values: values}
+
+		jobs, cleanup := len(p.jobs), len(p.cleanupJobs)
+
+		subTasks = append(subTasks, p.call(m.Name, c.Name, func(s TaskScope) {
+			define(s, *c)
+		}, inputs))
+
+		// The steps of the matrices the combination defines are run as part of the combination.
+		for i := jobs; i < len(p.jobs); i++ {
+			p.jobs[i].Combo = c
+		}
+
+		for i := cleanup; i < len(p.cleanupJobs); i++ {
+			p.cleanupJobs[i].Combo = c
+		}
+	}
+
+	placeholders := map[string]string{}
+
+	for _, a := range m.Axes {
+		placeholders[a.Name] = matrixPlaceholder(a.Name)
+	}
+
+	m.template, m.templateCleanup = matrixTemplate(p, m, inputs, func(s TaskScope) {
+		define(s, MatrixCombo{Matrix: m, Name: m.templateComboName(), Values: placeholders})
+	})
+
+	return subTasks
+}
+
+// matrixTemplate returns the steps and cleanup steps define defines for the template of the matrix,
+// or none when define panics, like when it parses the values of the axes, which are placeholders.
+func matrixTemplate(p *TaskBuilder, m *Matrix, inputs map[string]Ref, define func(TaskScope)) (steps, cleanup []TaskStep) {
+	defer func() {
+		if recover() != nil {
+			steps, cleanup = nil, nil
+		}
+	}()
+
+	template := &TaskBuilder{cond: p.cond}
+
+	template.call(m.Name, m.templateComboName(), define, inputs)
+
+	return template.jobs, template.cleanupJobs
+}
+
+// matrixCombos returns the combinations of the values of the axes, varying the last axis first.
+func matrixCombos(axes []MatrixAxis) []map[string]string {
+	combos := []map[string]string{{}}
+
+	for _, a := range axes {
+		var next []map[string]string
+
+		for _, c := range combos {
+			for _, v := range a.Values {
+				n := map[string]string{a.Name: v}
+
+				for k, cv := range c {
+					n[k] = cv
+				}
+
+				next = append(next, n)
+			}
+		}
+
+		combos = next
+	}
+
+	return combos
+}
+
+func matrixComboName(m *Matrix, values map[string]string) string {
+	if len(m.Axes) == 1 {
+		return values[m.Axes[0].Name]
+	}
+
+	var kvs []string
+
+	for _, a := range m.Axes {
+		kvs = append(kvs, a.Name+"="+values[a.Name])
+	}
+
+	return strings.Join(kvs, ",")
+}
+
+// matrixSteps returns the steps of the matrix that starts at the first of the steps,
+// grouped by combination.
+func matrixSteps(steps []TaskStep) (m *Matrix, combos [][]TaskStep, rest []TaskStep) {
+	m = steps[0].Combo.Matrix
+
+	for i, s := range steps {
+		if s.Combo == nil || s.Combo.Matrix != m {
+			return m, combos, steps[i:]
+		}
+
+		if i == 0 || s.Combo != steps[i-1].Combo {
+			combos = append(combos, nil)
+		}
+
+		combos[len(combos)-1] = append(combos[len(combos)-1], s)
+	}
+
+	return m, combos, nil
+}
+
+// matrixStepName returns the name of the step of the matrix within its combination.
+func matrixStepName(m *Matrix, name string) string {
+	rest := strings.TrimPrefix(name, m.Name+"/")
+
+	return rest[strings.Index(rest, "/")+1:]
+}
+
+// matrixRenderable reports whether every combination of the matrix defines the same steps and
+// cleanup steps as its template, so that emitters can render the matrix once for all combinations.
+func matrixRenderable(m *Matrix, combos [][]TaskStep, cleanup []TaskStep) bool {
+	same := func(steps, template []TaskStep) bool {
+		if len(steps) != len(template) {
+			return false
+		}
+
+		for i := range steps {
+			if matrixStepName(m, steps[i].Name) != matrixStepName(m, template[i].Name) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if len(m.template) == 0 {
+		return false
+	}
+
+	for _, combo := range combos {
+		if !same(combo, m.template) {
+			return false
+		}
+	}
+
+	comboCleanup := map[*MatrixCombo][]TaskStep{}
+
+	for _, s := range cleanup {
+		if s.Combo != nil && s.Combo.Matrix == m {
+			comboCleanup[s.Combo] = append(comboCleanup[s.Combo], s)
+		}
+	}
+
+	for _, combo := range combos {
+		if !same(comboCleanup[combo[0].Combo], m.templateCleanup) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// expandMatrixState records the outputs of the steps of the combinations into state, which are the
+// outputs of the steps of the template with the placeholders replaced by the values of the combinations.
+func expandMatrixState(m *Matrix, combos [][]TaskStep, state map[string]map[string]string) {
+	for _, combo := range combos {
+		for i, s := range combo {
+			outputs := map[string]string{}
+
+			for k, v := range state[m.template[i].Name] {
+				outputs[k] = replaceMatrixPlaceholders(m, v, func(axis string) string {
+					return s.Combo.Values[axis]
+				})
+			}
+
+			state[s.Name] = outputs
+		}
+	}
+}
+
+// templateComboName returns the name of the combination of the template of the matrix.
+func (m *Matrix) templateComboName() string {
+	placeholders := map[string]string{}
+
+	for _, a := range m.Axes {
+		placeholders[a.Name] = matrixPlaceholder(a.Name)
+	}
+
+	return matrixComboName(m, placeholders)
+}
+
+// matrixTemplateRef returns the ref to the output of the step of the template of the matrix
+// corresponding to the ref to the output of the step of the combination, or the ref as is
+// when it is not to a step of the combination.
+func matrixTemplateRef(c *MatrixCombo, ref Ref) Ref {
+	prefix := c.Matrix.Name + "/" + c.Name + "/"
+
+	if strings.HasPrefix(ref.Job, prefix) {
+		ref.Job = c.Matrix.Name + "/" + c.Matrix.templateComboName() + "/" + strings.TrimPrefix(ref.Job, prefix)
+	}
+
+	return ref
+}
@@ -0,0 +1,364 @@
+package acc
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func matrixTestTask(opts ...MatrixOption) *Task {
+	var b TaskBuilder
+
+	b.Inputs.Def("seed", nil)
+
+	b.Matrix("e2e", map[string][]string{"k8s": {"1.27", "1.28"}, "mode": {"dind"}}, func(s TaskScope, c MatrixCombo) {
+		s.Defer("stop cluster", s.Cmd("kind", "delete", "cluster", "--name", c.Values["k8s"]))
+
+		s.Do("start cluster", s.Cmd("kind", "create", "cluster", "--image", c.Values["k8s"], "--name", s.Get("seed")))
+
+		s.Do("test", s.Cmd("go", "test", "-tags", c.Values["mode"]))
+	}, opts...)
+
+	b.ForEach("lint", []string{"a", "b"}, func(s TaskScope, item string) {
+		s.Do("lint", s.Cmd("golint", item))
+	})
+
+	b.Do("report", b.Cmd("echo", "done"))
+
+	return b.Build()
+}
+
+func TestMatrix(t *testing.T) {
+	p := matrixTestTask()
+
+	if errs := ValidateTask(p); len(errs) > 0 {
+		t.Fatalf("unexpected validation errors: %v", errs)
+	}
+
+	var names, combos []string
+
+	for _, s := range p.Steps {
+		names = append(names, s.Name)
+
+		if s.Combo != nil {
+			combos = append(combos, s.Combo.Matrix.Name+":"+s.Combo.Name)
+		}
+	}
+
+	if want, got := []string{
+		"e2e/k8s=1.27,mode=dind/start cluster",
+		"e2e/k8s=1.27,mode=dind/test",
+		"e2e/k8s=1.28,mode=dind/start cluster",
+		"e2e/k8s=1.28,mode=dind/test",
+		"lint/a/lint",
+		"lint/b/lint",
+		"report",
+	}, names; !equalStrings(want, got) {
+		t.Errorf("unexpected steps: want %q, got %q", want, got)
+	}
+
+	if want, got := []string{
+		"e2e:k8s=1.27,mode=dind",
+		"e2e:k8s=1.27,mode=dind",
+		"e2e:k8s=1.28,mode=dind",
+		"e2e:k8s=1.28,mode=dind",
+		"lint:a",
+		"lint:b",
+	}, combos; !equalStrings(want, got) {
+		t.Errorf("unexpected combinations: want %q, got %q", want, got)
+	}
+
+	fake := &FakeRuntime{}
+
+	res, err := Run(p, fake, NewInputs(map[string]string{"seed": "e2e"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.AssertPlan(t,
+		"kind create cluster --image 1.27 --name e2e",
+		"go test -tags dind",
+		"kind delete cluster --name 1.27",
+		"kind create cluster --image 1.28 --name e2e",
+		"go test -tags dind",
+		"kind delete cluster --name 1.28",
+		"golint a",
+		"golint b",
+		"echo done",
+	)
+
+	if want, got := []string{"e2e/k8s=1.27,mode=dind/stop cluster", "e2e/k8s=1.28,mode=dind/stop cluster"}, res.Cleanup; !equalStrings(want, got) {
+		t.Errorf("unexpected cleanup: want %q, got %q", want, got)
+	}
+}
+
+func TestMatrixParallel(t *testing.T) {
+	var b TaskBuilder
+
+	started := make(chan string, 2)
+
+	b.ForEach("shard", []string{"1", "2"}, func(s TaskScope, item string) {
+		s.Do("test", Func{Name: "test", F: func(ctx TaskStepContext) error {
+			started <- item
+
+			// Both shards have to be running at once for either to finish.
+			timeout := time.After(5 * time.Second)
+
+			for len(started) < 2 {
+				select {
+				case <-timeout:
+					return fmt.Errorf("shard %s: the other shard did not start", item)
+				case <-time.After(time.Millisecond):
+				}
+			}
+
+			ctx.Set("shard", item)
+
+			return nil
+		}, Outputs: []string{"shard"}})
+	}, MaxParallel(2))
+
+	res, err := Run(b.Build(), &FakeRuntime{}, NewInputs(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range []string{"1", "2"} {
+		if want, got := item, res.Outputs["shard/"+item+"/test"]["shard"]; want != got {
+			t.Errorf("unexpected output of shard %s: want %q, got %q", item, want, got)
+		}
+	}
+}
+
+func TestMatrixParallelUnexpected(t *testing.T) {
+	var b TaskBuilder
+
+	b.ForEach("shard", []string{"1", "2", "3", "4"}, func(s TaskScope, item string) {
+		s.Do("test", s.Cmd("go", "test", "-shard", item))
+	}, MaxParallel(4))
+
+	runtime := &Runtime{CollectUnexpected: true, Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+
+	if _, err := Run(b.Build(), runtime, NewInputs(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 4, len(runtime.UnexpectedCommands()); want != got {
+		t.Errorf("unexpected number of unexpected commands: want %d, got %d", want, got)
+	}
+}
+
+func TestMatrixFailFast(t *testing.T) {
+	for _, c := range []struct {
+		opts    []MatrixOption
+		steps   []string
+		skipped []string
+		err     string
+	}{
+		{
+			steps:   []string{"shard/1/test"},
+			skipped: []string{"shard/2/test", "shard/3/test"},
+			err:     "boom 1",
+		},
+		{
+			opts:  []MatrixOption{ContinueOnError()},
+			steps: []string{"shard/1/test", "shard/2/test", "shard/3/test"},
+			err:   `matrix "shard": boom 1; boom 3`,
+		},
+	} {
+		var b TaskBuilder
+
+		b.ForEach("shard", []string{"1", "2", "3"}, func(s TaskScope, item string) {
+			s.Do("test", Func{Name: "test", F: func(ctx TaskStepContext) error {
+				if item == "2" {
+					return nil
+				}
+
+				return fmt.Errorf("boom %s", item)
+			}})
+		}, c.opts...)
+
+		b.Do("report", b.Cmd("echo", "done"))
+
+		res, err := Run(b.Build(), &FakeRuntime{}, NewInputs(nil))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("unexpected error: want %q, got %v", c.err, err)
+		}
+
+		if want, got := c.steps, res.Steps; !equalStrings(want, got) {
+			t.Errorf("unexpected steps: want %q, got %q", want, got)
+		}
+
+		if want, got := c.skipped, res.Skipped; !equalStrings(want, got) {
+			t.Errorf("unexpected skipped steps: want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestMatrixRendered(t *testing.T) {
+	p := matrixTestTask(MaxParallel(2))
+
+	var bash, gha bytes.Buffer
+
+	WriteBashScript(p, NewInputs(map[string]string{"seed": "e2e"}), &bash)
+	WriteGitHubActionsWorkflow(p, "ci", &gha)
+
+	for _, c := range []struct {
+		name, got, want string
+	}{
+		{name: "bash", got: bash.String(), want: "# matrix e2e\nfor ACC_MATRIX_K8S in \"1.27\" \"1.28\"; do\n  for ACC_MATRIX_MODE in \"dind\"; do\n"},
+		{name: "bash", got: bash.String(), want: "    kind create cluster --image ${ACC_MATRIX_K8S} --name e2e\n"},
+		{name: "bash", got: bash.String(), want: "for ACC_MATRIX_ITEM in \"a\" \"b\"; do\n  # sub-task lint/${ACC_MATRIX_ITEM}\n  golint ${ACC_MATRIX_ITEM}\ndone\necho done\n"},
+		{name: "gha", got: gha.String(), want: "    strategy:\n      fail-fast: true\n      max-parallel: 2\n      matrix:\n        k8s: [\"1.27\", \"1.28\"]\n        mode: [\"dind\"]\n"},
+		{name: "gha", got: gha.String(), want: "      env:\n        ACC_MATRIX_K8S: ${{ matrix.k8s }}\n      run: |\n        kind delete cluster --name \"${ACC_MATRIX_K8S}\"\n"},
+		{name: "gha", got: gha.String(), want: "  lint:\n    needs: [e2e]\n    runs-on: ubuntu-latest\n    strategy:\n      fail-fast: true\n      max-parallel: 1\n"},
+		{name: "gha", got: gha.String(), want: "  task:\n    needs: [e2e, lint]\n"},
+	} {
+		if !strings.Contains(c.got, c.want) {
+			t.Errorf("%s: expected %q, got:\n%s", c.name, c.want, c.got)
+		}
+	}
+}
+
+func TestMatrixRenderedCleanup(t *testing.T) {
+	var b TaskBuilder
+
+	b.Defer("delete cluster", b.Cmd("kind", "delete", "cluster"))
+	b.Do("create cluster", b.Cmd("kind", "create", "cluster"))
+
+	b.ForEach("lint", []string{"a", "b"}, func(s TaskScope, item string) {
+		s.Do("lint", s.Cmd("golint", item))
+	})
+
+	b.Do("test", b.Cmd("go", "test"))
+
+	var gha bytes.Buffer
+
+	WriteGitHubActionsWorkflow(b.Build(), "ci", &gha)
+
+	// The cluster is deleted after all the jobs using it.
+	want := `  cleanup:
+    needs: [task, lint, task-2]
+    if: always()
+    runs-on: ubuntu-latest
+    steps:
+    - id: delete-cluster
+      name: "delete cluster"
+      if: always()
+      run: |
+        kind delete cluster
+`
+
+	if got := gha.String(); !strings.HasSuffix(got, want) {
+		t.Errorf("expected suffix %q, got:\n%s", want, got)
+	}
+
+	if strings.Count(gha.String(), "kind delete cluster") != 1 {
+		t.Errorf("expected a single cleanup step, got:\n%s", gha.String())
+	}
+}
+
+func TestMatrixRenderedExpanded(t *testing.T) {
+	var b TaskBuilder
+
+	// The combinations define different steps, which cannot be rendered as a loop.
+	b.ForEach("lint", []string{"a", "b"}, func(s TaskScope, item string) {
+		s.Do("lint "+item, s.Cmd("golint", item))
+	})
+
+	var bash bytes.Buffer
+
+	WriteBashScript(b.Build(), NewInputs(nil), &bash)
+
+	if want, got := "# sub-task lint\n# sub-task lint/a\ngolint a\n# sub-task lint/b\ngolint b\n", bash.String(); !strings.Contains(got, want) {
+		t.Errorf("expected %q, got:\n%s", want, got)
+	}
+
+	if strings.Contains(bash.String(), "for ") {
+		t.Errorf("unexpected loop:\n%s", bash.String())
+	}
+}
+
+func TestMatrixTemplate(t *testing.T) {
+	var (
+		b     TaskBuilder
+		calls int
+	)
+
+	// define is called for the template too, with placeholders that are not numbers.
+	b.ForEach("shard", []string{"1", "2"}, func(s TaskScope, item string) {
+		calls++
+
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			panic(err)
+		}
+
+		s.Do("test", s.Cmd("go", "test", "-shard", strconv.Itoa(n-1)))
+	})
+
+	if want, got := 3, calls; want != got {
+		t.Errorf("unexpected calls of define: want %d, got %d", want, got)
+	}
+
+	var bash bytes.Buffer
+
+	WriteBashScript(b.Build(), NewInputs(nil), &bash)
+
+	if want, got := "# sub-task shard/1\ngo test -shard 0\n# sub-task shard/2\ngo test -shard 1\n", bash.String(); !strings.Contains(got, want) {
+		t.Errorf("expected %q, got:\n%s", want, got)
+	}
+}
+
+func TestMatrixInvalid(t *testing.T) {
+	var b TaskBuilder
+
+	b.ForEach("shard", []string{"1", "2"}, func(s TaskScope, item string) {
+		if item == "2" {
+			s.Do("test", s.Cmd("go", "test", Ref{Job: "shard/1/build", Key: "stdout"}))
+
+			return
+		}
+
+		build := s.Do("build", s.Cmd("go", "build"))
+
+		s.Export("binary", build.Get("stdout"))
+	})
+
+	b.Do("after", b.Cmd("echo", Ref{Job: "shard/1/build", Key: "stdout"}))
+
+	var errs []string
+
+	for _, err := range ValidateTask(b.Build()) {
+		errs = append(errs, err.Error())
+	}
+
+	if want, got := []string{
+		`step "shard/2/test" refers to step "shard/1/build" of another combination of matrix "shard"`,
+		`step "after" refers to step "shard/1/build" of matrix "shard", whose outputs are not available outside of its combinations`,
+	}, errs; !equalStrings(want, got) {
+		t.Errorf("unexpected errors: want %q, got %q", want, got)
+	}
+
+	for name, define := range map[string]func(*TaskBuilder){
+		"no axes": func(b *TaskBuilder) { b.Matrix("e2e", nil, func(TaskScope, MatrixCombo) {}) },
+		"no values": func(b *TaskBuilder) {
+			b.Matrix("e2e", map[string][]string{"k8s": nil}, func(TaskScope, MatrixCombo) {})
+		},
+		"invalid name": func(b *TaskBuilder) { b.ForEach("a/b", []string{"1"}, func(TaskScope, string) {}) },
+		"invalid item": func(b *TaskBuilder) { b.ForEach("shard", []string{"1/2"}, func(TaskScope, string) {}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+
+			define(&TaskBuilder{})
+		}()
+	}
+}
@@ -5,6 +5,15 @@ import (
 	"io/ioutil"
 )
 
+type genWorkflowIn struct {
+	Seed string `acc:"seed,required"`
+}
+
+type genWorkflowOut struct {
+	YamlPath string `acc:"yamlPath"`
+	EchoTest string `acc:"echoTest"`
+}
+
 // MyScript is a script written Go to produce a program
 func MyScript(s TaskScope) {
 	s.Defer("stop cluster",
@@ -31,29 +40,26 @@ func MyScript(s TaskScope) {
 		s.Cmd("ghcp", "empty-commit", "-u", "mumoshu", "-r", "actions-test", "-m", "empty commit 1", "-b", "main"),
 	)
 
-	const (
-		outputKeyYamlPath = "yamlPath"
-	)
-
-	genWorkflow := s.Do("generate workflow", Func{Name: "gen", Outputs: []string{outputKeyYamlPath}, F: func(ctx TaskStepContext) error {
-		workflowYamlPath := fmt.Sprintf(".github/workflows/%s.yaml", ctx.Get("seed"))
+	var genWorkflow struct {
+		YamlPath Ref
+	}
 
+	s.Do("generate workflow", TypedFunc("gen", func(ctx TaskStepContext, in genWorkflowIn) (genWorkflowOut, error) {
 		res, err := ctx.Cmd("bash", "-c", "echo test").Exec()
 		if err != nil {
-			return err
+			return genWorkflowOut{}, err
 		}
 
 		bs, err := ioutil.ReadAll(res.Stdout)
 		if err != nil {
-			return err
+			return genWorkflowOut{}, err
 		}
-		echoOut := string(bs)
-
-		ctx.Set(outputKeyYamlPath, workflowYamlPath)
-		ctx.Set("echoTest", echoOut)
 
-		return nil
-	}})
+		return genWorkflowOut{
+			YamlPath: fmt.Sprintf(".github/workflows/%s.yaml", in.Seed),
+			EchoTest: string(bs),
+		}, nil
+	})).Refs(&genWorkflow)
 
 	s.Do(
 		"setup workflow",
@@ -64,7 +70,7 @@ func MyScript(s TaskScope) {
 			"-r", "actions-test",
 			"-m", "mpty commit 1",
 			"-b", "main",
-			genWorkflow.Get(outputKeyYamlPath),
+			genWorkflow.YamlPath,
 		),
 	)
 
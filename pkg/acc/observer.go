@@ -0,0 +1,434 @@
+package acc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Observer is notified of the progress of a task run with RunWithOptions.
+//
+// StepOutputLine is called from the goroutines copying the stdout and stderr of the commands,
+// so observers must be safe for concurrent use.
+type Observer interface {
+	// StepStarted is called before a step or a cleanup step is executed.
+	StepStarted(Event)
+
+	// StepOutputLine is called for every line the commands of a step write to stdout or stderr.
+	StepOutputLine(Event)
+
+	// StepFinished is called after a step or a cleanup step is executed or skipped.
+	StepFinished(Event)
+
+	// CleanupStarted is called before the cleanup steps are executed.
+	CleanupStarted(Event)
+
+	// TaskFinished is called after the cleanup steps are executed.
+	TaskFinished(Event)
+}
+
+// EventType is the type of an event.
+type EventType string
+
+const (
+	EventStepStarted    EventType = "stepStarted"
+	EventStepOutputLine EventType = "stepOutputLine"
+	EventStepFinished   EventType = "stepFinished"
+	EventCleanupStarted EventType = "cleanupStarted"
+	EventTaskFinished   EventType = "taskFinished"
+)
+
+// Event is something that happened while running a task. Which fields are set depends on the type.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Step is the name of the step, if the event is about a step.
+	Step string `json:"step,omitempty"`
+
+	// SubTask is the name of the sub-task the step is defined in, if any.
+	SubTask string `json:"subTask,omitempty"`
+
+	// Cleanup is true when the step is a cleanup step.
+	Cleanup bool `json:"cleanup,omitempty"`
+
+	// Command is the resolved command line of a started command step.
+	Command string `json:"command,omitempty"`
+
+	// Stream is "stdout" or "stderr" for an output line.
+	Stream string `json:"stream,omitempty"`
+	Line   string `json:"line,omitempty"`
+
+	// Status is how a finished step ended.
+	Status StepStatus `json:"status,omitempty"`
+
+	// ExitCode is the exit code of the failed command of a finished step,
+	// or -1 when the step failed without one.
+	ExitCode int `json:"exitCode,omitempty"`
+
+	// Outputs are the outputs of a finished step.
+	Outputs map[string]string `json:"outputs,omitempty"`
+
+	// Duration is how long a finished step or task took.
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Error is the error a step or task failed with.
+	Error string `json:"error,omitempty"`
+
+	// Result is the result of a finished task.
+	Result *RunResult `json:"result,omitempty"`
+}
+
+// observers notifies all the observers of every event.
+type observers []Observer
+
+func (o observers) notify(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	for _, ob := range o {
+		switch e.Type {
+		case EventStepStarted:
+			ob.StepStarted(e)
+		case EventStepOutputLine:
+			ob.StepOutputLine(e)
+		case EventStepFinished:
+			ob.StepFinished(e)
+		case EventCleanupStarted:
+			ob.CleanupStarted(e)
+		case EventTaskFinished:
+			ob.TaskFinished(e)
+		}
+	}
+}
+
+// exitCode returns the exit code of the command the error is about, 0 for no error and -1 when unknown.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var wrapped WrappedExitErr
+	if errors.As(err, &wrapped) {
+		return wrapped.ExitErr.ExitCode()
+	}
+
+	var fake FakeExitError
+	if errors.As(err, &fake) {
+		return fake.ExitCode
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return -1
+}
+
+// exitOutputs returns the stdout and stderr the failed command wrote before exiting,
+// as far as the error keeps them.
+func exitOutputs(err error) (stdout, stderr string) {
+	var wrapped WrappedExitErr
+	if errors.As(err, &wrapped) {
+		if wrapped.Stdout != nil {
+			stdout = wrapped.Stdout.String()
+		}
+
+		if wrapped.Stderr != nil {
+			stderr = wrapped.Stderr.String()
+		}
+
+		return stdout, stderr
+	}
+
+	var fake FakeExitError
+	if errors.As(err, &fake) {
+		return fake.Stdout, fake.Stderr
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "", string(exitErr.Stderr)
+	}
+
+	return "", ""
+}
+
+// resolvedCommandLine returns the command line of a command step with the inputs and outputs
+// it refers to resolved, or "" for func steps and commands that fail to resolve.
+func resolvedCommandLine(instruction TaskStep, inputs *mapInputs, state map[string]map[string]string) (line string) {
+	cmd, ok := instruction.Run.(Command)
+	if !ok {
+		return ""
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			line = ""
+		}
+	}()
+
+	cmd, args := resolveCommand(instruction.Name, cmd, inputs, state)
+
+	return bashCommandLine(cmd, args)
+}
+
+// lineCallbackWriter calls f with every complete line written to it.
+type lineCallbackWriter struct {
+	f   func(line string)
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *lineCallbackWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+
+		line := string(w.buf.Next(i + 1))
+
+		w.f(strings.TrimSuffix(line, "\n"))
+	}
+
+	return len(p), nil
+}
+
+// flush calls f with the last line if it was not terminated by a newline.
+func (w *lineCallbackWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.f(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+// redirectedTarget is a target whose commands write their output to stdout and stderr
+// instead of the writers of the target.
+type redirectedTarget struct {
+	Target
+	stdout, stderr io.Writer
+
+	// secrets are masked in what a RedirectableTarget writes on its own.
+	secrets *secrets
+}
+
+func (o *redirectedTarget) GetStdout() io.Writer {
+	return o.stdout
+}
+
+func (o *redirectedTarget) GetStderr() io.Writer {
+	return o.stderr
+}
+
+func (o *redirectedTarget) Execute(cmd Command, args []string) ExecResult {
+	// A RedirectableTarget streams the output of the commands to its own writers while they run,
+	// so it is asked to write to ours instead.
+	if r, ok := o.Target.(RedirectableTarget); ok {
+		redirect := Redirect{Stdout: o.stdout, Stderr: o.stderr}
+
+		if o.secrets != nil {
+			redirect.Mask = o.secrets.mask
+		}
+
+		return r.ExecuteRedirected(cmd, args, redirect)
+	}
+
+	return o.Target.Execute(cmd, args)
+}
+
+func teeWriter(w, tee io.Writer) io.Writer {
+	if w == nil {
+		return tee
+	}
+
+	return io.MultiWriter(w, tee)
+}
+
+// ProgressObserver writes the progress of the task in a human-readable form.
+type ProgressObserver struct {
+	W io.Writer
+
+	// Output makes the output lines of the steps written too, prefixed with the step names.
+	Output bool
+
+	mu sync.Mutex
+}
+
+func (o *ProgressObserver) printf(format string, args ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fmt.Fprintf(o.W, format+"\n", args...)
+}
+
+func (o *ProgressObserver) StepStarted(e Event) {
+	if e.Command != "" {
+		o.printf("==> %s: %s", e.Step, e.Command)
+	} else {
+		o.printf("==> %s", e.Step)
+	}
+}
+
+func (o *ProgressObserver) StepOutputLine(e Event) {
+	if o.Output {
+		o.printf("%s | %s", e.Step, e.Line)
+	}
+}
+
+func (o *ProgressObserver) StepFinished(e Event) {
+	switch {
+	case e.Status == StepSkipped:
+		o.printf("--- %s skipped", e.Step)
+	case e.Error != "" && e.ExitCode > 0:
+		o.printf("<== %s failed in %s with exit code %d: %s", e.Step, e.Duration.Round(time.Millisecond), e.ExitCode, firstLine(e.Error))
+	case e.Error != "":
+		o.printf("<== %s failed in %s: %s", e.Step, e.Duration.Round(time.Millisecond), firstLine(e.Error))
+	default:
+		o.printf("<== %s succeeded in %s", e.Step, e.Duration.Round(time.Millisecond))
+	}
+}
+
+func (o *ProgressObserver) CleanupStarted(e Event) {
+	o.printf("==> cleanup")
+}
+
+func (o *ProgressObserver) TaskFinished(e Event) {
+	if e.Error != "" {
+		o.printf("task failed in %s: %s", e.Duration.Round(time.Millisecond), firstLine(e.Error))
+	} else {
+		o.printf("task succeeded in %s", e.Duration.Round(time.Millisecond))
+	}
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+
+	return s
+}
+
+// JSONLinesObserver writes every event as a line of JSON.
+type JSONLinesObserver struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+func (o *JSONLinesObserver) write(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	bs, err := json.Marshal(e)
+	if err != nil {
+		panic(fmt.Errorf("marshaling event: %v", err))
+	}
+
+	o.W.Write(append(bs, '\n'))
+}
+
+func (o *JSONLinesObserver) StepStarted(e Event)    { o.write(e) }
+func (o *JSONLinesObserver) StepOutputLine(e Event) { o.write(e) }
+func (o *JSONLinesObserver) StepFinished(e Event)   { o.write(e) }
+func (o *JSONLinesObserver) CleanupStarted(e Event) { o.write(e) }
+func (o *JSONLinesObserver) TaskFinished(e Event)   { o.write(e) }
+
+// RecordingObserver records the events for tests to make assertions on.
+type RecordingObserver struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (o *RecordingObserver) record(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.events = append(o.events, e)
+}
+
+func (o *RecordingObserver) StepStarted(e Event)    { o.record(e) }
+func (o *RecordingObserver) StepOutputLine(e Event) { o.record(e) }
+func (o *RecordingObserver) StepFinished(e Event)   { o.record(e) }
+func (o *RecordingObserver) CleanupStarted(e Event) { o.record(e) }
+func (o *RecordingObserver) TaskFinished(e Event)   { o.record(e) }
+
+// Events returns the events recorded so far, in order.
+func (o *RecordingObserver) Events() []Event {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]Event(nil), o.events...)
+}
+
+// Finished returns the StepFinished event of the step, or nil if the step has not finished.
+// When the step was retried, the last event is returned.
+func (o *RecordingObserver) Finished(step string) *Event {
+	var found *Event
+
+	for _, e := range o.Events() {
+		if e.Type == EventStepFinished && e.Step == step {
+			e := e
+			found = &e
+		}
+	}
+
+	return found
+}
+
+// Lines returns the lines the step wrote to the stream, "stdout" or "stderr".
+func (o *RecordingObserver) Lines(step, stream string) []string {
+	var lines []string
+
+	for _, e := range o.Events() {
+		if e.Type == EventStepOutputLine && e.Step == step && e.Stream == stream {
+			lines = append(lines, e.Line)
+		}
+	}
+
+	return lines
+}
+
+// AssertSteps fails the test unless the steps and cleanup steps finished in order with the statuses,
+// each given as "<step>: <status>" like "create cluster: succeeded".
+func (o *RecordingObserver) AssertSteps(t TestingT, want ...string) {
+	t.Helper()
+
+	var got []string
+
+	for _, e := range o.Events() {
+		if e.Type == EventStepFinished {
+			got = append(got, fmt.Sprintf("%s: %s", e.Step, e.Status))
+		}
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected steps:\nwant:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// AssertOutput fails the test unless the step wrote the lines to the stream, "stdout" or "stderr".
+func (o *RecordingObserver) AssertOutput(t TestingT, step, stream string, want ...string) {
+	t.Helper()
+
+	if got := o.Lines(step, stream); !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected %s of step %q:\nwant:\n%s\ngot:\n%s", stream, step, strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,136 @@
+package acc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestObserverWithFakeRuntime(t *testing.T) {
+	var b TaskBuilder
+
+	b.Inputs.Def("name", nil)
+
+	b.Defer("delete cluster", b.Cmd("kind", "delete", "cluster", "--name", b.Get("name")))
+	b.Do("create cluster", b.Cmd("kind", "create", "cluster", "--name", b.Get("name")))
+	b.Do("install", b.Cmd("helm", "install", "web"))
+	b.Do("test", b.Cmd("helm", "test", "web"))
+
+	fake := &FakeRuntime{
+		Responses: []FakeResponse{
+			{Path: "kind", Args: []string{"create", "cluster", "--name", "e2e"}, Stdout: "creating\ncreated", Stderr: "warning\n"},
+			{Path: "helm", Args: []string{"install", "web"}, ExitCode: 2},
+		},
+	}
+
+	rec := &RecordingObserver{}
+
+	var events bytes.Buffer
+
+	_, err := RunWithOptions(b.Build(), fake, NewInputs(map[string]string{"name": "e2e"}), RunOptions{
+		Observers: []Observer{rec, &JSONLinesObserver{W: &events}},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	rec.AssertSteps(t,
+		"create cluster: succeeded",
+		"install: failed",
+		"delete cluster: succeeded",
+	)
+
+	rec.AssertOutput(t, "create cluster", "stdout", "creating", "created")
+	rec.AssertOutput(t, "create cluster", "stderr", "warning")
+
+	if e := rec.Finished("install"); e == nil || e.ExitCode != 2 {
+		t.Errorf("unexpected StepFinished event of install: %+v", e)
+	}
+
+	if e := rec.Finished("create cluster"); e == nil || e.Outputs["stdout"] != "creating\ncreated" {
+		t.Errorf("unexpected StepFinished event of create cluster: %+v", e)
+	}
+
+	var types []string
+
+	for _, e := range rec.Events() {
+		if e.Type == EventStepStarted {
+			types = append(types, string(e.Type)+" "+e.Command)
+		} else if e.Type != EventStepOutputLine {
+			types = append(types, string(e.Type))
+		}
+	}
+
+	want := []string{
+		"stepStarted kind create cluster --name e2e",
+		"stepFinished",
+		"stepStarted helm install web",
+		"stepFinished",
+		"cleanupStarted",
+		"stepStarted kind delete cluster --name e2e",
+		"stepFinished",
+		"taskFinished",
+	}
+
+	if !equalStrings(want, types) {
+		t.Errorf("unexpected events: want %q, got %q", want, types)
+	}
+
+	scanner := bufio.NewScanner(&events)
+
+	var n int
+
+	for ; scanner.Scan(); n++ {
+		var e Event
+
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %d: %v", n+1, err)
+		}
+	}
+
+	if want, got := len(rec.Events()), n; got != want {
+		t.Errorf("unexpected number of JSON lines: want %d, got %d", want, got)
+	}
+}
+
+func TestObserverWithRuntime(t *testing.T) {
+	var b TaskBuilder
+
+	b.Do("print", b.Cmd("sh", "-c", "echo one; echo two >&2; echo three"))
+	b.Do("fail", b.Cmd("sh", "-c", "exit 3"))
+
+	var stdout, stderr, progress bytes.Buffer
+
+	rec := &RecordingObserver{}
+
+	_, err := RunWithOptions(b.Build(), &Runtime{AllowByDefault: true, Stdout: &stdout, Stderr: &stderr}, nil, RunOptions{
+		Observers: []Observer{rec, &ProgressObserver{W: &progress}},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	rec.AssertSteps(t, "print: succeeded", "fail: failed")
+	rec.AssertOutput(t, "print", "stdout", "one", "three")
+	rec.AssertOutput(t, "print", "stderr", "two")
+
+	if want, got := "one\nthree\n", stdout.String(); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	if e := rec.Finished("fail"); e == nil || e.ExitCode != 3 {
+		t.Errorf("unexpected StepFinished event of fail: %+v", e)
+	}
+
+	lines := strings.Split(strings.TrimSpace(progress.String()), "\n")
+
+	if want, got := `==> print: sh -c echo one; echo two >&2; echo three`, lines[0]; got != want {
+		t.Errorf("unexpected progress: want %q, got %q", want, got)
+	}
+
+	if want, got := "<== fail failed in ", lines[3]; !strings.HasPrefix(got, want) || !strings.Contains(got, "with exit code 3") {
+		t.Errorf("unexpected progress: want %q with exit code 3, got %q", want, got)
+	}
+}
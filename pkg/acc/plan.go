@@ -0,0 +1,227 @@
+package acc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Plan is what running a task would do, computed without executing anything.
+type Plan struct {
+	// Inputs are the values of the task inputs. Inputs that were not given,
+	// and secret ones, have symbolic values like `${inputs.seed}`.
+	Inputs map[string]string `json:"inputs"`
+
+	Steps []PlannedStep `json:"steps"`
+
+	// Cleanup are the cleanup steps in the order they would be executed when the steps succeed.
+	Cleanup []PlannedStep `json:"cleanup,omitempty"`
+}
+
+// PlannedStep is a step of a Plan. The outputs of upstream steps it refers to
+// have symbolic values like `${steps.create cluster.stdout}`.
+type PlannedStep struct {
+	Name string `json:"name"`
+
+	// SubTask is the name of the sub-task the step is defined in, if any.
+	SubTask string `json:"subTask,omitempty"`
+
+	// Command is the resolved command line of a Command step. It is empty for Func steps.
+	Command string   `json:"command,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Args    []string `json:"args,omitempty"`
+
+	// Func is the name of the Go function run by a Func step.
+	Func string `json:"func,omitempty"`
+
+	// Outputs are the keys of the outputs the step produces.
+	Outputs []string `json:"outputs,omitempty"`
+
+	// DependsOn are the names of the steps whose outputs or status the step uses.
+	DependsOn []string `json:"dependsOn,omitempty"`
+
+	// If is the condition the step is run on, if any.
+	If string `json:"if,omitempty"`
+}
+
+// PlanTask resolves every step of the task from the inputs and the symbolic outputs
+// of upstream steps, without executing anything, and returns the plan.
+func PlanTask(p *Task, inputs *mapInputs) (plan *Plan, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if er, ok := e.(error); ok {
+				err = er
+			} else {
+				err = fmt.Errorf("%v", e)
+			}
+		}
+	}()
+
+	planInputs := NewInputs(nil)
+
+	if inputs != nil {
+		for k, v := range inputs.m {
+			planInputs.m[k] = v
+		}
+	}
+
+	for _, in := range p.Inputs {
+		if _, ok := planInputs.m[in]; !ok {
+			planInputs.m[in] = fmt.Sprintf("${inputs.%s}", in)
+		}
+	}
+
+	for _, in := range p.Secrets {
+		planInputs.m[in] = fmt.Sprintf("${inputs.%s}", in)
+	}
+
+	plan = &Plan{Inputs: planInputs.m}
+
+	state := map[string]map[string]string{}
+
+	for _, s := range p.Steps {
+		plan.Steps = append(plan.Steps, planStep(s, planInputs, state))
+	}
+
+	for _, s := range cleanupOrder(p) {
+		plan.Cleanup = append(plan.Cleanup, planStep(s, planInputs, state))
+	}
+
+	return plan, nil
+}
+
+func planStep(s TaskStep, inputs *mapInputs, state map[string]map[string]string) PlannedStep {
+	step := PlannedStep{Name: s.Name, SubTask: s.SubTask}
+
+	symbolic := func(key string) string {
+		return fmt.Sprintf("${steps.%s.%s}", s.Name, key)
+	}
+
+	seen := map[string]bool{}
+
+	for _, ref := range stepRefs(s) {
+		if ref.Job != "" && !seen[ref.Job] {
+			seen[ref.Job] = true
+			step.DependsOn = append(step.DependsOn, ref.Job)
+		}
+	}
+
+	if s.If != nil {
+		for _, name := range s.If.statusSteps() {
+			if _, ok := state[name]; !ok {
+				panic(fmt.Errorf("instruction %q: depends on the status of %q but it is not yet executed", s.Name, name))
+			}
+
+			if !seen[name] {
+				seen[name] = true
+				step.DependsOn = append(step.DependsOn, name)
+			}
+		}
+
+		step.If = s.If.text(s.Name, inputs, state)
+	}
+
+	switch impl := s.Run.(type) {
+	case Command:
+		cmd, args := resolveCommand(s.Name, impl, inputs, state)
+
+		step.Command = bashCommandLine(cmd, args)
+		step.Path = cmd.Path
+		step.Args = args
+		step.Outputs = []string{"stdout", "stderr", "exitCode"}
+
+		state[s.Name] = map[string]string{"stdout": symbolic("stdout"), "stderr": symbolic("stderr"), "exitCode": symbolic("exitCode")}
+	case Func:
+		// The outputs the func reads have to be produced by the steps executed before it.
+		for _, ref := range impl.Inputs {
+			resolveValue(s.Name, ref, inputs, state)
+		}
+
+		outputs := map[string]string{}
+
+		for _, o := range impl.Outputs {
+			outputs[o] = symbolic(o)
+		}
+
+		step.Func = impl.Name
+		step.Outputs = impl.Outputs
+
+		state[s.Name] = outputs
+	default:
+		panic(fmt.Errorf("unsupported type of instruction: %T", impl))
+	}
+
+	return step
+}
+
+// WriteText prints the plan for humans to review.
+func (p *Plan) WriteText(w io.Writer) error {
+	var b strings.Builder
+
+	if len(p.Inputs) > 0 {
+		b.WriteString("Inputs:\n")
+
+		var keys []string
+
+		for k := range p.Inputs {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(&b, "  %s = %s\n", k, p.Inputs[k])
+		}
+
+		b.WriteString("\n")
+	}
+
+	writeSteps := func(title string, steps []PlannedStep) {
+		fmt.Fprintf(&b, "%s:\n", title)
+
+		for i, s := range steps {
+			fmt.Fprintf(&b, "  %d. %s\n", i+1, s.Name)
+
+			if s.Command != "" {
+				fmt.Fprintf(&b, "     $ %s\n", s.Command)
+			} else {
+				fmt.Fprintf(&b, "     func %s\n", s.Func)
+			}
+
+			if len(s.DependsOn) > 0 {
+				fmt.Fprintf(&b, "     depends on: %s\n", strings.Join(s.DependsOn, ", "))
+			}
+
+			if s.If != "" {
+				fmt.Fprintf(&b, "     if: %s\n", s.If)
+			}
+
+			if s.Command == "" && len(s.Outputs) > 0 {
+				fmt.Fprintf(&b, "     outputs: %s\n", strings.Join(s.Outputs, ", "))
+			}
+		}
+	}
+
+	writeSteps("Steps", p.Steps)
+
+	if len(p.Cleanup) > 0 {
+		b.WriteString("\n")
+
+		writeSteps("Cleanup", p.Cleanup)
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// WriteJSON prints the plan as indented JSON for tools to consume.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(p)
+}
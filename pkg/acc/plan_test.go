@@ -0,0 +1,110 @@
+package acc
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestPlanTask(t *testing.T) {
+	var b TaskBuilder
+
+	b.Inputs.Def("seed", nil)
+	b.Inputs.Def("namespace", nil)
+
+	create := b.Do("create cluster", b.Cmd("kind", "create", "cluster", "--name", b.Get("seed")))
+
+	kubeconfig, _ := create.Outputs.Get("stdout")
+
+	b.Do("install", b.Cmd("helm", "upgrade", "--install", b.Get("seed"), "stable/nginx", "-n", b.Get("namespace")).
+		WithEnv("KUBECONFIG", *kubeconfig))
+
+	b.Defer("delete cluster", b.Cmd("kind", "delete", "cluster", "--name", b.Get("seed")))
+
+	plan, err := PlanTask(b.Build(), NewInputs(map[string]string{"seed": "e2e"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+
+	if err := plan.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `Inputs:
+  namespace = ${inputs.namespace}
+  seed = e2e
+
+Steps:
+  1. create cluster
+     $ kind create cluster --name e2e
+  2. install
+     $ KUBECONFIG="${steps.create cluster.stdout}" helm upgrade --install e2e stable/nginx -n ${inputs.namespace}
+     depends on: create cluster
+
+Cleanup:
+  1. delete cluster
+     $ kind delete cluster --name e2e
+`
+
+	if got := text.String(); got != want {
+		t.Errorf("unexpected plan:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	var js bytes.Buffer
+
+	if err := plan.WriteJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Plan
+
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []string{"create cluster"}, decoded.Steps[1].DependsOn; !equalStrings(want, got) {
+		t.Errorf("unexpected dependencies: want %v, got %v", want, got)
+	}
+
+	if want, got := "${inputs.namespace}", decoded.Steps[1].Args[5]; got != want {
+		t.Errorf("unexpected arg: want %q, got %q", want, got)
+	}
+}
+
+func TestPlanTaskUndefinedOutput(t *testing.T) {
+	var b TaskBuilder
+
+	b.Do("install", b.Cmd("helm", "install", Ref{Job: "create cluster", Key: "stdout"}))
+
+	if _, err := PlanTask(b.Build(), nil); err == nil {
+		t.Error("expected an error for the reference to a step that is not yet executed")
+	}
+}
+
+func TestPlanTaskFuncInputs(t *testing.T) {
+	var b TaskBuilder
+
+	create := b.Do("create cluster", b.Cmd("kind", "create", "cluster"))
+
+	b.Do("check", Func{Name: "check", Inputs: []Ref{create.Get("stdout")}, F: func(ctx TaskStepContext) error { return nil }})
+
+	plan, err := PlanTask(b.Build(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []string{"create cluster"}, plan.Steps[1].DependsOn; !equalStrings(want, got) {
+		t.Errorf("unexpected dependencies: want %q, got %q", want, got)
+	}
+
+	var invalid TaskBuilder
+
+	invalid.Do("check", Func{Name: "check", Inputs: []Ref{{Job: "create cluster", Key: "stdout"}}, F: func(ctx TaskStepContext) error { return nil }})
+	invalid.Do("create cluster", invalid.Cmd("kind", "create", "cluster"))
+
+	if errs := ValidateTask(invalid.Build()); len(errs) != 1 {
+		t.Errorf("expected an error for the func reading the output of a step executed after it, got %v", errs)
+	}
+}
@@ -0,0 +1,342 @@
+package acc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PolicyAction is what a Policy decides to do with a command.
+type PolicyAction string
+
+const (
+	// PolicyAllow runs the command, with the matching stub if any and for real otherwise.
+	PolicyAllow PolicyAction = "allow"
+	// PolicyDeny fails the command with PolicyDeniedError, even when it has a stub.
+	PolicyDeny PolicyAction = "deny"
+	// PolicyRequireStub runs the command only when it has a matching stub and
+	// fails with UnexpectedCommandError otherwise.
+	PolicyRequireStub PolicyAction = "require-stub"
+)
+
+// PolicyRule decides the action for the commands it matches. Empty fields match anything.
+type PolicyRule struct {
+	// Name identifies the rule in the audit log and errors. Defaults to "rules[<index>]".
+	Name string `json:"name,omitempty"`
+
+	Action PolicyAction `json:"action"`
+
+	// Path is a glob matched against the command path. A pattern without a slash,
+	// like "kubectl", is matched against the base name of the path.
+	Path string `json:"path,omitempty"`
+
+	// Args is a regexp matched against the args joined with spaces, like `^delete (ns|namespace) kube-system\b`.
+	Args string `json:"args,omitempty"`
+
+	// Env maps environment variable names to regexps their values must match.
+	// A variable missing from the environment of the command never matches.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Dir is a regexp matched against the absolute working directory of the command.
+	Dir string `json:"dir,omitempty"`
+}
+
+// Policy decides whether Runtime runs a command for real, requires a stub for it or denies it.
+// Rules are evaluated in order and the first matching rule wins.
+//
+// The patterns of the rules are compiled by Validate, or by the first decision when the policy
+// was not validated. A policy whose rules do not validate denies every command.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+
+	// Default is the action for commands no rule matches. When empty, Runtime falls back to
+	// AllowByDefault and Allowed, requiring a stub for the commands they do not allow.
+	Default PolicyAction `json:"default,omitempty"`
+
+	// Audit receives every decision as a line of JSON.
+	Audit io.Writer `json:"-"`
+
+	// Now returns the time recorded in the audit log. Defaults to time.Now.
+	Now func() time.Time `json:"-"`
+
+	mu sync.Mutex
+
+	// compiled is true once the rules were compiled into matchers, or found invalid.
+	compiled bool
+
+	// matchers are the compiled patterns of Rules, in the same order.
+	matchers []ruleMatcher
+
+	// invalid is the name of the first rule that does not validate, if any.
+	invalid string
+}
+
+// ruleMatcher holds the compiled regexps of a PolicyRule.
+type ruleMatcher struct {
+	args, dir *regexp.Regexp
+	env       map[string]*regexp.Regexp
+}
+
+// PolicyDecision is an entry of the audit log.
+type PolicyDecision struct {
+	Time    time.Time    `json:"time"`
+	Path    string       `json:"path"`
+	Args    []string     `json:"args"`
+	Dir     string       `json:"dir"`
+	Action  PolicyAction `json:"action"`
+	Rule    string       `json:"rule,omitempty"`
+	Stubbed bool         `json:"stubbed"`
+}
+
+// PolicyDeniedError is raised when a policy denies a command.
+type PolicyDeniedError struct {
+	Decision PolicyDecision
+}
+
+func (e PolicyDeniedError) Error() string {
+	rule := e.Decision.Rule
+	if rule == "" {
+		rule = "default"
+	}
+
+	return fmt.Sprintf("command %q is denied by policy rule %q", strings.TrimSpace(e.Decision.Path+" "+strings.Join(e.Decision.Args, " ")), rule)
+}
+
+// LoadPolicy reads a policy from the JSON file at path and validates its rules.
+func LoadPolicy(path string) (*Policy, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+
+	if err := json.Unmarshal(bs, &p); err != nil {
+		return nil, fmt.Errorf("parsing policy %s: %v", path, err)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("validating policy %s: %v", path, err)
+	}
+
+	return &p, nil
+}
+
+// Validate checks that the actions are known and the patterns compile, keeping the compiled
+// patterns for the decisions.
+func (p *Policy) Validate() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.compile()
+}
+
+// compile is Validate with p.mu held. The name of the rule that does not validate,
+// or "default" for an unknown default action, is kept to deny every command.
+func (p *Policy) compile() error {
+	matchers, invalid, err := p.compileRules()
+
+	p.compiled = true
+	p.matchers = matchers
+	p.invalid = invalid
+
+	return err
+}
+
+// compileRules returns the matchers of the rules, or the name of the first rule that
+// does not validate with the reason.
+func (p *Policy) compileRules() ([]ruleMatcher, string, error) {
+	validAction := func(a PolicyAction) bool {
+		return a == PolicyAllow || a == PolicyDeny || a == PolicyRequireStub
+	}
+
+	if p.Default != "" && !validAction(p.Default) {
+		return nil, "default", fmt.Errorf("unknown default action %q", p.Default)
+	}
+
+	var matchers []ruleMatcher
+
+	for i, r := range p.Rules {
+		name := r.name(i)
+
+		if !validAction(r.Action) {
+			return nil, name, fmt.Errorf("%s: unknown action %q", name, r.Action)
+		}
+
+		if _, err := filepath.Match(r.Path, ""); err != nil {
+			return nil, name, fmt.Errorf("%s: path: %v", name, err)
+		}
+
+		var (
+			m   = ruleMatcher{env: map[string]*regexp.Regexp{}}
+			err error
+		)
+
+		if m.args, err = regexp.Compile(r.Args); err != nil {
+			return nil, name, fmt.Errorf("%s: args: %v", name, err)
+		}
+
+		if m.dir, err = regexp.Compile(r.Dir); err != nil {
+			return nil, name, fmt.Errorf("%s: dir: %v", name, err)
+		}
+
+		for k, v := range r.Env {
+			if m.env[k], err = regexp.Compile(v); err != nil {
+				return nil, name, fmt.Errorf("%s: env %s: %v", name, k, err)
+			}
+		}
+
+		matchers = append(matchers, m)
+	}
+
+	return matchers, "", nil
+}
+
+// Decide returns the action of the first rule matching the command and records the decision
+// in the audit log. fallback is the action for commands no rule matches when Default is empty.
+func (p *Policy) Decide(cmd Command, args []string, stubbed bool, fallback PolicyAction) PolicyDecision {
+	return p.decide(cmd, args, stubbed, fallback, nil)
+}
+
+// decide is Decide recording the args masked with mask, when set, in the audit log.
+func (p *Policy) decide(cmd Command, args []string, stubbed bool, fallback PolicyAction, mask func(string) string) PolicyDecision {
+	dir := cmd.dir()
+	if dir == "" {
+		dir, _ = os.Getwd()
+	} else if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	d := PolicyDecision{
+		Path:    cmd.Path,
+		Args:    append([]string{}, args...),
+		Dir:     dir,
+		Action:  p.Default,
+		Stubbed: stubbed,
+	}
+
+	if d.Action == "" {
+		d.Action = fallback
+	}
+
+	env := environMap(cmd.environ(""))
+
+	p.mu.Lock()
+
+	if !p.compiled {
+		p.compile()
+	}
+
+	matchers, invalid := p.matchers, p.invalid
+
+	p.mu.Unlock()
+
+	if invalid != "" {
+		d.Action = PolicyDeny
+		d.Rule = invalid
+	}
+
+	for i, m := range matchers {
+		if r := p.Rules[i]; r.matches(m, cmd.Path, args, env, dir) {
+			d.Action = r.Action
+			d.Rule = r.name(i)
+			break
+		}
+	}
+
+	p.audit(&d, mask)
+
+	return d
+}
+
+func (p *Policy) audit(d *PolicyDecision, mask func(string) string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Now != nil {
+		d.Time = p.Now()
+	} else {
+		d.Time = time.Now()
+	}
+
+	if p.Audit == nil {
+		return
+	}
+
+	logged := *d
+
+	if mask != nil {
+		logged.Args = nil
+
+		for _, a := range d.Args {
+			logged.Args = append(logged.Args, mask(a))
+		}
+	}
+
+	bs, err := json.Marshal(logged)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, err := p.Audit.Write(append(bs, '\n')); err != nil {
+		panic(fmt.Errorf("writing policy audit log: %v", err))
+	}
+}
+
+func (r PolicyRule) name(i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return fmt.Sprintf("rules[%d]", i)
+}
+
+func (r PolicyRule) matches(m ruleMatcher, path string, args []string, env map[string]string, dir string) bool {
+	if r.Path != "" {
+		target := path
+		if !strings.Contains(r.Path, "/") {
+			target = filepath.Base(path)
+		}
+
+		if ok, _ := filepath.Match(r.Path, target); !ok {
+			return false
+		}
+	}
+
+	if r.Args != "" && !m.args.MatchString(strings.Join(args, " ")) {
+		return false
+	}
+
+	for k, pattern := range m.env {
+		v, ok := env[k]
+		if !ok || !pattern.MatchString(v) {
+			return false
+		}
+	}
+
+	if r.Dir != "" && !m.dir.MatchString(dir) {
+		return false
+	}
+
+	return true
+}
+
+// environMap turns KEY=VALUE pairs into a map. Later pairs win.
+func environMap(environ []string) map[string]string {
+	m := map[string]string{}
+
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i >= 0 {
+			m[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	return m
+}
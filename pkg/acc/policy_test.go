@@ -0,0 +1,151 @@
+package acc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	policy, err := LoadPolicy("testdata/policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var audit bytes.Buffer
+
+	policy.Audit = &audit
+
+	runtime := &Runtime{
+		AllowByDefault: true,
+		Policy:         policy,
+		ExecutionStubs: []ExecutionStub{
+			{
+				Command: Command{Path: "kubectl"},
+				Match: func(args []string) bool {
+					return true
+				},
+				Run: func(ctx RunContext) {
+					fmt.Fprintf(ctx.Stdout, "stubbed %s", strings.Join(ctx.Args, " "))
+				},
+			},
+		},
+		Stdout: &bytes.Buffer{},
+		Stderr: &bytes.Buffer{},
+	}
+
+	Start(t, runtime)
+
+	recovered := func(f func()) (e interface{}) {
+		defer func() {
+			e = recover()
+		}()
+
+		f()
+
+		return nil
+	}
+
+	stdout := func(res ExecResult) string {
+		bs, err := ioutil.ReadAll(res.Stdout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(bs)
+	}
+
+	if want, got := "stubbed get ns", stdout(runtime.Execute(Command{Path: "kubectl"}, []string{"get", "ns"})); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	panicked := recovered(func() {
+		runtime.Execute(Command{Path: "kubectl"}, []string{"delete", "ns", "kube-system"})
+	})
+	if denied, ok := panicked.(PolicyDeniedError); !ok || denied.Decision.Rule != "protect-system-namespaces" {
+		t.Errorf("expected PolicyDeniedError by protect-system-namespaces, got %v", panicked)
+	}
+
+	if want, got := "ci\n", stdout(runtime.Execute(Command{Path: "echo"}.WithEnv("CI", "true"), []string{"ci"})); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	// Commands no rule matches fall back to AllowByDefault.
+	if want, got := "local\n", stdout(runtime.Execute(Command{Path: "echo"}.WithEnv("CI", "false"), []string{"local"})); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	policy.Default = PolicyRequireStub
+
+	panicked = recovered(func() {
+		runtime.Execute(Command{Path: "echo"}.WithEnv("CI", "false"), []string{"local"})
+	})
+	if _, ok := panicked.(UnexpectedCommandError); !ok {
+		t.Errorf("expected UnexpectedCommandError, got %v", panicked)
+	}
+
+	var got []string
+
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var d PolicyDecision
+
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, fmt.Sprintf("%s %s: %s %s stubbed=%v", d.Path, strings.Join(d.Args, " "), d.Action, d.Rule, d.Stubbed))
+	}
+
+	want := []string{
+		"kubectl get ns: require-stub kubectl stubbed=true",
+		"kubectl delete ns kube-system: deny protect-system-namespaces stubbed=true",
+		"echo ci: allow echo-in-ci stubbed=false",
+		"echo local: allow  stubbed=false",
+		"echo local: require-stub  stubbed=false",
+	}
+
+	if !equalStrings(want, got) {
+		t.Errorf("unexpected audit log:\nwant:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestLoadPolicyValidation(t *testing.T) {
+	p := &Policy{Rules: []PolicyRule{{Action: "block"}}}
+
+	if err := p.Validate(); err == nil || err.Error() != `rules[0]: unknown action "block"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	p = &Policy{Rules: []PolicyRule{{Name: "bad", Action: PolicyDeny, Args: "("}}}
+
+	if err := p.Validate(); err == nil || !strings.HasPrefix(err.Error(), "bad: args: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPolicyNotValidated(t *testing.T) {
+	p := &Policy{Rules: []PolicyRule{{Name: "no-delete", Action: PolicyDeny, Args: "^delete "}}, Default: PolicyAllow}
+
+	for _, c := range []struct {
+		args []string
+		want PolicyAction
+	}{
+		{args: []string{"delete", "ns", "foo"}, want: PolicyDeny},
+		{args: []string{"get", "ns"}, want: PolicyAllow},
+	} {
+		if got := p.Decide(Command{Path: "kubectl"}, c.args, false, PolicyRequireStub).Action; got != c.want {
+			t.Errorf("unexpected action for %q: want %q, got %q", c.args, c.want, got)
+		}
+	}
+
+	p = &Policy{Rules: []PolicyRule{{Name: "bad", Action: PolicyAllow, Args: "("}}}
+
+	d := p.Decide(Command{Path: "kubectl"}, []string{"get", "ns"}, false, PolicyAllow)
+
+	if d.Action != PolicyDeny || d.Rule != "bad" {
+		t.Errorf("unexpected decision of an invalid policy: want %q by %q, got %q by %q", PolicyDeny, "bad", d.Action, d.Rule)
+	}
+}
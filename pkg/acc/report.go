@@ -0,0 +1,440 @@
+package acc
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Report is what happened in a task run, built from the events recorded during the run.
+type Report struct {
+	// Name is the name of the task.
+	Name string
+
+	Started  time.Time
+	Duration time.Duration
+
+	// Steps are the steps in the order they were executed, followed by the cleanup steps.
+	// Steps that were not executed because an earlier step failed are reported as skipped.
+	Steps []StepReport
+
+	// Error is the error the task failed with, if any.
+	Error string
+}
+
+// StepReport is what happened in a step.
+type StepReport struct {
+	Name    string
+	Cleanup bool
+
+	// Command is the resolved command line of a command step.
+	Command string
+
+	Status   StepStatus
+	Started  time.Time
+	Duration time.Duration
+	ExitCode int
+	Error    string
+
+	Outputs map[string]string
+
+	// Stdout and Stderr are the lines the step wrote, each terminated by a newline.
+	Stdout, Stderr string
+
+	// Attempts is how many times the step was executed, which is more than one when it was retried.
+	Attempts int
+}
+
+// NewReport builds the report of the run of the task from the events recorded with RecordingObserver.
+// When the task is not nil, its steps that have no events are reported as skipped.
+func NewReport(name string, p *Task, events []Event) *Report {
+	r := &Report{Name: name}
+
+	index := map[string]int{}
+
+	step := func(e Event) *StepReport {
+		i, ok := index[e.Step]
+		if !ok {
+			i = len(r.Steps)
+			index[e.Step] = i
+			r.Steps = append(r.Steps, StepReport{Name: e.Step, Cleanup: e.Cleanup, Started: e.Time})
+		}
+
+		return &r.Steps[i]
+	}
+
+	for _, e := range events {
+		switch e.Type {
+		case EventStepStarted:
+			s := step(e)
+			s.Attempts++
+			s.Command = e.Command
+			s.Started = e.Time
+			s.Stdout, s.Stderr = "", ""
+		case EventStepOutputLine:
+			s := step(e)
+			if e.Stream == "stderr" {
+				s.Stderr += e.Line + "\n"
+			} else {
+				s.Stdout += e.Line + "\n"
+			}
+		case EventStepFinished:
+			s := step(e)
+			s.Status = e.Status
+			s.Duration = e.Duration
+			s.ExitCode = e.ExitCode
+			s.Error = e.Error
+			s.Outputs = e.Outputs
+
+			if e.Status == StepSkipped {
+				s.Started = e.Time
+			}
+		case EventTaskFinished:
+			r.Duration = e.Duration
+			r.Started = e.Time.Add(-e.Duration)
+			r.Error = e.Error
+		}
+	}
+
+	if r.Started.IsZero() && len(r.Steps) > 0 {
+		r.Started = r.Steps[0].Started
+	}
+
+	if p != nil {
+		var missing []StepReport
+
+		for _, s := range p.Steps {
+			if _, ok := index[s.Name]; !ok {
+				missing = append(missing, StepReport{Name: s.Name, Status: StepSkipped, Command: resolvedCommandLine(s, nil, nil)})
+			}
+		}
+
+		// The steps not executed go right before the cleanup steps.
+		i := sort.Search(len(r.Steps), func(i int) bool { return r.Steps[i].Cleanup })
+
+		r.Steps = append(r.Steps[:i], append(missing, r.Steps[i:]...)...)
+
+		for i := len(p.Cleanup) - 1; i >= 0; i-- {
+			if s := p.Cleanup[i]; !r.has(s.Name) {
+				r.Steps = append(r.Steps, StepReport{Name: s.Name, Cleanup: true, Status: StepSkipped})
+			}
+		}
+	}
+
+	return r
+}
+
+func (r *Report) has(name string) bool {
+	for _, s := range r.Steps {
+		if s.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// counts returns the numbers of failed and skipped steps.
+func (r *Report) counts() (failed, skipped int) {
+	for _, s := range r.Steps {
+		switch s.Status {
+		case StepFailed:
+			failed++
+		case StepSkipped:
+			skipped++
+		}
+	}
+
+	return failed, skipped
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name       string          `xml:"name,attr"`
+	Classname  string          `xml:"classname,attr"`
+	Time       string          `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Failure    *junitFailure   `xml:"failure,omitempty"`
+	Skipped    *struct{}       `xml:"skipped,omitempty"`
+	SystemOut  string          `xml:"system-out,omitempty"`
+	SystemErr  string          `xml:"system-err,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the report as JUnit XML with a testcase per step. The cleanup steps
+// have the classname of the task suffixed with ".cleanup".
+func (r *Report) WriteJUnit(w io.Writer) error {
+	failed, skipped := r.counts()
+
+	suite := junitTestSuite{
+		Name:     r.Name,
+		Tests:    len(r.Steps),
+		Failures: failed,
+		Skipped:  skipped,
+		Time:     junitSeconds(r.Duration),
+	}
+
+	if !r.Started.IsZero() {
+		suite.Timestamp = r.Started.UTC().Format("2006-01-02T15:04:05")
+	}
+
+	for _, s := range r.Steps {
+		c := junitTestCase{
+			Name:      s.Name,
+			Classname: r.Name,
+			Time:      junitSeconds(s.Duration),
+			SystemOut: s.Stdout,
+			SystemErr: s.Stderr,
+		}
+
+		if s.Cleanup {
+			c.Classname += ".cleanup"
+		}
+
+		if s.Command != "" {
+			c.Properties = append(c.Properties, junitProperty{Name: "command", Value: s.Command})
+		}
+
+		for _, k := range sortedKeys(s.Outputs) {
+			c.Properties = append(c.Properties, junitProperty{Name: "output." + k, Value: s.Outputs[k]})
+		}
+
+		switch s.Status {
+		case StepFailed:
+			typ := "error"
+			if s.ExitCode > 0 {
+				typ = fmt.Sprintf("exit code %d", s.ExitCode)
+			}
+
+			c.Failure = &junitFailure{Message: firstLine(s.Error), Type: typ, Text: s.Error}
+		case StepSkipped:
+			c.Skipped = &struct{}{}
+		}
+
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	suites := junitTestSuites{
+		Name:     r.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+
+	enc.Indent("", "  ")
+
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+
+	return err
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+	"sortedKeys": sortedKeys,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+.succeeded { color: #1a7f37; }
+.failed { color: #cf222e; }
+.skipped { color: #6e7781; }
+.timeline { border: 1px solid #d0d7de; padding: .5em; margin-bottom: 2em; }
+.row { display: flex; align-items: center; height: 1.6em; }
+.label { width: 14em; overflow: hidden; white-space: nowrap; text-overflow: ellipsis; font-size: .9em; }
+.track { position: relative; flex: 1; height: 1em; background: #f6f8fa; }
+.bar { position: absolute; height: 100%; min-width: 2px; }
+.bar.succeeded { background: #2da44e; }
+.bar.failed { background: #cf222e; }
+.bar.skipped { background: #d0d7de; }
+.cleanup .label { font-style: italic; }
+details { border: 1px solid #d0d7de; margin: .5em 0; padding: .5em; }
+summary { cursor: pointer; }
+pre { background: #f6f8fa; padding: .5em; overflow-x: auto; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #d0d7de; padding: .2em .5em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Name}} <span class="{{.Status}}">{{.Status}}</span></h1>
+<p>Started at {{.Started.Format "2006-01-02 15:04:05 MST"}}, took {{duration .Duration}}.</p>
+{{- if .Error}}
+<pre class="failed">{{.Error}}</pre>
+{{- end}}
+<h2>Timeline</h2>
+<div class="timeline">
+{{- range .Steps}}
+<div class="row{{if .Cleanup}} cleanup{{end}}"><div class="label" title="{{.Name}}">{{.Name}}</div><div class="track"><div class="bar {{.Status}}" style="left: {{.Left}}%; width: {{.Width}}%"></div></div></div>
+{{- end}}
+</div>
+{{- range .Sections}}
+{{- if .Steps}}
+<h2>{{.Title}}</h2>
+{{- range .Steps}}
+<details{{if eq .Status "failed"}} open{{end}}>
+<summary><span class="{{.Status}}">{{.Status}}</span> {{.Name}} ({{duration .Duration}}{{if gt .Attempts 1}}, {{.Attempts}} attempts{{end}})</summary>
+{{- if .Command}}
+<p>Command:</p>
+<pre>{{.Command}}</pre>
+{{- end}}
+{{- if .Error}}
+<p>Error{{if gt .ExitCode 0}} (exit code {{.ExitCode}}){{end}}:</p>
+<pre class="failed">{{.Error}}</pre>
+{{- end}}
+{{- if .Outputs}}
+<p>Outputs:</p>
+<table>
+{{- $outputs := .Outputs}}
+{{- range sortedKeys .Outputs}}
+<tr><th>{{.}}</th><td><pre>{{index $outputs .}}</pre></td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Stdout}}
+<p>Stdout:</p>
+<pre>{{.Stdout}}</pre>
+{{- end}}
+{{- if .Stderr}}
+<p>Stderr:</p>
+<pre>{{.Stderr}}</pre>
+{{- end}}
+</details>
+{{- end}}
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
+
+type htmlReportStep struct {
+	StepReport
+
+	// Left and Width position the step on the timeline, in percent of the duration of the task.
+	Left, Width string
+}
+
+type htmlReportSection struct {
+	Title string
+	Steps []htmlReportStep
+}
+
+// WriteHTML writes the report as a self-contained HTML page with a timeline of the steps,
+// and the resolved commands, outputs, logs and errors of every step and cleanup step.
+func (r *Report) WriteHTML(w io.Writer) error {
+	status := StepSucceeded
+	if r.Error != "" {
+		status = StepFailed
+	}
+
+	percent := func(d time.Duration) string {
+		if r.Duration <= 0 {
+			return "0"
+		}
+
+		p := float64(d) / float64(r.Duration) * 100
+		if p < 0 {
+			p = 0
+		} else if p > 100 {
+			p = 100
+		}
+
+		return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", p), "0"), ".")
+	}
+
+	var steps, cleanup []htmlReportStep
+
+	for _, s := range r.Steps {
+		h := htmlReportStep{StepReport: s, Left: "0", Width: "0"}
+
+		if !s.Started.IsZero() {
+			h.Left = percent(s.Started.Sub(r.Started))
+			h.Width = percent(s.Duration)
+		}
+
+		if s.Cleanup {
+			cleanup = append(cleanup, h)
+		} else {
+			steps = append(steps, h)
+		}
+	}
+
+	return htmlReportTemplate.Execute(w, struct {
+		*Report
+		Status   StepStatus
+		Steps    []htmlReportStep
+		Sections []htmlReportSection
+	}{
+		Report: r,
+		Status: status,
+		Steps:  append(append([]htmlReportStep(nil), steps...), cleanup...),
+		Sections: []htmlReportSection{
+			{Title: "Steps", Steps: steps},
+			{Title: "Cleanup", Steps: cleanup},
+		},
+	})
+}
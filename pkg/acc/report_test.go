@@ -0,0 +1,138 @@
+package acc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func reportTestEvents() []Event {
+	at := func(ms int) time.Time {
+		return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC).Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	return []Event{
+		{Type: EventStepStarted, Time: at(0), Step: "create cluster", Command: "kind create cluster --name e2e"},
+		{Type: EventStepOutputLine, Time: at(100), Step: "create cluster", Stream: "stdout", Line: "created"},
+		{Type: EventStepOutputLine, Time: at(100), Step: "create cluster", Stream: "stderr", Line: "warning: <slow>"},
+		{Type: EventStepFinished, Time: at(1000), Step: "create cluster", Status: StepSucceeded, Duration: time.Second, Outputs: map[string]string{"stdout": "created\n"}},
+		{Type: EventStepStarted, Time: at(1000), Step: "install", Command: "helm install web"},
+		{Type: EventStepFinished, Time: at(1500), Step: "install", Status: StepFailed, Duration: 500 * time.Millisecond, ExitCode: 2, Error: "helm install web: exit code 2\nError: timed out"},
+		{Type: EventCleanupStarted, Time: at(1500)},
+		{Type: EventStepStarted, Time: at(1500), Step: "delete cluster", Cleanup: true, Command: "kind delete cluster --name e2e"},
+		{Type: EventStepFinished, Time: at(2000), Step: "delete cluster", Cleanup: true, Status: StepSucceeded, Duration: 500 * time.Millisecond},
+		{Type: EventTaskFinished, Time: at(2000), Duration: 2 * time.Second, Error: "helm install web: exit code 2\nError: timed out"},
+	}
+}
+
+func reportTestTask() *Task {
+	var b TaskBuilder
+
+	b.Inputs.Def("name", nil)
+
+	b.Defer("delete cluster", b.Cmd("kind", "delete", "cluster", "--name", b.Get("name")))
+	b.Do("create cluster", b.Cmd("kind", "create", "cluster", "--name", b.Get("name")))
+	b.Do("install", b.Cmd("helm", "install", "web"))
+	b.Do("test", b.Cmd("helm", "test", "web"))
+
+	return b.Build()
+}
+
+func TestReportJUnit(t *testing.T) {
+	r := NewReport("e2e", reportTestTask(), reportTestEvents())
+
+	var buf bytes.Buffer
+
+	if err := r.WriteJUnit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="e2e" tests="4" failures="1" skipped="1" time="2.000">
+  <testsuite name="e2e" tests="4" failures="1" skipped="1" time="2.000" timestamp="2021-01-02T03:04:05">
+    <testcase name="create cluster" classname="e2e" time="1.000">
+      <properties>
+        <property name="command" value="kind create cluster --name e2e"></property>
+        <property name="output.stdout" value="created&#xA;"></property>
+      </properties>
+      <system-out>created&#xA;</system-out>
+      <system-err>warning: &lt;slow&gt;&#xA;</system-err>
+    </testcase>
+    <testcase name="install" classname="e2e" time="0.500">
+      <properties>
+        <property name="command" value="helm install web"></property>
+      </properties>
+      <failure message="helm install web: exit code 2" type="exit code 2">helm install web: exit code 2&#xA;Error: timed out</failure>
+    </testcase>
+    <testcase name="test" classname="e2e" time="0.000">
+      <properties>
+        <property name="command" value="helm test web"></property>
+      </properties>
+      <skipped></skipped>
+    </testcase>
+    <testcase name="delete cluster" classname="e2e.cleanup" time="0.500">
+      <properties>
+        <property name="command" value="kind delete cluster --name e2e"></property>
+      </properties>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected JUnit XML:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestReportHTML(t *testing.T) {
+	r := NewReport("e2e", reportTestTask(), reportTestEvents())
+
+	var buf bytes.Buffer
+
+	if err := r.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got := buf.String()
+
+	for _, want := range []string{
+		`<h1>e2e <span class="failed">failed</span></h1>`,
+		`<div class="bar succeeded" style="left: 0%; width: 50%"></div>`,
+		`<div class="bar failed" style="left: 50%; width: 25%"></div>`,
+		`<div class="row cleanup"><div class="label" title="delete cluster">delete cluster</div><div class="track"><div class="bar succeeded" style="left: 75%; width: 25%"></div></div></div>`,
+		`<pre>kind create cluster --name e2e</pre>`,
+		`<pre>warning: &lt;slow&gt;` + "\n</pre>",
+		`<details open>` + "\n" + `<summary><span class="failed">failed</span> install (500ms)</summary>`,
+		`<p>Error (exit code 2):</p>`,
+		`<h2>Cleanup</h2>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected the HTML report to contain %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestReportFromRun(t *testing.T) {
+	rec := &RecordingObserver{}
+
+	p := reportTestTask()
+
+	fake := &FakeRuntime{Responses: []FakeResponse{{Path: "helm", Args: []string{"install", "web"}, ExitCode: 1}}}
+
+	RunWithOptions(p, fake, NewInputs(map[string]string{"name": "e2e"}), RunOptions{Observers: []Observer{rec}})
+
+	r := NewReport("e2e", p, rec.Events())
+
+	var got []string
+
+	for _, s := range r.Steps {
+		got = append(got, s.Name+": "+string(s.Status))
+	}
+
+	want := []string{"create cluster: succeeded", "install: failed", "test: skipped", "delete cluster: succeeded"}
+
+	if !equalStrings(want, got) {
+		t.Errorf("unexpected steps: want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,120 @@
+package acc
+
+import (
+	"fmt"
+	"sort"
+)
+
+// resolveValue turns a string, Ref or Expr found in a command into its string value,
+// looking up task inputs and the outputs of already executed steps.
+func resolveValue(stepName string, v interface{}, inputs *mapInputs, state map[string]map[string]string) string {
+	switch typed := v.(type) {
+	case string:
+		return typed
+	case Ref:
+		if typed.Job == "" {
+			v, err := inputs.get(typed.Key)
+			if err != nil {
+				panic(fmt.Errorf("instruction %q: %v", stepName, err))
+			}
+			return v
+		}
+
+		j, ok := state[typed.Job]
+		if !ok {
+			panic(fmt.Errorf("instruction %q: depends on %q but it is not yet executed", stepName, typed.Job))
+		}
+
+		v, ok := j[typed.Key]
+		if !ok {
+			panic(fmt.Errorf("instruction %q: instruction %q does not have output named %q", stepName, typed.Job, typed.Key))
+		}
+
+		return v
+	case Expr:
+		var args []interface{}
+
+		for _, a := range typed.Args {
+			args = append(args, resolveValue(stepName, a, inputs, state))
+		}
+
+		return fmt.Sprintf(typed.Format, args...)
+	default:
+		panic(fmt.Errorf("unexpected type of arg: %T: %+v", v, v))
+	}
+}
+
+// resolveCommand resolves the args of the command and returns them along with
+// a copy of the command whose Env, Dir and Stdin hold resolved strings.
+func resolveCommand(stepName string, cmd Command, inputs *mapInputs, state map[string]map[string]string) (Command, []string) {
+	var args []string
+
+	for _, a := range cmd.Args {
+		args = append(args, resolveValue(stepName, a, inputs, state))
+	}
+
+	if cmd.Env != nil {
+		env := map[string]interface{}{}
+
+		for k, v := range cmd.Env {
+			env[k] = resolveValue(stepName, v, inputs, state)
+		}
+
+		cmd.Env = env
+	}
+
+	if cmd.Dir != nil {
+		cmd.Dir = resolveValue(stepName, cmd.Dir, inputs, state)
+	}
+
+	if cmd.Stdin != nil {
+		cmd.Stdin = resolveValue(stepName, cmd.Stdin, inputs, state)
+	}
+
+	return cmd, args
+}
+
+// commandRefs returns the refs to inputs and step outputs found in the args, env, dir and stdin
+// of the command, in the order they appear.
+func commandRefs(cmd Command) []Ref {
+	var refs []Ref
+
+	var visit func(v interface{})
+
+	visit = func(v interface{}) {
+		switch typed := v.(type) {
+		case Ref:
+			refs = append(refs, typed)
+		case Expr:
+			for _, a := range typed.Args {
+				visit(a)
+			}
+		}
+	}
+
+	for _, a := range cmd.Args {
+		visit(a)
+	}
+
+	for _, k := range sortedEnvKeys(cmd.Env) {
+		visit(cmd.Env[k])
+	}
+
+	visit(cmd.Dir)
+	visit(cmd.Stdin)
+
+	return refs
+}
+
+// sortedEnvKeys returns the keys of env in a stable order.
+func sortedEnvKeys(env map[string]interface{}) []string {
+	var keys []string
+
+	for k := range env {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
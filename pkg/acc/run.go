@@ -4,142 +4,912 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// RunResult is what happened while running a task.
+type RunResult struct {
+	// Outputs are the outputs of the executed steps keyed by step name and output key.
+	Outputs map[string]map[string]string `json:"outputs"`
+
+	// Steps are the names of the steps that were executed, in order,
+	// including the failed one if any.
+	Steps []string `json:"steps"`
+
+	// Failed is the name of the step that failed, if any.
+	Failed string `json:"failed,omitempty"`
+
+	// Cleanup are the names of the cleanup steps that were executed, in order.
+	Cleanup []string `json:"cleanup"`
+
+	// FailedCleanup are the names of the cleanup steps that failed.
+	FailedCleanup []string `json:"failedCleanup,omitempty"`
+
+	// Skipped are the names of the steps and cleanup steps that were skipped, in order.
+	Skipped []string `json:"skipped,omitempty"`
+
+	// CacheHits are the names of the cached steps whose outputs were reused, in order.
+	CacheHits []string `json:"cacheHits,omitempty"`
+
+	// CacheMisses are the names of the cached steps that were executed, in order.
+	CacheMisses []string `json:"cacheMisses,omitempty"`
+
+	// secrets mask the outputs derived from secrets when the result is marshaled.
+	secrets *secrets
+}
+
 // RunTask provides the inputs to the task and executes it against the target,
 // so that some useful side-effects happen on the target.
-func RunTask(p *Task, t Target, inputs *mapInputs) {
+// It panics when a step or a cleanup step fails.
+func RunTask(p *Task, t Target, inputs *mapInputs) *RunResult {
+	res, err := Run(p, t, inputs)
+	if err != nil {
+		panic(err)
+	}
+
+	return res
+}
+
+// Run is like RunTask but returns the error that made the task fail along with
+// the result of the steps executed so far.
+//
+// The steps are executed in order until one fails. The cleanup steps of a sub-task are executed
+// in the reverse order of their definition once the steps of the sub-task finish. The rest of
+// the cleanup steps are then executed in the reverse order of their definition, regardless of
+// whether the steps succeeded.
+// Steps whose condition does not hold are skipped, as are cleanup steps whose condition
+// refers to steps the run stopped before.
+func Run(p *Task, t Target, inputs *mapInputs) (*RunResult, error) {
+	return RunWithOptions(p, t, inputs, RunOptions{})
+}
+
+// RunWithOptions is like Run but executes only the steps selected by the options,
+// pausing at the breakpoints they set and checkpointing the state of the run after every step.
+func RunWithOptions(p *Task, t Target, inputs *mapInputs, opts RunOptions) (*RunResult, error) {
+	var ckpt *checkpointer
+
+	if opts.Checkpoint != "" {
+		unlock, err := lockStateFile(opts.Checkpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		defer unlock()
+
+		var resumed *RunState
+
+		if opts.resume {
+			resumed, err = LoadRunState(opts.Checkpoint)
+			if err != nil {
+				return nil, err
+			}
+
+			opts, inputs, err = opts.resumeFrom(p, resumed, inputs)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Secret inputs are not saved, so a resumed run has to be given them again.
+		ckpt = newCheckpointer(opts.Checkpoint, inputs.without(p.Secrets), resumed)
+	}
+
+	// The copies of a Runtime made for the steps share where it collects the unexpected commands.
+	if r, ok := t.(*Runtime); ok {
+		r.collected()
+	}
+
+	sec := newSecrets(p, inputs)
+	if sec != nil {
+		inputs = inputs.withSecrets(sec)
+	}
+
+	selected, err := opts.selectSteps(p)
+	if err != nil {
+		return nil, err
+	}
+
+	provided, err := opts.providedOutputs()
+	if err != nil {
+		return nil, err
+	}
+
+	breakpoints := map[string]bool{}
+
+	for _, name := range opts.BreakBefore {
+		breakpoints[name] = true
+	}
+
 	state := map[string]map[string]string{}
 
-	for _, instruction := range p.Steps {
-		switch impl := instruction.Run.(type) {
-		case Command:
-			var args []string
-
-			for _, a := range impl.Args {
-				switch typed := a.(type) {
-				case string:
-					args = append(args, typed)
-				case Ref:
-					if typed.Job == "" {
-						v, err := inputs.get(typed.Key)
-						if err != nil {
-							panic(fmt.Errorf("instruction %q: %v", instruction.Name, err))
-						}
-						args = append(args, v)
-					} else {
-						j, ok := state[typed.Job]
-						if !ok {
-							panic(fmt.Errorf("instruction %q: depends on %q but it is not yet executed", instruction.Name, typed.Job))
-						}
+	res := &RunResult{Outputs: state, secrets: sec}
 
-						v, ok := j[typed.Key]
-						if !ok {
-							panic(fmt.Errorf("instruction %q does not have output named %q", typed.Job, typed.Key))
-						}
+	obs := observers(opts.Observers)
 
-						args = append(args, v)
-					}
-				default:
-					panic(fmt.Errorf("unexpected type of arg: %T: %+v", a, a))
+	// mu serializes the notifications of the observers and guards the result and the checkpoint,
+	// as the combinations of a matrix may run at once. Each combination has its own state,
+	// which holds the outputs of the steps run before the matrix and of its own steps.
+	var mu sync.Mutex
+
+	// writeMu serializes the writes of the combinations run at once to the writers of the target.
+	var writeMu sync.Mutex
+
+	locked := func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		f()
+	}
+
+	notify := func(e Event) {
+		locked(func() {
+			obs.notify(sec.maskEvent(e))
+		})
+	}
+
+	started := time.Now()
+
+	root := opts.Tracer.startTask(opts.TaskName, p, sec)
+
+	// saved returns the outputs of the step to checkpoint, which are none when they are derived from secrets.
+	saved := func(name string, state map[string]map[string]string) map[string]string {
+		if sec.isTainted(name) {
+			return nil
+		}
+
+		return state[name]
+	}
+
+	// statuses are how the steps executed or skipped so far ended, which their conditions check.
+	statuses := map[string]StepStatus{}
+
+	holds := func(instruction TaskStep, state map[string]map[string]string) (bool, error) {
+		if instruction.If == nil {
+			return true, nil
+		}
+
+		return evalCond(instruction, inputs, state, func(step string) (s StepStatus) {
+			locked(func() {
+				s = statuses[step]
+			})
+
+			return s
+		})
+	}
+
+	skip := func(instruction TaskStep, cleanup bool, state map[string]map[string]string) error {
+		name := instruction.Name
+
+		outputs, reused := provided[name]
+
+		locked(func() {
+			res.Skipped = append(res.Skipped, name)
+
+			// A step whose outputs are provided was executed before, like by the resumed run.
+			statuses[name] = StepSkipped
+			if reused {
+				statuses[name] = StepSucceeded
+			}
+		})
+
+		if reused {
+			state[name] = outputs
+
+			if sec.derived(instruction) {
+				sec.addOutputs(outputs)
+			}
+		}
+
+		now := time.Now()
+
+		notify(Event{Type: EventStepFinished, Time: now, Step: name, SubTask: instruction.SubTask, Cleanup: cleanup, Status: StepSkipped, Outputs: state[name]})
+
+		var err error
+
+		locked(func() {
+			err = ckpt.record(name, StepState{Status: StepSkipped, StartedAt: now, FinishedAt: now}, saved(name, state))
+		})
+
+		if err != nil {
+			return fmt.Errorf("checkpointing step %q: %v", name, err)
+		}
+
+		return nil
+	}
+
+	// checkpoint records how the executed step ended and returns the error it failed with, if any.
+	checkpoint := func(name string, started time.Time, stepErr error, state map[string]map[string]string) error {
+		s := StepState{Status: StepSucceeded, StartedAt: started, FinishedAt: time.Now()}
+
+		if stepErr != nil {
+			s.Status = StepFailed
+			s.Error = sec.mask(stepErr.Error())
+		}
+
+		s.SecretOutputs = sec.isTainted(name)
+
+		var err error
+
+		locked(func() {
+			statuses[name] = s.Status
+			err = ckpt.record(name, s, saved(name, state))
+		})
+
+		if err != nil {
+			if stepErr != nil {
+				return fmt.Errorf("%v; checkpointing step %q: %v", stepErr, name, err)
+			}
+
+			return fmt.Errorf("checkpointing step %q: %v", name, err)
+		}
+
+		return stepErr
+	}
+
+	run := func(instruction TaskStep, t Target, state map[string]map[string]string) error {
+		// The outputs derived from secrets are never written to the cache.
+		if instruction.Cache == nil || opts.Cache == nil || sec.isTainted(instruction.Name) {
+			return runStep(instruction, t, inputs, state)
+		}
+
+		hit, err := runCachedStep(instruction, t, inputs, state, opts.Cache)
+
+		locked(func() {
+			if hit {
+				res.CacheHits = append(res.CacheHits, instruction.Name)
+			} else {
+				res.CacheMisses = append(res.CacheMisses, instruction.Name)
+			}
+		})
+
+		return err
+	}
+
+	execute := func(instruction TaskStep, cleanup bool, state map[string]map[string]string) error {
+		span := root.startStep(instruction, cleanup, inputs, state)
+
+		target := t
+
+		var stdout, stderr *lineCallbackWriter
+
+		stepStarted := time.Now()
+
+		outWriter, errWriter := t.GetStdout(), t.GetStderr()
+
+		// The combinations of a matrix run at once share the writers of the target.
+		concurrent := instruction.Combo != nil && instruction.Combo.Matrix.MaxParallel > 1
+
+		if concurrent {
+			outWriter, errWriter = newLockedWriter(outWriter, &writeMu), newLockedWriter(errWriter, &writeMu)
+		}
+
+		if len(obs) > 0 {
+			notify(Event{Type: EventStepStarted, Time: stepStarted, Step: instruction.Name, SubTask: instruction.SubTask, Cleanup: cleanup, Command: resolvedCommandLine(instruction, inputs, state)})
+
+			lines := func(stream string) *lineCallbackWriter {
+				return &lineCallbackWriter{f: func(line string) {
+					notify(Event{Type: EventStepOutputLine, Step: instruction.Name, SubTask: instruction.SubTask, Cleanup: cleanup, Stream: stream, Line: line})
+				}}
+			}
+
+			stdout, stderr = lines("stdout"), lines("stderr")
+
+			outWriter, errWriter = teeWriter(outWriter, stdout), teeWriter(errWriter, stderr)
+		}
+
+		var maskedOut, maskedErr *maskingWriter
+
+		if sec != nil {
+			// The output of a step whose outputs may be derived from secrets is held until it finishes,
+			// so that the outputs are masked in it too.
+			_, isFunc := instruction.Run.(Func)
+
+			hold := isFunc || sec.derived(instruction)
+
+			maskedOut = newMaskingWriter(outWriter, sec, hold)
+			maskedErr = newMaskingWriter(errWriter, sec, hold)
+
+			outWriter, errWriter = maskedOut, maskedErr
+		}
+
+		if len(obs) > 0 || sec != nil || concurrent {
+			target = &redirectedTarget{Target: target, stdout: outWriter, stderr: errWriter, secrets: sec}
+		}
+
+		if span != nil {
+			target = &tracedTarget{Target: target, span: span}
+		}
+
+		err := run(instruction, target, state)
+
+		if sec.derived(instruction) {
+			sec.addOutputs(state[instruction.Name])
+		}
+
+		if sec != nil {
+			maskedOut.flush()
+			maskedErr.flush()
+		}
+
+		span.finishStep(err, state[instruction.Name])
+
+		if len(obs) == 0 {
+			return err
+		}
+
+		stdout.flush()
+		stderr.flush()
+
+		e := Event{Type: EventStepFinished, Step: instruction.Name, SubTask: instruction.SubTask, Cleanup: cleanup, Status: StepSucceeded, Outputs: state[instruction.Name]}
+
+		e.Time = time.Now()
+		e.Duration = e.Time.Sub(stepStarted)
+
+		if err != nil {
+			e.Status = StepFailed
+			e.ExitCode = exitCode(err)
+			e.Error = err.Error()
+		}
+
+		notify(e)
+
+		return err
+	}
+
+	var promptMu sync.Mutex
+
+	prompter := opts.prompter()
+
+	prompt := func(name string, err error, state map[string]map[string]string) BreakAction {
+		promptMu.Lock()
+		defer promptMu.Unlock()
+
+		return prompter.Prompt(Breakpoint{Step: name, Outputs: sec.maskState(state), Err: sec.maskError(err)})
+	}
+
+	// step runs the step unless it is not selected or skipped at its breakpoint,
+	// and returns the error that stops the run.
+	step := func(instruction TaskStep, state map[string]map[string]string) error {
+		if !selected[instruction.Name] {
+			return skip(instruction, false, state)
+		}
+
+		ok, err := holds(instruction, state)
+		if err != nil {
+			locked(func() {
+				res.Steps = append(res.Steps, instruction.Name)
+
+				if res.Failed == "" {
+					res.Failed = instruction.Name
+				}
+			})
+
+			return checkpoint(instruction.Name, time.Now(), err, state)
+		}
+
+		if !ok {
+			return skip(instruction, false, state)
+		}
+
+		if breakpoints[instruction.Name] {
+			switch prompt(instruction.Name, nil, state) {
+			case BreakSkip:
+				return skip(instruction, false, state)
+			case BreakAbort:
+				return fmt.Errorf("aborted at the breakpoint before step %q", instruction.Name)
+			}
+		}
+
+		locked(func() {
+			res.Steps = append(res.Steps, instruction.Name)
+		})
+
+		stepStarted := time.Now()
+
+		for {
+			err = execute(instruction, false, state)
+			if err == nil || !breakpoints[instruction.Name] {
+				err = checkpoint(instruction.Name, stepStarted, err, state)
+				break
+			}
+
+			action := prompt(instruction.Name, err, state)
+			if action == BreakRetry {
+				continue
+			}
+
+			if action == BreakSkip {
+				err = skip(instruction, false, state)
+			} else {
+				err = checkpoint(instruction.Name, stepStarted, err, state)
+			}
+
+			break
+		}
+
+		if err != nil {
+			locked(func() {
+				if res.Failed == "" {
+					res.Failed = instruction.Name
 				}
+			})
+		}
+
+		return err
+	}
+
+	var cleanupErrs []string
+
+	// cleanedUp are the cleanup steps executed or skipped before the ones of the task,
+	// which are the ones of the sub-tasks whose steps finished.
+	cleanedUp := map[string]bool{}
+
+	cleanUp := func(instruction TaskStep, state map[string]map[string]string) {
+		locked(func() {
+			cleanedUp[instruction.Name] = true
+		})
+
+		// The condition of a cleanup step may refer to the steps the run stopped before.
+		if ok, e := holds(instruction, state); !selected[instruction.Name] || !ok || e != nil {
+			if e := skip(instruction, true, state); e != nil {
+				locked(func() {
+					cleanupErrs = append(cleanupErrs, e.Error())
+				})
 			}
 
-			res := t.Execute(impl, args)
+			return
+		}
+
+		locked(func() {
+			res.Cleanup = append(res.Cleanup, instruction.Name)
+		})
+
+		stepStarted := time.Now()
 
-			var (
-				stdoutBuf, stderrBuf bytes.Buffer
-			)
+		if e := checkpoint(instruction.Name, stepStarted, execute(instruction, true, state), state); e != nil {
+			locked(func() {
+				res.FailedCleanup = append(res.FailedCleanup, instruction.Name)
+				cleanupErrs = append(cleanupErrs, e.Error())
+			})
+		}
+	}
 
-			stdout := io.TeeReader(res.Stdout, &stdoutBuf)
-			stderr := io.TeeReader(res.Stderr, &stderrBuf)
+	// exit runs the cleanup steps of the sub-tasks the step in the sub-task prev is in
+	// but the step in the sub-task next is not, as their steps finished.
+	exit := func(prev, next string, state map[string]map[string]string) {
+		for _, t := range exitedSubTasks(prev, next) {
+			for _, c := range subTaskCleanup(p, t) {
+				cleanUp(c, state)
 
-			var wg sync.WaitGroup
+				locked(func() {
+					if outputs, ok := state[c.Name]; ok {
+						res.Outputs[c.Name] = outputs
+					}
+				})
+			}
+		}
+	}
+
+	// runMatrix runs the combinations of the matrix, up to MaxParallel of them at once.
+	// Unless the matrix continues on error, the steps not started yet are skipped once a combination fails.
+	runMatrix := func(m *Matrix, combos [][]TaskStep) error {
+		parallel := m.MaxParallel
+		if parallel < 1 {
+			parallel = 1
+		}
 
-			var err error
+		var (
+			wg     sync.WaitGroup
+			failed bool
+		)
 
-			var once sync.Once
+		errs := make([]error, len(combos))
+		sem := make(chan struct{}, parallel)
+
+		for i, combo := range combos {
+			sem <- struct{}{}
 
 			wg.Add(1)
-			go func() {
+
+			go func(i int, combo []TaskStep) {
 				defer func() {
-					if e := recover(); e != nil {
-						once.Do(func() {
-							err = fmt.Errorf("stdout: %w", e)
-						})
-					}
+					<-sem
+					wg.Done()
 				}()
-				defer wg.Done()
 
-				if _, e := io.Copy(t.GetStdout(), stdout); e != nil {
-					once.Do(func() {
-						err = e
+				local := map[string]map[string]string{}
+
+				locked(func() {
+					for k, v := range state {
+						local[k] = v
+					}
+				})
+
+				for j, s := range combo {
+					var cancelled bool
+
+					locked(func() {
+						cancelled = failed && !m.ContinueOnError
 					})
-				}
-			}()
 
-			wg.Add(1)
-			go func() {
-				defer func() {
-					if e := recover(); e != nil {
-						once.Do(func() {
-							err = fmt.Errorf("stderr: %w", e)
-						})
+					var err error
+
+					if cancelled {
+						err = skip(s, false, local)
+					} else {
+						err = step(s, local)
 					}
-				}()
-				defer wg.Done()
 
-				if _, e := io.Copy(t.GetStderr(), stderr); e != nil {
-					once.Do(func() {
-						err = e
+					locked(func() {
+						if outputs, ok := local[s.Name]; ok {
+							state[s.Name] = outputs
+						}
+
+						if err != nil {
+							failed = true
+						}
 					})
+
+					if err != nil {
+						errs[i] = err
+						return
+					}
+
+					next := m.Name
+					if j < len(combo)-1 {
+						next = combo[j+1].SubTask
+					}
+
+					exit(s.SubTask, next, local)
 				}
-			}()
+			}(i, combo)
+		}
+
+		wg.Wait()
 
-			wg.Wait()
+		var msgs []string
 
+		for _, err := range errs {
 			if err != nil {
-				panic(err)
+				msgs = append(msgs, err.Error())
 			}
+		}
 
-			state[instruction.Name] = map[string]string{
-				"stdout": stdoutBuf.String(),
+		switch len(msgs) {
+		case 0:
+			return nil
+		case 1:
+			for _, err := range errs {
+				if err != nil {
+					return err
+				}
 			}
-		case Func:
-			outputs := map[string]string{}
+		}
 
-			var err error
+		return fmt.Errorf("matrix %q: %s", m.Name, strings.Join(msgs, "; "))
+	}
 
-			func() {
-				defer func() {
-					if e := recover(); e != nil {
-						err = fmt.Errorf("unhandled error in func: %v", e)
-					}
-				}()
+	// nextSubTask returns the sub-task of the first of the steps, or "" when there is none.
+	nextSubTask := func(steps []TaskStep) string {
+		if len(steps) == 0 {
+			return ""
+		}
 
-				err = impl.F(&stepContext{
-					setOutput: func(key, val string) {
-						outputs[key] = val
-					},
-					get: func(key string) string {
-						v, err := inputs.get(key)
-						if err != nil {
-							panic(fmt.Errorf("instruction %q: %v", instruction.Name, err))
-						}
-						return v
-					},
-					executor: t,
+		return steps[0].SubTask
+	}
+
+	for steps := p.Steps; len(steps) > 0 && err == nil; {
+		if steps[0].Combo == nil {
+			err = step(steps[0], state)
+			if err == nil {
+				exit(steps[0].SubTask, nextSubTask(steps[1:]), state)
+			}
+
+			steps = steps[1:]
+
+			continue
+		}
+
+		m, combos, rest := matrixSteps(steps)
+
+		err = runMatrix(m, combos)
+		if err == nil {
+			exit(m.Name, nextSubTask(rest), state)
+		}
+
+		steps = rest
+	}
+
+	// The rest of the cleanup steps are the ones of the task and of the sub-tasks the run stopped in.
+	var rest []TaskStep
+
+	for _, c := range p.Cleanup {
+		if !cleanedUp[c.Name] {
+			rest = append(rest, c)
+		}
+	}
+
+	if len(rest) > 0 {
+		notify(Event{Type: EventCleanupStarted})
+	}
+
+	for i := len(rest) - 1; i >= 0; i-- {
+		cleanUp(rest[i], state)
+	}
+
+	if len(cleanupErrs) > 0 {
+		cleanupErr := fmt.Errorf("cleanup: %s", strings.Join(cleanupErrs, "; "))
+
+		if err == nil {
+			err = cleanupErr
+		} else {
+			err = fmt.Errorf("%v; %v", err, cleanupErr)
+		}
+	}
+
+	err = sec.maskError(err)
+
+	finished := Event{Type: EventTaskFinished, Time: time.Now(), Result: res}
+
+	finished.Duration = finished.Time.Sub(started)
+
+	if err != nil {
+		finished.Error = err.Error()
+	}
+
+	notify(finished)
+
+	if root != nil {
+		if res.Failed != "" {
+			root.set("acc.task.failed_step", res.Failed)
+		}
+
+		root.set("acc.task.executed_steps", int64(len(res.Steps)+len(res.Cleanup)))
+		root.finish(err)
+
+		opts.Tracer.flush()
+	}
+
+	return res, err
+}
+
+// runStep executes the step and records its outputs into state, turning panics into errors.
+func runStep(instruction TaskStep, t Target, inputs *mapInputs, state map[string]map[string]string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if er, ok := e.(error); ok {
+				err = er
+			} else {
+				err = fmt.Errorf("%v", e)
+			}
+		}
+	}()
+
+	switch impl := instruction.Run.(type) {
+	case Command:
+		impl, args := resolveCommand(instruction.Name, impl, inputs, state)
+
+		res := executeCommand(instruction.Name, t, impl, args, state)
+
+		var (
+			stdoutBuf, stderrBuf bytes.Buffer
+		)
+
+		copyStreams(t, res, &stdoutBuf, &stderrBuf)
+
+		state[instruction.Name] = map[string]string{
+			"stdout":   stdoutBuf.String(),
+			"stderr":   stderrBuf.String(),
+			"exitCode": "0",
+		}
+	case Func:
+		outputs, err := runFunc(instruction, impl, t, inputs, state)
+		if err != nil {
+			panic(err)
+		}
+
+		state[instruction.Name] = outputs
+	default:
+		panic(fmt.Errorf("unsupported type of instruction: %T", impl))
+	}
+
+	return nil
+}
+
+// runFunc runs the func of the step against the target and returns the outputs it set.
+// Reading a secret input marks the outputs of the step as derived from secrets.
+func runFunc(instruction TaskStep, impl Func, t Target, inputs *mapInputs, state map[string]map[string]string) (outputs map[string]string, err error) {
+	outputs = map[string]string{}
+
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				err = fmt.Errorf("unhandled error in func: %v", e)
+			}
+		}()
+
+		err = impl.F(&stepContext{
+			setOutput: func(key, val string) {
+				setFuncOutput(instruction.Name, impl, outputs, key, val)
+			},
+			get: func(key string) string {
+				v, err := inputs.get(key)
+				if err != nil {
+					panic(fmt.Errorf("instruction %q: %v", instruction.Name, err))
+				}
+				if inputs.secrets.isInput(key) {
+					inputs.secrets.taint(instruction.Name)
+				}
+				return v
+			},
+			output: func(ref Ref) string {
+				return funcInput(instruction.Name, impl, ref, inputs, state)
+			},
+			executor: t,
+		})
+	}()
+
+	if err == nil {
+		err = checkFuncOutputs(instruction.Name, impl, outputs)
+	}
+
+	return outputs, err
+}
+
+// executeCommand executes the command of the step, recording the exit code along with
+// the stdout and stderr written before the exit as the outputs of the step when the command fails.
+func executeCommand(stepName string, t Target, cmd Command, args []string, state map[string]map[string]string) ExecResult {
+	defer func() {
+		if e := recover(); e != nil {
+			err, ok := e.(error)
+			if !ok {
+				err = fmt.Errorf("%v", e)
+			}
+
+			if code := exitCode(err); code > 0 {
+				stdout, stderr := exitOutputs(err)
+
+				state[stepName] = map[string]string{
+					"stdout":   stdout,
+					"stderr":   stderr,
+					"exitCode": strconv.Itoa(code),
+				}
+			}
+
+			panic(e)
+		}
+	}()
+
+	return t.Execute(cmd, args)
+}
+
+// setFuncOutput sets the output of the func, failing unless it is declared in the Outputs of the func.
+func setFuncOutput(stepName string, impl Func, outputs map[string]string, key, val string) {
+	for _, o := range impl.Outputs {
+		if o == key {
+			outputs[key] = val
+			return
+		}
+	}
+
+	panic(fmt.Errorf("instruction %q: output %q is not declared in the outputs of the func", stepName, key))
+}
+
+// checkFuncOutputs returns an error unless the func set all of its declared outputs.
+func checkFuncOutputs(stepName string, impl Func, outputs map[string]string) error {
+	var missing []string
+
+	for _, o := range impl.Outputs {
+		if _, ok := outputs[o]; !ok {
+			missing = append(missing, fmt.Sprintf("%q", o))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("instruction %q: func did not set its declared outputs %s", stepName, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// funcInput returns the value of the upstream step output the func reads, failing unless
+// it is declared in the Inputs of the func.
+func funcInput(stepName string, impl Func, ref Ref, inputs *mapInputs, state map[string]map[string]string) string {
+	for _, in := range impl.Inputs {
+		if in == ref {
+			return resolveValue(stepName, ref, inputs, state)
+		}
+	}
+
+	panic(fmt.Errorf("instruction %q: output %q of %q is not declared in the inputs of the func", stepName, ref.Key, ref.Job))
+}
+
+// copyStreams keeps a copy of each stream of the result, forwarding the ones the target
+// did not stream by itself to the target's stdout and stderr.
+func copyStreams(t Target, res ExecResult, stdoutBuf, stderrBuf *bytes.Buffer) {
+	stdout := io.TeeReader(res.Stdout, stdoutBuf)
+	stderr := io.TeeReader(res.Stderr, stderrBuf)
+
+	stdoutDst, stderrDst := ioutil.Discard, ioutil.Discard
+
+	if !res.StdoutStreamed {
+		stdoutDst = t.GetStdout()
+	}
+
+	if !res.StderrStreamed {
+		stderrDst = t.GetStderr()
+	}
+
+	var wg sync.WaitGroup
+
+	var err error
+
+	var once sync.Once
+
+	wg.Add(1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				once.Do(func() {
+					err = fmt.Errorf("stdout: %v", e)
 				})
-			}()
+			}
+		}()
+		defer wg.Done()
 
-			if err != nil {
-				panic(err)
+		if _, e := io.Copy(stdoutDst, stdout); e != nil {
+			once.Do(func() {
+				err = e
+			})
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				once.Do(func() {
+					err = fmt.Errorf("stderr: %v", e)
+				})
 			}
+		}()
+		defer wg.Done()
 
-			state[instruction.Name] = outputs
-		default:
-			panic(fmt.Errorf("unsupported type of instruction: %T", impl))
+		if _, e := io.Copy(stderrDst, stderr); e != nil {
+			once.Do(func() {
+				err = e
+			})
 		}
+	}()
+
+	wg.Wait()
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// lockedWriter serializes the writes to w with the writes of the other writers sharing mu.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func newLockedWriter(w io.Writer, mu *sync.Mutex) io.Writer {
+	if w == nil {
+		return nil
 	}
+
+	return &lockedWriter{w: w, mu: mu}
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.w.Write(p)
 }
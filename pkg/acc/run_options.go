@@ -0,0 +1,307 @@
+package acc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RunOptions changes which steps RunWithOptions executes and lets it pause before steps.
+type RunOptions struct {
+	// SkipSteps are the names of the steps and cleanup steps not to execute.
+	SkipSteps []string
+
+	// OnlySteps, when not empty, are the names of the only steps to execute, besides the cleanup
+	// steps, which cannot be named here.
+	OnlySteps []string
+
+	// FromStep skips the steps before the named step, which cannot be a cleanup step.
+	FromStep string
+
+	// ToStep skips the steps after the named step, which cannot be a cleanup step either.
+	ToStep string
+
+	// BreakBefore are the names of the steps to pause before, asking Prompter what to do.
+	// The Prompter is asked again when a step paused before fails, so that it can be retried.
+	BreakBefore []string
+
+	// Prompter is asked what to do at breakpoints. Defaults to a TerminalPrompter
+	// reading os.Stdin, which aborts the run when stdin is not a terminal.
+	Prompter Prompter
+
+	// Outputs are the outputs of skipped steps keyed by step name and output key,
+	// used to resolve the references of later steps to them.
+	Outputs map[string]map[string]string
+
+	// StateFile is the path to a RunState whose outputs are used for skipped steps
+	// that Outputs has no outputs for.
+	StateFile string
+
+	// Checkpoint is the path to save the RunState to after every step, so that
+	// the run can be resumed with Resume. It is locked against concurrent runs.
+	Checkpoint string
+
+	// Cache stores the outputs of the steps defined with the Cache option.
+	// The steps are always executed when it is nil.
+	Cache CacheStore
+
+	// Observers are notified of the progress of the run.
+	Observers []Observer
+
+	// Tracer, when set, records a trace of the run.
+	Tracer *Tracer
+
+	// TaskName names the task in the traces of the run.
+	TaskName string
+
+	// resume makes the run continue from the state saved at Checkpoint.
+	resume bool
+}
+
+// BreakAction is what to do at a breakpoint.
+type BreakAction int
+
+const (
+	// BreakContinue executes the step, or lets it fail when it has already failed.
+	BreakContinue BreakAction = iota
+	// BreakSkip skips the step, using the provided outputs for it if any.
+	BreakSkip
+	// BreakRetry executes the step again after it failed. Before the step it is the same as BreakContinue.
+	BreakRetry
+	// BreakAbort stops executing steps. The cleanup steps are still executed.
+	BreakAbort
+)
+
+// Breakpoint is where a run pauses.
+type Breakpoint struct {
+	// Step is the name of the step paused before.
+	Step string
+
+	// Outputs are the outputs of the steps executed or skipped so far.
+	Outputs map[string]map[string]string
+
+	// Err is the error the step failed with, when the run pauses after the step failed.
+	Err error
+}
+
+// Prompter decides what to do at breakpoints.
+type Prompter interface {
+	Prompt(Breakpoint) BreakAction
+}
+
+// TerminalPrompter asks the user on a terminal what to do at breakpoints.
+// It reads In through a single buffer across prompts, so that input typed ahead is not lost.
+type TerminalPrompter struct {
+	In  io.Reader
+	Out io.Writer
+
+	in *bufio.Reader
+}
+
+func (p *TerminalPrompter) Prompt(bp Breakpoint) BreakAction {
+	if p.in == nil {
+		p.in = bufio.NewReader(p.In)
+	}
+
+	in := p.in
+
+	for {
+		if bp.Err != nil {
+			fmt.Fprintf(p.Out, "Step %q failed: %v\n", bp.Step, bp.Err)
+		} else {
+			fmt.Fprintf(p.Out, "Paused before step %q.\n", bp.Step)
+		}
+
+		fmt.Fprint(p.Out, "[c]ontinue, [s]kip, [r]etry, [i]nspect outputs or [a]bort? ")
+
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(p.Out)
+			return BreakAbort
+		}
+
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "c", "continue":
+			return BreakContinue
+		case "s", "skip":
+			return BreakSkip
+		case "r", "retry":
+			return BreakRetry
+		case "a", "abort":
+			return BreakAbort
+		case "i", "inspect":
+			var steps []string
+
+			for name := range bp.Outputs {
+				steps = append(steps, name)
+			}
+
+			sort.Strings(steps)
+
+			for _, name := range steps {
+				fmt.Fprintf(p.Out, "%s:\n", name)
+
+				var keys []string
+
+				for k := range bp.Outputs[name] {
+					keys = append(keys, k)
+				}
+
+				sort.Strings(keys)
+
+				for _, k := range keys {
+					fmt.Fprintf(p.Out, "  %s: %q\n", k, bp.Outputs[name][k])
+				}
+			}
+		default:
+			fmt.Fprintf(p.Out, "Unknown answer %q.\n", strings.TrimSpace(line))
+		}
+	}
+}
+
+// nonInteractivePrompter aborts at every breakpoint because nobody can answer.
+type nonInteractivePrompter struct {
+	out io.Writer
+}
+
+func (p nonInteractivePrompter) Prompt(bp Breakpoint) BreakAction {
+	fmt.Fprintf(p.out, "Aborting at the breakpoint before step %q because stdin is not a terminal.\n", bp.Step)
+
+	return BreakAbort
+}
+
+func (o RunOptions) prompter() Prompter {
+	if o.Prompter != nil {
+		return o.Prompter
+	}
+
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return &TerminalPrompter{In: os.Stdin, Out: os.Stderr}
+	}
+
+	return nonInteractivePrompter{out: os.Stderr}
+}
+
+// UnknownStepError is returned by RunWithOptions when the options name a step the task does not have.
+type UnknownStepError struct {
+	Step string
+}
+
+func (e UnknownStepError) Error() string {
+	return fmt.Sprintf("unknown step %q", e.Step)
+}
+
+// CleanupStepRangeError is returned by RunWithOptions when FromStep, ToStep or OnlySteps names a cleanup step.
+type CleanupStepRangeError struct {
+	Step string
+}
+
+func (e CleanupStepRangeError) Error() string {
+	return fmt.Sprintf("cleanup step %q cannot select the steps to run, as cleanup steps always run", e.Step)
+}
+
+// selectSteps returns the names of the steps and cleanup steps to execute.
+func (o RunOptions) selectSteps(p *Task) (map[string]bool, error) {
+	index := map[string]int{}
+
+	for i, s := range p.Steps {
+		index[s.Name] = i
+	}
+
+	known := func(name string) bool {
+		if _, ok := index[name]; ok {
+			return true
+		}
+
+		for _, s := range p.Cleanup {
+			if s.Name == name {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var names []string
+
+	names = append(names, o.SkipSteps...)
+	names = append(names, o.BreakBefore...)
+
+	for _, name := range names {
+		if !known(name) {
+			return nil, UnknownStepError{Step: name}
+		}
+	}
+
+	// The cleanup steps are run whatever the range of steps is, so they cannot select it.
+	for _, name := range append([]string{o.FromStep, o.ToStep}, o.OnlySteps...) {
+		if name == "" {
+			continue
+		}
+
+		if _, ok := index[name]; !ok {
+			if known(name) {
+				return nil, CleanupStepRangeError{Step: name}
+			}
+
+			return nil, UnknownStepError{Step: name}
+		}
+	}
+
+	from, to := 0, len(p.Steps)-1
+
+	if o.FromStep != "" {
+		from = index[o.FromStep]
+	}
+
+	if o.ToStep != "" {
+		to = index[o.ToStep]
+	}
+
+	only := map[string]bool{}
+
+	for _, name := range o.OnlySteps {
+		only[name] = true
+	}
+
+	selected := map[string]bool{}
+
+	for i, s := range p.Steps {
+		selected[s.Name] = i >= from && i <= to && (len(only) == 0 || only[s.Name])
+	}
+
+	for _, s := range p.Cleanup {
+		selected[s.Name] = true
+	}
+
+	for _, name := range o.SkipSteps {
+		selected[name] = false
+	}
+
+	return selected, nil
+}
+
+// providedOutputs returns the outputs for skipped steps, taken from Outputs and then StateFile.
+func (o RunOptions) providedOutputs() (map[string]map[string]string, error) {
+	provided := map[string]map[string]string{}
+
+	if o.StateFile != "" {
+		s, err := LoadRunState(o.StateFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, outputs := range s.Outputs {
+			provided[name] = outputs
+		}
+	}
+
+	for name, outputs := range o.Outputs {
+		provided[name] = outputs
+	}
+
+	return provided, nil
+}
@@ -0,0 +1,217 @@
+package acc
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func optionsTestTask() *Task {
+	var b TaskBuilder
+
+	create := b.Do("create", b.Cmd("kind", "create", "cluster"))
+	b.Do("install", b.Cmd("helm", "install", "web", "stable/nginx").WithEnv("KUBECONFIG", create.Get("stdout")))
+	b.Do("test", b.Cmd("helm", "test", "web"))
+	b.Defer("delete", b.Cmd("kind", "delete", "cluster"))
+
+	return b.Build()
+}
+
+// scriptedPrompter answers the breakpoints with the actions in order.
+type scriptedPrompter struct {
+	actions     []BreakAction
+	breakpoints []string
+}
+
+func (p *scriptedPrompter) Prompt(bp Breakpoint) BreakAction {
+	name := bp.Step
+	if bp.Err != nil {
+		name += " failed"
+	}
+
+	p.breakpoints = append(p.breakpoints, name)
+
+	a := p.actions[0]
+	p.actions = p.actions[1:]
+
+	return a
+}
+
+func TestRunWithOptionsSelection(t *testing.T) {
+	testcases := []struct {
+		name    string
+		opts    RunOptions
+		plan    []string
+		skipped []string
+	}{
+		{
+			name: "skip",
+			opts: RunOptions{
+				SkipSteps: []string{"create", "delete"},
+				Outputs:   map[string]map[string]string{"create": {"stdout": "/tmp/kubeconfig"}},
+			},
+			plan:    []string{`KUBECONFIG="/tmp/kubeconfig" helm install web stable/nginx`, "helm test web"},
+			skipped: []string{"create", "delete"},
+		},
+		{
+			name: "only",
+			opts: RunOptions{
+				OnlySteps: []string{"create", "test"},
+			},
+			plan:    []string{"kind create cluster", "helm test web", "kind delete cluster"},
+			skipped: []string{"install"},
+		},
+		{
+			name: "range",
+			opts: RunOptions{
+				FromStep: "install",
+				ToStep:   "install",
+				Outputs:  map[string]map[string]string{"create": {"stdout": "/tmp/kubeconfig"}},
+			},
+			plan:    []string{`KUBECONFIG="/tmp/kubeconfig" helm install web stable/nginx`, "kind delete cluster"},
+			skipped: []string{"create", "test"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &FakeRuntime{}
+
+			res, err := RunWithOptions(optionsTestTask(), fake, NewInputs(nil), tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fake.AssertPlan(t, tc.plan...)
+
+			if !equalStrings(tc.skipped, res.Skipped) {
+				t.Errorf("unexpected skipped steps: want %v, got %v", tc.skipped, res.Skipped)
+			}
+		})
+	}
+}
+
+func TestRunWithOptionsStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	if err := ioutil.WriteFile(path, []byte(`{"outputs": {"create": {"stdout": "/saved/kubeconfig"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &FakeRuntime{}
+
+	if _, err := RunWithOptions(optionsTestTask(), fake, NewInputs(nil), RunOptions{FromStep: "install", StateFile: path}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.AssertPlan(t,
+		`KUBECONFIG="/saved/kubeconfig" helm install web stable/nginx`,
+		"helm test web",
+		"kind delete cluster",
+	)
+}
+
+func TestRunWithOptionsUnknownStep(t *testing.T) {
+	_, err := RunWithOptions(optionsTestTask(), &FakeRuntime{}, NewInputs(nil), RunOptions{SkipSteps: []string{"crate"}})
+	if want := (UnknownStepError{Step: "crate"}); err != want {
+		t.Errorf("unexpected error: want %v, got %v", want, err)
+	}
+
+	fake := &FakeRuntime{}
+
+	_, err = RunWithOptions(optionsTestTask(), fake, NewInputs(nil), RunOptions{FromStep: "delete"})
+	if want := (CleanupStepRangeError{Step: "delete"}); err != want {
+		t.Errorf("unexpected error: want %v, got %v", want, err)
+	}
+
+	_, err = RunWithOptions(optionsTestTask(), fake, NewInputs(nil), RunOptions{OnlySteps: []string{"delete"}})
+	if want := (CleanupStepRangeError{Step: "delete"}); err != want {
+		t.Errorf("unexpected error for only steps: want %v, got %v", want, err)
+	}
+
+	fake.AssertPlan(t)
+}
+
+func TestRunWithOptionsBreakpoints(t *testing.T) {
+	var attempts int
+
+	var b TaskBuilder
+
+	b.Do("create", b.Cmd("kind", "create", "cluster"))
+	b.Do("flaky", Func{
+		Name: "flaky",
+		F: func(ctx TaskStepContext) error {
+			attempts++
+			if attempts < 2 {
+				return errors.New("not yet")
+			}
+			return nil
+		},
+	})
+	b.Do("test", b.Cmd("helm", "test", "web"))
+	b.Defer("delete", b.Cmd("kind", "delete", "cluster"))
+
+	prompter := &scriptedPrompter{actions: []BreakAction{BreakSkip, BreakContinue, BreakRetry, BreakAbort}}
+
+	fake := &FakeRuntime{}
+
+	res, err := RunWithOptions(b.Build(), fake, NewInputs(nil), RunOptions{
+		BreakBefore: []string{"create", "flaky", "test"},
+		Prompter:    prompter,
+	})
+	if err == nil || err.Error() != `aborted at the breakpoint before step "test"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if want, got := []string{"create", "flaky", "flaky failed", "test"}, prompter.breakpoints; !equalStrings(want, got) {
+		t.Errorf("unexpected breakpoints: want %v, got %v", want, got)
+	}
+
+	if want, got := 2, attempts; got != want {
+		t.Errorf("unexpected attempts: want %d, got %d", want, got)
+	}
+
+	if want, got := []string{"create"}, res.Skipped; !equalStrings(want, got) {
+		t.Errorf("unexpected skipped steps: want %v, got %v", want, got)
+	}
+
+	fake.AssertPlan(t, "kind delete cluster")
+}
+
+func TestTerminalPrompter(t *testing.T) {
+	var out bytes.Buffer
+
+	p := TerminalPrompter{In: strings.NewReader("x\ni\ns\nc\n"), Out: &out}
+
+	action := p.Prompt(Breakpoint{
+		Step:    "install",
+		Outputs: map[string]map[string]string{"create": {"stdout": "done\n"}},
+	})
+
+	if want, got := BreakSkip, action; got != want {
+		t.Errorf("unexpected action: want %v, got %v", want, got)
+	}
+
+	prompt := `Paused before step "install".
+[c]ontinue, [s]kip, [r]etry, [i]nspect outputs or [a]bort? `
+
+	want := prompt + `Unknown answer "x".
+` + prompt + `create:
+  stdout: "done\n"
+` + prompt
+
+	if got := out.String(); got != want {
+		t.Errorf("unexpected output:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	if want, got := BreakContinue, p.Prompt(Breakpoint{Step: "uninstall"}); got != want {
+		t.Errorf("unexpected action of the input typed ahead: want %v, got %v", want, got)
+	}
+
+	if want, got := BreakAbort, (&TerminalPrompter{In: strings.NewReader(""), Out: &out}).Prompt(Breakpoint{Step: "install"}); got != want {
+		t.Errorf("unexpected action on EOF: want %v, got %v", want, got)
+	}
+}
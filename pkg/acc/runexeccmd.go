@@ -3,70 +3,222 @@ package acc
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"os/exec"
 	"sync"
+	"time"
 )
 
+// DefaultMaxCaptureBytes is the number of bytes kept per stream for step outputs
+// when ExecOptions.MaxCaptureBytes is not set.
+const DefaultMaxCaptureBytes = 1024 * 1024
+
+// ExecOptions controls how RunExecCmdWithOptions forwards and captures
+// the output of a command.
+type ExecOptions struct {
+	// Stdout and Stderr receive the output of the command line by line
+	// while it is running. Nil means the stream is only captured.
+	Stdout, Stderr io.Writer
+
+	// Timestamps prefixes every forwarded line with the time it was read.
+	Timestamps bool
+
+	// TimeFormat is the layout used for Timestamps. Defaults to time.RFC3339.
+	TimeFormat string
+
+	// MaxCaptureBytes bounds the copy of each stream kept in the ExecResult.
+	// Defaults to DefaultMaxCaptureBytes.
+	MaxCaptureBytes int
+}
+
+// RunExecCmd runs the command and returns its captured stdout and stderr.
 func RunExecCmd(cmd *exec.Cmd) (*ExecResult, error) {
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
+	return RunExecCmdWithOptions(cmd, ExecOptions{})
+}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, err
+// RunExecCmdWithOptions runs the command, forwarding its output line by line
+// to opts.Stdout and opts.Stderr as it is produced, and returns a bounded copy
+// of each stream once the command exits.
+func RunExecCmdWithOptions(cmd *exec.Cmd, opts ExecOptions) (*ExecResult, error) {
+	max := opts.MaxCaptureBytes
+	if max <= 0 {
+		max = DefaultMaxCaptureBytes
 	}
 
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
+	stdoutBuf := &boundedBuffer{max: max}
+	stderrBuf := &boundedBuffer{max: max}
+	combinedBuf := &boundedBuffer{max: max}
 
-	combinedBuf := &bytes.Buffer{}
+	// Both forwarders may share the same destination, e.g. a terminal,
+	// so they share a lock to never interleave partial lines.
+	var mu sync.Mutex
 
-	stdout2 := io.TeeReader(stdout, combinedBuf)
-	stderr2 := io.TeeReader(stderr, combinedBuf)
+	var prefix func() string
+	if opts.Timestamps {
+		format := opts.TimeFormat
+		if format == "" {
+			format = time.RFC3339
+		}
+		prefix = func() string {
+			return time.Now().Format(format) + " "
+		}
+	}
 
-	stdoutBuf := &bytes.Buffer{}
-	stderrBuf := &bytes.Buffer{}
+	stdoutWriters := []io.Writer{stdoutBuf, combinedBuf}
+	stderrWriters := []io.Writer{stderrBuf, combinedBuf}
 
-	var wg sync.WaitGroup
+	var forwarders []*lineWriter
 
-	wg.Add(1)
-	go func() {
-		wg.Done()
+	if opts.Stdout != nil {
+		lw := &lineWriter{mu: &mu, dst: opts.Stdout, prefix: prefix}
+		forwarders = append(forwarders, lw)
+		stdoutWriters = append(stdoutWriters, lw)
+	}
 
-		io.Copy(stdoutBuf, stdout2)
-	}()
+	if opts.Stderr != nil {
+		lw := &lineWriter{mu: &mu, dst: opts.Stderr, prefix: prefix}
+		forwarders = append(forwarders, lw)
+		stderrWriters = append(stderrWriters, lw)
+	}
 
-	wg.Add(1)
-	go func() {
-		wg.Done()
+	// exec.Cmd copies both streams in its own goroutines and
+	// Wait does not return until those copies are complete.
+	cmd.Stdout = io.MultiWriter(stdoutWriters...)
+	cmd.Stderr = io.MultiWriter(stderrWriters...)
 
-		io.Copy(stderrBuf, stderr2)
-	}()
+	err := cmd.Run()
 
-	if err := cmd.Wait(); err != nil {
-		wg.Wait()
+	for _, f := range forwarders {
+		f.Flush()
+	}
 
+	if err != nil {
 		exitErr := &exec.ExitError{}
 
 		if errors.As(err, &exitErr) {
-			return nil, WrappedExitErr{ExitErr: exitErr, CombinedBuf: combinedBuf}
+			return nil, WrappedExitErr{ExitErr: exitErr, CombinedBuf: combinedBuf.Snapshot(), Stdout: stdoutBuf.Snapshot(), Stderr: stderrBuf.Snapshot()}
 		}
 
 		return nil, err
 	}
 
-	wg.Wait()
-
 	res := ExecResult{
-		Stdout: stdoutBuf,
-		Stderr: stderrBuf,
-		Err:    nil,
+		Stdout:         stdoutBuf.Snapshot(),
+		Stderr:         stderrBuf.Snapshot(),
+		Err:            nil,
+		StdoutStreamed: opts.Stdout != nil,
+		StderrStreamed: opts.Stderr != nil,
+		Truncated:      stdoutBuf.truncated || stderrBuf.truncated,
 	}
 
 	return &res, nil
 }
 
+// boundedBuffer keeps the last max bytes written to it, dropping the head of the output
+// so that the end of it, where errors are usually reported, is never lost.
+type boundedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(p) > b.max {
+		b.buf.Reset()
+		b.buf.Write(p[len(p)-b.max:])
+		b.truncated = true
+
+		return len(p), nil
+	}
+
+	if over := b.buf.Len() + len(p) - b.max; over > 0 {
+		b.buf.Next(over)
+		b.truncated = true
+	}
+
+	b.buf.Write(p)
+
+	return len(p), nil
+}
+
+func (b *boundedBuffer) Snapshot() *bytes.Buffer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return bytes.NewBuffer(append([]byte(nil), b.buf.Bytes()...))
+}
+
+// maxPartialLineBytes is the length a partial line is held back up to by a lineWriter.
+// A longer line, like a progress bar redrawn with carriage returns, is forwarded in chunks.
+const maxPartialLineBytes = 64 * 1024
+
+// lineWriter forwards complete lines to dst, holding back a trailing partial line
+// until it is terminated, it exceeds maxPartialLineBytes or Flush is called.
+type lineWriter struct {
+	mu     *sync.Mutex
+	dst    io.Writer
+	prefix func() string
+	buf    []byte
+
+	// midLine is true when the last forwarded chunk did not end its line,
+	// so that the rest of the line is not prefixed again.
+	midLine bool
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return 0, err
+		}
+
+		w.buf = w.buf[i+1:]
+	}
+
+	if len(w.buf) >= maxPartialLineBytes {
+		if err := w.writeLine(w.buf); err != nil {
+			return 0, err
+		}
+
+		w.buf = nil
+	}
+
+	return len(p), nil
+}
+
+func (w *lineWriter) Flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+
+	w.writeLine(w.buf)
+	w.buf = nil
+}
+
+func (w *lineWriter) writeLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.prefix != nil && !w.midLine {
+		if _, err := fmt.Fprint(w.dst, w.prefix()); err != nil {
+			return err
+		}
+	}
+
+	w.midLine = line[len(line)-1] != '\n'
+
+	_, err := w.dst.Write(line)
+
+	return err
+}
@@ -1,8 +1,11 @@
 package acc
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os/exec"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -22,3 +25,99 @@ func TestRunExecCmd(t *testing.T) {
 	}
 }
 
+func TestRunExecCmdWithOptions(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("bash", "-c", "echo foo; echo bar 1>&2; printf baz")
+
+	res, err := RunExecCmdWithOptions(cmd, ExecOptions{
+		Stdout:          &stdout,
+		Stderr:          &stderr,
+		Timestamps:      true,
+		TimeFormat:      "[ts]",
+		MaxCaptureBytes: 5,
+	})
+	if err != nil {
+		t.Fatalf("cmd: %v", err)
+	}
+
+	if want, got := "[ts] foo\n[ts] baz", stdout.String(); got != want {
+		t.Errorf("unexpected forwarded stdout: want %q, got %q", want, got)
+	}
+
+	if want, got := "[ts] bar\n", stderr.String(); got != want {
+		t.Errorf("unexpected forwarded stderr: want %q, got %q", want, got)
+	}
+
+	soBytes, err := ioutil.ReadAll(res.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "o\nbaz", string(soBytes); got != want {
+		t.Errorf("unexpected captured stdout: want %q, got %q", want, got)
+	}
+
+	if !res.StdoutStreamed || !res.StderrStreamed {
+		t.Error("expected the result to be marked as streamed")
+	}
+
+	if !res.Truncated {
+		t.Error("expected the result to be marked as truncated")
+	}
+}
+
+func TestCopyStreams(t *testing.T) {
+	cmd := exec.Command("bash", "-c", "echo foo; echo bar 1>&2")
+
+	target := &FakeRuntime{}
+
+	res, err := RunExecCmdWithOptions(cmd, ExecOptions{Stderr: target.GetStderr()})
+	if err != nil {
+		t.Fatalf("cmd: %v", err)
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+
+	copyStreams(target, *res, &stdoutBuf, &stderrBuf)
+
+	if want, got := "foo\n", target.Stdout.String(); got != want {
+		t.Errorf("unexpected forwarded stdout: want %q, got %q", want, got)
+	}
+
+	if want, got := "bar\n", target.Stderr.String(); got != want {
+		t.Errorf("unexpected forwarded stderr: want %q, got %q", want, got)
+	}
+
+	if want, got := "bar\n", stderrBuf.String(); got != want {
+		t.Errorf("unexpected captured stderr: want %q, got %q", want, got)
+	}
+}
+
+func TestLineWriterLongLine(t *testing.T) {
+	var dst bytes.Buffer
+
+	w := &lineWriter{mu: &sync.Mutex{}, dst: &dst, prefix: func() string { return "[ts] " }}
+
+	chunk := strings.Repeat("x", 1024)
+
+	for i := 0; i < 3*maxPartialLineBytes/len(chunk); i++ {
+		w.Write([]byte(chunk))
+
+		if len(w.buf) >= maxPartialLineBytes {
+			t.Fatalf("expected the partial line to be bounded, got %d bytes held back", len(w.buf))
+		}
+	}
+
+	if dst.Len() == 0 {
+		t.Error("expected the long line to be forwarded before it is terminated")
+	}
+
+	w.Write([]byte("\nnext"))
+	w.Flush()
+
+	want := "[ts] " + strings.Repeat("x", 3*maxPartialLineBytes) + "\n[ts] next"
+	if got := dst.String(); got != want {
+		t.Errorf("unexpected forwarded output: want %d bytes, got %d bytes", len(want), len(got))
+	}
+}
@@ -0,0 +1,344 @@
+package acc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces the values of secret inputs, and of the outputs derived from them,
+// in everything a task run writes.
+const Mask = "***"
+
+// minDerivedSecretLen is the length under which the outputs derived from secrets are not masked,
+// as masking values like "0" or "ok" would mangle everything else without hiding anything.
+const minDerivedSecretLen = 4
+
+// secrets are the values a task run masks, and the steps whose outputs are derived from secrets.
+type secrets struct {
+	inputs map[string]bool
+
+	mu       sync.RWMutex
+	values   []string
+	replacer *strings.Replacer
+	tainted  map[string]bool
+}
+
+// newSecrets returns the secrets of a run of the task with the inputs, or nil when the task
+// declares no secret inputs.
+func newSecrets(p *Task, inputs *mapInputs) *secrets {
+	if len(p.Secrets) == 0 {
+		return nil
+	}
+
+	s := &secrets{inputs: map[string]bool{}, tainted: map[string]bool{}}
+
+	for _, key := range p.Secrets {
+		s.inputs[key] = true
+
+		if inputs != nil {
+			s.add(inputs.m[key], 1)
+		}
+	}
+
+	return s
+}
+
+// add makes the value masked along with each of its lines, ignoring the ones shorter than min.
+func (s *secrets) add(v string, min int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+
+	for _, known := range s.values {
+		seen[known] = true
+	}
+
+	for _, c := range append([]string{v}, strings.Split(v, "\n")...) {
+		c = strings.TrimSpace(c)
+
+		if len(c) < min || seen[c] {
+			continue
+		}
+
+		seen[c] = true
+		s.values = append(s.values, c)
+	}
+
+	// Longer values go first so that a value containing another one is masked as a whole.
+	sort.SliceStable(s.values, func(i, j int) bool {
+		return len(s.values[i]) > len(s.values[j])
+	})
+
+	var oldnew []string
+
+	for _, known := range s.values {
+		oldnew = append(oldnew, known, Mask)
+	}
+
+	if len(oldnew) > 0 {
+		s.replacer = strings.NewReplacer(oldnew...)
+	}
+}
+
+// addOutputs makes the values of the outputs derived from secrets masked. The lines that
+// contain a secret are masked as they are, which keeps the rest of them readable.
+func (s *secrets) addOutputs(outputs map[string]string) {
+	for _, v := range outputs {
+		var lines []string
+
+		for _, l := range strings.Split(v, "\n") {
+			if s.mask(l) == l {
+				lines = append(lines, l)
+			}
+		}
+
+		s.add(strings.Join(lines, "\n"), minDerivedSecretLen)
+	}
+}
+
+func (s *secrets) mask(str string) string {
+	if s == nil {
+		return str
+	}
+
+	s.mu.RLock()
+	r := s.replacer
+	s.mu.RUnlock()
+
+	if r == nil {
+		return str
+	}
+
+	return r.Replace(str)
+}
+
+func (s *secrets) maskAll(strs []string) []string {
+	if s == nil {
+		return strs
+	}
+
+	masked := make([]string, len(strs))
+
+	for i, str := range strs {
+		masked[i] = s.mask(str)
+	}
+
+	return masked
+}
+
+func (s *secrets) maskOutputs(outputs map[string]string) map[string]string {
+	if s == nil || outputs == nil {
+		return outputs
+	}
+
+	masked := map[string]string{}
+
+	for k, v := range outputs {
+		masked[k] = s.mask(v)
+	}
+
+	return masked
+}
+
+func (s *secrets) maskState(state map[string]map[string]string) map[string]map[string]string {
+	if s == nil {
+		return state
+	}
+
+	masked := map[string]map[string]string{}
+
+	for step, outputs := range state {
+		masked[step] = s.maskOutputs(outputs)
+	}
+
+	return masked
+}
+
+// maskError returns err with the secrets masked in its message.
+func (s *secrets) maskError(err error) error {
+	if s == nil || err == nil {
+		return err
+	}
+
+	if msg := s.mask(err.Error()); msg != err.Error() {
+		return &maskedError{err: err, msg: msg}
+	}
+
+	return err
+}
+
+func (s *secrets) maskEvent(e Event) Event {
+	if s == nil {
+		return e
+	}
+
+	e.Command = s.mask(e.Command)
+	e.Line = s.mask(e.Line)
+	e.Error = s.mask(e.Error)
+	e.Outputs = s.maskOutputs(e.Outputs)
+
+	return e
+}
+
+// isInput reports whether the input is secret.
+func (s *secrets) isInput(key string) bool {
+	return s != nil && s.inputs[key]
+}
+
+// taint marks the outputs of the step as derived from secrets.
+func (s *secrets) taint(step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tainted[step] = true
+}
+
+// isTainted reports whether the outputs of the step were marked as derived from secrets.
+func (s *secrets) isTainted(step string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tainted[step]
+}
+
+// derived reports whether the outputs of the step are derived from secrets, because it refers
+// to a secret input or to the outputs of a step derived from secrets, marking it so.
+func (s *secrets) derived(step TaskStep) bool {
+	if s == nil {
+		return false
+	}
+
+	for _, ref := range stepRefs(step) {
+		if (ref.Job == "" && s.inputs[ref.Key]) || (ref.Job != "" && s.isTainted(ref.Job)) {
+			s.taint(step.Name)
+		}
+	}
+
+	return s.isTainted(step.Name)
+}
+
+// maskedError is an error whose message has the secrets masked.
+type maskedError struct {
+	err error
+	msg string
+}
+
+func (e *maskedError) Error() string {
+	return e.msg
+}
+
+func (e *maskedError) Unwrap() error {
+	return e.err
+}
+
+// maskingWriter writes the lines written to it to w with the secrets masked.
+// When held, it keeps the lines until flush, so that the outputs the step derives
+// from secrets are known by the time they are written.
+type maskingWriter struct {
+	w       io.Writer
+	secrets *secrets
+	hold    bool
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newMaskingWriter(w io.Writer, secrets *secrets, hold bool) *maskingWriter {
+	if w == nil {
+		w = ioutil.Discard
+	}
+
+	return &maskingWriter{w: w, secrets: secrets, hold: hold}
+}
+
+func (w *maskingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+
+	if w.hold {
+		return len(p), nil
+	}
+
+	i := bytes.LastIndexByte(w.buf.Bytes(), '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+
+	if _, err := io.WriteString(w.w, w.secrets.mask(string(w.buf.Next(i+1)))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// flush writes what is left, including the last line if it was not terminated by a newline.
+func (w *maskingWriter) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	s := w.buf.String()
+
+	w.buf.Reset()
+
+	_, err := io.WriteString(w.w, w.secrets.mask(s))
+
+	return err
+}
+
+// MarshalJSON marshals the result with the secrets masked in the outputs.
+func (r RunResult) MarshalJSON() ([]byte, error) {
+	type result RunResult
+
+	c := result(r)
+
+	c.Outputs = r.secrets.maskState(r.Outputs)
+
+	return json.Marshal(c)
+}
+
+// withSecrets returns the inputs of a run with the secrets, which tell the steps reading
+// secret inputs apart.
+func (m *mapInputs) withSecrets(s *secrets) *mapInputs {
+	var c *mapInputs
+
+	if m != nil {
+		c = NewInputs(m.m)
+	} else {
+		c = NewInputs(nil)
+	}
+
+	c.secrets = s
+
+	return c
+}
+
+// without returns the inputs other than the keys.
+func (m *mapInputs) without(keys []string) *mapInputs {
+	if m == nil {
+		return nil
+	}
+
+	c := NewInputs(m.m)
+
+	for _, k := range keys {
+		delete(c.m, k)
+	}
+
+	return c
+}
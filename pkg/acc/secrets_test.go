@@ -0,0 +1,190 @@
+package acc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const secretsTestToken = "s3cr3t-t0ken"
+
+func secretsTestTask() *Task {
+	var b TaskBuilder
+
+	b.Inputs.Def("name", nil)
+
+	b.Do("login", b.Cmd("sh", "-c", "echo logging in $NAME with $TOKEN; echo token=$TOKEN >&2").
+		WithEnv("NAME", b.Get("name")).
+		WithEnv("TOKEN", b.Secret("token")))
+
+	session := b.Do("session", Func{Name: "session", F: func(ctx TaskStepContext) error {
+		ctx.Set("id", strings.ToUpper(ctx.Get("token")))
+
+		return nil
+	}, Outputs: []string{"id"}})
+
+	b.Do("use", b.Cmd("sh", "-c", "echo using $SESSION; exit 1").WithEnv("SESSION", session.Get("id")))
+
+	return b.Build()
+}
+
+func TestSecretsMasked(t *testing.T) {
+	p := secretsTestTask()
+
+	if want, got := []string{"token"}, p.Secrets; !equalStrings(want, got) {
+		t.Fatalf("unexpected secrets: want %q, got %q", want, got)
+	}
+
+	var stdout, stderr, events bytes.Buffer
+
+	rec := &RecordingObserver{}
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	res, err := RunWithOptions(p, &Runtime{AllowByDefault: true, Stdout: &stdout, Stderr: &stderr},
+		NewInputs(map[string]string{"name": "alice", "token": secretsTestToken}),
+		RunOptions{Observers: []Observer{rec, &JSONLinesObserver{W: &events}}, Checkpoint: stateFile})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if want, got := "logging in alice with ***\nusing ***\n", stdout.String(); got != want {
+		t.Errorf("unexpected stdout: want %q, got %q", want, got)
+	}
+
+	if want, got := "token=***\n", stderr.String(); got != want {
+		t.Errorf("unexpected stderr: want %q, got %q", want, got)
+	}
+
+	rec.AssertOutput(t, "login", "stdout", "logging in alice with ***")
+	rec.AssertOutput(t, "use", "stdout", "using ***")
+
+	if e := rec.Finished("use"); e == nil || e.ExitCode != 1 {
+		t.Errorf("unexpected StepFinished event of use: %+v", e)
+	}
+
+	if want, got := strings.ToUpper(secretsTestToken), res.Outputs["session"]["id"]; got != want {
+		t.Errorf("unexpected output kept in memory: want %q, got %q", want, got)
+	}
+
+	bs, jerr := json.Marshal(res)
+	if jerr != nil {
+		t.Fatal(jerr)
+	}
+
+	state, serr := ioutil.ReadFile(stateFile)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+
+	for what, s := range map[string]string{
+		"error":      err.Error(),
+		"events":     events.String(),
+		"result":     string(bs),
+		"state file": string(state),
+	} {
+		if strings.Contains(s, secretsTestToken) || strings.Contains(s, strings.ToUpper(secretsTestToken)) {
+			t.Errorf("expected the secret to be masked in the %s, got:\n%s", what, s)
+		}
+	}
+
+	if !strings.Contains(err.Error(), "using ***") {
+		t.Errorf("expected the error to contain the masked output of the command, got %q", err.Error())
+	}
+
+	saved, lerr := LoadRunState(stateFile)
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+
+	if _, ok := saved.Inputs["token"]; ok {
+		t.Errorf("expected the secret input not to be saved, got %q", saved.Inputs)
+	}
+
+	if !saved.Steps["login"].SecretOutputs || !saved.Steps["session"].SecretOutputs {
+		t.Errorf("expected the outputs of login and session to be marked secret, got %+v", saved.Steps)
+	}
+}
+
+func TestSecretsResume(t *testing.T) {
+	p := secretsTestTask()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	inputs := NewInputs(map[string]string{"name": "alice", "token": secretsTestToken})
+
+	fake := &FakeRuntime{Responses: []FakeResponse{{Path: "sh", Args: []string{"-c", "echo using $SESSION; exit 1"}, ExitCode: 1}}}
+
+	if _, err := RunWithOptions(p, fake, inputs, RunOptions{Checkpoint: stateFile}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	fake = &FakeRuntime{}
+
+	res, err := ResumeWithInputs(p, fake, stateFile, NewInputs(map[string]string{"token": secretsTestToken}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []string{"login", "session", "use"}, res.Steps; !equalStrings(want, got) {
+		t.Errorf("unexpected steps: want %q, got %q", want, got)
+	}
+
+	if want, got := "alice", fake.Executions()[0].Command.Env["NAME"]; got != want {
+		t.Errorf("unexpected saved input: want %q, got %v", want, got)
+	}
+}
+
+func TestSecretsEmitted(t *testing.T) {
+	p := secretsTestTask()
+
+	var bash, gha, gitlab, makefile bytes.Buffer
+
+	WriteBashScript(p, NewInputs(map[string]string{"name": "alice", "token": secretsTestToken}), &bash)
+	WriteGitHubActionsWorkflow(p, "secrets", &gha)
+	WriteGitLabCI(p, &gitlab)
+	WriteMakefile(p, &makefile)
+
+	plan, err := PlanTask(p, NewInputs(map[string]string{"name": "alice", "token": secretsTestToken}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var planText bytes.Buffer
+
+	if err := plan.WriteText(&planText); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name, got string
+		want      []string
+	}{
+		{name: "bash", got: bash.String(), want: []string{`TOKEN="${TOKEN}"`}},
+		{name: "gha", got: gha.String(), want: []string{"    env:\n      TOKEN: ${{ secrets.TOKEN }}\n", `TOKEN="${TOKEN}"`}},
+		{name: "gitlab", got: gitlab.String(), want: []string{`TOKEN=\"${TOKEN}\"`}},
+		{name: "make", got: makefile.String(), want: []string{"export TOKEN\n", `TOKEN="$${TOKEN}"`}},
+		{name: "plan", got: planText.String(), want: []string{`TOKEN="${inputs.token}"`}},
+	} {
+		if strings.Contains(c.got, secretsTestToken) {
+			t.Errorf("%s: expected the secret not to be inlined, got:\n%s", c.name, c.got)
+		}
+
+		for _, want := range c.want {
+			if !strings.Contains(c.got, want) {
+				t.Errorf("%s: expected %q, got:\n%s", c.name, want, c.got)
+			}
+		}
+	}
+
+	if strings.Contains(gha.String(), "github.event.inputs.token") || !strings.Contains(gha.String(), "github.event.inputs.name") {
+		t.Errorf("expected only the non-secret inputs to be workflow inputs, got:\n%s", gha.String())
+	}
+
+	if strings.Contains(gitlab.String(), "  TOKEN:\n") {
+		t.Errorf("expected the secret not to be declared as a variable, got:\n%s", gitlab.String())
+	}
+}
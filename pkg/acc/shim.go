@@ -0,0 +1,279 @@
+package acc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// shimManifestName is the file written next to the shims in Runtime's bin directory.
+// A process whose executable sits next to it is a shim.
+const shimManifestName = "acc-shims.json"
+
+// shimManifest tells a shim where to forward its invocation to.
+type shimManifest struct {
+	// Socket is the path to the Unix domain socket the Runtime serves stubs on.
+	Socket string
+
+	// Commands maps the file name of each shim to the path of the stubbed command.
+	Commands map[string]string
+}
+
+// A shim is a copy of, or a hard link to, the executable that started the Runtime.
+// Any Go binary that imports this package turns into a shim when it finds the manifest
+// next to its executable, so stubs work the same within and outside of go test,
+// and without relying on a shell being installed.
+func init() {
+	if code, ok := runShim(); ok {
+		os.Exit(code)
+	}
+}
+
+func runShim() (int, bool) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, false
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(filepath.Dir(exe), shimManifestName))
+	if err != nil {
+		return 0, false
+	}
+
+	var manifest shimManifest
+
+	if err := json.Unmarshal(bs, &manifest); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: reading shim manifest: %v\n", LogPrefix, err)
+		return 1, true
+	}
+
+	name := filepath.Base(exe)
+
+	path, ok := manifest.Commands[name]
+	if !ok {
+		return 0, false
+	}
+
+	// The Runtime tells the exact path of the stubbed command when it runs the shim by itself,
+	// so that commands stubbed by absolute paths are matched as such.
+	if p := os.Getenv(InvocationEnv); p != "" && filepath.Base(p) == name {
+		path = p
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: getting working directory: %v\n", LogPrefix, err)
+		return 1, true
+	}
+
+	req := stubRequest{
+		Path: path,
+		Args: os.Args[1:],
+		Env:  unsetEnv(os.Environ(), InvocationEnv),
+		Dir:  wd,
+	}
+
+	code, err := callStub(manifest.Socket, req, os.Stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s: %v\n", LogPrefix, path, err)
+		return 1, true
+	}
+
+	return code, true
+}
+
+// callStub forwards the invocation to the Runtime listening on the socket,
+// streaming stdin to it and its output back until the stub exits.
+func callStub(socket string, req stubRequest, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return 0, fmt.Errorf("connecting to runtime: %v", err)
+	}
+	defer conn.Close()
+
+	fw := &frameWriter{w: conn}
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := fw.writeFrame(frameRequest, bs); err != nil {
+		return 0, fmt.Errorf("sending invocation: %v", err)
+	}
+
+	// The stub may exit without reading stdin, in which case this goroutine
+	// is left blocked on reading it until the shim process exits.
+	go func() {
+		if _, err := io.Copy(fw.streamWriter(frameStdin), stdin); err != nil {
+			return
+		}
+
+		fw.writeFrame(frameStdinEOF, nil)
+	}()
+
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return 0, fmt.Errorf("receiving result: %v", err)
+		}
+
+		switch typ {
+		case frameStdout:
+			stdout.Write(payload)
+		case frameStderr:
+			stderr.Write(payload)
+		case frameExit:
+			return exitCodeOf(payload)
+		default:
+			return 0, fmt.Errorf("unexpected frame type %d", typ)
+		}
+	}
+}
+
+// stubServer runs the stubs of a Runtime in the process that started it,
+// on behalf of the shims.
+type stubServer struct {
+	listener net.Listener
+	runtime  *Runtime
+
+	wg sync.WaitGroup
+}
+
+func (s *stubServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *stubServer) handle(conn net.Conn) {
+	typ, payload, err := readFrame(conn)
+	if err != nil || typ != frameRequest {
+		return
+	}
+
+	var req stubRequest
+
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	stdin, stdinWriter := io.Pipe()
+
+	// Closing the reader once the stub returns unblocks the copy below
+	// when the stub did not consume all of its stdin.
+	defer stdin.Close()
+
+	go func() {
+		for {
+			typ, payload, err := readFrame(conn)
+			if err != nil {
+				stdinWriter.CloseWithError(err)
+				return
+			}
+
+			switch typ {
+			case frameStdin:
+				if _, err := stdinWriter.Write(payload); err != nil {
+					return
+				}
+			case frameStdinEOF:
+				stdinWriter.Close()
+				return
+			default:
+				stdinWriter.CloseWithError(fmt.Errorf("unexpected frame type %d", typ))
+				return
+			}
+		}
+	}()
+
+	fw := &frameWriter{w: conn}
+
+	code := s.run(req, stdin, fw.streamWriter(frameStdout), fw.streamWriter(frameStderr))
+
+	fw.writeExit(code)
+}
+
+// run looks up the stub for the invocation and runs it, returning the exit code.
+func (s *stubServer) run(req stubRequest, stdin io.Reader, stdout, stderr io.Writer) (code int) {
+	ex := s.runtime.findExpected(req.Path, req.Args)
+	if ex == nil {
+		fmt.Fprintf(stderr, "Path %s args %v is not expected: %+v\n", req.Path, req.Args, s.runtime.ExecutionStubs)
+		return 1
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			if exit, ok := e.(stubExit); ok {
+				code = exit.code
+				return
+			}
+
+			fmt.Fprintf(stderr, "%s: stub for %s panicked: %v\n", LogPrefix, req.Path, e)
+			code = 2
+		}
+	}()
+
+	ex.Run(RunContext{
+		Path:   req.Path,
+		Args:   req.Args,
+		Stdout: stdout,
+		Stderr: stderr,
+		Stdin:  stdin,
+		Env:    req.Env,
+		Dir:    req.Dir,
+	})
+
+	return 0
+}
+
+func (s *stubServer) close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// stubExit is raised by RunContext.Exit to end a stub with the exit code.
+type stubExit struct {
+	code int
+}
+
+// writeShim places a copy of the current executable at path, preferring a hard link.
+func writeShim(exe, path string) error {
+	if err := os.Link(exe, path); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
@@ -0,0 +1,222 @@
+package acc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShim(t *testing.T) {
+	var invocations int
+
+	runtime := &Runtime{
+		Allowed: map[string]bool{
+			"bash": true,
+		},
+		ExecutionStubs: []ExecutionStub{
+			{
+				Command: Command{
+					Path: "/opt/bin/helm",
+					Args: []interface{}{"version"},
+				},
+				Run: func(ctx RunContext) {
+					invocations++
+					fmt.Fprintf(ctx.Stdout, "helm %d in %s\n", invocations, ctx.Dir)
+				},
+			},
+			{
+				Command: Command{
+					Path: "/opt/bin/helm",
+					Args: []interface{}{"fail"},
+				},
+				Run: func(ctx RunContext) {
+					fmt.Fprintln(ctx.Stderr, "failed")
+					ctx.Exit(3)
+				},
+			},
+		},
+	}
+
+	runtime.Start()
+	defer runtime.Stop()
+
+	execute := func(cmd Command, args ...string) string {
+		t.Helper()
+
+		res := runtime.Execute(cmd, args)
+
+		bs, err := ioutil.ReadAll(res.Stdout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(bs)
+	}
+
+	if want, got := "helm 1 in /\n", execute(Command{Path: "/opt/bin/helm", Dir: "/"}, "version"); got != want {
+		t.Errorf("unexpected output of direct invocation: want %q, got %q", want, got)
+	}
+
+	if want, got := "helm 2 in /\n", execute(Command{Path: "bash", Dir: "/"}, "-c", "helm version"); got != want {
+		t.Errorf("unexpected output of nested invocation: want %q, got %q", want, got)
+	}
+
+	if want, got := "failed\n3\n", execute(Command{Path: "bash"}, "-c", "helm fail 2>&1 || echo $?"); got != want {
+		t.Errorf("unexpected output of failed invocation: want %q, got %q", want, got)
+	}
+}
+
+func TestStatefulStubs(t *testing.T) {
+	var (
+		clusters []string
+		applied  []string
+	)
+
+	runtime := &Runtime{
+		Allowed: map[string]bool{
+			"bash": true,
+		},
+		ExecutionStubs: []ExecutionStub{
+			{
+				Command: Command{Path: "kind", Args: []interface{}{"create", "cluster", "--name", "test"}},
+				Run: func(ctx RunContext) {
+					clusters = append(clusters, "test")
+					fmt.Fprintln(ctx.Stderr, "Creating cluster \"test\" ...")
+				},
+			},
+			{
+				Command: Command{Path: "kind", Args: []interface{}{"get", "clusters"}},
+				Run: func(ctx RunContext) {
+					if len(clusters) == 0 {
+						fmt.Fprintln(ctx.Stderr, "No kind clusters found.")
+						return
+					}
+					for _, c := range clusters {
+						fmt.Fprintln(ctx.Stdout, c)
+					}
+				},
+			},
+			{
+				Command: Command{Path: "kubectl", Args: []interface{}{"apply", "-f", "-"}},
+				Run: func(ctx RunContext) {
+					bs, err := ioutil.ReadAll(ctx.Stdin)
+					if err != nil {
+						fmt.Fprintln(ctx.Stderr, err)
+						ctx.Exit(1)
+					}
+					applied = append(applied, string(bs))
+					fmt.Fprintln(ctx.Stdout, "namespace/test created")
+				},
+			},
+		},
+		Stdout: &bytes.Buffer{},
+		Stderr: &bytes.Buffer{},
+	}
+
+	Start(t, runtime)
+
+	var builder TaskBuilder
+
+	builder.Do("before", builder.Cmd("kind", "get", "clusters"))
+	builder.Do("create", builder.Cmd("kind", "create", "cluster", "--name", "test"))
+	after := builder.Do("after", builder.Cmd("bash", "-c", "kind get clusters"))
+	builder.Do("apply", builder.Cmd("kubectl", "apply", "-f", "-").WithStdin(after.Get("stdout")))
+
+	RunTask(builder.Build(), runtime, &mapInputs{})
+
+	if want, got := "namespace/test created\n", runtime.Stdout.(*bytes.Buffer).String(); !strings.HasSuffix(got, want) {
+		t.Errorf("unexpected stdout: want suffix %q, got %q", want, got)
+	}
+
+	if want, got := "No kind clusters found.\nCreating cluster \"test\" ...\n", runtime.Stderr.(*bytes.Buffer).String(); got != want {
+		t.Errorf("unexpected stderr: want %q, got %q", want, got)
+	}
+
+	if want, got := []string{"test\n"}, applied; !equalStrings(want, got) {
+		t.Errorf("unexpected applied manifests: want %q, got %q", want, got)
+	}
+}
+
+func TestPipedStubs(t *testing.T) {
+	runtime := &Runtime{
+		Allowed: map[string]bool{
+			"bash": true,
+		},
+		ExecutionStubs: []ExecutionStub{
+			{
+				Command: Command{Path: "kind", Args: []interface{}{"get", "kubeconfig"}},
+				Run: func(ctx RunContext) {
+					fmt.Fprintln(ctx.Stdout, "kind: Config")
+				},
+			},
+			{
+				Command: Command{Path: "kubectl", Args: []interface{}{"apply", "-f", "-"}},
+				Run: func(ctx RunContext) {
+					bs, err := ioutil.ReadAll(ctx.Stdin)
+					if err != nil {
+						fmt.Fprintln(ctx.Stderr, err)
+						ctx.Exit(1)
+					}
+					fmt.Fprintf(ctx.Stdout, "applied %s", bs)
+				},
+			},
+		},
+	}
+
+	runtime.Start()
+	defer runtime.Stop()
+
+	out := make(chan string, 1)
+
+	go func() {
+		// kubectl is run, and waits for its stdin, before kind writes to it.
+		res := runtime.Execute(Command{Path: "bash"}, []string{"-c", "(sleep 0.2; kind get kubeconfig) | kubectl apply -f -"})
+
+		bs, _ := ioutil.ReadAll(res.Stdout)
+
+		out <- string(bs)
+	}()
+
+	select {
+	case got := <-out:
+		if want := "applied kind: Config\n"; got != want {
+			t.Errorf("unexpected output: want %q, got %q", want, got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("piped stubs did not finish")
+	}
+}
+
+func TestStreamWriterSplitsFrames(t *testing.T) {
+	var buf bytes.Buffer
+
+	fw := &frameWriter{w: &buf}
+
+	payload := bytes.Repeat([]byte("x"), maxFramePayload+3)
+
+	if n, err := fw.streamWriter(frameStdout).Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("unexpected write: want %d bytes, got %d: %v", len(payload), n, err)
+	}
+
+	var sizes []int
+
+	for buf.Len() > 0 {
+		typ, p, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if typ != frameStdout {
+			t.Errorf("unexpected frame type: want %d, got %d", frameStdout, typ)
+		}
+
+		sizes = append(sizes, len(p))
+	}
+
+	if want, got := fmt.Sprint([]int{maxFramePayload, 3}), fmt.Sprint(sizes); want != got {
+		t.Errorf("unexpected frame sizes: want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,108 @@
+package sims
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mumoshu/golang-experiments/pkg/acc"
+)
+
+// parsedArgs are the args of a command split into positional args and flags.
+type parsedArgs struct {
+	positional []string
+	flags      map[string][]string
+}
+
+// parseArgs splits args into positional args and flags. valueFlags lists the flags,
+// with their leading dashes, that take a value either as the next arg or after "=".
+// Every other flag is a boolean flag.
+func parseArgs(args []string, valueFlags ...string) parsedArgs {
+	takesValue := map[string]bool{}
+
+	for _, f := range valueFlags {
+		takesValue[f] = true
+	}
+
+	res := parsedArgs{flags: map[string][]string{}}
+
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+
+		if a == "--" {
+			res.positional = append(res.positional, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			res.positional = append(res.positional, a)
+			continue
+		}
+
+		if kv := strings.SplitN(a, "=", 2); len(kv) == 2 {
+			res.flags[kv[0]] = append(res.flags[kv[0]], kv[1])
+			continue
+		}
+
+		if takesValue[a] && i+1 < len(args) {
+			res.flags[a] = append(res.flags[a], args[i+1])
+			i++
+			continue
+		}
+
+		res.flags[a] = append(res.flags[a], "true")
+	}
+
+	return res
+}
+
+// value returns the last value given to any of the flags, or def.
+func (p parsedArgs) value(def string, names ...string) string {
+	v := def
+
+	for _, a := range names {
+		if vs := p.flags[a]; len(vs) > 0 {
+			v = vs[len(vs)-1]
+		}
+	}
+
+	return v
+}
+
+// values returns all the values given to any of the flags.
+func (p parsedArgs) values(names ...string) []string {
+	var vs []string
+
+	for _, a := range names {
+		vs = append(vs, p.flags[a]...)
+	}
+
+	return vs
+}
+
+// has returns true when any of the flags is given.
+func (p parsedArgs) has(names ...string) bool {
+	for _, a := range names {
+		if vs, ok := p.flags[a]; ok && vs[len(vs)-1] != "false" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stub returns an ExecutionStub that simulates every invocation of the command at path.
+func stub(path string, run func(ctx acc.RunContext)) acc.ExecutionStub {
+	return acc.ExecutionStub{
+		Command: acc.Command{Path: path},
+		Run:     run,
+		Match: func(args []string) bool {
+			return true
+		},
+	}
+}
+
+// fail prints the message to the stderr of the simulated command and exits with 1.
+func fail(ctx acc.RunContext, format string, args ...interface{}) {
+	fmt.Fprintf(ctx.Stderr, format+"\n", args...)
+	ctx.Exit(1)
+}
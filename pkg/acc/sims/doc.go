@@ -0,0 +1,15 @@
+// Package sims provides stateful simulators of the command-line tools that tasks commonly run.
+//
+// Each simulator keeps the state a real tool would keep, like kind clusters,
+// objects applied with kubectl and helm releases, and plugs into acc.Runtime
+// via the stubs returned by its Stubs method:
+//
+//	kind := sims.NewKind()
+//	kubectl := sims.NewKubectl(kind)
+//	helm := sims.NewHelm(kubectl)
+//
+//	runtime := &acc.Runtime{}
+//	runtime.ExecutionStubs = append(runtime.ExecutionStubs, kind.Stubs()...)
+//	runtime.ExecutionStubs = append(runtime.ExecutionStubs, kubectl.Stubs()...)
+//	runtime.ExecutionStubs = append(runtime.ExecutionStubs, helm.Stubs()...)
+package sims
@@ -0,0 +1,354 @@
+package sims
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mumoshu/golang-experiments/pkg/acc"
+)
+
+// Release is a helm release tracked by the simulator.
+type Release struct {
+	Name      string
+	Namespace string
+	Chart     string
+	Revision  int
+	Status    string
+	Updated   time.Time
+
+	// Values are the values given with --set and the files given with --values, in order.
+	Values []string
+}
+
+// Helm simulates helm, tracking the releases it installs, upgrades and uninstalls.
+type Helm struct {
+	// Path is the path the simulated command is invoked with. Defaults to "helm".
+	Path string
+
+	// Kubectl, when set, receives the objects of the installed charts and
+	// makes helm fail like the real one when the cluster is unreachable.
+	Kubectl *Kubectl
+
+	// Charts maps chart references like "stable/nginx" or "../charts/foo" to the objects
+	// the chart renders. Objects without a namespace are put into the release namespace.
+	// References that are neither registered nor local chart directories fail to install.
+	Charts map[string][]Object
+
+	// Now returns the current time, used for release timestamps. Defaults to time.Now.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	releases map[string]*Release
+}
+
+// NewHelm returns a simulator of helm. kubectl can be nil when the installed objects are not of interest.
+func NewHelm(kubectl *Kubectl) *Helm {
+	return &Helm{Path: "helm", Kubectl: kubectl, Charts: map[string][]Object{}}
+}
+
+// Releases returns the releases in the current cluster, ordered by namespace and name.
+func (h *Helm) Releases() []Release {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	prefix := h.clusterID() + "/"
+
+	var rs []Release
+
+	for key, r := range h.releases {
+		if strings.HasPrefix(key, prefix) {
+			rs = append(rs, *r)
+		}
+	}
+
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Namespace != rs[j].Namespace {
+			return rs[i].Namespace < rs[j].Namespace
+		}
+		return rs[i].Name < rs[j].Name
+	})
+
+	return rs
+}
+
+// Stubs returns the stubs that simulate helm.
+func (h *Helm) Stubs() []acc.ExecutionStub {
+	path := h.Path
+	if path == "" {
+		path = "helm"
+	}
+
+	return []acc.ExecutionStub{stub(path, h.run)}
+}
+
+// releaseNameRegexp is the rule helm enforces on release names.
+var releaseNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+const clusterUnreachable = `Kubernetes cluster unreachable: Get "http://localhost:8080/version?timeout=32s": dial tcp 127.0.0.1:8080: connect: connection refused`
+
+// clusterID returns the identity of the cluster releases are stored in.
+func (h *Helm) clusterID() string {
+	if h.Kubectl == nil || h.Kubectl.Kind == nil {
+		return ""
+	}
+
+	id, _ := h.Kubectl.Kind.currentClusterID()
+
+	return id
+}
+
+func (h *Helm) now() time.Time {
+	if h.Now != nil {
+		return h.Now()
+	}
+
+	return time.Now()
+}
+
+func (h *Helm) run(ctx acc.RunContext) {
+	args := parseArgs(ctx.Args,
+		"-n", "--namespace", "--set", "--set-string", "-f", "--values", "--version",
+		"--timeout", "--kube-context", "--kubeconfig", "-o", "--output",
+	)
+
+	if len(args.positional) == 0 {
+		fail(ctx, "Error: no command given to helm")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.Kubectl != nil && h.Kubectl.Kind != nil {
+		if _, ok := h.Kubectl.Kind.currentClusterID(); !ok {
+			fail(ctx, "Error: %s", clusterUnreachable)
+		}
+	}
+
+	ns := args.value("default", "-n", "--namespace")
+
+	switch cmd := args.positional[0]; cmd {
+	case "install":
+		if len(args.positional) != 3 {
+			fail(ctx, "Error: INSTALLATION FAILED: \"helm install\" requires 2 arguments")
+		}
+
+		h.install(ctx, args, "INSTALLATION FAILED", args.positional[1], args.positional[2], ns, false)
+	case "upgrade":
+		if len(args.positional) != 3 {
+			fail(ctx, "Error: \"helm upgrade\" requires 2 arguments")
+		}
+
+		name, chart := args.positional[1], args.positional[2]
+
+		_, exists := h.releases[h.key(ns, name)]
+
+		switch {
+		case exists:
+			h.install(ctx, args, "UPGRADE FAILED", name, chart, ns, true)
+		case args.has("--install", "-i"):
+			fmt.Fprintf(ctx.Stdout, "Release %q does not exist. Installing it now.\n", name)
+			h.install(ctx, args, "INSTALLATION FAILED", name, chart, ns, false)
+		default:
+			fail(ctx, "Error: UPGRADE FAILED: %q has no deployed releases", name)
+		}
+	case "uninstall", "delete", "del", "un":
+		if len(args.positional) < 2 {
+			fail(ctx, "Error: \"helm uninstall\" requires at least 1 argument")
+		}
+
+		for _, name := range args.positional[1:] {
+			r, ok := h.releases[h.key(ns, name)]
+			if !ok {
+				fail(ctx, "Error: uninstall: Release not loaded: %s: release: not found", name)
+			}
+
+			h.removeObjects(r)
+
+			delete(h.releases, h.key(ns, name))
+
+			fmt.Fprintf(ctx.Stdout, "release %q uninstalled\n", name)
+		}
+	case "list", "ls":
+		h.list(ctx, ns, args.has("-A", "--all-namespaces"))
+	case "status":
+		if len(args.positional) != 2 {
+			fail(ctx, "Error: \"helm status\" requires 1 argument")
+		}
+
+		r, ok := h.releases[h.key(ns, args.positional[1])]
+		if !ok {
+			fail(ctx, "Error: release: not found")
+		}
+
+		printStatus(ctx, r)
+	default:
+		fail(ctx, "Error: unknown command %q for \"helm\"", cmd)
+	}
+}
+
+func (h *Helm) key(ns, name string) string {
+	return h.clusterID() + "/" + ns + "/" + name
+}
+
+func (h *Helm) install(ctx acc.RunContext, args parsedArgs, failure, name, chart, ns string, upgrade bool) {
+	if len(name) > 53 || !releaseNameRegexp.MatchString(name) {
+		fail(ctx, "Error: %s: release name %q: invalid release name, must match regex %s and the length must not be longer than 53", failure, name, releaseNameRegexp)
+	}
+
+	objs, ok := h.Charts[chart]
+	if !ok {
+		if !isLocalChart(ctx, chart) {
+			if strings.HasPrefix(chart, ".") || filepath.IsAbs(chart) {
+				fail(ctx, "Error: %s: path %q not found", failure, chart)
+			}
+
+			fail(ctx, "Error: %s: failed to download %q", failure, chart)
+		}
+	}
+
+	key := h.key(ns, name)
+
+	if !upgrade {
+		if _, exists := h.releases[key]; exists {
+			fail(ctx, "Error: %s: cannot re-use a name that is still in use", failure)
+		}
+	}
+
+	if err := h.applyObjects(ns, objs, args.has("--create-namespace")); err != nil {
+		fail(ctx, "Error: %s: %v", failure, err)
+	}
+
+	if h.releases == nil {
+		h.releases = map[string]*Release{}
+	}
+
+	r, ok := h.releases[key]
+	if !ok {
+		r = &Release{Name: name, Namespace: ns}
+		h.releases[key] = r
+	}
+
+	r.Chart = chart
+	r.Revision++
+	r.Status = "deployed"
+	r.Updated = h.now()
+	r.Values = append(args.values("--set", "--set-string"), args.values("-f", "--values")...)
+
+	if upgrade {
+		fmt.Fprintf(ctx.Stdout, "Release %q has been upgraded. Happy Helming!\n", name)
+	}
+
+	printStatus(ctx, r)
+}
+
+func isLocalChart(ctx acc.RunContext, chart string) bool {
+	path := chart
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(ctx.Dir, path)
+	}
+
+	_, err := os.Stat(filepath.Join(path, "Chart.yaml"))
+
+	return err == nil
+}
+
+// applyObjects puts the objects of a chart into the current cluster. The caller must hold h.mu.
+func (h *Helm) applyObjects(ns string, objs []Object, createNamespace bool) error {
+	if h.Kubectl == nil {
+		return nil
+	}
+
+	h.Kubectl.mu.Lock()
+	defer h.Kubectl.mu.Unlock()
+
+	s, ok := h.Kubectl.store()
+	if !ok {
+		return errors.New(clusterUnreachable)
+	}
+
+	if !s.namespaceExists(ns) {
+		if !createNamespace {
+			return fmt.Errorf("create: failed to create: namespaces %q not found", ns)
+		}
+
+		s.put("", Object{APIVersion: "v1", Kind: "Namespace", Name: ns}, h.Kubectl.now())
+	}
+
+	for _, o := range objs {
+		if o.Namespace == "" && o.namespaced() {
+			o.Namespace = ns
+		}
+
+		if _, err := s.put("", o, h.Kubectl.now()); err != nil {
+			return fmt.Errorf("failed to create resource: namespaces %q not found", o.Namespace)
+		}
+	}
+
+	return nil
+}
+
+// removeObjects deletes the objects of the release's chart from the current cluster. The caller must hold h.mu.
+func (h *Helm) removeObjects(r *Release) {
+	if h.Kubectl == nil {
+		return
+	}
+
+	h.Kubectl.mu.Lock()
+	defer h.Kubectl.mu.Unlock()
+
+	s, ok := h.Kubectl.store()
+	if !ok {
+		return
+	}
+
+	for _, o := range h.Charts[r.Chart] {
+		if o.Namespace == "" && o.namespaced() {
+			o.Namespace = r.Namespace
+		}
+
+		s.remove(keyOf(o))
+	}
+}
+
+func (h *Helm) list(ctx acc.RunContext, ns string, all bool) {
+	prefix := h.clusterID() + "/"
+
+	var keys []string
+
+	for key, r := range h.releases {
+		if strings.HasPrefix(key, prefix) && (all || r.Namespace == ns) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(ctx.Stdout, 0, 8, 1, '\t', 0)
+
+	fmt.Fprintln(w, "NAME\tNAMESPACE\tREVISION\tUPDATED\tSTATUS\tCHART")
+
+	for _, key := range keys {
+		r := h.releases[key]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", r.Name, r.Namespace, r.Revision, r.Updated.Format("2006-01-02 15:04:05.999999999 -0700 MST"), r.Status, r.Chart)
+	}
+
+	w.Flush()
+}
+
+func printStatus(ctx acc.RunContext, r *Release) {
+	fmt.Fprintf(ctx.Stdout, `NAME: %s
+LAST DEPLOYED: %s
+NAMESPACE: %s
+STATUS: %s
+REVISION: %d
+TEST SUITE: None
+`, r.Name, r.Updated.Format(time.ANSIC), r.Namespace, r.Status, r.Revision)
+}
@@ -0,0 +1,187 @@
+package sims
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mumoshu/golang-experiments/pkg/acc"
+)
+
+// DefaultKindNodeImage is the node image of clusters created without --image.
+const DefaultKindNodeImage = "kindest/node:v1.20.2"
+
+// Kind simulates kind, tracking the clusters it creates and deletes.
+type Kind struct {
+	// Path is the path the simulated command is invoked with. Defaults to "kind".
+	Path string
+
+	mu       sync.Mutex
+	clusters map[string]*kindCluster
+	current  string
+	created  int
+}
+
+type kindCluster struct {
+	name  string
+	image string
+
+	// id differs between clusters created with the same name, so that
+	// the state kept by other simulators does not survive a re-creation.
+	id string
+}
+
+// NewKind returns a simulator of kind with no clusters.
+func NewKind() *Kind {
+	return &Kind{Path: "kind"}
+}
+
+// Clusters returns the names of the existing clusters in alphabetical order.
+func (k *Kind) Clusters() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.clusterNames()
+}
+
+// CurrentCluster returns the name of the cluster kubectl is pointed at, or an empty string.
+func (k *Kind) CurrentCluster() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.current
+}
+
+// NodeImage returns the node image of the cluster, or an empty string if it does not exist.
+func (k *Kind) NodeImage(cluster string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if c, ok := k.clusters[cluster]; ok {
+		return c.image
+	}
+
+	return ""
+}
+
+// Stubs returns the stubs that simulate kind.
+func (k *Kind) Stubs() []acc.ExecutionStub {
+	path := k.Path
+	if path == "" {
+		path = "kind"
+	}
+
+	return []acc.ExecutionStub{stub(path, k.run)}
+}
+
+// currentClusterID returns the identity of the current cluster and true,
+// or false when kubectl would have no cluster to talk to.
+func (k *Kind) currentClusterID() (string, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	c, ok := k.clusters[k.current]
+	if !ok {
+		return "", false
+	}
+
+	return c.id, true
+}
+
+func (k *Kind) clusterNames() []string {
+	var names []string
+
+	for name := range k.clusters {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (k *Kind) run(ctx acc.RunContext) {
+	args := parseArgs(ctx.Args, "--name", "--image", "--config", "--kubeconfig", "--wait")
+
+	if len(args.positional) < 2 {
+		fail(ctx, "ERROR: unknown command %q for \"kind\"", fmt.Sprint(args.positional))
+	}
+
+	name := args.value("kind", "--name")
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	switch cmd := args.positional[0] + " " + args.positional[1]; cmd {
+	case "create cluster":
+		if _, ok := k.clusters[name]; ok {
+			fail(ctx, "ERROR: failed to create cluster: node(s) already exist for a cluster with the name %q", name)
+		}
+
+		image := args.value(DefaultKindNodeImage, "--image")
+
+		if k.clusters == nil {
+			k.clusters = map[string]*kindCluster{}
+		}
+
+		k.created++
+		k.clusters[name] = &kindCluster{name: name, image: image, id: fmt.Sprintf("%s@%d", name, k.created)}
+		k.current = name
+
+		fmt.Fprintf(ctx.Stderr, `Creating cluster %q ...
+ ✓ Ensuring node image (%s) 🖼
+ ✓ Preparing nodes 📦
+ ✓ Writing configuration 📜
+ ✓ Starting control-plane 🕹️
+ ✓ Installing CNI 🔌
+ ✓ Installing StorageClass 💾
+Set kubectl context to "kind-%s"
+You can now use your cluster with:
+
+kubectl cluster-info --context kind-%s
+
+Have a nice day! 👋
+`, name, image, name, name)
+	case "delete cluster":
+		// Like the real kind, deleting a missing cluster is not an error.
+		fmt.Fprintf(ctx.Stderr, "Deleting cluster %q ...\n", name)
+
+		delete(k.clusters, name)
+
+		if k.current == name {
+			k.current = ""
+		}
+	case "get clusters":
+		names := k.clusterNames()
+		if len(names) == 0 {
+			fmt.Fprintln(ctx.Stderr, "No kind clusters found.")
+			return
+		}
+
+		for _, n := range names {
+			fmt.Fprintln(ctx.Stdout, n)
+		}
+	case "get kubeconfig":
+		if _, ok := k.clusters[name]; !ok {
+			fail(ctx, "ERROR: could not locate any control plane nodes for cluster named %q. Use the --name option to select a different cluster", name)
+		}
+
+		fmt.Fprintf(ctx.Stdout, `apiVersion: v1
+kind: Config
+current-context: kind-%s
+clusters:
+- name: kind-%s
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: kind-%s
+  context:
+    cluster: kind-%s
+    user: kind-%s
+users:
+- name: kind-%s
+`, name, name, name, name, name, name)
+	default:
+		fail(ctx, "ERROR: unknown command %q for \"kind\"", cmd)
+	}
+}
@@ -0,0 +1,636 @@
+package sims
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mumoshu/golang-experiments/pkg/acc"
+)
+
+// Kubectl simulates kubectl against a fake object store with apply, get, delete, wait and create namespace.
+type Kubectl struct {
+	// Path is the path the simulated command is invoked with. Defaults to "kubectl".
+	Path string
+
+	// Kind, when set, makes kubectl talk to the current cluster of the simulated kind,
+	// failing like the real kubectl when there is none. Each cluster has its own objects.
+	Kind *Kind
+
+	// Now returns the current time, used to print object ages. Defaults to time.Now.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	stores map[string]*objectStore
+}
+
+type objectKey struct {
+	kind, namespace, name string
+}
+
+type storedObject struct {
+	Object
+
+	created time.Time
+}
+
+type objectStore struct {
+	objects map[objectKey]*storedObject
+}
+
+// NewKubectl returns a simulator of kubectl. kind can be nil for a single, always reachable cluster.
+func NewKubectl(kind *Kind) *Kubectl {
+	return &Kubectl{Path: "kubectl", Kind: kind}
+}
+
+// Objects returns the objects in the current cluster, ordered by kind, namespace and name.
+func (k *Kubectl) Objects() []Object {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, ok := k.store()
+	if !ok {
+		return nil
+	}
+
+	var objs []Object
+
+	for _, o := range s.sorted() {
+		objs = append(objs, o.Object)
+	}
+
+	return objs
+}
+
+// Get returns the object in the current cluster. namespace is ignored for cluster-scoped kinds.
+func (k *Kubectl) Get(kind, namespace, name string) (Object, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, ok := k.store()
+	if !ok {
+		return Object{}, false
+	}
+
+	o, ok := s.objects[keyOf(Object{Kind: kind, Namespace: namespace, Name: name})]
+	if !ok {
+		return Object{}, false
+	}
+
+	return o.Object, true
+}
+
+// Stubs returns the stubs that simulate kubectl.
+func (k *Kubectl) Stubs() []acc.ExecutionStub {
+	path := k.Path
+	if path == "" {
+		path = "kubectl"
+	}
+
+	return []acc.ExecutionStub{stub(path, k.run)}
+}
+
+const connectionRefused = "The connection to the server localhost:8080 was refused - did you specify the right host or port?"
+
+// store returns the objects of the current cluster, or false when it is unreachable.
+// The caller must hold k.mu.
+func (k *Kubectl) store() (*objectStore, bool) {
+	id := ""
+
+	if k.Kind != nil {
+		var ok bool
+
+		id, ok = k.Kind.currentClusterID()
+		if !ok {
+			return nil, false
+		}
+	}
+
+	if k.stores == nil {
+		k.stores = map[string]*objectStore{}
+	}
+
+	s, ok := k.stores[id]
+	if !ok {
+		s = &objectStore{objects: map[objectKey]*storedObject{}}
+
+		for _, ns := range []string{"default", "kube-node-lease", "kube-public", "kube-system"} {
+			s.objects[keyOf(Object{Kind: "Namespace", Name: ns})] = &storedObject{
+				Object: Object{APIVersion: "v1", Kind: "Namespace", Name: ns},
+			}
+		}
+
+		k.stores[id] = s
+	}
+
+	return s, true
+}
+
+func (k *Kubectl) now() time.Time {
+	if k.Now != nil {
+		return k.Now()
+	}
+
+	return time.Now()
+}
+
+func keyOf(o Object) objectKey {
+	if !o.namespaced() {
+		return objectKey{kind: o.Kind, name: o.Name}
+	}
+
+	ns := o.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+
+	return objectKey{kind: o.Kind, namespace: ns, name: o.Name}
+}
+
+func (s *objectStore) sorted() []*storedObject {
+	var objs []*storedObject
+
+	for _, o := range s.objects {
+		objs = append(objs, o)
+	}
+
+	sort.Slice(objs, func(i, j int) bool {
+		a, b := keyOf(objs[i].Object), keyOf(objs[j].Object)
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		return a.name < b.name
+	})
+
+	return objs
+}
+
+func (s *objectStore) namespaceExists(ns string) bool {
+	_, ok := s.objects[keyOf(Object{Kind: "Namespace", Name: ns})]
+
+	return ok
+}
+
+// put creates or updates the object and returns what kubectl apply prints for it.
+func (s *objectStore) put(source string, o Object, now time.Time) (string, error) {
+	if o.namespaced() {
+		if o.Namespace == "" {
+			o.Namespace = "default"
+		}
+
+		if !s.namespaceExists(o.Namespace) {
+			return "", fmt.Errorf("Error from server (NotFound): error when creating %q: namespaces %q not found", source, o.Namespace)
+		}
+	} else {
+		o.Namespace = ""
+	}
+
+	key := keyOf(o)
+
+	cur, ok := s.objects[key]
+	if !ok {
+		s.objects[key] = &storedObject{Object: o, created: now}
+		return "created", nil
+	}
+
+	if cur.Manifest == o.Manifest {
+		return "unchanged", nil
+	}
+
+	cur.Object = o
+
+	return "configured", nil
+}
+
+// remove deletes the object along with the objects in it when it is a namespace.
+func (s *objectStore) remove(key objectKey) {
+	delete(s.objects, key)
+
+	if key.kind != "Namespace" {
+		return
+	}
+
+	for k := range s.objects {
+		if k.namespace == key.name {
+			delete(s.objects, k)
+		}
+	}
+}
+
+// knownResources maps the resource names kubectl accepts to the kinds they refer to.
+var knownResources = map[string]Object{}
+
+func init() {
+	for _, r := range []struct {
+		names      []string
+		apiVersion string
+		kind       string
+	}{
+		{[]string{"po", "pod", "pods"}, "v1", "Pod"},
+		{[]string{"svc", "service", "services"}, "v1", "Service"},
+		{[]string{"cm", "configmap", "configmaps"}, "v1", "ConfigMap"},
+		{[]string{"secret", "secrets"}, "v1", "Secret"},
+		{[]string{"sa", "serviceaccount", "serviceaccounts"}, "v1", "ServiceAccount"},
+		{[]string{"ns", "namespace", "namespaces"}, "v1", "Namespace"},
+		{[]string{"deploy", "deployment", "deployments"}, "apps/v1", "Deployment"},
+		{[]string{"rs", "replicaset", "replicasets"}, "apps/v1", "ReplicaSet"},
+		{[]string{"sts", "statefulset", "statefulsets"}, "apps/v1", "StatefulSet"},
+		{[]string{"ds", "daemonset", "daemonsets"}, "apps/v1", "DaemonSet"},
+		{[]string{"crd", "crds", "customresourcedefinition", "customresourcedefinitions"}, "apiextensions.k8s.io/v1", "CustomResourceDefinition"},
+	} {
+		for _, n := range r.names {
+			knownResources[n] = Object{APIVersion: r.apiVersion, Kind: r.kind}
+		}
+	}
+}
+
+// resourceOf returns a template object for the resource name given to kubectl, like "deploy" or "runners.actions.summerwind.dev".
+func resourceOf(arg string) Object {
+	parts := strings.SplitN(strings.ToLower(arg), ".", 2)
+
+	if o, ok := knownResources[parts[0]]; ok {
+		return o
+	}
+
+	kind := strings.TrimSuffix(parts[0], "s")
+	if kind != "" {
+		kind = strings.ToUpper(kind[:1]) + kind[1:]
+	}
+
+	o := Object{APIVersion: "v1", Kind: kind}
+	if len(parts) == 2 {
+		o.APIVersion = parts[1] + "/v1"
+	}
+
+	return o
+}
+
+// matches returns true when the object is of the kind the resource name given to kubectl refers to.
+func matches(arg string, o Object) bool {
+	name := strings.ToLower(strings.SplitN(arg, ".", 2)[0])
+
+	if r, ok := knownResources[name]; ok {
+		return r.Kind == o.Kind
+	}
+
+	k := strings.ToLower(o.Kind)
+
+	return name == k || name == k+"s" || name == k+"es"
+}
+
+func (k *Kubectl) run(ctx acc.RunContext) {
+	args := parseArgs(ctx.Args,
+		"-n", "--namespace", "-f", "--filename", "-o", "--output", "--for", "--timeout",
+		"--context", "--kubeconfig", "-l", "--selector",
+	)
+
+	if len(args.positional) == 0 {
+		fail(ctx, "error: no command given to kubectl")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, ok := k.store()
+	if !ok {
+		fail(ctx, connectionRefused)
+	}
+
+	ns := args.value("default", "-n", "--namespace")
+
+	switch cmd := args.positional[0]; cmd {
+	case "apply":
+		k.apply(ctx, s, args, ns)
+	case "get":
+		k.get(ctx, s, args, ns)
+	case "delete":
+		k.delete(ctx, s, args, ns)
+	case "wait":
+		k.wait(ctx, s, args, ns)
+	case "create":
+		if len(args.positional) != 3 || resourceOf(args.positional[1]).Kind != "Namespace" {
+			fail(ctx, "error: only `kubectl create namespace NAME` is simulated")
+		}
+
+		name := args.positional[2]
+		if s.namespaceExists(name) {
+			fail(ctx, "Error from server (AlreadyExists): namespaces %q already exists", name)
+		}
+
+		s.put("", Object{APIVersion: "v1", Kind: "Namespace", Name: name}, k.now())
+
+		fmt.Fprintf(ctx.Stdout, "namespace/%s created\n", name)
+	default:
+		fail(ctx, "error: unknown command %q for \"kubectl\"", cmd)
+	}
+}
+
+// sourcedObject is an object read from a manifest along with the name of its source.
+type sourcedObject struct {
+	Object
+
+	source string
+}
+
+func (k *Kubectl) readManifests(ctx acc.RunContext, args parsedArgs, ns string) []sourcedObject {
+	files := args.values("-f", "--filename")
+	if len(files) == 0 {
+		fail(ctx, "error: must specify one of -f and -k")
+	}
+
+	var objs []sourcedObject
+
+	for _, f := range files {
+		for _, src := range k.sources(ctx, f) {
+			parsed, err := parseManifests(src.name, src.data)
+			if err != nil {
+				fail(ctx, "%v", err)
+			}
+
+			for _, o := range parsed {
+				if o.Namespace == "" && o.namespaced() {
+					o.Namespace = ns
+				}
+
+				objs = append(objs, sourcedObject{Object: o, source: src.name})
+			}
+		}
+	}
+
+	return objs
+}
+
+type manifestSource struct {
+	name, data string
+}
+
+// sources reads the manifests given to -f, which can be "-" for stdin, a file or a directory.
+func (k *Kubectl) sources(ctx acc.RunContext, f string) []manifestSource {
+	if f == "-" {
+		bs, err := ioutil.ReadAll(ctx.Stdin)
+		if err != nil {
+			fail(ctx, "error: reading stdin: %v", err)
+		}
+
+		return []manifestSource{{name: "STDIN", data: string(bs)}}
+	}
+
+	path := f
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(ctx.Dir, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		fail(ctx, "error: the path %q does not exist", f)
+	}
+
+	var paths []string
+
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			fail(ctx, "error: %v", err)
+		}
+
+		for _, e := range entries {
+			switch filepath.Ext(e.Name()) {
+			case ".yaml", ".yml", ".json":
+				paths = append(paths, filepath.Join(path, e.Name()))
+			}
+		}
+	} else {
+		paths = append(paths, path)
+	}
+
+	var srcs []manifestSource
+
+	for _, p := range paths {
+		bs, err := ioutil.ReadFile(p)
+		if err != nil {
+			fail(ctx, "error: %v", err)
+		}
+
+		name := p
+		if rel, err := filepath.Rel(ctx.Dir, p); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+
+		srcs = append(srcs, manifestSource{name: name, data: string(bs)})
+	}
+
+	return srcs
+}
+
+func (k *Kubectl) apply(ctx acc.RunContext, s *objectStore, args parsedArgs, ns string) {
+	for _, o := range k.readManifests(ctx, args, ns) {
+		result, err := s.put(o.source, o.Object, k.now())
+		if err != nil {
+			fail(ctx, "%v", err)
+		}
+
+		fmt.Fprintf(ctx.Stdout, "%s/%s %s\n", o.resource(), o.Name, result)
+	}
+}
+
+// targets returns the objects named by `TYPE NAME...` or `TYPE/NAME...` args, or all objects
+// of the type in the namespace when no name is given. Missing named objects are reported as errors.
+func (k *Kubectl) targets(ctx acc.RunContext, s *objectStore, positional []string, ns string, allNamespaces bool) ([]*storedObject, []string) {
+	type ref struct {
+		resource, name string
+	}
+
+	var refs []ref
+
+	if len(positional) > 0 && !strings.Contains(positional[0], "/") {
+		if len(positional) == 1 {
+			var objs []*storedObject
+
+			for _, o := range s.sorted() {
+				if matches(positional[0], o.Object) && (allNamespaces || !o.namespaced() || o.Namespace == ns) {
+					objs = append(objs, o)
+				}
+			}
+
+			return objs, nil
+		}
+
+		for _, name := range positional[1:] {
+			refs = append(refs, ref{positional[0], name})
+		}
+	} else {
+		for _, p := range positional {
+			kv := strings.SplitN(p, "/", 2)
+			if len(kv) != 2 {
+				fail(ctx, "error: there is no need to specify a resource type as a separate argument when passing arguments in resource/name form")
+			}
+
+			refs = append(refs, ref{kv[0], kv[1]})
+		}
+	}
+
+	var (
+		objs     []*storedObject
+		notFound []string
+	)
+
+	for _, r := range refs {
+		tmpl := resourceOf(r.resource)
+		tmpl.Name = r.name
+		tmpl.Namespace = ns
+
+		found := false
+
+		for _, o := range s.sorted() {
+			if matches(r.resource, o.Object) && o.Name == r.name && (!o.namespaced() || o.Namespace == ns) {
+				objs = append(objs, o)
+				found = true
+			}
+		}
+
+		if !found {
+			notFound = append(notFound, fmt.Sprintf("Error from server (NotFound): %s %q not found", tmpl.resources(), r.name))
+		}
+	}
+
+	return objs, notFound
+}
+
+func (k *Kubectl) get(ctx acc.RunContext, s *objectStore, args parsedArgs, ns string) {
+	if len(args.positional) < 2 {
+		fail(ctx, "You must specify the type of resource to get.")
+	}
+
+	all := args.has("-A", "--all-namespaces")
+
+	objs, notFound := k.targets(ctx, s, args.positional[1:], ns, all)
+
+	switch output := args.value("", "-o", "--output"); output {
+	case "name":
+		for _, o := range objs {
+			fmt.Fprintf(ctx.Stdout, "%s/%s\n", o.resource(), o.Name)
+		}
+	case "yaml", "json":
+		for _, o := range objs {
+			fmt.Fprint(ctx.Stdout, o.Manifest)
+		}
+	case "":
+		if len(objs) == 0 && len(notFound) == 0 {
+			if all {
+				fmt.Fprintln(ctx.Stderr, "No resources found")
+			} else {
+				fmt.Fprintf(ctx.Stderr, "No resources found in %s namespace.\n", ns)
+			}
+			return
+		}
+
+		if len(objs) > 0 {
+			w := tabwriter.NewWriter(ctx.Stdout, 0, 8, 3, ' ', 0)
+
+			if all {
+				fmt.Fprintln(w, "NAMESPACE\tNAME\tAGE")
+			} else {
+				fmt.Fprintln(w, "NAME\tAGE")
+			}
+
+			for _, o := range objs {
+				if all {
+					fmt.Fprintf(w, "%s\t", o.Namespace)
+				}
+				fmt.Fprintf(w, "%s\t%s\n", o.Name, age(k.now().Sub(o.created)))
+			}
+
+			w.Flush()
+		}
+	default:
+		fail(ctx, "error: unable to match a printer suitable for the output format %q", output)
+	}
+
+	if len(notFound) > 0 {
+		fail(ctx, "%s", strings.Join(notFound, "\n"))
+	}
+}
+
+func (k *Kubectl) delete(ctx acc.RunContext, s *objectStore, args parsedArgs, ns string) {
+	var (
+		objs     []*storedObject
+		notFound []string
+	)
+
+	if len(args.values("-f", "--filename")) > 0 {
+		for _, o := range k.readManifests(ctx, args, ns) {
+			if cur, ok := s.objects[keyOf(o.Object)]; ok {
+				objs = append(objs, cur)
+			} else {
+				notFound = append(notFound, fmt.Sprintf("Error from server (NotFound): error when deleting %q: %s %q not found", o.source, o.resources(), o.Name))
+			}
+		}
+	} else {
+		if len(args.positional) < 3 && (len(args.positional) < 2 || !strings.Contains(args.positional[1], "/")) {
+			fail(ctx, "error: resource(s) were provided, but no name was specified")
+		}
+
+		objs, notFound = k.targets(ctx, s, args.positional[1:], ns, false)
+	}
+
+	for _, o := range objs {
+		s.remove(keyOf(o.Object))
+
+		fmt.Fprintf(ctx.Stdout, "%s %q deleted\n", o.resource(), o.Name)
+	}
+
+	if len(notFound) > 0 && !args.has("--ignore-not-found") {
+		fail(ctx, "%s", strings.Join(notFound, "\n"))
+	}
+}
+
+func (k *Kubectl) wait(ctx acc.RunContext, s *objectStore, args parsedArgs, ns string) {
+	if len(args.positional) < 2 {
+		fail(ctx, "error: resource name may not be empty")
+	}
+
+	forDelete := args.value("", "--for") == "delete"
+
+	for _, p := range args.positional[1:] {
+		kv := strings.SplitN(p, "/", 2)
+		if len(kv) != 2 {
+			fail(ctx, "error: arguments in resource/name form must have a single resource and name")
+		}
+
+		tmpl := resourceOf(kv[0])
+		tmpl.Name = kv[1]
+
+		objs, _ := k.targets(ctx, s, []string{p}, ns, false)
+
+		switch {
+		case forDelete && len(objs) > 0:
+			fail(ctx, "error: timed out waiting for the condition on %s/%s", tmpl.resources(), tmpl.Name)
+		case !forDelete && len(objs) == 0:
+			fail(ctx, "Error from server (NotFound): %s %q not found", tmpl.resources(), tmpl.Name)
+		}
+
+		fmt.Fprintf(ctx.Stdout, "%s/%s condition met\n", tmpl.resource(), tmpl.Name)
+	}
+}
+
+func age(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,244 @@
+package sims
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Object is a Kubernetes object known to the simulators.
+type Object struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+
+	// Manifest is the document the object was applied from.
+	Manifest string
+}
+
+// group returns the API group of the object, which is empty for the core group.
+func (o Object) group() string {
+	if i := strings.Index(o.APIVersion, "/"); i >= 0 {
+		return o.APIVersion[:i]
+	}
+
+	return ""
+}
+
+// resource returns the singular resource name kubectl prints for the object, like "deployment.apps".
+func (o Object) resource() string {
+	r := strings.ToLower(o.Kind)
+
+	if g := o.group(); g != "" {
+		r += "." + g
+	}
+
+	return r
+}
+
+// resources returns the plural resource name kubectl prints in errors, like "deployments.apps".
+func (o Object) resources() string {
+	r := strings.ToLower(o.Kind)
+
+	if strings.HasSuffix(r, "s") {
+		r += "es"
+	} else {
+		r += "s"
+	}
+
+	if g := o.group(); g != "" {
+		r += "." + g
+	}
+
+	return r
+}
+
+// clusterScopedKinds are the kinds whose objects do not belong to a namespace.
+var clusterScopedKinds = map[string]bool{
+	"Namespace":                true,
+	"Node":                     true,
+	"PersistentVolume":         true,
+	"StorageClass":             true,
+	"ClusterRole":              true,
+	"ClusterRoleBinding":       true,
+	"CustomResourceDefinition": true,
+}
+
+func (o Object) namespaced() bool {
+	return !clusterScopedKinds[o.Kind]
+}
+
+// parseManifests parses the YAML or JSON documents in data. Only the fields
+// the simulators need are read, so that no YAML library is required.
+func parseManifests(source string, data string) ([]Object, error) {
+	var objs []Object
+
+	for _, doc := range splitDocuments(data) {
+		var (
+			obj Object
+			err error
+		)
+
+		if strings.HasPrefix(doc, "{") {
+			obj, err = parseJSONManifest(doc)
+		} else {
+			obj, err = parseYAMLManifest(doc)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error: error parsing %s: %v", source, err)
+		}
+
+		var missing []string
+
+		if obj.APIVersion == "" {
+			missing = append(missing, "apiVersion not set")
+		}
+
+		if obj.Kind == "" {
+			missing = append(missing, "kind not set")
+		}
+
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("error: error validating %q: error validating data: [%s]", source, strings.Join(missing, ", "))
+		}
+
+		if obj.Name == "" {
+			return nil, fmt.Errorf("error: error when retrieving current configuration of %q: resource name may not be empty", source)
+		}
+
+		obj.Manifest = doc
+
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
+
+func splitDocuments(data string) []string {
+	var (
+		docs []string
+		cur  []string
+	)
+
+	flush := func() {
+		doc := strings.TrimSpace(strings.Join(cur, "\n"))
+		if doc != "" {
+			docs = append(docs, doc+"\n")
+		}
+		cur = nil
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimRight(line, " \t\r") == "---" {
+			flush()
+			continue
+		}
+
+		cur = append(cur, line)
+	}
+
+	flush()
+
+	return docs
+}
+
+func parseJSONManifest(doc string) (Object, error) {
+	var m struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+	}
+
+	if err := json.Unmarshal([]byte(doc), &m); err != nil {
+		return Object{}, err
+	}
+
+	return Object{
+		APIVersion: m.APIVersion,
+		Kind:       m.Kind,
+		Name:       m.Metadata.Name,
+		Namespace:  m.Metadata.Namespace,
+	}, nil
+}
+
+func parseYAMLManifest(doc string) (Object, error) {
+	var (
+		obj Object
+
+		inMetadata     bool
+		metadataIndent = -1
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(doc))
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		indent := len(line) - len(trimmed)
+
+		key, value := splitYAMLField(trimmed)
+
+		if indent == 0 {
+			inMetadata = key == "metadata"
+
+			switch key {
+			case "apiVersion":
+				obj.APIVersion = value
+			case "kind":
+				obj.Kind = value
+			}
+
+			continue
+		}
+
+		if !inMetadata {
+			continue
+		}
+
+		if metadataIndent < 0 {
+			metadataIndent = indent
+		}
+
+		if indent != metadataIndent {
+			continue
+		}
+
+		switch key {
+		case "name":
+			obj.Name = value
+		case "namespace":
+			obj.Namespace = value
+		}
+	}
+
+	return obj, scanner.Err()
+}
+
+// splitYAMLField splits `key: value # comment` into the key and the unquoted value.
+func splitYAMLField(line string) (string, string) {
+	kv := strings.SplitN(line, ":", 2)
+	if len(kv) != 2 {
+		return "", ""
+	}
+
+	value := strings.TrimSpace(kv[1])
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+
+	value = strings.Trim(value, `"'`)
+
+	return strings.TrimSpace(kv[0]), value
+}
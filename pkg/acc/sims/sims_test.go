@@ -0,0 +1,244 @@
+package sims
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/golang-experiments/pkg/acc"
+)
+
+func startRuntime(t *testing.T, stubs ...acc.ExecutionStub) *acc.Runtime {
+	t.Helper()
+
+	runtime := &acc.Runtime{
+		Allowed: map[string]bool{
+			"bash": true,
+		},
+		ExecutionStubs: stubs,
+		Stdout:         &bytes.Buffer{},
+		Stderr:         &bytes.Buffer{},
+	}
+
+	runtime.Start()
+
+	t.Cleanup(runtime.Stop)
+
+	return runtime
+}
+
+// transcript runs the script with bash and returns its combined output.
+func transcript(t *testing.T, runtime *acc.Runtime, script string) string {
+	t.Helper()
+
+	res := runtime.Execute(acc.Command{Path: "bash"}, []string{"-c", "exec 2>&1; " + script})
+
+	bs, err := ioutil.ReadAll(res.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(bs)
+}
+
+func TestKind(t *testing.T) {
+	kind := NewKind()
+
+	runtime := startRuntime(t, kind.Stubs()...)
+
+	got := transcript(t, runtime, `
+kind get clusters
+kind create cluster --name a > /dev/null 2>&1
+kind create cluster --name b --image kindest/node:v1.19.7 > /dev/null 2>&1
+kind create cluster --name a || echo exit $?
+kind get clusters
+kind delete cluster --name a
+kind get clusters
+`)
+
+	want := `No kind clusters found.
+ERROR: failed to create cluster: node(s) already exist for a cluster with the name "a"
+exit 1
+a
+b
+Deleting cluster "a" ...
+b
+`
+
+	if got != want {
+		t.Errorf("unexpected transcript:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	if want, got := "kindest/node:v1.19.7", kind.NodeImage("b"); got != want {
+		t.Errorf("unexpected node image: want %q, got %q", want, got)
+	}
+
+	if want, got := "b", kind.CurrentCluster(); got != want {
+		t.Errorf("unexpected current cluster: want %q, got %q", want, got)
+	}
+}
+
+func TestKubectl(t *testing.T) {
+	kind := NewKind()
+	kubectl := NewKubectl(kind)
+
+	runtime := startRuntime(t, append(kind.Stubs(), kubectl.Stubs()...)...)
+
+	got := transcript(t, runtime, `
+kubectl get ns || echo exit $?
+kind create cluster > /dev/null 2>&1
+kubectl apply -f testdata/
+kubectl apply -f testdata/
+kubectl get runnerdeployments -o name
+printf 'apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: app\n' | kubectl apply -f - || echo exit $?
+kubectl create ns app
+printf 'apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: app\n' | kubectl apply -f -
+kubectl wait -n app deploy/web --for=condition=available
+kubectl wait -n app deploy/db || echo exit $?
+kubectl delete ns app
+kubectl get deploy -A
+kubectl wait -n app deploy/web --for=delete
+kind delete cluster > /dev/null 2>&1
+kind create cluster > /dev/null 2>&1
+kubectl get runnerdeployments
+`)
+
+	want := `The connection to the server localhost:8080 was refused - did you specify the right host or port?
+exit 1
+runnerdeployment.actions.summerwind.dev/example-runnerdeploy created
+runnerdeployment.actions.summerwind.dev/example-runnerdeploy unchanged
+runnerdeployment.actions.summerwind.dev/example-runnerdeploy
+Error from server (NotFound): error when creating "STDIN": namespaces "app" not found
+exit 1
+namespace/app created
+deployment.apps/web created
+deployment.apps/web condition met
+Error from server (NotFound): deployments.apps "db" not found
+exit 1
+namespace "app" deleted
+No resources found
+deployment.apps/web condition met
+No resources found in default namespace.
+`
+
+	if got != want {
+		t.Errorf("unexpected transcript:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestHelm(t *testing.T) {
+	kind := NewKind()
+	kubectl := NewKubectl(kind)
+	helm := NewHelm(kubectl)
+	helm.Charts["stable/nginx"] = []Object{
+		{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx"},
+	}
+
+	runtime := startRuntime(t, append(append(kind.Stubs(), kubectl.Stubs()...), helm.Stubs()...)...)
+
+	got := transcript(t, runtime, `
+pick() { while read -r l; do case $l in Release*|REVISION*) echo "$l";; esac; done; }
+helm list || echo exit $?
+kind create cluster > /dev/null 2>&1
+helm upgrade --install ../charts/foo stable/nginx || echo exit $?
+helm upgrade web stable/nginx || echo exit $?
+helm install web stable/unknown || echo exit $?
+helm upgrade --install web stable/nginx -n web || echo exit $?
+helm upgrade --install web stable/nginx -n web --create-namespace --set replicas=2 | pick
+helm upgrade --install web stable/nginx -n web | pick
+kubectl get deploy -n web -o name
+helm install web stable/nginx -n web || echo exit $?
+helm uninstall web -n web
+kubectl get deploy -n web
+`)
+
+	want := `Error: Kubernetes cluster unreachable: Get "http://localhost:8080/version?timeout=32s": dial tcp 127.0.0.1:8080: connect: connection refused
+exit 1
+Release "../charts/foo" does not exist. Installing it now.
+Error: INSTALLATION FAILED: release name "../charts/foo": invalid release name, must match regex ^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$ and the length must not be longer than 53
+exit 1
+Error: UPGRADE FAILED: "web" has no deployed releases
+exit 1
+Error: INSTALLATION FAILED: failed to download "stable/unknown"
+exit 1
+Release "web" does not exist. Installing it now.
+Error: INSTALLATION FAILED: create: failed to create: namespaces "web" not found
+exit 1
+Release "web" does not exist. Installing it now.
+REVISION: 1
+Release "web" has been upgraded. Happy Helming!
+REVISION: 2
+deployment.apps/nginx
+Error: INSTALLATION FAILED: cannot re-use a name that is still in use
+exit 1
+release "web" uninstalled
+No resources found in web namespace.
+`
+
+	if got != want {
+		t.Errorf("unexpected transcript:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	if rs := helm.Releases(); len(rs) != 0 {
+		t.Errorf("expected no releases, got %+v", rs)
+	}
+}
+
+func TestMyScript(t *testing.T) {
+	kind := NewKind()
+	kubectl := NewKubectl(kind)
+	helm := NewHelm(kubectl)
+
+	var commits [][]string
+
+	ghcp := acc.ExecutionStub{
+		Command: acc.Command{Path: "ghcp"},
+		Match: func(args []string) bool {
+			return true
+		},
+		Run: func(ctx acc.RunContext) {
+			commits = append(commits, ctx.Args)
+			fmt.Fprintln(ctx.Stdout, "created a commit")
+		},
+	}
+
+	stubs := append(append(kind.Stubs(), kubectl.Stubs()...), helm.Stubs()...)
+
+	runtime := startRuntime(t, append(stubs, ghcp)...)
+
+	var builder acc.TaskBuilder
+
+	builder.Inputs.Def("seed", nil)
+
+	acc.MyScript(&builder)
+
+	// MyScript passes the chart before the release name to helm upgrade, which helm rejects
+	// as an invalid release name. The cluster created before it must still be deleted.
+	res, err := acc.Run(builder.Build(), runtime, acc.NewInputs(map[string]string{"seed": "e2e"}))
+	if err == nil || !strings.Contains(err.Error(), `release name "../charts/actions-runner-controller": invalid release name`) {
+		t.Fatalf("expected helm to reject the release name, got %v", err)
+	}
+
+	if want, got := "deploy controller", res.Failed; want != got {
+		t.Errorf("unexpected failed step: want %q, got %q", want, got)
+	}
+
+	if want, got := []string{"stop cluster"}, res.Cleanup; !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected cleanup: want %v, got %v", want, got)
+	}
+
+	if got := kind.Clusters(); len(got) != 0 {
+		t.Errorf("expected the cluster to be deleted on cleanup, got %v", got)
+	}
+
+	if rs := helm.Releases(); len(rs) != 0 {
+		t.Errorf("expected no releases, got %+v", rs)
+	}
+
+	if len(commits) != 0 {
+		t.Errorf("expected no ghcp invocations, got %v", commits)
+	}
+}
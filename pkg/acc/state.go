@@ -0,0 +1,254 @@
+package acc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RunState is the saved state of a run.
+type RunState struct {
+	// Inputs are the inputs the run was given, other than the secret ones.
+	Inputs map[string]string `json:"inputs,omitempty"`
+
+	// Outputs are the outputs of the executed steps keyed by step name and output key.
+	Outputs map[string]map[string]string `json:"outputs"`
+
+	// Steps are the states of the steps and cleanup steps keyed by step name.
+	Steps map[string]StepState `json:"steps,omitempty"`
+
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
+
+// StepStatus is how a step ended.
+type StepStatus string
+
+const (
+	StepSucceeded StepStatus = "succeeded"
+	StepFailed    StepStatus = "failed"
+	StepSkipped   StepStatus = "skipped"
+)
+
+// StepState is the saved state of a step.
+type StepState struct {
+	Status     StepStatus `json:"status"`
+	StartedAt  time.Time  `json:"startedAt,omitempty"`
+	FinishedAt time.Time  `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	// SecretOutputs is true when the outputs of the step were derived from secrets,
+	// which are not saved.
+	SecretOutputs bool `json:"secretOutputs,omitempty"`
+}
+
+// LoadRunState reads the RunState saved as JSON at path.
+func LoadRunState(path string) (*RunState, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s RunState
+
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return nil, fmt.Errorf("parsing run state %s: %v", path, err)
+	}
+
+	return &s, nil
+}
+
+// Resume continues the run checkpointed at stateFile, like one that died before finishing,
+// with the inputs it was given. The steps that succeeded are skipped, their saved outputs
+// being used by the later steps, and the others are executed, followed by the cleanup steps.
+//
+// A run whose cleanup steps were executed cannot be resumed, as they have undone the steps,
+// unless they are the ones of sub-tasks executed once the steps of the sub-tasks finished.
+func Resume(p *Task, t Target, stateFile string) (*RunResult, error) {
+	return ResumeWithInputs(p, t, stateFile, nil)
+}
+
+// ResumeWithInputs is like Resume but gives the run the inputs that were not saved,
+// which are the secret ones. The steps whose outputs were derived from secrets are executed again,
+// as their outputs were not saved either.
+func ResumeWithInputs(p *Task, t Target, stateFile string, inputs *mapInputs) (*RunResult, error) {
+	return RunWithOptions(p, t, inputs, RunOptions{Checkpoint: stateFile, resume: true})
+}
+
+// resumeFrom returns the options and inputs that continue the run saved as s,
+// taking the inputs that were not saved from given.
+func (o RunOptions) resumeFrom(p *Task, s *RunState, given *mapInputs) (RunOptions, *mapInputs, error) {
+	for _, step := range p.Cleanup {
+		st := s.Steps[step.Name].Status
+		if st != StepSucceeded && st != StepFailed {
+			continue
+		}
+
+		// The cleanup steps of a sub-task whose steps all finished undid nothing the rest of the run needs.
+		if step.SubTask != "" && subTaskFinished(p, s, step.SubTask) {
+			o.SkipSteps = append(o.SkipSteps, step.Name)
+			continue
+		}
+
+		return o, nil, fmt.Errorf("the run saved at %s has already executed its cleanup step %q", o.Checkpoint, step.Name)
+	}
+
+	o.Outputs = s.Outputs
+
+	for _, step := range p.Steps {
+		if st := s.Steps[step.Name]; st.Status == StepSucceeded && !st.SecretOutputs {
+			o.SkipSteps = append(o.SkipSteps, step.Name)
+		}
+	}
+
+	inputs := NewInputs(s.Inputs)
+
+	if given != nil {
+		for k, v := range given.m {
+			if _, ok := inputs.m[k]; !ok {
+				inputs.m[k] = v
+			}
+		}
+	}
+
+	return o, inputs, nil
+}
+
+// checkpointer saves the state of a run after every step.
+type checkpointer struct {
+	path  string
+	state *RunState
+}
+
+func newCheckpointer(path string, inputs *mapInputs, resumed *RunState) *checkpointer {
+	state := resumed
+	if state == nil {
+		state = &RunState{}
+
+		if inputs != nil {
+			state.Inputs = inputs.m
+		}
+	}
+
+	if state.Outputs == nil {
+		state.Outputs = map[string]map[string]string{}
+	}
+
+	if state.Steps == nil {
+		state.Steps = map[string]StepState{}
+	}
+
+	return &checkpointer{path: path, state: state}
+}
+
+// record saves the state of the step and its outputs. A skipped step keeps the status
+// it had in the resumed run.
+func (c *checkpointer) record(name string, step StepState, outputs map[string]string) error {
+	if c == nil {
+		return nil
+	}
+
+	if step.Status != StepSkipped || c.state.Steps[name].Status == "" {
+		c.state.Steps[name] = step
+	}
+
+	if outputs != nil {
+		c.state.Outputs[name] = outputs
+	}
+
+	c.state.UpdatedAt = step.FinishedAt
+
+	return c.save()
+}
+
+// save writes the state to a temporary file and renames it over the state file,
+// so that the state file is complete even when the process dies while saving.
+func (c *checkpointer) save() error {
+	bs, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// subTaskFinished reports whether the saved run finished every step of the sub-task t,
+// by executing or skipping it.
+func subTaskFinished(p *Task, s *RunState, t string) bool {
+	for _, step := range p.Steps {
+		if !inSubTask(step.SubTask, t) {
+			continue
+		}
+
+		if st := s.Steps[step.Name].Status; st != StepSucceeded && st != StepSkipped {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lockStateFile locks the lock file of the state file, failing when another run holds it.
+// The lock is released by the returned func, or by the OS when the process dies, so that
+// the lock left behind by a dead run is simply taken over. The lock file is never removed,
+// as a run could otherwise lock a file removed by the run releasing it while another run
+// locks the new one. It holds the pid of the last run that locked it.
+func lockStateFile(path string) (func(), error) {
+	lock := path + ".lock"
+
+	f, err := os.OpenFile(lock, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := tryLockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if !locked {
+		bs, _ := ioutil.ReadAll(f)
+		f.Close()
+
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(bs)))
+
+		return nil, fmt.Errorf("state file %s is locked by another run (pid %d)", path, pid)
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
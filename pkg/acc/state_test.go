@@ -0,0 +1,193 @@
+package acc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	var b TaskBuilder
+
+	b.Inputs.Def("seed", nil)
+
+	create := b.Do("create", b.Cmd("kind", "create", "cluster", "--name", b.Get("seed")))
+	b.Do("install", b.Cmd("helm", "install", "web", "stable/nginx").WithEnv("KUBECONFIG", create.Get("stdout")))
+	b.Defer("delete", b.Cmd("kind", "delete", "cluster", "--name", b.Get("seed")))
+
+	task := b.Build()
+
+	first := &FakeRuntime{
+		Responses: []FakeResponse{
+			{Path: "kind", Stdout: "/tmp/kubeconfig"},
+		},
+	}
+
+	// The first run stops after creating the cluster, as if the process died.
+	if _, err := RunWithOptions(task, first, NewInputs(map[string]string{"seed": "e2e"}), RunOptions{
+		Checkpoint: stateFile,
+		ToStep:     "create",
+		SkipSteps:  []string{"delete"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	first.AssertPlan(t, "kind create cluster --name e2e")
+
+	saved, err := LoadRunState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "create=succeeded delete=skipped install=skipped", statuses(saved); got != want {
+		t.Errorf("unexpected statuses: want %q, got %q", want, got)
+	}
+
+	if want, got := "/tmp/kubeconfig", saved.Outputs["create"]["stdout"]; got != want {
+		t.Errorf("unexpected output: want %q, got %q", want, got)
+	}
+
+	if saved.Steps["create"].FinishedAt.Before(saved.Steps["create"].StartedAt) {
+		t.Errorf("unexpected timestamps: %+v", saved.Steps["create"])
+	}
+
+	second := &FakeRuntime{}
+
+	res, err := Resume(task, second, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second.AssertPlan(t,
+		`KUBECONFIG="/tmp/kubeconfig" helm install web stable/nginx`,
+		"kind delete cluster --name e2e",
+	)
+
+	if want, got := []string{"create"}, res.Skipped; !equalStrings(want, got) {
+		t.Errorf("unexpected skipped steps: want %v, got %v", want, got)
+	}
+
+	saved, err = LoadRunState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "create=succeeded delete=succeeded install=succeeded", statuses(saved); got != want {
+		t.Errorf("unexpected statuses: want %q, got %q", want, got)
+	}
+
+	_, err = Resume(task, &FakeRuntime{}, stateFile)
+	if err == nil || !strings.Contains(err.Error(), `has already executed its cleanup step "delete"`) {
+		t.Errorf("unexpected error resuming a finished run: %v", err)
+	}
+
+	unlock, err := lockStateFile(stateFile)
+	if err != nil {
+		t.Fatalf("expected the lock to be released, got %v", err)
+	}
+
+	unlock()
+}
+
+func TestCheckpointLock(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	var b TaskBuilder
+
+	b.Do("create", b.Cmd("kind", "create", "cluster"))
+
+	if err := ioutil.WriteFile(stateFile+".lock", []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is held by another run, as far as the OS is concerned.
+	held, err := os.OpenFile(stateFile+".lock", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if locked, err := tryLockFile(held); err != nil || !locked {
+		t.Fatalf("unexpected result of locking: %v, %v", locked, err)
+	}
+
+	_, err = RunWithOptions(b.Build(), &FakeRuntime{}, NewInputs(nil), RunOptions{Checkpoint: stateFile})
+	if want := fmt.Sprintf("state file %s is locked by another run (pid %d)", stateFile, os.Getpid()); err == nil || err.Error() != want {
+		t.Errorf("unexpected error: want %q, got %v", want, err)
+	}
+
+	held.Close()
+
+	// A lock left behind by a process that no longer exists is taken over.
+	if err := ioutil.WriteFile(stateFile+".lock", []byte("2147483646\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RunWithOptions(b.Build(), &FakeRuntime{}, NewInputs(nil), RunOptions{Checkpoint: stateFile}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckpointLockConcurrent(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	var (
+		wg            sync.WaitGroup
+		holders, held int32
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				unlock, err := lockStateFile(stateFile)
+				if err != nil {
+					continue
+				}
+
+				if n := atomic.AddInt32(&holders, 1); n > 1 {
+					t.Errorf("the lock is held by %d runs at once", n)
+				}
+
+				atomic.AddInt32(&held, 1)
+				atomic.AddInt32(&holders, -1)
+
+				unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if held == 0 {
+		t.Errorf("expected the lock to be taken at least once")
+	}
+}
+
+func statuses(s *RunState) string {
+	var names []string
+
+	for name := range s.Steps {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var kvs []string
+
+	for _, name := range names {
+		kvs = append(kvs, name+"="+string(s.Steps[name].Status))
+	}
+
+	return strings.Join(kvs, " ")
+}
@@ -0,0 +1,126 @@
+package acc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The shims and the Runtime talk over the socket in frames, each of which is
+// a one-byte type, a four-byte big-endian payload length and the payload.
+//
+// A shim sends a frameRequest and then streams its stdin as frameStdin frames
+// followed by a frameStdinEOF. The Runtime streams the output of the stub as
+// frameStdout and frameStderr frames and ends with a frameExit holding the exit code.
+const (
+	frameRequest byte = iota + 1
+	frameStdin
+	frameStdinEOF
+	frameStdout
+	frameStderr
+	frameExit
+)
+
+// maxFramePayload bounds the payload of a single frame so that a corrupted
+// length never makes the reader allocate an unbounded buffer.
+const maxFramePayload = 16 * 1024 * 1024
+
+// stubRequest is sent by a shim to the Runtime for each invocation.
+type stubRequest struct {
+	Path string
+	Args []string
+	Env  []string
+	Dir  string
+}
+
+// frameWriter writes frames to w. It is safe for concurrent use, so that
+// stdout and stderr can be streamed from different goroutines.
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (fw *frameWriter) writeFrame(typ byte, payload []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	var header [5]byte
+
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	if _, err := fw.w.Write(header[:]); err != nil {
+		return err
+	}
+
+	_, err := fw.w.Write(payload)
+
+	return err
+}
+
+func (fw *frameWriter) writeExit(code int) error {
+	var payload [4]byte
+
+	binary.BigEndian.PutUint32(payload[:], uint32(int32(code)))
+
+	return fw.writeFrame(frameExit, payload[:])
+}
+
+// streamWriter turns everything written to it into frames of the type, splitting
+// a write into as many frames as needed to stay within maxFramePayload.
+func (fw *frameWriter) streamWriter(typ byte) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		var n int
+
+		for n < len(p) {
+			chunk := p[n:]
+			if len(chunk) > maxFramePayload {
+				chunk = chunk[:maxFramePayload]
+			}
+
+			if err := fw.writeFrame(typ, chunk); err != nil {
+				return n, err
+			}
+
+			n += len(chunk)
+		}
+
+		return n, nil
+	})
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxFramePayload {
+		return 0, nil, fmt.Errorf("frame payload of %d bytes exceeds the limit", n)
+	}
+
+	payload := make([]byte, n)
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+func exitCodeOf(payload []byte) (int, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("malformed exit frame of %d bytes", len(payload))
+	}
+
+	return int(int32(binary.BigEndian.Uint32(payload))), nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,278 @@
+package acc
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// SubTask is a sub-task called with TaskScope.Call.
+type SubTask struct {
+	// Name is the namespaced name of the sub-task, like "setup/cluster" for the sub-task cluster
+	// called by the sub-task setup.
+	Name string
+
+	// Exports are the outputs the sub-task exports with TaskScope.Export.
+	Exports map[string]Ref
+}
+
+// Get returns the ref to the output the sub-task exports as key.
+func (t SubTask) Get(key string) Ref {
+	ref, ok := t.Exports[key]
+	if !ok {
+		f := getFrame(1)
+		msg := fmt.Sprintf("%s:%d: sub-task %q does not export %q", filepath.Base(f.File), f.Line, t.Name, key)
+		panic(msg)
+	}
+
+	return ref
+}
+
+var _ TaskScope = &subTaskScope{}
+
+// subTaskScope is the TaskScope of a sub-task, which defines its steps in the task being built
+// under names prefixed with the name of the sub-task.
+type subTaskScope struct {
+	root *TaskBuilder
+
+	// name is the namespaced name of the sub-task.
+	name string
+
+	// inputs are the inputs of the sub-task mapped to the refs of the task being built.
+	inputs map[string]Ref
+
+	exports map[string]Ref
+}
+
+// call defines the steps of the sub-task called by the sub-task parent, or by the task itself
+// when parent is empty, in the task being built.
+func (p *TaskBuilder) call(parent, name string, define func(TaskScope), inputs map[string]Ref) SubTask {
+	if name == "" || strings.Contains(name, "/") {
+		f := getFrame(2)
+		panic(fmt.Sprintf("%s:%d: invalid sub-task name %q: it must be non-empty and contain no \"/\"", filepath.Base(f.File), f.Line, name))
+	}
+
+	if parent != "" {
+		name = parent + "/" + name
+	}
+
+	s := &subTaskScope{root: p, name: name, inputs: map[string]Ref{}, exports: map[string]Ref{}}
+
+	for k, ref := range inputs {
+		s.inputs[k] = ref
+	}
+
+	define(s)
+
+	return SubTask{Name: name, Exports: s.exports}
+}
+
+func (s *subTaskScope) Do(name string, task TaskStepRun, opts ...StepOption) TaskStep {
+	opts = append(opts, func(j *TaskStep) {
+		j.SubTask = s.name
+	})
+
+	return s.root.Do(s.stepName(name), s.task(task), opts...)
+}
+
+func (s *subTaskScope) Defer(name string, task TaskStepRun) {
+	s.root.Defer(s.stepName(name), s.task(task))
+	s.root.cleanupJobs[len(s.root.cleanupJobs)-1].SubTask = s.name
+}
+
+func (s *subTaskScope) Get(key string) Ref {
+	ref, ok := s.inputs[key]
+	if !ok {
+		f := getFrame(1)
+		msg := fmt.Sprintf("%s:%d: sub-task %q has no input %q mapped", filepath.Base(f.File), f.Line, s.name, key)
+		panic(msg)
+	}
+
+	return ref
+}
+
+// Secret declares the task input the input of the sub-task is mapped to as secret.
+func (s *subTaskScope) Secret(key string) Ref {
+	ref, ok := s.inputs[key]
+	if !ok {
+		f := getFrame(1)
+		msg := fmt.Sprintf("%s:%d: sub-task %q has no input %q mapped", filepath.Base(f.File), f.Line, s.name, key)
+		panic(msg)
+	}
+
+	if ref.Job == "" {
+		s.root.Inputs.DefSecret(ref.Key)
+	}
+
+	return ref
+}
+
+func (s *subTaskScope) Cmd(path string, args ...interface{}) Command {
+	return s.root.Cmd(path, args...)
+}
+
+func (s *subTaskScope) Call(name string, define func(TaskScope), inputs map[string]Ref) SubTask {
+	return s.root.call(s.name, name, define, inputs)
+}
+
+func (s *subTaskScope) When(cond Cond, define func(TaskScope)) {
+	s.root.when(cond, func() {
+		define(s)
+	})
+}
+
+func (s *subTaskScope) Export(key string, ref Ref) {
+	s.exports[key] = ref
+}
+
+func (s *subTaskScope) stepName(name string) string {
+	return s.name + "/" + name
+}
+
+// task returns the func namespaced like the steps of the sub-task, reading the inputs of the
+// sub-task from the refs they are mapped to. The inputs of the func that are not mapped are dropped,
+// which leaves them not given to a TypedFunc. Commands need no change, as the refs they hold
+// are the ones returned by Get.
+func (s *subTaskScope) task(task TaskStepRun) TaskStepRun {
+	impl, ok := task.(Func)
+	if !ok {
+		return task
+	}
+
+	var refs []Ref
+
+	for _, ref := range impl.Inputs {
+		if ref.Job == "" {
+			mapped, ok := s.inputs[ref.Key]
+			if !ok {
+				continue
+			}
+
+			ref = mapped
+		}
+
+		refs = append(refs, ref)
+	}
+
+	f := impl.F
+
+	impl.Name = s.stepName(impl.Name)
+	impl.Inputs = refs
+	impl.F = func(ctx TaskStepContext) error {
+		return f(&subTaskStepContext{TaskStepContext: ctx, scope: s})
+	}
+
+	return impl
+}
+
+// subTaskStepContext is the TaskStepContext of a func step of a sub-task.
+type subTaskStepContext struct {
+	TaskStepContext
+
+	scope *subTaskScope
+}
+
+// Get returns the value of the ref the input of the sub-task is mapped to.
+func (c *subTaskStepContext) Get(key string) string {
+	ref, ok := c.scope.inputs[key]
+	if !ok {
+		panic(fmt.Errorf("sub-task %q has no input %q mapped", c.scope.name, key))
+	}
+
+	if ref.Job == "" {
+		return c.TaskStepContext.Get(ref.Key)
+	}
+
+	return c.TaskStepContext.Output(ref)
+}
+
+// Stdout returns the stdout of the command step of the sub-task.
+func (c *subTaskStepContext) Stdout(step string) string {
+	return c.TaskStepContext.Stdout(c.scope.stepName(step))
+}
+
+// Stderr returns the stderr of the command step of the sub-task.
+func (c *subTaskStepContext) Stderr(step string) string {
+	return c.TaskStepContext.Stderr(c.scope.stepName(step))
+}
+
+// parentSubTask returns the sub-task calling the sub-task, or "" when the task itself calls it.
+func parentSubTask(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+
+	return ""
+}
+
+// enteredSubTasks returns the sub-tasks the step is in but the step before it is not, outermost first.
+func enteredSubTasks(prev, next string) []string {
+	var entered []string
+
+	for t := next; t != "" && !inSubTask(prev, t); t = parentSubTask(t) {
+		entered = append([]string{t}, entered...)
+	}
+
+	return entered
+}
+
+// exitedSubTasks returns the sub-tasks the step is in but the step after it is not, innermost first.
+func exitedSubTasks(prev, next string) []string {
+	var exited []string
+
+	for t := prev; t != "" && !inSubTask(next, t); t = parentSubTask(t) {
+		exited = append(exited, t)
+	}
+
+	return exited
+}
+
+// cleanupOrder returns the cleanup steps in the order a run of the task that succeeds executes them:
+// the ones of each sub-task once its steps finish, followed by the rest in reverse order.
+func cleanupOrder(p *Task) []TaskStep {
+	var (
+		order []TaskStep
+		done  = map[string]bool{}
+	)
+
+	for i, s := range p.Steps {
+		var next string
+		if i < len(p.Steps)-1 {
+			next = p.Steps[i+1].SubTask
+		}
+
+		for _, t := range exitedSubTasks(s.SubTask, next) {
+			for _, c := range subTaskCleanup(p, t) {
+				order = append(order, c)
+				done[c.Name] = true
+			}
+		}
+	}
+
+	for i := len(p.Cleanup) - 1; i >= 0; i-- {
+		if !done[p.Cleanup[i].Name] {
+			order = append(order, p.Cleanup[i])
+		}
+	}
+
+	return order
+}
+
+// subTaskCleanup returns the cleanup steps the sub-task defines itself, in the order they are run.
+func subTaskCleanup(p *Task, t string) []TaskStep {
+	var cleanup []TaskStep
+
+	for i := len(p.Cleanup) - 1; i >= 0; i-- {
+		if p.Cleanup[i].SubTask == t {
+			cleanup = append(cleanup, p.Cleanup[i])
+		}
+	}
+
+	return cleanup
+}
+
+// inSubTask reports whether the step in the sub-task sub is in the sub-task t,
+// directly or via the sub-tasks t calls.
+func inSubTask(sub, t string) bool {
+	return sub == t || strings.HasPrefix(sub, t+"/")
+}
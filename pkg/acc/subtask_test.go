@@ -0,0 +1,264 @@
+package acc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func subTaskTestCluster(s TaskScope) {
+	s.Defer("stop cluster", s.Cmd("kind", "delete", "cluster", "--name", s.Get("name")))
+
+	s.Do("start cluster", s.Cmd("kind", "create", "cluster", "--name", s.Get("name")))
+
+	kubeconfig := s.Do("kubeconfig", Func{Name: "kubeconfig", F: func(ctx TaskStepContext) error {
+		ctx.Set("path", ctx.Get("name")+".kubeconfig")
+
+		return nil
+	}, Outputs: []string{"path"}})
+
+	s.Export("kubeconfig", kubeconfig.Get("path"))
+}
+
+func subTaskTestSetup(s TaskScope) {
+	cluster := s.Call("cluster", subTaskTestCluster, map[string]Ref{"name": s.Get("seed")})
+
+	s.Do("deploy controller", s.Cmd("helm", "upgrade", "--install", "controller", "--kubeconfig", cluster.Get("kubeconfig")))
+
+	s.Export("kubeconfig", cluster.Get("kubeconfig"))
+}
+
+func subTaskTestTask() *Task {
+	var b TaskBuilder
+
+	b.Inputs.Def("seed", nil)
+
+	b.Defer("report", b.Cmd("echo", "done"))
+
+	setup := b.Call("setup", subTaskTestSetup, map[string]Ref{"seed": b.Get("seed")})
+
+	b.Do("test", b.Cmd("kubectl", "--kubeconfig", setup.Get("kubeconfig"), "get", "pods"))
+
+	return b.Build()
+}
+
+func TestSubTask(t *testing.T) {
+	p := subTaskTestTask()
+
+	if errs := ValidateTask(p); len(errs) > 0 {
+		t.Fatalf("unexpected validation errors: %v", errs)
+	}
+
+	var names, subTasks []string
+
+	for _, s := range p.Steps {
+		names = append(names, s.Name)
+		subTasks = append(subTasks, s.SubTask)
+	}
+
+	if want, got := []string{"setup/cluster/start cluster", "setup/cluster/kubeconfig", "setup/deploy controller", "test"}, names; !equalStrings(want, got) {
+		t.Errorf("unexpected steps: want %q, got %q", want, got)
+	}
+
+	if want, got := []string{"setup/cluster", "setup/cluster", "setup", ""}, subTasks; !equalStrings(want, got) {
+		t.Errorf("unexpected sub-tasks: want %q, got %q", want, got)
+	}
+
+	fake := &FakeRuntime{}
+
+	res, err := Run(p, fake, NewInputs(map[string]string{"seed": "e2e"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.AssertPlan(t,
+		"kind create cluster --name e2e",
+		"kind delete cluster --name e2e",
+		"helm upgrade --install controller --kubeconfig e2e.kubeconfig",
+		"kubectl --kubeconfig e2e.kubeconfig get pods",
+		"echo done",
+	)
+
+	if want, got := []string{"setup/cluster/stop cluster", "report"}, res.Cleanup; !equalStrings(want, got) {
+		t.Errorf("unexpected cleanup: want %q, got %q", want, got)
+	}
+}
+
+func TestSubTaskRendered(t *testing.T) {
+	p := subTaskTestTask()
+
+	var bash, mermaid bytes.Buffer
+
+	WriteBashScript(p, NewInputs(map[string]string{"seed": "e2e"}), &bash)
+	WriteMermaid(p, &mermaid)
+
+	for _, c := range []struct {
+		name, got, want string
+	}{
+		{name: "bash", got: bash.String(), want: "# sub-task setup\n# sub-task setup/cluster\nkind create cluster --name e2e\n"},
+		{name: "bash", got: bash.String(), want: "SETUP_CLUSTER_KUBECONFIG_PATH"},
+		{name: "mermaid", got: mermaid.String(), want: "  subgraph subtask_0[\"setup\"]\n    step_2[\"setup/deploy controller\"]\n    subgraph subtask_1[\"setup/cluster\"]\n"},
+	} {
+		if !strings.Contains(c.got, c.want) {
+			t.Errorf("%s: expected %q, got:\n%s", c.name, c.want, c.got)
+		}
+	}
+}
+
+func TestSubTaskInvalid(t *testing.T) {
+	var b TaskBuilder
+
+	b.Inputs.Def("seed", nil)
+
+	b.Call("setup", subTaskTestSetup, map[string]Ref{"seed": b.Get("seed")})
+	b.Do("setup/cluster", b.Cmd("echo"))
+	b.Do("setup/deploy", b.Cmd("echo"))
+
+	var errs []string
+
+	for _, err := range ValidateTask(b.Build()) {
+		errs = append(errs, err.Error())
+	}
+
+	if want, got := []string{
+		`step "setup/cluster" has the name of a sub-task`,
+		`step "setup/cluster" is named like a step of sub-task "setup" but is not defined in it`,
+		`step "setup/deploy" is named like a step of sub-task "setup" but is not defined in it`,
+	}, errs; !equalStrings(want, got) {
+		t.Errorf("unexpected errors: want %q, got %q", want, got)
+	}
+
+	for name, define := range map[string]func(TaskScope){
+		"unmapped input":  subTaskTestSetup,
+		"invalid name":    func(s TaskScope) { s.Call("a/b", subTaskTestCluster, nil) },
+		"unknown export":  func(s TaskScope) { s.Call("cluster", func(TaskScope) {}, nil).Get("kubeconfig") },
+		"unmapped secret": func(s TaskScope) { s.Secret("token") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+
+			var b TaskBuilder
+
+			b.Call("setup", define, nil)
+		}()
+	}
+}
+
+func subTaskCleanupTestTask() *Task {
+	var b TaskBuilder
+
+	b.Defer("undo", b.Cmd("echo", "undo"))
+
+	b.Call("setup", func(s TaskScope) {
+		s.Defer("remove config", s.Cmd("rm", "kind.yaml"))
+
+		s.Do("write config", s.Cmd("touch", "kind.yaml"))
+		s.Do("create cluster", s.Cmd("kind", "create", "cluster", "--config", "kind.yaml"))
+	}, nil)
+
+	b.Do("test", b.Cmd("go", "test"))
+
+	return b.Build()
+}
+
+func TestSubTaskCleanup(t *testing.T) {
+	p := subTaskCleanupTestTask()
+
+	for _, c := range []struct {
+		name      string
+		responses []FakeResponse
+		plan      []string
+	}{
+		{
+			name: "success",
+			plan: []string{"touch kind.yaml", "kind create cluster --config kind.yaml", "rm kind.yaml", "go test", "echo undo"},
+		},
+		{
+			name:      "failure after the sub-task",
+			responses: []FakeResponse{{Path: "go", ExitCode: 1}},
+			plan:      []string{"touch kind.yaml", "kind create cluster --config kind.yaml", "rm kind.yaml", "go test", "echo undo"},
+		},
+		{
+			name:      "failure in the sub-task",
+			responses: []FakeResponse{{Path: "kind", ExitCode: 1}},
+			plan:      []string{"touch kind.yaml", "kind create cluster --config kind.yaml", "rm kind.yaml", "echo undo"},
+		},
+	} {
+		fake := &FakeRuntime{Responses: c.responses}
+
+		Run(p, fake, NewInputs(nil))
+
+		if got := fake.Plan(); !equalStrings(c.plan, got) {
+			t.Errorf("%s: unexpected plan: want %q, got %q", c.name, c.plan, got)
+		}
+	}
+
+	plan, err := PlanTask(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cleanup []string
+
+	for _, s := range plan.Cleanup {
+		cleanup = append(cleanup, s.Name)
+	}
+
+	if want, got := []string{"setup/remove config", "undo"}, cleanup; !equalStrings(want, got) {
+		t.Errorf("unexpected planned cleanup: want %q, got %q", want, got)
+	}
+}
+
+func TestSubTaskCleanupResumed(t *testing.T) {
+	p := subTaskCleanupTestTask()
+
+	for _, c := range []struct {
+		name, created string
+		plan          []string
+		err           string
+	}{
+		{
+			name:    "finished sub-task",
+			created: "succeeded",
+			plan:    []string{"go test", "echo undo"},
+		},
+		{
+			name:    "failed sub-task",
+			created: "failed",
+			err:     `has already executed its cleanup step "setup/remove config"`,
+		},
+	} {
+		stateFile := filepath.Join(t.TempDir(), "state.json")
+
+		state := `{"outputs": {}, "steps": {
+  "setup/write config": {"status": "succeeded"},
+  "setup/create cluster": {"status": "` + c.created + `"},
+  "setup/remove config": {"status": "succeeded"}
+}}`
+
+		if err := ioutil.WriteFile(stateFile, []byte(state), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		fake := &FakeRuntime{}
+
+		_, err := Resume(p, fake, stateFile)
+
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+
+		if got := fake.Plan(); !equalStrings(c.plan, got) {
+			t.Errorf("%s: unexpected plan: want %q, got %q", c.name, c.plan, got)
+		}
+	}
+}
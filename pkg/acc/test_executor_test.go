@@ -36,11 +36,11 @@ func TestTestExecutor(t *testing.T) {
 				},
 			},
 		},
-		binDir:     tmpDir,
-		GoTestName: t.Name(),
+		binDir: tmpDir,
 	}
 
 	testExecutor.Start()
+	defer testExecutor.Stop()
 
 	testExecutor.Execute(Command{
 		Path: "helm",
@@ -0,0 +1,511 @@
+package acc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentEnv is the environment variable the W3C trace context is propagated with
+// to the commands, and read from to continue the trace of the process running the task.
+const TraceparentEnv = "TRACEPARENT"
+
+// SpanKind is the kind of a span as defined by OpenTelemetry.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindClient   SpanKind = 3
+)
+
+// SpanStatus is the status code of a span as defined by OpenTelemetry.
+type SpanStatus int
+
+const (
+	SpanStatusUnset SpanStatus = 0
+	SpanStatusOK    SpanStatus = 1
+	SpanStatusError SpanStatus = 2
+)
+
+// Span is a finished span of a task run.
+type Span struct {
+	// TraceID, SpanID and ParentSpanID are lower-case hex, 32 characters for trace IDs and 16 for span IDs.
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+
+	Name  string
+	Kind  SpanKind
+	Start time.Time
+	End   time.Time
+
+	// Attributes are strings, int64s, bools or string slices.
+	Attributes map[string]interface{}
+
+	Status        SpanStatus
+	StatusMessage string
+}
+
+// SpanExporter exports the spans of task runs.
+type SpanExporter interface {
+	// ExportSpans exports the spans of a task run, which are given at once when the task finishes.
+	ExportSpans(spans []Span) error
+}
+
+// Tracer records a trace for every task run with it. The task run is the root span, with
+// a child span for every step, which has a child span for every command the step executes.
+// The context of the command spans is passed to the commands in $TRACEPARENT.
+type Tracer struct {
+	Exporter SpanExporter
+
+	// Parent is the W3C traceparent the task spans are children of. Defaults to $TRACEPARENT,
+	// so that the task runs join the trace of the process running them.
+	Parent string
+
+	// OnError is called when the spans fail to be exported. Defaults to printing the error to stderr,
+	// as a task does not fail because of its traces.
+	OnError func(error)
+
+	mu    sync.Mutex
+	ended []Span
+}
+
+// activeSpan is a span being recorded. Its methods do nothing on nil, so that
+// spans can be recorded unconditionally whether or not a tracer is set.
+type activeSpan struct {
+	tracer *Tracer
+
+	// secrets are masked in the attributes and the status message of the span.
+	secrets *secrets
+
+	mu   sync.Mutex
+	span Span
+}
+
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+func randomHex(n int) string {
+	bs := make([]byte, n)
+
+	if _, err := rand.Read(bs); err != nil {
+		panic(fmt.Errorf("generating an id: %v", err))
+	}
+
+	return hex.EncodeToString(bs)
+}
+
+// start starts a span that is a child of parent, or the root span of a new trace when parent is nil.
+func (t *Tracer) start(name string, kind SpanKind, parent *activeSpan) *activeSpan {
+	s := &activeSpan{
+		tracer: t,
+		span: Span{
+			SpanID:     randomHex(8),
+			Name:       name,
+			Kind:       kind,
+			Start:      time.Now(),
+			Attributes: map[string]interface{}{},
+		},
+	}
+
+	if parent != nil {
+		s.secrets = parent.secrets
+		s.span.TraceID = parent.span.TraceID
+		s.span.ParentSpanID = parent.span.SpanID
+
+		return s
+	}
+
+	traceparent := t.Parent
+	if traceparent == "" {
+		traceparent = os.Getenv(TraceparentEnv)
+	}
+
+	if m := traceparentPattern.FindStringSubmatch(traceparent); m != nil {
+		s.span.TraceID = m[1]
+		s.span.ParentSpanID = m[2]
+	} else {
+		s.span.TraceID = randomHex(16)
+	}
+
+	return s
+}
+
+// child starts a span that is a child of s.
+func (s *activeSpan) child(name string, kind SpanKind) *activeSpan {
+	if s == nil {
+		return nil
+	}
+
+	return s.tracer.start(name, kind, s)
+}
+
+func (s *activeSpan) set(key string, val interface{}) {
+	if s == nil {
+		return
+	}
+
+	switch v := val.(type) {
+	case string:
+		val = s.secrets.mask(v)
+	case []string:
+		val = s.secrets.maskAll(v)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.span.Attributes[key] = val
+}
+
+// finish sets the status of the span according to err, and ends it.
+func (s *activeSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+
+	s.span.End = time.Now()
+
+	if err != nil {
+		s.span.Status = SpanStatusError
+		s.span.StatusMessage = s.secrets.mask(err.Error())
+	} else {
+		s.span.Status = SpanStatusOK
+	}
+
+	span := s.span
+
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	s.tracer.ended = append(s.tracer.ended, span)
+	s.tracer.mu.Unlock()
+}
+
+// traceparent returns the W3C traceparent of the span.
+func (s *activeSpan) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", s.span.TraceID, s.span.SpanID)
+}
+
+// flush exports the ended spans.
+func (t *Tracer) flush() {
+	t.mu.Lock()
+	spans := t.ended
+	t.ended = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 || t.Exporter == nil {
+		return
+	}
+
+	if err := t.Exporter.ExportSpans(spans); err != nil {
+		err = fmt.Errorf("exporting spans: %v", err)
+
+		if t.OnError != nil {
+			t.OnError(err)
+		} else {
+			fmt.Fprintf(os.Stderr, "acc: %v\n", err)
+		}
+	}
+}
+
+// startTask starts the root span of a task run, whose spans mask the secrets.
+func (t *Tracer) startTask(name string, p *Task, secrets *secrets) *activeSpan {
+	if t == nil {
+		return nil
+	}
+
+	spanName := "task"
+	if name != "" {
+		spanName = "task " + name
+	}
+
+	s := t.start(spanName, SpanKindInternal, nil)
+
+	s.secrets = secrets
+
+	if name != "" {
+		s.set("acc.task.name", name)
+	}
+
+	s.set("acc.task.steps", int64(len(p.Steps)))
+	s.set("acc.task.cleanup_steps", int64(len(p.Cleanup)))
+
+	return s
+}
+
+// startStep starts the span of a step.
+func (s *activeSpan) startStep(instruction TaskStep, cleanup bool, inputs *mapInputs, state map[string]map[string]string) *activeSpan {
+	if s == nil {
+		return nil
+	}
+
+	step := s.child(instruction.Name, SpanKindInternal)
+
+	step.set("acc.step.name", instruction.Name)
+	step.set("acc.step.kind", stepKind(instruction))
+	step.set("acc.step.cleanup", cleanup)
+
+	if instruction.SubTask != "" {
+		step.set("acc.step.sub_task", instruction.SubTask)
+	}
+
+	if line := resolvedCommandLine(instruction, inputs, state); line != "" {
+		step.set("acc.step.command", line)
+	}
+
+	return step
+}
+
+// finishStep records the outputs of the step and ends its span.
+func (s *activeSpan) finishStep(err error, outputs map[string]string) {
+	if s == nil {
+		return
+	}
+
+	if err != nil {
+		s.set("process.exit_code", int64(exitCode(err)))
+	}
+
+	for k, v := range outputs {
+		s.set("acc.step.output."+k+".size", int64(len(v)))
+	}
+
+	s.finish(err)
+}
+
+// tracedTarget is a target that records a span for every command, passing the context of
+// the span to the command in $TRACEPARENT.
+type tracedTarget struct {
+	Target
+	span *activeSpan
+}
+
+func (o *tracedTarget) Execute(cmd Command, args []string) ExecResult {
+	span := o.span.child(filepath.Base(cmd.Path), SpanKindClient)
+
+	span.set("process.executable.name", filepath.Base(cmd.Path))
+	span.set("process.command", cmd.Path)
+	span.set("process.command_args", append([]string{cmd.Path}, args...))
+
+	cmd = cmd.WithEnv(TraceparentEnv, span.traceparent())
+
+	finished := false
+
+	defer func() {
+		if finished {
+			return
+		}
+
+		e := recover()
+
+		err, ok := e.(error)
+		if !ok {
+			err = fmt.Errorf("%v", e)
+		}
+
+		span.set("process.exit_code", int64(exitCode(err)))
+		span.finish(err)
+
+		panic(e)
+	}()
+
+	res := o.Target.Execute(cmd, args)
+
+	finished = true
+
+	span.set("process.exit_code", int64(0))
+
+	// The sizes are known for the outputs that are captured in memory.
+	for key, r := range map[string]interface{}{"stdout": res.Stdout, "stderr": res.Stderr} {
+		if l, ok := r.(interface{ Len() int }); ok {
+			span.set("process."+key+".size", int64(l.Len()))
+		}
+	}
+
+	span.finish(res.Err)
+
+	return res
+}
+
+// otlpRequest returns the OTLP/JSON ExportTraceServiceRequest of the spans.
+func otlpRequest(serviceName string, spans []Span) map[string]interface{} {
+	if serviceName == "" {
+		serviceName = "acc"
+	}
+
+	var otlpSpans []interface{}
+
+	for _, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              int(s.Kind),
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+			"status":            map[string]interface{}{"code": int(s.Status), "message": s.StatusMessage},
+		}
+
+		if s.ParentSpanID != "" {
+			span["parentSpanId"] = s.ParentSpanID
+		}
+
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/mumoshu/golang-experiments/pkg/acc"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	var keys []string
+
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	kvs := []interface{}{}
+
+	for _, k := range keys {
+		kvs = append(kvs, map[string]interface{}{"key": k, "value": otlpValue(attrs[k])})
+	}
+
+	return kvs
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch typed := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": typed}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(typed, 10)}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(typed)}
+	case []string:
+		var values []interface{}
+
+		for _, s := range typed {
+			values = append(values, map[string]interface{}{"stringValue": s})
+		}
+
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprintf("%v", typed)}
+	}
+}
+
+// OTLPExporter exports spans to an OpenTelemetry collector with OTLP over HTTP in the JSON encoding.
+type OTLPExporter struct {
+	// Endpoint is the base URL of the collector like http://localhost:4318, to which /v1/traces is appended.
+	Endpoint string
+
+	// Headers are added to the requests, like for authentication.
+	Headers map[string]string
+
+	// ServiceName is the service.name of the spans. Defaults to "acc".
+	ServiceName string
+
+	// Client defaults to a client with a 10 seconds timeout.
+	Client *http.Client
+}
+
+func (e *OTLPExporter) ExportSpans(spans []Span) error {
+	body, err := json.Marshal(otlpRequest(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(e.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(res.Body)
+
+		return fmt.Errorf("collector responded with %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// FileExporter appends the spans of every task run to a file as a line of OTLP/JSON,
+// in the format of the file exporter of the OpenTelemetry collector.
+type FileExporter struct {
+	Path string
+
+	// ServiceName is the service.name of the spans. Defaults to "acc".
+	ServiceName string
+
+	mu sync.Mutex
+}
+
+func (e *FileExporter) ExportSpans(spans []Span) error {
+	line, err := json.Marshal(otlpRequest(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	f, err := os.OpenFile(e.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,256 @@
+package acc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// otlpTestSpan is a span as decoded from an OTLP/JSON request.
+type otlpTestSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+func (s otlpTestSpan) attr(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+
+	return nil
+}
+
+type otlpTestRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string                 `json:"key"`
+				Value map[string]interface{} `json:"value"`
+			} `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpTestSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// spans returns the spans keyed by name, and by name and the name of the parent for commands.
+func (r otlpTestRequest) spans() map[string]otlpTestSpan {
+	spans := map[string]otlpTestSpan{}
+
+	var all []otlpTestSpan
+
+	for _, rs := range r.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			all = append(all, ss.Spans...)
+		}
+	}
+
+	for _, s := range all {
+		spans[s.Name] = s
+
+		for _, parent := range all {
+			if s.Kind == int(SpanKindClient) && parent.SpanID == s.ParentSpanID {
+				spans[parent.Name+"/"+s.Name] = s
+			}
+		}
+	}
+
+	return spans
+}
+
+func TestTracingOTLP(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []otlpTestRequest
+	)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		var req otlpTestRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		w.Write([]byte("{}"))
+	}))
+	defer collector.Close()
+
+	var b TaskBuilder
+
+	b.Do("print traceparent", b.Cmd("sh", "-c", "echo $TRACEPARENT"))
+	b.Do("fail", b.Cmd("sh", "-c", "exit 3"))
+
+	var stdout bytes.Buffer
+
+	tracer := &Tracer{
+		Exporter: &OTLPExporter{Endpoint: collector.URL, Headers: map[string]string{"Authorization": "Bearer token"}, ServiceName: "e2e"},
+		Parent:   "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		OnError: func(err error) {
+			t.Errorf("unexpected error: %v", err)
+		},
+	}
+
+	_, err := RunWithOptions(b.Build(), &Runtime{AllowByDefault: true, Stdout: &stdout, Stderr: ioutil.Discard}, nil, RunOptions{Tracer: tracer, TaskName: "e2e"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("unexpected number of requests to the collector: want 1, got %d", len(requests))
+	}
+
+	spans := requests[0].spans()
+
+	root, step, exec := spans["task e2e"], spans["print traceparent"], spans["print traceparent/sh"]
+
+	if want, got := "0af7651916cd43dd8448eb211c80319c", root.TraceID; got != want {
+		t.Errorf("unexpected trace id: want %q, got %q", want, got)
+	}
+
+	if want, got := "b7ad6b7169203331", root.ParentSpanID; got != want {
+		t.Errorf("unexpected parent of the task span: want %q, got %q", want, got)
+	}
+
+	if step.ParentSpanID != root.SpanID {
+		t.Errorf("expected the step span to be a child of the task span, got %+v", step)
+	}
+
+	if want, got := "00-0af7651916cd43dd8448eb211c80319c-"+exec.SpanID+"-01\n", stdout.String(); got != want {
+		t.Errorf("unexpected TRACEPARENT of the command: want %q, got %q", want, got)
+	}
+
+	if want, got := "sh -c echo $TRACEPARENT", step.attr("acc.step.command"); got != want {
+		t.Errorf("unexpected command of the step: want %q, got %v", want, got)
+	}
+
+	if want, got := "0", exec.attr("process.exit_code"); got != want {
+		t.Errorf("unexpected exit code: want %q, got %v", want, got)
+	}
+
+	fail := spans["fail"]
+
+	if want, got := "3", fail.attr("process.exit_code"); got != want {
+		t.Errorf("unexpected exit code of the failed step: want %q, got %v", want, got)
+	}
+
+	if want, got := int(SpanStatusError), fail.Status.Code; got != want {
+		t.Errorf("unexpected status of the failed step: want %d, got %d", want, got)
+	}
+
+	if want, got := "fail", root.attr("acc.task.failed_step"); got != want {
+		t.Errorf("unexpected failed step: want %q, got %v", want, got)
+	}
+}
+
+func TestTracingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+
+	var b TaskBuilder
+
+	b.Do("check", Func{Name: "check", F: func(ctx TaskStepContext) error {
+		if _, err := ctx.Cmd("kubectl", "get", "pods").Exec(); err != nil {
+			return err
+		}
+
+		_, err := ctx.Cmd("kubectl", "logs", "web").Exec()
+
+		return err
+	}})
+
+	fake := &FakeRuntime{
+		Responses: []FakeResponse{
+			{Path: "kubectl", Args: []string{"get", "pods"}, Stdout: "web"},
+			{Path: "kubectl", Args: []string{"logs", "web"}, ExitCode: 1},
+		},
+	}
+
+	tracer := &Tracer{Exporter: &FileExporter{Path: path}, Parent: "none"}
+
+	for i := 0; i < 2; i++ {
+		RunWithOptions(b.Build(), fake, nil, RunOptions{Tracer: tracer})
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("unexpected number of lines: want 2, got %d", len(lines))
+	}
+
+	var req otlpTestRequest
+
+	if err := json.Unmarshal([]byte(lines[0]), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	var execs []otlpTestSpan
+
+	var step otlpTestSpan
+
+	for _, s := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+		switch s.Name {
+		case "kubectl":
+			execs = append(execs, s)
+		case "check":
+			step = s
+		}
+	}
+
+	if len(execs) != 2 {
+		t.Fatalf("unexpected number of command spans: want 2, got %d", len(execs))
+	}
+
+	for _, s := range execs {
+		if s.ParentSpanID != step.SpanID || s.Kind != int(SpanKindClient) {
+			t.Errorf("expected a client span that is a child of the step span, got %+v", s)
+		}
+	}
+
+	if want, got := "3", execs[0].attr("process.stdout.size"); got != want {
+		t.Errorf("unexpected stdout size: want %q, got %v", want, got)
+	}
+
+	if want, got := "1", execs[1].attr("process.exit_code"); got != want {
+		t.Errorf("unexpected exit code: want %q, got %v", want, got)
+	}
+
+	if want, got := "acc", req.ResourceSpans[0].Resource.Attributes[0].Value["stringValue"]; got != want {
+		t.Errorf("unexpected service name: want %q, got %v", want, got)
+	}
+}
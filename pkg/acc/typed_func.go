@@ -0,0 +1,250 @@
+package acc
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	taskStepContextType = reflect.TypeOf((*TaskStepContext)(nil)).Elem()
+	errorType           = reflect.TypeOf((*error)(nil)).Elem()
+	refType             = reflect.TypeOf(Ref{})
+)
+
+// TypedFunc returns the Func running f, which must be a func(TaskStepContext, In) (Out, error)
+// whose In and Out are structs, like:
+//
+//	type GenIn struct {
+//	    Seed string `acc:"seed,required"`
+//	}
+//
+//	type GenOut struct {
+//	    YamlPath string `acc:"yamlPath"`
+//	}
+//
+// The fields of In tagged with `acc` are bound to the task inputs named by the tags, which
+// become the Inputs of the Func. An input tagged `required` fails the step when it is empty,
+// and an input that is not given leaves the field as is otherwise. The tagged fields of Out
+// become the Outputs of the Func, which are set from the values f returns.
+//
+// Fields can be strings, bools, ints, uints and floats.
+func TypedFunc(name string, f interface{}) Func {
+	fv := reflect.ValueOf(f)
+	ft := fv.Type()
+
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 2 ||
+		ft.In(0) != taskStepContextType || ft.In(1).Kind() != reflect.Struct ||
+		ft.Out(0).Kind() != reflect.Struct || ft.Out(1) != errorType {
+		panic(fmt.Errorf("func %q: %T is not a func(TaskStepContext, In) (Out, error) with struct In and Out", name, f))
+	}
+
+	in, out := typedFields(name, ft.In(1)), typedFields(name, ft.Out(0))
+
+	fn := Func{Name: name, outType: ft.Out(0)}
+
+	for _, field := range in {
+		fn.Inputs = append(fn.Inputs, Ref{Key: field.key})
+	}
+
+	for _, field := range out {
+		fn.Outputs = append(fn.Outputs, field.key)
+	}
+
+	fn.F = func(ctx TaskStepContext) error {
+		inV := reflect.New(ft.In(1)).Elem()
+
+		for _, field := range in {
+			v, ok := lookupInput(ctx, field.key)
+			if field.required && v == "" {
+				return fmt.Errorf("func %q: input %q is required", name, field.key)
+			}
+
+			if !ok {
+				continue
+			}
+
+			if err := setTypedField(inV.Field(field.index), v); err != nil {
+				return fmt.Errorf("func %q: input %q: %v", name, field.key, err)
+			}
+		}
+
+		res := fv.Call([]reflect.Value{reflect.ValueOf(&ctx).Elem(), inV})
+
+		if err, _ := res[1].Interface().(error); err != nil {
+			return err
+		}
+
+		for _, field := range out {
+			ctx.Set(field.key, formatTypedField(res[0].Field(field.index)))
+		}
+
+		return nil
+	}
+
+	return fn
+}
+
+// typedField is a field of the In or Out struct of a TypedFunc.
+type typedField struct {
+	index    int
+	name     string
+	key      string
+	required bool
+}
+
+// typedFields returns the fields of the struct tagged with `acc`.
+func typedFields(funcName string, t reflect.Type) []typedField {
+	var fields []typedField
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag, ok := f.Tag.Lookup("acc")
+		if !ok || tag == "-" {
+			continue
+		}
+
+		if f.PkgPath != "" {
+			panic(fmt.Errorf("func %q: field %s of %s is tagged but not exported", funcName, f.Name, t))
+		}
+
+		switch f.Type.Kind() {
+		case reflect.String, reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			panic(fmt.Errorf("func %q: field %s of %s has unsupported type %s", funcName, f.Name, t, f.Type))
+		}
+
+		opts := strings.Split(tag, ",")
+
+		field := typedField{index: i, name: f.Name, key: opts[0]}
+
+		if field.key == "" {
+			field.key = f.Name
+		}
+
+		for _, o := range opts[1:] {
+			switch o {
+			case "required":
+				field.required = true
+			default:
+				panic(fmt.Errorf("func %q: field %s of %s has unknown option %q", funcName, f.Name, t, o))
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// lookupInput returns the task input, reporting whether it was given.
+func lookupInput(ctx TaskStepContext, key string) (v string, ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			v, ok = "", false
+		}
+	}()
+
+	return ctx.Get(key), true
+}
+
+func setTypedField(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetFloat(f)
+	}
+
+	return nil
+}
+
+func formatTypedField(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return v.String()
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+// Refs sets the Ref fields of the struct v points to, to the refs to the outputs of the step
+// run by a TypedFunc, matching the fields of the Out struct by name. For the GenOut of TypedFunc:
+//
+//	var gen struct {
+//	    YamlPath Ref
+//	}
+//
+//	s.Do("generate workflow", TypedFunc("gen", generate)).Refs(&gen)
+//
+//	s.Do("commit", s.Cmd("ghcp", "commit", gen.YamlPath))
+func (j TaskStep) Refs(v interface{}) {
+	fail := func(err error) {
+		f := getFrame(2)
+		panic(fmt.Sprintf("%s:%d: %v", filepath.Base(f.File), f.Line, err))
+	}
+
+	impl, ok := j.Run.(Func)
+	if !ok || impl.outType == nil {
+		fail(fmt.Errorf("step %q is not run by a TypedFunc", j.Name))
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		fail(fmt.Errorf("%T is not a pointer to a struct", v))
+	}
+
+	keys := map[string]string{}
+
+	for _, field := range typedFields(impl.Name, impl.outType) {
+		keys[field.name] = field.key
+	}
+
+	s := rv.Elem()
+
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Type().Field(i)
+
+		if f.Type != refType {
+			continue
+		}
+
+		key, ok := keys[f.Name]
+		if !ok {
+			fail(fmt.Errorf("step %q has no output for field %s", j.Name, f.Name))
+		}
+
+		s.Field(i).Set(reflect.ValueOf(Ref{Job: j.Name, Key: key}))
+	}
+}
@@ -0,0 +1,122 @@
+package acc
+
+import (
+	"strings"
+	"testing"
+)
+
+type typedFuncTestIn struct {
+	Seed     string `acc:"seed,required"`
+	Replicas int    `acc:"replicas"`
+	Debug    bool   `acc:"debug"`
+
+	Untagged string
+}
+
+type typedFuncTestOut struct {
+	Path  string `acc:"path"`
+	Count int    `acc:"count"`
+}
+
+func typedFuncTestTask() *Task {
+	var b TaskBuilder
+
+	var gen struct {
+		Path  Ref
+		Count Ref
+	}
+
+	b.Do("generate", TypedFunc("gen", func(ctx TaskStepContext, in typedFuncTestIn) (typedFuncTestOut, error) {
+		if in.Debug {
+			in.Replicas *= 10
+		}
+
+		return typedFuncTestOut{Path: in.Seed + ".yaml", Count: in.Replicas}, nil
+	})).Refs(&gen)
+
+	b.Do("apply", b.Cmd("kubectl", "apply", "-f", gen.Path, "--replicas", gen.Count))
+
+	return b.Build()
+}
+
+func TestTypedFunc(t *testing.T) {
+	p := typedFuncTestTask()
+
+	if want, got := []string{"debug", "replicas", "seed"}, p.Inputs; !equalStrings(want, got) {
+		t.Errorf("unexpected inputs: want %q, got %q", want, got)
+	}
+
+	if want, got := []string{"path", "count"}, p.Steps[0].Run.(Func).Outputs; !equalStrings(want, got) {
+		t.Errorf("unexpected outputs: want %q, got %q", want, got)
+	}
+
+	fake := &FakeRuntime{}
+
+	res, err := Run(p, fake, NewInputs(map[string]string{"seed": "e2e", "replicas": "3"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "e2e.yaml", res.Outputs["generate"]["path"]; got != want {
+		t.Errorf("unexpected output: want %q, got %q", want, got)
+	}
+
+	fake.AssertPlan(t, "kubectl apply -f e2e.yaml --replicas 3")
+
+	for _, c := range []struct {
+		inputs map[string]string
+		err    string
+	}{
+		{inputs: map[string]string{"replicas": "3"}, err: `func "gen": input "seed" is required`},
+		{inputs: map[string]string{"seed": "e2e", "replicas": "three"}, err: `func "gen": input "replicas": strconv.ParseInt: parsing "three": invalid syntax`},
+	} {
+		if _, err := Run(p, &FakeRuntime{}, NewInputs(c.inputs)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected an error containing %q, got %v", c.err, err)
+		}
+	}
+}
+
+type (
+	typedFuncTestUnsupported struct {
+		Names []string `acc:"names"`
+	}
+
+	typedFuncTestUnknownOption struct {
+		Name string `acc:"name,optional"`
+	}
+
+	typedFuncTestUnexported struct {
+		name string `acc:"name"`
+	}
+)
+
+func TestTypedFuncInvalid(t *testing.T) {
+	for name, f := range map[string]interface{}{
+		"not a func": "gen",
+		"no context": func(in typedFuncTestIn) (typedFuncTestOut, error) {
+			return typedFuncTestOut{}, nil
+		},
+		"no error": func(ctx TaskStepContext, in typedFuncTestIn) typedFuncTestOut {
+			return typedFuncTestOut{}
+		},
+		"unsupported type": func(ctx TaskStepContext, in typedFuncTestUnsupported) (typedFuncTestOut, error) {
+			return typedFuncTestOut{}, nil
+		},
+		"unknown option": func(ctx TaskStepContext, in typedFuncTestUnknownOption) (typedFuncTestOut, error) {
+			return typedFuncTestOut{}, nil
+		},
+		"unexported field": func(ctx TaskStepContext, in typedFuncTestUnexported) (typedFuncTestOut, error) {
+			return typedFuncTestOut{}, nil
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+
+			TypedFunc("gen", f)
+		}()
+	}
+}
@@ -0,0 +1,80 @@
+package acc
+
+import (
+	"fmt"
+)
+
+// ValidateTask returns the problems that would make the task fail regardless of its inputs,
+// like duplicate step names, step names clashing with the namespaced names of sub-tasks,
+// references between the combinations of a matrix, which may run at once, references to the
+// outputs of a matrix from outside of it, which workflows cannot pass to later jobs,
+// and references to outputs of steps that are not executed before.
+func ValidateTask(p *Task) []error {
+	var errs []error
+
+	seen := map[string]bool{}
+
+	steps := append(append([]TaskStep(nil), p.Steps...), p.Cleanup...)
+
+	subTasks := map[string]bool{}
+	combos := map[string]*MatrixCombo{}
+
+	for _, s := range steps {
+		combos[s.Name] = s.Combo
+
+		for t := s.SubTask; t != ""; t = parentSubTask(t) {
+			subTasks[t] = true
+		}
+	}
+
+	for _, s := range steps {
+		if s.Name == "" {
+			errs = append(errs, fmt.Errorf("a step has no name"))
+			continue
+		}
+
+		if seen[s.Name] {
+			errs = append(errs, fmt.Errorf("step %q is defined more than once", s.Name))
+		}
+
+		seen[s.Name] = true
+
+		if subTasks[s.Name] {
+			errs = append(errs, fmt.Errorf("step %q has the name of a sub-task", s.Name))
+		}
+
+		for t := parentSubTask(s.Name); t != ""; t = parentSubTask(t) {
+			if subTasks[t] && !inSubTask(s.SubTask, t) {
+				errs = append(errs, fmt.Errorf("step %q is named like a step of sub-task %q but is not defined in it", s.Name, t))
+			}
+		}
+
+		for _, ref := range stepRefs(s) {
+			c := combos[ref.Job]
+
+			switch {
+			case c == nil || c == s.Combo:
+			case s.Combo != nil && c.Matrix == s.Combo.Matrix:
+				errs = append(errs, fmt.Errorf("step %q refers to step %q of another combination of matrix %q", s.Name, ref.Job, c.Matrix.Name))
+			default:
+				errs = append(errs, fmt.Errorf("step %q refers to step %q of matrix %q, whose outputs are not available outside of its combinations", s.Name, ref.Job, c.Matrix.Name))
+			}
+		}
+
+		switch s.Run.(type) {
+		case Command, Func:
+		default:
+			errs = append(errs, fmt.Errorf("step %q: unsupported type of instruction: %T", s.Name, s.Run))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if _, err := PlanTask(p, nil); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
@@ -1,10 +1,16 @@
 package acc
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+)
 
 type Values struct {
 	Job   string
 	exprs map[string]*Expr
+
+	// secrets are the keys defined with DefSecret.
+	secrets map[string]bool
 }
 
 type ValueNotDefinedError struct {
@@ -25,6 +31,19 @@ func (v *Values) Get(key string) (*Ref, error) {
 	return &Ref{Job: v.Job, Key: key}, nil
 }
 
+// Keys returns the defined keys in alphabetical order.
+func (v *Values) Keys() []string {
+	var keys []string
+
+	for k := range v.exprs {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
 func (v *Values) Def(key string, expr *Expr) {
 	if v.exprs == nil {
 		v.exprs = map[string]*Expr{}
@@ -33,11 +52,40 @@ func (v *Values) Def(key string, expr *Expr) {
 	v.exprs[key] = expr
 }
 
+// DefSecret defines the key as a secret whose value is masked in everything the task run writes.
+func (v *Values) DefSecret(key string) {
+	v.Def(key, nil)
+
+	if v.secrets == nil {
+		v.secrets = map[string]bool{}
+	}
+
+	v.secrets[key] = true
+}
+
+// Secrets returns the keys defined with DefSecret in alphabetical order.
+func (v *Values) Secrets() []string {
+	var keys []string
+
+	for k := range v.secrets {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
 type Ref struct {
 	Job string
 	Key string
 }
 
+// Expr is a string computed from inputs and step outputs at run time.
+// Format is a fmt format whose verbs are filled with the resolved Args,
+// each of which can be a string, Ref or another Expr.
 type Expr struct {
+	Format string
+	Args   []interface{}
 }
 
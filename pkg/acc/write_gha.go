@@ -0,0 +1,656 @@
+package acc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// WriteGitHubActionsWorkflow compiles the task into a GitHub Actions workflow that is
+// dispatched manually with the task inputs and runs the steps, followed by the cleanup
+// steps in reverse order, as the steps of a single job.
+//
+// A matrix whose combinations define the same steps is rendered as a job of its own with
+// the strategy of the matrix, split from the jobs of the steps before and after it, which pass
+// the outputs the later jobs refer to as job outputs. The steps after a matrix cannot refer to
+// the outputs of its steps, which ValidateTask reports. The cleanup steps of a task split into
+// jobs are run by a final job after all the others, whether they succeed or not. As it runs on
+// a runner of its own, the cleanup steps can only undo what is outside of the runners of the
+// other jobs, like cloud resources.
+//
+// Func steps are run by invoking the current executable with `run-task-step`,
+// which is expected to write the outputs of the step to $GITHUB_OUTPUT. The outputs
+// derived from secrets are masked in the log with ::add-mask:: before they are written.
+//
+// Secret inputs are the repository secrets named after them in upper case, which are
+// set as environment variables of the job that the steps refer to. The other inputs and
+// the outputs of steps are set as environment variables of the steps referring to them,
+// rather than expanded into the scripts.
+//
+// The condition of a step is rendered as the `if` of the step. The status of a step of
+// another job is the condition of the step, as the workflow stops at the first failure.
+func WriteGitHubActionsWorkflow(p *Task, name string, writer io.Writer) {
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(writer, format+"\n", args...)
+	}
+
+	inputs := NewInputs(nil)
+
+	secret := map[string]bool{}
+
+	for _, in := range p.Secrets {
+		secret[in] = true
+	}
+
+	var dispatched []string
+
+	for _, in := range p.Inputs {
+		if secret[in] {
+			inputs.m[in] = fmt.Sprintf("${%s}", envName(in))
+		} else {
+			inputs.m[in] = fmt.Sprintf("${{ github.event.inputs.%s }}", in)
+			dispatched = append(dispatched, in)
+		}
+	}
+
+	stepIDs := ghaStepIDs(p, nil)
+	state := map[string]map[string]string{}
+
+	printf("name: %s", yamlQuote(name))
+	printf("on:")
+	printf("  workflow_dispatch:")
+
+	if len(dispatched) > 0 {
+		printf("    inputs:")
+		for _, in := range dispatched {
+			printf("      %s:", in)
+			printf("        required: true")
+		}
+	}
+
+	printf("jobs:")
+
+	var subTask string
+
+	conds := stepConds(p.Steps, p.Cleanup)
+
+	writeStep := func(instruction TaskStep, cleanup bool, ids map[string]string, inJob, referenced map[string]bool, expand func(string) string) {
+		id := ids[instruction.Name]
+
+		for _, t := range enteredSubTasks(subTask, instruction.SubTask) {
+			printf("    # sub-task %s", expand(t))
+		}
+
+		subTask = instruction.SubTask
+
+		printf("    - id: %s", id)
+		printf("      name: %s", yamlQuote(expand(instruction.Name)))
+
+		var cond string
+
+		if instruction.If != nil {
+			cond = ghaCond(*instruction.If, conds, func(v interface{}) string {
+				return ghaExpr(expand(resolveValue(instruction.Name, v, inputs, state)))
+			}, func(step string) (string, bool) {
+				return ids[step], inJob[step]
+			})
+		}
+
+		switch {
+		case cleanup && cond != "":
+			printf("      if: ${{ always() && %s }}", cond)
+		case cleanup:
+			printf("      if: always()")
+		case cond != "":
+			printf("      if: ${{ %s }}", cond)
+		}
+
+		var script []string
+
+		switch impl := instruction.Run.(type) {
+		case Command:
+			impl, args := resolveCommand(instruction.Name, impl, inputs, state)
+
+			// The args referring to inputs and outputs are quoted, as they are replaced
+			// with the environment variables set to them.
+			for i, a := range args {
+				if a = expand(a); strings.Contains(a, "${{") {
+					args[i] = bashDoubleQuote(a)
+				}
+			}
+
+			line := bashCommandLine(impl, args)
+
+			if referenced[instruction.Name] {
+				v := "ACC_" + envName(id)
+
+				captured, outputs := shellCaptureState(v), []string{"{"}
+
+				for _, k := range ghaStepOutputs(instruction) {
+					outputs = append(outputs,
+						fmt.Sprintf("  echo '%s<<ACC_EOF'", k),
+						fmt.Sprintf(`  echo "%s"`, captured[k]),
+						"  echo 'ACC_EOF'",
+					)
+				}
+
+				script = shellCaptureLines(v, line, append(outputs, `} >> "$GITHUB_OUTPUT"`)...)
+			} else {
+				script = []string{line}
+			}
+
+			outputs := map[string]string{}
+
+			for _, k := range ghaStepOutputs(instruction) {
+				outputs[k] = fmt.Sprintf("${{ steps.%s.outputs.%s }}", id, k)
+			}
+
+			state[instruction.Name] = outputs
+		case Func:
+			outputs := map[string]string{}
+
+			for _, o := range impl.Outputs {
+				outputs[o] = fmt.Sprintf("${{ steps.%s.outputs.%s }}", id, o)
+			}
+
+			script = []string{fmt.Sprintf("%s%s run-task-step %s", funcInputsEnv(instruction, impl, inputs, state), os.Args[0], bashDoubleQuote(instruction.Name))}
+
+			state[instruction.Name] = outputs
+		default:
+			panic(fmt.Errorf("unsupported type of instruction: %T", impl))
+		}
+
+		for i, l := range script {
+			script[i] = expand(l)
+		}
+
+		script, env := ghaScriptEnv(script)
+
+		if len(env) > 0 {
+			printf("      env:")
+
+			for e := 0; e < len(env); e += 2 {
+				printf("        %s: %s", env[e], env[e+1])
+			}
+		}
+
+		printf("      run: |")
+
+		for _, l := range script {
+			printf("        %s", l)
+		}
+	}
+
+	jobs := ghaJobs(p)
+
+	var needs []string
+
+	for i, j := range jobs {
+		printf("  %s:", j.id)
+
+		if len(needs) > 0 {
+			printf("    needs: [%s]", strings.Join(needs, ", "))
+		}
+
+		if j.final {
+			printf("    if: always()")
+		}
+
+		printf("    runs-on: ubuntu-latest")
+
+		ids, referenced, expand := stepIDs, referencedSteps(p), func(s string) string { return s }
+
+		inJob := map[string]bool{}
+
+		for _, s := range append(append([]TaskStep(nil), j.steps...), j.cleanup...) {
+			inJob[s.Name] = true
+		}
+
+		if m := j.matrix; m != nil {
+			for _, s := range append(append([]TaskStep(nil), m.template...), m.templateCleanup...) {
+				conds[s.Name] = s.If
+			}
+
+			ids = ghaStepIDs(&Task{Steps: m.template, Cleanup: m.templateCleanup}, func(name string) string {
+				return matrixStepName(m, name)
+			})
+			referenced = referencedSteps(&Task{Steps: m.template, Cleanup: m.templateCleanup})
+			expand = func(s string) string {
+				return replaceMatrixPlaceholders(m, s, func(axis string) string {
+					return fmt.Sprintf("${{ matrix.%s }}", axis)
+				})
+			}
+
+			printf("    strategy:")
+			printf("      fail-fast: %t", !m.ContinueOnError)
+
+			// The combinations are run one by one unless MaxParallel is given, as they are by Run.
+			parallel := m.MaxParallel
+			if parallel < 1 {
+				parallel = 1
+			}
+
+			printf("      max-parallel: %d", parallel)
+
+			printf("      matrix:")
+
+			for _, a := range m.Axes {
+				var values []string
+
+				for _, v := range a.Values {
+					values = append(values, yamlQuote(v))
+				}
+
+				printf("        %s: [%s]", a.Name, strings.Join(values, ", "))
+			}
+		}
+
+		// The outputs the jobs after this one refer to are passed as the outputs of the job.
+		var outputs []string
+
+		if j.matrix == nil && i < len(jobs)-1 {
+			for _, s := range j.steps {
+				if !referenced[s.Name] {
+					continue
+				}
+
+				for _, k := range ghaStepOutputs(s) {
+					outputs = append(outputs, s.Name, k)
+				}
+			}
+		}
+
+		if len(outputs) > 0 {
+			printf("    outputs:")
+
+			for o := 0; o < len(outputs); o += 2 {
+				printf("      %s-%s: ${{ steps.%s.outputs.%s }}", ids[outputs[o]], outputs[o+1], ids[outputs[o]], outputs[o+1])
+			}
+		}
+
+		if len(p.Secrets) > 0 {
+			printf("    env:")
+			for _, in := range p.Secrets {
+				printf("      %s: ${{ secrets.%s }}", envName(in), envName(in))
+			}
+		}
+		printf("    steps:")
+
+		subTask = ""
+
+		for _, instruction := range j.steps {
+			writeStep(instruction, false, ids, inJob, referenced, expand)
+		}
+
+		subTask = ""
+
+		for _, instruction := range j.cleanup {
+			writeStep(instruction, true, ids, inJob, referenced, expand)
+		}
+
+		if j.matrix != nil {
+			expandMatrixState(j.matrix, j.combos, state)
+		}
+
+		for o := 0; o < len(outputs); o += 2 {
+			state[outputs[o]][outputs[o+1]] = fmt.Sprintf("${{ needs.%s.outputs.%s-%s }}", j.id, ids[outputs[o]], outputs[o+1])
+		}
+
+		needs = append(needs, j.id)
+	}
+}
+
+// ghaCond returns the condition as a GitHub Actions expression. The status of a step of the job is
+// the outcome of the step, while the status of a step of another job is the condition of the step.
+func ghaCond(c Cond, conds map[string]*Cond, value func(v interface{}) string, step func(name string) (id string, inJob bool)) string {
+	join := func(op, empty string) func([]string) string {
+		return func(cs []string) string {
+			if len(cs) == 0 {
+				return empty
+			}
+
+			return "(" + strings.Join(cs, " "+op+" ") + ")"
+		}
+	}
+
+	return c.format(condFormat{
+		equals: func(a, b interface{}) string {
+			return value(a) + " == " + value(b)
+		},
+		contains: func(a, b interface{}) string {
+			return fmt.Sprintf("contains(%s, %s)", value(a), value(b))
+		},
+		status: func(name string, status StepStatus) string {
+			if id, ok := step(name); ok {
+				outcome := "success"
+				if status == StepSkipped {
+					outcome = "skipped"
+				}
+
+				return fmt.Sprintf("steps.%s.outcome == '%s'", id, outcome)
+			}
+
+			ran := "true"
+			if d := conds[name]; d != nil {
+				ran = ghaCond(*d, conds, value, func(string) (string, bool) { return "", false })
+			}
+
+			if status == StepSkipped {
+				return "!(" + ran + ")"
+			}
+
+			return ran
+		},
+		not: func(c string) string {
+			return "!(" + c + ")"
+		},
+		and: join("&&", "true"),
+		or:  join("||", "false"),
+	})
+}
+
+// ghaExpr returns the GitHub Actions expression of the string, in which the expressions like
+// ${{ matrix.k8s }} are evaluated, like format('v{0}', matrix.k8s) for "v${{ matrix.k8s }}".
+func ghaExpr(s string) string {
+	literal := func(s string) string {
+		return strings.Replace(s, "'", "''", -1)
+	}
+
+	var (
+		format string
+		args   []string
+	)
+
+	for {
+		i := strings.Index(s, "${{")
+		if i < 0 {
+			break
+		}
+
+		j := strings.Index(s[i:], "}}")
+		if j < 0 {
+			break
+		}
+
+		j += i
+
+		format += strings.NewReplacer("{", "{{", "}", "}}").Replace(literal(s[:i])) + fmt.Sprintf("{%d}", len(args))
+		args = append(args, strings.TrimSpace(s[i+len("${{"):j]))
+		s = s[j+len("}}"):]
+	}
+
+	switch {
+	case len(args) == 0:
+		return "'" + literal(s) + "'"
+	case len(args) == 1 && format == "{0}" && s == "":
+		return args[0]
+	}
+
+	format += strings.NewReplacer("{", "{{", "}", "}}").Replace(literal(s))
+
+	return fmt.Sprintf("format('%s', %s)", format, strings.Join(args, ", "))
+}
+
+// ghaScriptEnv replaces the expressions in the script, like ${{ github.event.inputs.name }},
+// with the environment variables of the step set to them, so that their values are never parsed
+// as a part of the script. It returns the names and values of the variables in pairs.
+func ghaScriptEnv(script []string) (lines, env []string) {
+	names := map[string]bool{}
+
+	for _, l := range script {
+		var b strings.Builder
+
+		for {
+			i := strings.Index(l, "${{")
+			if i < 0 {
+				break
+			}
+
+			j := strings.Index(l[i:], "}}")
+			if j < 0 {
+				break
+			}
+
+			j += i
+
+			expr := strings.TrimSpace(l[i+len("${{") : j])
+			name := ghaEnvName(expr)
+
+			if !names[name] {
+				names[name] = true
+				env = append(env, name, fmt.Sprintf("${{ %s }}", expr))
+			}
+
+			b.WriteString(l[:i] + "${" + name + "}")
+
+			l = l[j+len("}}"):]
+		}
+
+		lines = append(lines, b.String()+l)
+	}
+
+	return lines, env
+}
+
+// ghaEnvName returns the name of the environment variable set to the expression, like NAME
+// for github.event.inputs.name, ACC_MATRIX_K8S for matrix.k8s and ACC_STEPS_CREATE_STDOUT
+// for steps.create.outputs.stdout.
+func ghaEnvName(expr string) string {
+	switch {
+	case strings.HasPrefix(expr, "github.event.inputs."):
+		return envName(strings.TrimPrefix(expr, "github.event.inputs."))
+	case strings.HasPrefix(expr, "matrix."):
+		return bashMatrixVar(strings.TrimPrefix(expr, "matrix."))
+	default:
+		return "ACC_" + envName(strings.Replace(expr, ".outputs.", ".", 1))
+	}
+}
+
+// ghaJob is a job of the GitHub Actions workflow of a task.
+type ghaJob struct {
+	id string
+
+	// steps and cleanup are the steps and cleanup steps of the job in the order they are run.
+	steps, cleanup []TaskStep
+
+	// matrix is the matrix the job runs the template of, along with the steps of its combinations.
+	matrix *Matrix
+	combos [][]TaskStep
+
+	// final is true for the job running the cleanup steps of the task after all the other jobs.
+	final bool
+}
+
+// ghaJobs splits the steps of the task into the jobs of the workflow, which is a single job unless
+// the task has matrices whose combinations can be rendered once. Each such matrix is a job with
+// the strategy of the matrix, between the jobs of the steps before and after it.
+// The cleanup steps are run by the single job, or otherwise by a final job run after all the others
+// whether they succeed or not. The cleanup steps of a matrix are run by the job of the matrix.
+func ghaJobs(p *Task) []ghaJob {
+	var jobs []ghaJob
+
+	plain := func() *ghaJob {
+		if len(jobs) == 0 || jobs[len(jobs)-1].matrix != nil {
+			jobs = append(jobs, ghaJob{})
+		}
+
+		return &jobs[len(jobs)-1]
+	}
+
+	rendered := map[*Matrix]bool{}
+
+	for steps := p.Steps; len(steps) > 0; {
+		if steps[0].Combo == nil {
+			j := plain()
+			j.steps = append(j.steps, steps[0])
+			steps = steps[1:]
+
+			continue
+		}
+
+		m, combos, rest := matrixSteps(steps)
+
+		steps = rest
+
+		if !matrixRenderable(m, combos, p.Cleanup) {
+			j := plain()
+
+			for _, combo := range combos {
+				j.steps = append(j.steps, combo...)
+			}
+
+			continue
+		}
+
+		rendered[m] = true
+
+		j := ghaJob{matrix: m, combos: combos, steps: m.template}
+
+		for i := len(m.templateCleanup) - 1; i >= 0; i-- {
+			j.cleanup = append(j.cleanup, m.templateCleanup[i])
+		}
+
+		jobs = append(jobs, j)
+	}
+
+	if len(jobs) == 0 {
+		plain()
+	}
+
+	var cleanup []TaskStep
+
+	for i := len(p.Cleanup) - 1; i >= 0; i-- {
+		s := p.Cleanup[i]
+
+		if s.Combo != nil && rendered[s.Combo.Matrix] {
+			continue
+		}
+
+		cleanup = append(cleanup, s)
+	}
+
+	switch {
+	case len(jobs) == 1 && jobs[0].matrix == nil:
+		jobs[0].cleanup = cleanup
+	case len(cleanup) > 0:
+		jobs = append(jobs, ghaJob{cleanup: cleanup, final: true})
+	}
+
+	used := map[string]bool{}
+
+	for i := range jobs {
+		label := "task"
+
+		switch {
+		case jobs[i].matrix != nil:
+			label = jobs[i].matrix.Name
+		case jobs[i].final:
+			label = "cleanup"
+		}
+
+		id := ghaID(label)
+
+		jobs[i].id = id
+		for n := 2; used[jobs[i].id]; n++ {
+			jobs[i].id = fmt.Sprintf("%s-%d", id, n)
+		}
+
+		used[jobs[i].id] = true
+	}
+
+	return jobs
+}
+
+// ghaStepOutputs returns the keys of the outputs of the step the workflow passes to the steps after it.
+func ghaStepOutputs(s TaskStep) []string {
+	switch impl := s.Run.(type) {
+	case Command:
+		return []string{"stdout", "stderr", "exitCode"}
+	case Func:
+		return impl.Outputs
+	}
+
+	return nil
+}
+
+// ghaStepIDs returns unique GitHub Actions step ids derived from the step names,
+// or from what label returns for them when it is not nil.
+func ghaStepIDs(p *Task, label func(name string) string) map[string]string {
+	ids := map[string]string{}
+	used := map[string]bool{}
+
+	steps := append(append([]TaskStep(nil), p.Steps...), p.Cleanup...)
+
+	for _, s := range steps {
+		l := s.Name
+		if label != nil {
+			l = label(s.Name)
+		}
+
+		id := ghaID(l)
+
+		unique := id
+		for n := 2; used[unique]; n++ {
+			unique = fmt.Sprintf("%s-%d", id, n)
+		}
+
+		used[unique] = true
+		ids[s.Name] = unique
+	}
+
+	return ids
+}
+
+// ghaID returns the GitHub Actions id derived from the name, like start-cluster for "start cluster".
+func ghaID(name string) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+
+	id := strings.Trim(b.String(), "-")
+	if id == "" || (id[0] >= '0' && id[0] <= '9') {
+		id = "step-" + id
+	}
+
+	return id
+}
+
+// referencedSteps returns the names of the steps whose outputs are referenced by other steps.
+func referencedSteps(p *Task) map[string]bool {
+	referenced := map[string]bool{}
+
+	for _, s := range append(append([]TaskStep(nil), p.Steps...), p.Cleanup...) {
+		for _, ref := range stepRefs(s) {
+			if ref.Job != "" {
+				referenced[ref.Job] = true
+			}
+		}
+	}
+
+	return referenced
+}
+
+// yamlQuote returns s as a YAML double-quoted scalar, which is a superset of JSON strings.
+// Shell syntax like 2>&1 is kept as is rather than escaped for HTML.
+func yamlQuote(s string) string {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(s); err != nil {
+		panic(err)
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,196 @@
+package acc
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteGitLabCI compiles the task into a GitLab CI configuration whose single job runs the steps
+// as its script and the cleanup steps, in reverse order, as its after_script.
+// The task inputs are the CI/CD variables named after the inputs in upper case.
+// Secret inputs are not declared in the configuration, as they are to be set as masked variables
+// in the settings of the project.
+//
+// Outputs of command steps, stdout, stderr and exitCode, are kept in shell variables. Func steps are run by invoking
+// the current executable with `run-task-step`, whose output is evaluated to set their outputs.
+//
+// Conditions of steps are tested by the script as in WriteBashScript.
+func WriteGitLabCI(p *Task, writer io.Writer) {
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(writer, format+"\n", args...)
+	}
+
+	inputs := NewInputs(nil)
+
+	for _, in := range p.Inputs {
+		inputs.m[in] = fmt.Sprintf("${%s}", envName(in))
+	}
+
+	ids := ghaStepIDs(p, nil)
+	referenced := referencedSteps(p)
+	conds := stepConds(p.Steps, p.Cleanup)
+	state := map[string]map[string]string{}
+
+	secret := map[string]bool{}
+
+	for _, in := range p.Secrets {
+		secret[in] = true
+	}
+
+	var declared []string
+
+	for _, in := range p.Inputs {
+		if !secret[in] {
+			declared = append(declared, in)
+		}
+	}
+
+	for _, in := range p.Secrets {
+		printf("# %s is the secret %s input of the task, to be set as a masked CI/CD variable.", envName(in), in)
+	}
+
+	if len(p.Secrets) > 0 {
+		printf("")
+	}
+
+	if len(declared) > 0 {
+		printf("variables:")
+
+		for _, in := range declared {
+			printf("  %s:", envName(in))
+			printf("    value: \"\"")
+			printf("    description: %s", yamlQuote("The "+in+" input of the task"))
+		}
+
+		printf("")
+	}
+
+	printf("task:")
+
+	var subTask string
+
+	writeStep := func(instruction TaskStep) {
+		for _, t := range enteredSubTasks(subTask, instruction.SubTask) {
+			printf("    # sub-task %s", t)
+		}
+
+		subTask = instruction.SubTask
+
+		printf("    # %s", instruction.Name)
+
+		var cond string
+
+		if instruction.If != nil {
+			cond = bashCond(*instruction.If, conds, func(v interface{}) string {
+				return resolveValue(instruction.Name, v, inputs, state)
+			})
+		}
+
+		lines := shellStepLines(instruction, ids[instruction.Name], referenced, inputs, state)
+
+		if cond != "" {
+			lines = []string{bashIf(cond, bashGroup(lines))}
+		}
+
+		for _, l := range lines {
+			printf("    - %s", yamlQuote(l))
+		}
+	}
+
+	printf("  script:")
+
+	for _, instruction := range p.Steps {
+		writeStep(instruction)
+	}
+
+	if len(p.Cleanup) > 0 {
+		printf("  after_script:")
+
+		subTask = ""
+
+		for i := len(p.Cleanup) - 1; i >= 0; i-- {
+			writeStep(p.Cleanup[i])
+		}
+	}
+}
+
+// shellStepLines returns the shell commands that run the step within a shell session,
+// keeping the outputs of the command steps other steps refer to in shell variables.
+func shellStepLines(instruction TaskStep, id string, referenced map[string]bool, inputs *mapInputs, state map[string]map[string]string) []string {
+	switch impl := instruction.Run.(type) {
+	case Command:
+		impl, args := resolveCommand(instruction.Name, impl, inputs, state)
+
+		line := bashCommandLine(impl, args)
+
+		v := "ACC_" + envName(id)
+
+		state[instruction.Name] = shellCaptureState(v)
+
+		if !referenced[instruction.Name] {
+			return []string{line}
+		}
+
+		return shellCaptureLines(v, line)
+	case Func:
+		outputs := map[string]string{}
+
+		for _, o := range impl.Outputs {
+			outputs[o] = fmt.Sprintf("${%s}", funcOutputVar(instruction.Name, o))
+		}
+
+		line := funcStepLine(instruction, impl, inputs, state)
+
+		state[instruction.Name] = outputs
+
+		return []string{line}
+	default:
+		panic(fmt.Errorf("unsupported type of instruction: %T", impl))
+	}
+}
+
+// shellCaptureLines returns the shell commands that run the command line and keep its stdout,
+// stderr and exit code in the shell variables v_STDOUT, v_STDERR and v_EXIT_CODE,
+// like ACC_CREATE_CLUSTER_STDOUT, while still printing the output. The then commands are run after the command, even when it failed,
+// before the commands fail with its exit code.
+func shellCaptureLines(v, line string, then ...string) []string {
+	lines := []string{
+		fmt.Sprintf("%s_STDERR_FILE=$(mktemp)", v),
+		fmt.Sprintf("%s_EXIT_CODE=0", v),
+		fmt.Sprintf(`%s_STDOUT=$({ %s; } 2>"${%s_STDERR_FILE}") || %s_EXIT_CODE=$?`, v, line, v, v),
+		fmt.Sprintf(`%s_STDERR=$(cat "${%s_STDERR_FILE}")`, v, v),
+		fmt.Sprintf(`rm -f "${%s_STDERR_FILE}"`, v),
+		fmt.Sprintf(`echo "${%s_STDOUT}"`, v),
+		fmt.Sprintf(`if [ -n "${%s_STDERR}" ]; then echo "${%s_STDERR}" >&2; fi`, v, v),
+	}
+
+	lines = append(lines, then...)
+
+	return append(lines, fmt.Sprintf(`(exit "${%s_EXIT_CODE}")`, v))
+}
+
+// shellCaptureState returns the outputs of a command step captured by shellCaptureLines.
+func shellCaptureState(v string) map[string]string {
+	return map[string]string{
+		"stdout":   fmt.Sprintf("${%s_STDOUT}", v),
+		"stderr":   fmt.Sprintf("${%s_STDERR}", v),
+		"exitCode": fmt.Sprintf("${%s_EXIT_CODE}", v),
+	}
+}
+
+// envName returns the name of the environment variable for the input or id, like SEED for seed.
+func envName(s string) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToUpper(s) {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	return b.String()
+}
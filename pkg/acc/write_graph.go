@@ -0,0 +1,206 @@
+package acc
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// graphIDs returns the node IDs of the inputs and steps of the graph, which are
+// numbered so that inputs and steps can share names.
+func graphIDs(g *Graph) (inputs, steps map[string]string) {
+	inputs = map[string]string{}
+	steps = map[string]string{}
+
+	for i, in := range g.Inputs {
+		inputs[in] = fmt.Sprintf("input_%d", i)
+	}
+
+	for i, n := range g.Nodes {
+		steps[n.Name] = fmt.Sprintf("step_%d", i)
+	}
+
+	return inputs, steps
+}
+
+// graphSubTasks returns the sub-tasks of the steps of the graph, including the sub-tasks calling them,
+// in order of appearance, along with their IDs.
+func graphSubTasks(g *Graph) (subTasks []string, ids map[string]string) {
+	ids = map[string]string{}
+
+	for _, n := range g.Nodes {
+		for _, t := range enteredSubTasks("", n.SubTask) {
+			if _, ok := ids[t]; ok {
+				continue
+			}
+
+			ids[t] = fmt.Sprintf("subtask_%d", len(subTasks))
+			subTasks = append(subTasks, t)
+		}
+	}
+
+	return subTasks, ids
+}
+
+// writeGraphNodes writes the nodes of the steps of the sub-task, or of the task itself when it is empty,
+// followed by the sub-tasks it calls, each written by group with the nodes and sub-tasks within it.
+func writeGraphNodes(g *Graph, subTask string, node func(GraphNode), group func(subTask string, within func())) {
+	for _, n := range g.Nodes {
+		if n.SubTask == subTask {
+			node(n)
+		}
+	}
+
+	subTasks, _ := graphSubTasks(g)
+
+	for _, t := range subTasks {
+		if parentSubTask(t) != subTask {
+			continue
+		}
+
+		t := t
+
+		group(t, func() {
+			writeGraphNodes(g, t, node, group)
+		})
+	}
+}
+
+// WriteDOT renders the graph of the task in the Graphviz DOT language.
+//
+// Inputs are ellipses, steps are boxes and cleanup steps are dashed red boxes.
+// The steps of a sub-task are clustered under the name of the sub-task.
+// Edges carrying outputs are labeled with the output keys, implicit ordering edges are dashed gray,
+// and dotted red edges link cleanup steps to the steps that make them necessary.
+func WriteDOT(p *Task, writer io.Writer) {
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(writer, format+"\n", args...)
+	}
+
+	g := TaskGraph(p)
+	inputIDs, stepIDs := graphIDs(g)
+
+	printf("digraph task {")
+	printf("  node [shape=box, style=rounded];")
+
+	if len(g.Inputs) > 0 {
+		printf("")
+
+		for _, in := range g.Inputs {
+			printf("  %s [label=%s, shape=ellipse, style=solid];", inputIDs[in], dotQuote(in))
+		}
+	}
+
+	printf("")
+
+	_, subTaskIDs := graphSubTasks(g)
+
+	indent := "  "
+
+	writeGraphNodes(g, "", func(n GraphNode) {
+		if n.Cleanup {
+			printf("%s%s [label=%s, style=\"rounded,dashed\", color=firebrick, fontcolor=firebrick];", indent, stepIDs[n.Name], dotQuote(n.Name))
+		} else {
+			printf("%s%s [label=%s];", indent, stepIDs[n.Name], dotQuote(n.Name))
+		}
+	}, func(subTask string, within func()) {
+		printf("%ssubgraph cluster_%s {", indent, subTaskIDs[subTask])
+		printf("%s  label=%s;", indent, dotQuote(subTask))
+
+		indent += "  "
+		within()
+		indent = indent[2:]
+
+		printf("%s}", indent)
+	})
+
+	if len(g.Edges) > 0 {
+		printf("")
+	}
+
+	for _, e := range g.Edges {
+		switch e.Kind {
+		case EdgeInput:
+			printf("  %s -> %s;", inputIDs[e.From], stepIDs[e.To])
+		case EdgeOrder:
+			printf("  %s -> %s [style=dashed, color=gray];", stepIDs[e.From], stepIDs[e.To])
+		case EdgeCleanup:
+			printf("  %s -> %s [style=dotted, color=firebrick, label=\"cleanup\"];", stepIDs[e.From], stepIDs[e.To])
+		default:
+			printf("  %s -> %s [label=%s];", stepIDs[e.From], stepIDs[e.To], dotQuote(e.Label))
+		}
+	}
+
+	printf("}")
+}
+
+// dotQuote returns s as a double-quoted DOT string.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// WriteMermaid renders the graph of the task as a Mermaid flowchart.
+//
+// Inputs are stadium-shaped, steps are rectangles and cleanup steps have the cleanup class.
+// The steps of a sub-task are in a subgraph titled with the name of the sub-task.
+// Edges carrying outputs are labeled with the output keys, implicit ordering edges are dotted,
+// and dotted edges labeled cleanup link cleanup steps to the steps that make them necessary.
+func WriteMermaid(p *Task, writer io.Writer) {
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(writer, format+"\n", args...)
+	}
+
+	g := TaskGraph(p)
+	inputIDs, stepIDs := graphIDs(g)
+
+	printf("flowchart TD")
+
+	for _, in := range g.Inputs {
+		printf("  %s([%s])", inputIDs[in], mermaidQuote(in))
+	}
+
+	var cleanup bool
+
+	_, subTaskIDs := graphSubTasks(g)
+
+	indent := "  "
+
+	writeGraphNodes(g, "", func(n GraphNode) {
+		if n.Cleanup {
+			cleanup = true
+			printf("%s%s[%s]:::cleanup", indent, stepIDs[n.Name], mermaidQuote(n.Name))
+		} else {
+			printf("%s%s[%s]", indent, stepIDs[n.Name], mermaidQuote(n.Name))
+		}
+	}, func(subTask string, within func()) {
+		printf("%ssubgraph %s[%s]", indent, subTaskIDs[subTask], mermaidQuote(subTask))
+
+		indent += "  "
+		within()
+		indent = indent[2:]
+
+		printf("%send", indent)
+	})
+
+	for _, e := range g.Edges {
+		switch e.Kind {
+		case EdgeInput:
+			printf("  %s --> %s", inputIDs[e.From], stepIDs[e.To])
+		case EdgeOrder:
+			printf("  %s -.-> %s", stepIDs[e.From], stepIDs[e.To])
+		case EdgeCleanup:
+			printf("  %s -.->|cleanup| %s", stepIDs[e.From], stepIDs[e.To])
+		default:
+			printf("  %s -->|%s| %s", stepIDs[e.From], mermaidQuote(e.Label), stepIDs[e.To])
+		}
+	}
+
+	if cleanup {
+		printf("  classDef cleanup stroke:#b22222,stroke-dasharray:5 5,color:#b22222")
+	}
+}
+
+// mermaidQuote returns s as a double-quoted Mermaid label.
+func mermaidQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s) + `"`
+}
@@ -0,0 +1,97 @@
+package acc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func graphTestTask() *Task {
+	var b TaskBuilder
+
+	b.Inputs.Def("seed", nil)
+
+	b.Defer("delete cluster", b.Cmd("kind", "delete", "cluster", "--name", b.Get("seed")))
+
+	create := b.Do("create cluster", b.Cmd("kind", "create", "cluster", "--name", b.Get("seed")))
+
+	b.Do("install", b.Cmd("helm", "upgrade", "--install", "web", "stable/nginx").
+		WithEnv("KUBECONFIG", create.Get("stdout")).
+		WithStdin(create.Get("stderr")))
+
+	b.Do("test", b.Cmd("helm", "test", "web"))
+
+	b.Defer("collect logs", b.Cmd("kubectl", "logs", "deploy/web"))
+
+	return b.Build()
+}
+
+func TestCleanupFor(t *testing.T) {
+	p := graphTestTask()
+
+	for _, tc := range []struct{ cleanup, want string }{
+		{cleanup: "delete cluster", want: "create cluster"},
+		{cleanup: "collect logs", want: "test"},
+	} {
+		for _, s := range p.Cleanup {
+			if s.Name == tc.cleanup && s.CleanupFor != tc.want {
+				t.Errorf("unexpected CleanupFor of %q: want %q, got %q", tc.cleanup, tc.want, s.CleanupFor)
+			}
+		}
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	var buf bytes.Buffer
+
+	WriteDOT(graphTestTask(), &buf)
+
+	want := `digraph task {
+  node [shape=box, style=rounded];
+
+  input_0 [label="seed", shape=ellipse, style=solid];
+
+  step_0 [label="create cluster"];
+  step_1 [label="install"];
+  step_2 [label="test"];
+  step_3 [label="collect logs", style="rounded,dashed", color=firebrick, fontcolor=firebrick];
+  step_4 [label="delete cluster", style="rounded,dashed", color=firebrick, fontcolor=firebrick];
+
+  input_0 -> step_0;
+  step_0 -> step_1 [label="stdout, stderr"];
+  step_1 -> step_2 [style=dashed, color=gray];
+  step_2 -> step_3 [style=dotted, color=firebrick, label="cleanup"];
+  input_0 -> step_4;
+  step_0 -> step_4 [style=dotted, color=firebrick, label="cleanup"];
+}
+`
+
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected DOT: want %q, got %q", want, got)
+	}
+}
+
+func TestWriteMermaid(t *testing.T) {
+	var buf bytes.Buffer
+
+	WriteMermaid(graphTestTask(), &buf)
+
+	want := `flowchart TD
+  input_0(["seed"])
+  step_0["create cluster"]
+  step_1["install"]
+  step_2["test"]
+  step_3["collect logs"]:::cleanup
+  step_4["delete cluster"]:::cleanup
+  input_0 --> step_0
+  step_0 -->|"stdout, stderr"| step_1
+  step_1 -.-> step_2
+  step_2 -.->|cleanup| step_3
+  input_0 --> step_4
+  step_0 -.->|cleanup| step_4
+  classDef cleanup stroke:#b22222,stroke-dasharray:5 5,color:#b22222
+`
+
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected Mermaid: want %q, got %q", want, got)
+	}
+}
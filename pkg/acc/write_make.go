@@ -0,0 +1,163 @@
+package acc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// makeStateDir is where the Makefile keeps the outputs of the steps.
+const makeStateDir = ".acc"
+
+// WriteMakefile compiles the task into a Makefile with a target per step, each depending on
+// the previous step, so that `make` runs the steps in order and `make <step>` runs the steps
+// up to it. The cleanup steps are run in reverse order by `make cleanup`, ignoring their failures.
+// The task inputs are the make variables named after the inputs in upper case.
+// Secret inputs are exported to the recipes, which refer to them as environment variables
+// so that make never prints their values.
+//
+// The outputs of the steps are kept in files under .acc. Func steps are run by invoking
+// the current executable with `run-task-step --output-dir`.
+//
+// The recipe of a step with a condition tests it first. Since make stops at the first failed recipe,
+// whether a step succeeded is tested as the condition of that step.
+func WriteMakefile(p *Task, writer io.Writer) {
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(writer, format+"\n", args...)
+	}
+
+	// Inputs and outputs are resolved to sentinels so that the rest of the command lines
+	// can be escaped for make before the sentinels are replaced with make syntax.
+	var sentinels []string
+
+	sentinel := func(replacement string) string {
+		s := fmt.Sprintf("\x00%d\x00", len(sentinels)/2)
+		sentinels = append(sentinels, s, replacement)
+		return s
+	}
+
+	inputs := NewInputs(nil)
+
+	for _, in := range p.Inputs {
+		inputs.m[in] = sentinel(fmt.Sprintf("$(%s)", envName(in)))
+	}
+
+	for _, in := range p.Secrets {
+		inputs.m[in] = sentinel(fmt.Sprintf("$${%s}", envName(in)))
+	}
+
+	ids := ghaStepIDs(p, nil)
+	conds := stepConds(p.Steps, p.Cleanup)
+	state := map[string]map[string]string{}
+
+	recipe := func(line string) string {
+		line = strings.Replace(line, "$", "$$", -1)
+
+		return strings.NewReplacer(sentinels...).Replace(line)
+	}
+
+	stepLines := func(instruction TaskStep) []string {
+		dir := makeStateDir + "/" + ids[instruction.Name]
+
+		output := func(key string) string {
+			return sentinel(fmt.Sprintf("$$(cat %s/%s)", dir, key))
+		}
+
+		var cond, line string
+
+		if instruction.If != nil {
+			cond = bashCond(*instruction.If, conds, func(v interface{}) string {
+				return resolveValue(instruction.Name, v, inputs, state)
+			})
+		}
+
+		switch impl := instruction.Run.(type) {
+		case Command:
+			impl, args := resolveCommand(instruction.Name, impl, inputs, state)
+
+			// fd 3 passes the stdout of the command by the tee of its stderr.
+			line = fmt.Sprintf("{ { %s; } 2>&1 1>&3 | tee %s/stderr >&2; } 3>&1 | tee %s/stdout; code=$?; echo $code > %s/exitCode; exit $code", bashCommandLine(impl, args), dir, dir, dir)
+
+			state[instruction.Name] = map[string]string{"stdout": output("stdout"), "stderr": output("stderr"), "exitCode": output("exitCode")}
+		case Func:
+			outputs := map[string]string{}
+
+			for _, o := range impl.Outputs {
+				outputs[o] = output(o)
+			}
+
+			line = fmt.Sprintf("%s%s run-task-step --output-dir %s %s", funcInputsEnv(instruction, impl, inputs, state), os.Args[0], dir, bashDoubleQuote(instruction.Name))
+
+			state[instruction.Name] = outputs
+		default:
+			panic(fmt.Errorf("unsupported type of instruction: %T", impl))
+		}
+
+		return []string{"@mkdir -p " + dir, recipe(bashIf(cond, line))}
+	}
+
+	var phony []string
+
+	for _, s := range p.Steps {
+		phony = append(phony, ids[s.Name])
+	}
+
+	printf("SHELL := /bin/bash")
+	printf(".SHELLFLAGS := -o pipefail -c")
+	printf("")
+
+	for _, in := range p.Inputs {
+		printf("%s ?= $(error %s is required)", envName(in), envName(in))
+	}
+
+	for _, in := range p.Secrets {
+		printf("export %s", envName(in))
+	}
+
+	if len(p.Inputs) > 0 {
+		printf("")
+	}
+
+	printf(".PHONY: all cleanup %s", strings.Join(phony, " "))
+	printf("")
+
+	if len(p.Steps) > 0 {
+		printf("all: %s", ids[p.Steps[len(p.Steps)-1].Name])
+	} else {
+		printf("all:")
+	}
+
+	var subTask string
+
+	for i, s := range p.Steps {
+		printf("")
+
+		for _, t := range enteredSubTasks(subTask, s.SubTask) {
+			printf("# sub-task %s", t)
+		}
+
+		subTask = s.SubTask
+
+		printf("# %s", s.Name)
+
+		if i == 0 {
+			printf("%s:", ids[s.Name])
+		} else {
+			printf("%s: %s", ids[s.Name], ids[p.Steps[i-1].Name])
+		}
+
+		for _, l := range stepLines(s) {
+			printf("\t%s", l)
+		}
+	}
+
+	printf("")
+	printf("cleanup:")
+
+	for i := len(p.Cleanup) - 1; i >= 0; i-- {
+		for _, l := range stepLines(p.Cleanup[i]) {
+			printf("\t-%s", l)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package acc
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -8,59 +9,76 @@ import (
 )
 
 // WriteBashScript compiles the function and writes the result as an executable bash script.
+// Secret inputs are never inlined but read from the environment variables named after them
+// in upper case, like GITHUB_TOKEN for github-token.
+//
+// A matrix whose combinations define the same steps is rendered as nested loops over
+// the values of its axes, which run the combinations one by one.
+//
+// The stdout, stderr and exit code of a command step other steps or conditions refer to are kept
+// in shell variables, like ACC_CREATE_CLUSTER_STDOUT.
+// A Func step evaluates the shell variable assignments `run-task-step` prints for its outputs,
+// like GENERATE_WORKFLOW_PATH.
+//
+// A step with a condition is run in an if statement testing the condition, where a step
+// counts as succeeded when its own condition holds, as the script stops at the first failure.
+//
+// The cleanup steps, including the ones of sub-tasks, are run by a trap on exit in the order
+// a run executes them, whether the steps succeed or not.
 func WriteBashScript(p *Task, inputs *mapInputs, writer io.Writer) {
 	state := map[string]map[string]string{}
 
-	printf := func(format string, args ...interface{}) {
+	inputs = inputs.without(p.Secrets)
+	if inputs == nil {
+		inputs = NewInputs(nil)
+	}
+
+	for _, in := range p.Secrets {
+		inputs.m[in] = fmt.Sprintf("${%s}", envName(in))
+	}
+
+	header := func(format string, args ...interface{}) {
 		fmt.Fprintf(writer, format+"\n", args...)
 	}
 
-	printf("#!/usr/bin/env bash")
-	printf("set -e")
+	header("#!/usr/bin/env bash")
+	header("set -e")
 
 	for _, in := range inputs.m {
-		printf(`if [ -z "%s" ]; then echo "\%s is empty.; exit 1; fi"`, in, in)
+		header(`if [ -z "%s" ]; then echo "\%s is empty.; exit 1; fi"`, in, in)
+	}
+
+	// The steps are written once the cleanup steps, which refer to their outputs, are known.
+	var body bytes.Buffer
+
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(&body, format+"\n", args...)
 	}
 
-	for _, instruction := range p.Steps {
+	conds := stepConds(p.Steps, p.Cleanup)
+	referenced := referencedSteps(p)
+
+	writeStep := func(instruction TaskStep, printf func(format string, args ...interface{})) {
+		var cond, line string
+
+		if instruction.If != nil {
+			cond = bashCond(*instruction.If, conds, func(v interface{}) string {
+				return resolveValue(instruction.Name, v, inputs, state)
+			})
+		}
+
 		switch impl := instruction.Run.(type) {
 		case Command:
-			var args []string
-
-			for _, a := range impl.Args {
-				switch typed := a.(type) {
-				case string:
-					args = append(args, typed)
-				case Ref:
-					if typed.Job == "" {
-						v, err := inputs.get(typed.Key)
-						if err != nil {
-							panic(fmt.Errorf("instruction %q: %v", instruction.Name, err))
-						}
-						args = append(args, v)
-					} else {
-						j, ok := state[typed.Job]
-						if !ok {
-							panic(fmt.Errorf("instruction %q: depends on %q but it is not yet executed", instruction.Name, typed.Job))
-						}
-
-						v, ok := j[typed.Key]
-						if !ok {
-							panic(fmt.Errorf("instruction %q: instruction %q does not have output named %q", instruction.Name, typed.Job, typed.Key))
-						}
-
-						args = append(args, v)
-					}
-				default:
-					panic(fmt.Errorf("unexpected type of arg: %T: %+v", a, a))
-				}
-			}
+			impl, args := resolveCommand(instruction.Name, impl, inputs, state)
+
+			line = bashCommandLine(impl, args)
+
+			v := "ACC_" + envName(instruction.Name)
 
-			printf("%s %s", impl.Path, strings.Join(args, " "))
+			state[instruction.Name] = shellCaptureState(v)
 
-			stdout := "example stdout of " + instruction.Name
-			state[instruction.Name] = map[string]string{
-				"stdout": stdout,
+			if referenced[instruction.Name] {
+				line = bashGroup(shellCaptureLines(v, line))
 			}
 		case Func:
 			outputs := map[string]string{}
@@ -79,17 +97,297 @@ func WriteBashScript(p *Task, inputs *mapInputs, writer io.Writer) {
 			//	executor:
 			//})
 
-			self := os.Args[0]
-
 			for _, o := range impl.Outputs {
-				outputs[o] = fmt.Sprintf("${%s_%s}", strings.ToUpper(impl.Name), strings.ToUpper(o))
+				outputs[o] = fmt.Sprintf("${%s}", funcOutputVar(instruction.Name, o))
 			}
 
-			printf("%s run-task-step %q", self, instruction.Name)
+			line = funcStepLine(instruction, impl, inputs, state)
 
 			state[instruction.Name] = outputs
 		default:
 			panic(fmt.Errorf("unsupported type of instruction: %T", impl))
 		}
+
+		printf("%s", bashIf(cond, line))
+	}
+
+	var subTask string
+
+	for steps := p.Steps; len(steps) > 0; {
+		if steps[0].Combo == nil {
+			for _, t := range enteredSubTasks(subTask, steps[0].SubTask) {
+				printf("# sub-task %s", t)
+			}
+
+			subTask = steps[0].SubTask
+
+			writeStep(steps[0], printf)
+
+			steps = steps[1:]
+
+			continue
+		}
+
+		m, combos, rest := matrixSteps(steps)
+
+		steps = rest
+
+		if !matrixRenderable(m, combos, p.Cleanup) {
+			for _, combo := range combos {
+				for _, s := range combo {
+					for _, t := range enteredSubTasks(subTask, s.SubTask) {
+						printf("# sub-task %s", t)
+					}
+
+					subTask = s.SubTask
+
+					writeStep(s, printf)
+				}
+			}
+
+			continue
+		}
+
+		for _, t := range enteredSubTasks(subTask, parentSubTask(m.Name)) {
+			printf("# sub-task %s", t)
+		}
+
+		subTask = parentSubTask(m.Name)
+
+		var lines []string
+
+		collect := func(format string, args ...interface{}) {
+			lines = append(lines, replaceMatrixPlaceholders(m, fmt.Sprintf(format, args...), func(axis string) string {
+				return "${" + bashMatrixVar(axis) + "}"
+			}))
+		}
+
+		inner := m.Name
+
+		for _, s := range m.template {
+			conds[s.Name] = s.If
+		}
+
+		for name := range referencedSteps(&Task{Steps: m.template, Cleanup: m.templateCleanup}) {
+			referenced[name] = true
+		}
+
+		for _, s := range m.template {
+			for _, t := range enteredSubTasks(inner, s.SubTask) {
+				collect("# sub-task %s", t)
+			}
+
+			inner = s.SubTask
+
+			writeStep(s, collect)
+		}
+
+		writeBashMatrix(m, lines, printf)
+
+		expandMatrixState(m, combos, state)
+	}
+
+	if len(p.Cleanup) > 0 {
+		var cleanup []string
+
+		for _, s := range cleanupOrder(p) {
+			writeStep(s, func(format string, args ...interface{}) {
+				cleanup = append(cleanup, fmt.Sprintf(format, args...))
+			})
+		}
+
+		writeBashCleanup(cleanup, header)
+	}
+
+	io.Copy(writer, &body)
+}
+
+// writeBashCleanup writes the function running the lines of the cleanup steps in order on exit,
+// whether the script succeeds or not. A failing cleanup step does not stop the others,
+// but makes the script fail.
+func writeBashCleanup(lines []string, printf func(format string, args ...interface{})) {
+	printf("acc_cleanup() {")
+	printf("  ACC_EXIT_CODE=$?")
+
+	for _, l := range lines {
+		printf("  %s || ACC_CLEANUP_FAILED=1", l)
+	}
+
+	printf(`  if [ -n "${ACC_CLEANUP_FAILED}" ] && [ "${ACC_EXIT_CODE}" -eq 0 ]; then ACC_EXIT_CODE=1; fi`)
+	printf(`  exit "${ACC_EXIT_CODE}"`)
+	printf("}")
+	printf("trap acc_cleanup EXIT")
+}
+
+// bashIf returns the command line run only when the bash condition holds, or the command line
+// as is when there is no condition.
+func bashIf(cond, line string) string {
+	if cond == "" {
+		return line
+	}
+
+	return fmt.Sprintf("if %s; then %s; fi", cond, line)
+}
+
+// bashGroup returns the commands as a single command line.
+func bashGroup(lines []string) string {
+	if len(lines) == 1 {
+		return lines[0]
+	}
+
+	return "{ " + strings.Join(lines, "; ") + "; }"
+}
+
+// bashMatrixVar returns the name of the shell variable holding the value of the axis
+// of a matrix in the emitted scripts, like ACC_MATRIX_K8S.
+func bashMatrixVar(axis string) string {
+	return "ACC_MATRIX_" + envName(axis)
+}
+
+// writeBashMatrix writes the lines of the steps of the matrix in nested loops over the values of its axes.
+// The loops stop at the first failure, unless the matrix continues on error, in which case the script
+// fails after running every combination.
+func writeBashMatrix(m *Matrix, lines []string, printf func(format string, args ...interface{})) {
+	printf("# matrix %s", m.Name)
+
+	if m.ContinueOnError {
+		printf("ACC_MATRIX_FAILED=")
+	}
+
+	indent := ""
+
+	for _, a := range m.Axes {
+		var values []string
+
+		for _, v := range a.Values {
+			values = append(values, bashDoubleQuote(v))
+		}
+
+		printf("%sfor %s in %s; do", indent, bashMatrixVar(a.Name), strings.Join(values, " "))
+
+		indent += "  "
 	}
+
+	if m.ContinueOnError {
+		printf("%sif ! {", indent)
+
+		last := len(lines) - 1
+
+		for last >= 0 && strings.HasPrefix(lines[last], "#") {
+			last--
+		}
+
+		for i, l := range lines {
+			if i < last && !strings.HasPrefix(l, "#") {
+				l += " &&"
+			}
+
+			printf("%s  %s", indent, l)
+		}
+
+		printf("%s}; then", indent)
+		printf("%s  ACC_MATRIX_FAILED=1", indent)
+		printf("%sfi", indent)
+	} else {
+		for _, l := range lines {
+			printf("%s%s", indent, l)
+		}
+	}
+
+	for range m.Axes {
+		indent = indent[2:]
+
+		printf("%sdone", indent)
+	}
+
+	if m.ContinueOnError {
+		printf(`if [ -n "${ACC_MATRIX_FAILED}" ]; then exit 1; fi`)
+	}
+}
+
+// bashCommandLine renders the resolved command as a bash command line that honors
+// its environment, working directory and stdin.
+func bashCommandLine(cmd Command, args []string) string {
+	line := fmt.Sprintf("%s %s", cmd.Path, strings.Join(args, " "))
+
+	var env []string
+
+	switch cmd.EnvInheritance {
+	case EnvInherit:
+	case EnvInheritAllowlist:
+		env = append(env, "env", "-i")
+		for _, key := range cmd.EnvAllowlist {
+			env = append(env, fmt.Sprintf(`%s="${%s}"`, key, key))
+		}
+	case EnvInheritClean:
+		env = append(env, "env", "-i")
+	default:
+		panic(fmt.Errorf("unsupported env inheritance: %d", cmd.EnvInheritance))
+	}
+
+	for _, k := range sortedEnvKeys(cmd.Env) {
+		env = append(env, fmt.Sprintf("%s=%s", k, bashDoubleQuote(fmt.Sprintf("%s", cmd.Env[k]))))
+	}
+
+	if len(env) > 0 {
+		line = strings.Join(env, " ") + " " + line
+	}
+
+	if stdin, ok := cmd.stdin(); ok {
+		line = fmt.Sprintf("printf '%%s' %s | %s", bashDoubleQuote(stdin), line)
+	}
+
+	if dir := cmd.dir(); dir != "" {
+		line = fmt.Sprintf("(cd %s && %s)", bashDoubleQuote(dir), line)
+	}
+
+	return line
+}
+
+// bashDoubleQuote quotes s for bash while keeping parameter expansions like ${SEED} working.
+func bashDoubleQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+
+	return `"` + r.Replace(s) + `"`
+}
+
+// funcOutputVar returns the name of the shell variable holding an output of the Func step
+// in the emitted scripts, like GENERATE_WORKFLOW_PATH, or SETUP_GENERATE_WORKFLOW_PATH for
+// the step of the sub-task setup. It is named after the step rather than the Func, so that
+// the steps running the same Func keep their outputs apart.
+func funcOutputVar(stepName, key string) string {
+	return fmt.Sprintf("%s_%s", envName(stepName), envName(key))
+}
+
+// funcStepLine returns the command line running the Func step by invoking the current executable
+// with `run-task-step` and evaluating the assignments of the outputs it prints. The command line
+// fails with the exit code of `run-task-step` when it fails, which eval alone would ignore.
+func funcStepLine(instruction TaskStep, impl Func, inputs *mapInputs, state map[string]map[string]string) string {
+	return fmt.Sprintf(`eval "$(%s%s run-task-step %s || echo "(exit $?)")"`, funcInputsEnv(instruction, impl, inputs, state), os.Args[0], bashDoubleQuote(instruction.Name))
+}
+
+// funcInputEnv returns the name of the environment variable passing an upstream output
+// the Func reads to `run-task-step`, like ACC_INPUT_CREATE_CLUSTER_STDOUT.
+func funcInputEnv(ref Ref) string {
+	return fmt.Sprintf("ACC_INPUT_%s_%s", envName(ref.Job), envName(ref.Key))
+}
+
+// funcInputsEnv returns the assignments of the environment variables passing the upstream outputs
+// the Func reads to `run-task-step`, followed by a space, or "" when it reads none.
+func funcInputsEnv(instruction TaskStep, impl Func, inputs *mapInputs, state map[string]map[string]string) string {
+	var env []string
+
+	for _, ref := range impl.Inputs {
+		if ref.Job == "" {
+			continue
+		}
+
+		env = append(env, fmt.Sprintf("%s=%s", funcInputEnv(ref), bashDoubleQuote(resolveValue(instruction.Name, ref, inputs, state))))
+	}
+
+	if len(env) == 0 {
+		return ""
+	}
+
+	return strings.Join(env, " ") + " "
 }